@@ -0,0 +1,230 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package acl decides who may do what to which charts.
+//
+// Access is granted per subtree of the chart store. A name is governed by the
+// entries of the nearest enclosing subtree that has any, so a subtree's
+// entries replace, rather than add to, those it inherits.
+package acl
+
+import (
+	"akamai/atlas/auth"
+	"akamai/atlas/chartfs"
+
+	"github.com/golang/glog"
+
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("acl "+s, v...)
+	}
+}
+
+type Perm uint
+
+const (
+	READ   Perm = 1 << iota // view charts and their files
+	EDIT                    // create and change charts and drawings
+	UPLOAD                  // upload resumes
+	ADMIN                   // all of the above, plus administration
+)
+
+var permNames = []struct {
+	perm Perm
+	name string
+}{
+	{READ, "read"},
+	{EDIT, "edit"},
+	{UPLOAD, "upload"},
+	{ADMIN, "admin"},
+}
+
+// ParsePerms parses a comma-separated list of permission names.
+func ParsePerms(s string) (Perm, error) {
+	var perms Perm
+	for _, word := range strings.Split(s, ",") {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			continue
+		}
+		found := false
+		for _, pn := range permNames {
+			if pn.name == word {
+				perms |= pn.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("acl: unknown permission %q", word)
+		}
+	}
+	return perms, nil
+}
+
+func (self Perm) String() string {
+	var names []string
+	for _, pn := range permNames {
+		if self&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+const (
+	EVERYONE = "*"      // principal matching anyone, logged in or not
+	USERS    = "@users" // principal matching anyone logged in
+)
+
+// Entry grants Perms on Subtree to Principal, which is EVERYONE, a user name,
+// or a group name prefixed with "@".
+type Entry struct {
+	Subtree   string
+	Principal string
+	Perms     Perm
+}
+
+// DEFAULT governs atlases without entries of their own for the root: anyone
+// may read, and anyone logged in may edit and upload.
+var DEFAULT = []Entry{
+	{"", EVERYONE, READ},
+	{"", USERS, READ | EDIT | UPLOAD},
+}
+
+// Rules is an immutable snapshot of an atlas's entries and groups.
+type Rules struct {
+	bySubtree map[string][]Entry
+	members   map[string]map[string]bool
+	gen       int64
+}
+
+// OPEN lets anyone do anything. It applies when atlas runs without
+// authentication.
+var OPEN = NewRules([]Entry{{"", EVERYONE, READ | EDIT | UPLOAD | ADMIN}}, nil)
+
+// NewRules builds rules from entries and from members, which maps group names
+// (without "@") to user names.
+func NewRules(entries []Entry, members map[string][]string) *Rules {
+	self := &Rules{
+		bySubtree: map[string][]Entry{},
+		members:   map[string]map[string]bool{},
+	}
+	for _, e := range entries {
+		e.Subtree = chartfs.Clean(e.Subtree)
+		self.bySubtree[e.Subtree] = append(self.bySubtree[e.Subtree], e)
+	}
+	for group, names := range members {
+		self.members[group] = map[string]bool{}
+		for _, name := range names {
+			self.members[group][name] = true
+		}
+	}
+	return self
+}
+
+func (self *Rules) matches(user *auth.User, principal string) bool {
+	switch {
+	case principal == EVERYONE:
+		return true
+	case user == nil:
+		return false
+	case principal == USERS:
+		return true
+	case strings.HasPrefix(principal, "@"):
+		group := principal[1:]
+		if self.members[group][user.Name] {
+			return true
+		}
+		for _, g := range user.Groups {
+			if g == group {
+				return true
+			}
+		}
+		return false
+	}
+	return principal == user.Name
+}
+
+// governing returns the entries of the nearest subtree enclosing name.
+func (self *Rules) governing(name string) []Entry {
+	name = chartfs.Clean(name)
+	for {
+		if entries, ok := self.bySubtree[name]; ok {
+			return entries
+		}
+		if name == "" {
+			return nil
+		}
+		name = chartfs.Clean(path.Dir(name))
+		if name == "." {
+			name = ""
+		}
+	}
+}
+
+// Perms returns the permissions user holds on name. ADMIN implies the rest.
+func (self *Rules) Perms(user *auth.User, name string) Perm {
+	var perms Perm
+	for _, e := range self.governing(name) {
+		if self.matches(user, e.Principal) {
+			perms |= e.Perms
+		}
+	}
+	if perms&ADMIN != 0 {
+		perms |= READ | EDIT | UPLOAD
+	}
+	return perms
+}
+
+func (self *Rules) Allowed(user *auth.User, name string, perm Perm) bool {
+	allowed := self.Perms(user, name)&perm == perm
+	L("allowed %v %q %v -> %t", user, name, perm, allowed)
+	return allowed
+}
+
+// AllowedBeneath reports whether user holds perm on name and on every
+// subtree beneath it with entries of its own, as acting on a chart and
+// everything beneath it requires.
+func (self *Rules) AllowedBeneath(user *auth.User, name string, perm Perm) bool {
+	name = chartfs.Clean(name)
+	if !self.Allowed(user, name, perm) {
+		return false
+	}
+	for subtree := range self.bySubtree {
+		beneath := name == "" || strings.HasPrefix(subtree, name+"/")
+		if beneath && !self.Allowed(user, subtree, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// Gen returns the generation of the rules, which changes whenever a Db's
+// rules do. Rules not loaded from a Db are generation 0.
+func (self *Rules) Gen() int64 {
+	return self.gen
+}
+
+// same reports whether self and other say the same things.
+func (self *Rules) same(other *Rules) bool {
+	return reflect.DeepEqual(self.bySubtree, other.bySubtree) && reflect.DeepEqual(self.members, other.members)
+}
+
+// ReadsAll reports whether user may read every chart, so that callers can
+// skip filtering.
+func (self *Rules) ReadsAll(user *auth.User) bool {
+	if len(self.bySubtree[""]) == 0 {
+		return false
+	}
+	for subtree := range self.bySubtree {
+		if !self.Allowed(user, subtree, READ) {
+			return false
+		}
+	}
+	return true
+}
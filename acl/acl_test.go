@@ -0,0 +1,122 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package acl
+
+import (
+	"akamai/atlas/auth"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"database/sql"
+	"testing"
+)
+
+func TestParsePerms(t *testing.T) {
+	t.Parallel()
+
+	perms, err := ParsePerms("read, edit")
+	if err != nil || perms != READ|EDIT || perms.String() != "read,edit" {
+		t.Fatalf("TestParsePerms() failed: got %v, %v", perms, err)
+	}
+	if _, err := ParsePerms("read,fly"); err == nil {
+		t.Fatalf("TestParsePerms() failed: accepted an unknown permission")
+	}
+}
+
+func TestRules(t *testing.T) {
+	t.Parallel()
+
+	entries := append([]Entry{
+		{"resumes", "@hr", READ | UPLOAD},
+		{"resumes/open", EVERYONE, READ},
+		{"ops", "grace", ADMIN},
+	}, DEFAULT...)
+	rules := NewRules(entries, map[string][]string{"hr": {"ada"}})
+
+	ada := &auth.User{Name: "ada"}
+	bob := &auth.User{Name: "bob"}
+	grace := &auth.User{Name: "grace"}
+	claimed := &auth.User{Name: "eve", Groups: []string{"hr"}}
+
+	for _, c := range []struct {
+		user  *auth.User
+		name  string
+		perm  Perm
+		allow bool
+	}{
+		{nil, "index.txt", READ, true},
+		{nil, "index.txt", EDIT, false},
+		{bob, "sub/index.txt", EDIT, true},
+		{nil, "resumes/a/index.txt", READ, false},
+		{bob, "resumes/a/index.txt", READ, false},
+		{ada, "resumes/a/index.txt", READ, true},
+		{ada, "resumes/a/index.txt", EDIT, false},
+		{claimed, "resumes", UPLOAD, true},
+		{nil, "resumes/open/index.txt", READ, true},
+		{ada, "resumes/open/index.txt", UPLOAD, false},
+		{grace, "ops/index.txt", EDIT | UPLOAD, true},
+		{bob, "ops/index.txt", READ, false},
+	} {
+		if got := rules.Allowed(c.user, c.name, c.perm); got != c.allow {
+			t.Fatalf("TestRules() failed: Allowed(%v, %q, %v) = %t", c.user, c.name, c.perm, got)
+		}
+	}
+
+	if !rules.AllowedBeneath(grace, "ops", ADMIN) || rules.AllowedBeneath(grace, "", EDIT) || rules.AllowedBeneath(ada, "resumes", UPLOAD) {
+		t.Fatalf("TestRules() failed: AllowedBeneath")
+	}
+
+	if rules.ReadsAll(ada) || !NewRules(DEFAULT, nil).ReadsAll(nil) || !OPEN.ReadsAll(nil) {
+		t.Fatalf("TestRules() failed: ReadsAll")
+	}
+}
+
+func TestDb(t *testing.T) {
+	t.Parallel()
+
+	sqlDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestDb() failed: open: %v", err)
+	}
+	defer sqlDb.Close()
+	sqlDb.SetMaxOpenConns(1)
+
+	db, err := NewDb(sqlDb)
+	if err != nil {
+		t.Fatalf("TestDb() failed: NewDb: %v", err)
+	}
+
+	ada := &auth.User{Name: "ada"}
+	rules, err := db.Rules()
+	if err != nil || !rules.Allowed(nil, "x/index.txt", READ) || !rules.Allowed(ada, "x", EDIT) {
+		t.Fatalf("TestDb() failed: empty db does not apply DEFAULT (err %v)", err)
+	}
+
+	if err = db.Set("/x/", "@staff", READ|EDIT); err != nil {
+		t.Fatalf("TestDb() failed: Set: %v", err)
+	}
+	if err = db.AddMember("staff", "ada"); err != nil {
+		t.Fatalf("TestDb() failed: AddMember: %v", err)
+	}
+	rules, _ = db.Rules()
+	if rules.Allowed(nil, "x/index.txt", READ) || !rules.Allowed(ada, "x/index.txt", EDIT) {
+		t.Fatalf("TestDb() failed: x is not restricted to staff")
+	}
+	gen := rules.Gen()
+	if err = db.Set("x", "@staff", READ|EDIT); err != nil {
+		t.Fatalf("TestDb() failed: Set: %v", err)
+	}
+	if rules, _ = db.Rules(); rules.Gen() != gen {
+		t.Fatalf("TestDb() failed: unchanged rules moved from generation %d to %d", gen, rules.Gen())
+	}
+
+	db.RemoveMember("staff", "ada")
+	db.Set("x", "@staff", 0)
+	rules, _ = db.Rules()
+	if !rules.Allowed(nil, "x/index.txt", READ) || rules.Allowed(ada, "x/index.txt", ADMIN) {
+		t.Fatalf("TestDb() failed: removals did not take")
+	}
+	if rules.Gen() == gen {
+		t.Fatalf("TestDb() failed: changed rules kept generation %d", gen)
+	}
+}
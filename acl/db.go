@@ -0,0 +1,152 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package acl
+
+import (
+	"akamai/atlas/chartfs"
+
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const ACL_SCHEMA = `
+CREATE TABLE IF NOT EXISTS A (
+	subtree   TEXT NOT NULL,
+	principal TEXT NOT NULL,
+	perms     INTEGER NOT NULL,
+	PRIMARY KEY (subtree, principal)
+);
+CREATE TABLE IF NOT EXISTS G (
+	grp  TEXT NOT NULL,
+	name TEXT NOT NULL,
+	PRIMARY KEY (grp, name)
+);
+`
+
+// RELOAD_INTERVAL bounds how stale a Db's rules may be, since other processes
+// (atlas -acl, for one) may change them.
+const RELOAD_INTERVAL = 5 * time.Second
+
+// Db keeps entries and group memberships in tables of the config database.
+// Without entries for the root, DEFAULT applies there.
+type Db struct {
+	db     *sql.DB
+	rules  *Rules
+	loaded time.Time
+	gen    int64
+	mu     sync.Mutex
+}
+
+func NewDb(db *sql.DB) (*Db, error) {
+	_, err := db.Exec(ACL_SCHEMA)
+	if err != nil {
+		return nil, err
+	}
+	return &Db{db: db}, nil
+}
+
+// Rules returns the current rules, reloading them if they may be stale.
+func (self *Db) Rules() (*Rules, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.rules != nil && time.Since(self.loaded) < RELOAD_INTERVAL {
+		return self.rules, nil
+	}
+
+	rules, err := self.load()
+	if err != nil {
+		return nil, err
+	}
+	if self.rules != nil && rules.same(self.rules) {
+		rules = self.rules
+	} else {
+		self.gen++
+		rules.gen = self.gen
+	}
+	self.rules = rules
+	self.loaded = time.Now()
+	return rules, nil
+}
+
+func (self *Db) load() (*Rules, error) {
+	var entries []Entry
+	hasRoot := false
+
+	rows, err := self.db.Query("SELECT subtree, principal, perms FROM A;")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e Entry
+		err = rows.Scan(&e.Subtree, &e.Principal, &e.Perms)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hasRoot = hasRoot || chartfs.Clean(e.Subtree) == ""
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if !hasRoot {
+		entries = append(entries, DEFAULT...)
+	}
+
+	members := map[string][]string{}
+	rows, err = self.db.Query("SELECT grp, name FROM G;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group, name string
+		err = rows.Scan(&group, &name)
+		if err != nil {
+			return nil, err
+		}
+		members[group] = append(members[group], name)
+	}
+
+	L("load %d entries, %d groups", len(entries), len(members))
+	return NewRules(entries, members), rows.Err()
+}
+
+// Set grants perms on subtree to principal, replacing what it held before.
+// Zero perms remove the entry.
+func (self *Db) Set(subtree, principal string, perms Perm) error {
+	subtree = chartfs.Clean(subtree)
+
+	var err error
+	if perms == 0 {
+		_, err = self.db.Exec("DELETE FROM A WHERE subtree = ? AND principal = ?;", subtree, principal)
+	} else {
+		_, err = self.db.Exec("INSERT OR REPLACE INTO A (subtree, principal, perms) VALUES (?, ?, ?);", subtree, principal, perms)
+	}
+	self.invalidate()
+	return err
+}
+
+// AddMember puts user name in group, given without "@".
+func (self *Db) AddMember(group, name string) error {
+	_, err := self.db.Exec("INSERT OR IGNORE INTO G (grp, name) VALUES (?, ?);", group, name)
+	self.invalidate()
+	return err
+}
+
+func (self *Db) RemoveMember(group, name string) error {
+	_, err := self.db.Exec("DELETE FROM G WHERE grp = ? AND name = ?;", group, name)
+	self.invalidate()
+	return err
+}
+
+// invalidate has the next Rules reload, keeping the rules it has to tell
+// whether they changed.
+func (self *Db) invalidate() {
+	self.mu.Lock()
+	self.loaded = time.Time{}
+	self.mu.Unlock()
+}
@@ -46,6 +46,7 @@ type Feed struct {
 	Updated TimeStr  `xml:"updated"`
 	Author  *Person  `xml:"author"`
 	Entry   []*Entry `xml:"entry"`
+	Deleted []*DeletedEntry
 }
 
 type Entry struct {
@@ -59,6 +60,13 @@ type Entry struct {
 	Content   *Text   `xml:"content"`
 }
 
+// DeletedEntry is an RFC 6721 tombstone announcing that an entry is gone.
+type DeletedEntry struct {
+	XMLName xml.Name `xml:"http://purl.org/atompub/tombstones/1.0 deleted-entry"`
+	Ref     string   `xml:"ref,attr"`
+	When    TimeStr  `xml:"when,attr"`
+}
+
 type Link struct {
 	Rel  string `xml:"rel,attr"`
 	Href string `xml:"href,attr"`
@@ -0,0 +1,196 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package audit records who changed what in the atlas.
+//
+// Records are appended, one JSON object per line, to a log file that atlas
+// never rewrites, so the file itself is the export format.
+package audit
+
+import (
+	"github.com/golang/glog"
+
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("audit "+s, v...)
+	}
+}
+
+// Actions recorded by atlas.
+const (
+	CREATE  = "create"  // an editor created a chart or drawing
+	SAVE    = "save"    // a chart or drawing was saved
+	RELOAD  = "reload"  // a pad was reset to its chart
+	UPLOAD  = "upload"  // a resume was uploaded
+	SYNC    = "sync"    // a pad was saved to its chart in the background
+	DELETE  = "delete"  // a chart was moved to the trash
+	RESTORE = "restore" // a chart was restored from the trash
+	PURGE   = "purge"   // a chart was purged from the trash for good
+)
+
+type Record struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Addr   string    `json:"addr"`
+	Path   string    `json:"path"`
+	Action string    `json:"action"`
+	Before string    `json:"before,omitempty"`
+	After  string    `json:"after,omitempty"`
+}
+
+// Hash returns the content hash recorded for data, or "" for content that
+// doesn't exist.
+func Hash(data []byte) string {
+	if data == nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Filter selects records. Zero fields match everything.
+type Filter struct {
+	User   string
+	Path   string // a prefix of the paths to match
+	Exact  bool   // whether Path must match whole
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (self *Filter) Match(rec *Record) bool {
+	switch {
+	case self.User != "" && rec.User != self.User:
+		return false
+	case self.Path != "" && !strings.HasPrefix(rec.Path, self.Path):
+		return false
+	case self.Exact && rec.Path != self.Path:
+		return false
+	case self.Action != "" && rec.Action != self.Action:
+		return false
+	case !self.Since.IsZero() && rec.Time.Before(self.Since):
+		return false
+	case !self.Until.IsZero() && !rec.Time.Before(self.Until):
+		return false
+	}
+	return true
+}
+
+// Log is an append-only log file.
+type Log struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Open returns the log at path, creating it if need be.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{Path: path}, f.Close()
+}
+
+// Append writes rec to the log and syncs it to disk. Records without a time
+// are stamped with the current one.
+func (self *Log) Append(rec *Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	f, err := os.OpenFile(self.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	L("append %s", line)
+	return err
+}
+
+// scan calls fn with each record matching filter, oldest first, and the line
+// it came from.
+func (self *Log) scan(filter *Filter, fn func(rec *Record, line []byte) error) error {
+	f, err := os.Open(self.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		rec := &Record{}
+		err = json.Unmarshal(line, rec)
+		if err != nil {
+			glog.Warningf("audit: skipping unreadable record %q: %v", line, err)
+			continue
+		}
+		if filter.Match(rec) {
+			err = fn(rec, line)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Query returns up to limit of the newest records matching filter, newest
+// first. A limit of 0 returns them all.
+func (self *Log) Query(filter *Filter, limit int) ([]*Record, error) {
+	var recs []*Record
+	err := self.scan(filter, func(rec *Record, line []byte) error {
+		recs = append(recs, rec)
+		if limit > 0 && len(recs) > 2*limit {
+			recs = append(recs[:0], recs[len(recs)-limit:]...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(recs) > limit {
+		recs = recs[len(recs)-limit:]
+	}
+	for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+		recs[i], recs[j] = recs[j], recs[i]
+	}
+	return recs, nil
+}
+
+// Export copies the records matching filter to w as JSON lines, oldest first.
+func (self *Log) Export(w io.Writer, filter *Filter) error {
+	return self.scan(filter, func(rec *Record, line []byte) error {
+		_, err := w.Write(line)
+		if err == nil {
+			_, err = w.Write([]byte{'\n'})
+		}
+		return err
+	})
+}
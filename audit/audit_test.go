@@ -0,0 +1,81 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-audit")
+	if err != nil {
+		t.Fatalf("TestLog() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	log, err := Open(path.Join(tmp, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("TestLog() open failed: err: %q", err)
+	}
+
+	day := time.Date(2014, 1, 31, 12, 0, 0, 0, time.UTC)
+	for i, rec := range []*Record{
+		{User: "ada", Path: "a/index.txt", Action: CREATE, After: Hash([]byte("one"))},
+		{User: "ada", Path: "a/index.txt", Action: SAVE, Before: Hash([]byte("one")), After: Hash([]byte("two"))},
+		{User: "bob", Path: "b/x.svg", Action: SAVE},
+		{User: "bob", Path: "a/y.svg", Action: SAVE},
+	} {
+		rec.Time = day.Add(time.Duration(i) * time.Hour)
+		err = log.Append(rec)
+		if err != nil {
+			t.Fatalf("TestLog() append failed: err: %q", err)
+		}
+	}
+
+	recs, err := log.Query(&Filter{Path: "a/"}, 0)
+	if err != nil || len(recs) != 3 || recs[0].Path != "a/y.svg" || recs[2].Action != CREATE {
+		t.Fatalf("TestLog() path query failed: %v %v", recs, err)
+	}
+
+	recs, _ = log.Query(&Filter{Path: "a/index.txt", Exact: true}, 1)
+	if len(recs) != 1 || recs[0].Action != SAVE {
+		t.Fatalf("TestLog() exact path query failed: %v", recs)
+	}
+	if recs, _ = log.Query(&Filter{Path: "a/", Exact: true}, 0); len(recs) != 0 {
+		t.Fatalf("TestLog() exact path query matched a prefix: %v", recs)
+	}
+
+	recs, _ = log.Query(&Filter{User: "ada", Action: SAVE}, 0)
+	if len(recs) != 1 || recs[0].Before != Hash([]byte("one")) {
+		t.Fatalf("TestLog() user query failed: %v", recs)
+	}
+
+	recs, _ = log.Query(&Filter{Since: day.Add(time.Hour), Until: day.Add(3 * time.Hour)}, 0)
+	if len(recs) != 2 || recs[0].Path != "b/x.svg" {
+		t.Fatalf("TestLog() time query failed: %v", recs)
+	}
+
+	recs, _ = log.Query(&Filter{}, 1)
+	if len(recs) != 1 || recs[0].Path != "a/y.svg" {
+		t.Fatalf("TestLog() limited query failed: %v", recs)
+	}
+
+	var buf bytes.Buffer
+	err = log.Export(&buf, &Filter{User: "bob"})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if err != nil || len(lines) != 2 || !strings.Contains(lines[0], `"path":"b/x.svg"`) {
+		t.Fatalf("TestLog() export failed: %q %v", buf.String(), err)
+	}
+
+	if Hash(nil) != "" || !strings.HasPrefix(Hash([]byte{}), "sha256:") {
+		t.Fatalf("TestLog() hash failed")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package auth identifies the people editing the atlas.
+//
+// Authenticators check names and passwords against a user database or an
+// htpasswd file; Sessions remember who has logged in.
+package auth
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("auth "+s, v...)
+	}
+}
+
+// ErrBadCredentials is returned for unknown users and wrong passwords alike.
+var ErrBadCredentials = errors.New("auth: bad user name or password")
+
+type User struct {
+	Name     string
+	FullName string
+	Groups   []string
+}
+
+// Author returns the name to credit in the Authors line of charts.
+func (self *User) Author() string {
+	if self.FullName != "" {
+		return self.FullName
+	}
+	return self.Name
+}
+
+type Authenticator interface {
+	Authenticate(name, password string) (*User, error)
+}
+
+// dummyHash is compared against when a user doesn't exist, so that looking up
+// unknown names takes as long as checking real ones.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("atlas"), bcrypt.DefaultCost)
+
+// checkHash compares password with hash, which may be empty for unknown
+// users.
+func checkHash(hash []byte, password string) error {
+	if len(hash) == 0 {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrBadCredentials
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		L("checkHash: %v", err)
+		return ErrBadCredentials
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package auth
+
+import (
+	"akamai/atlas/fakeidp"
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDbUsers(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-auth")
+	if err != nil {
+		t.Fatalf("TestDbUsers() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	db, err := sql.Open("sqlite3", path.Join(tmp, "config.db"))
+	if err != nil {
+		t.Fatalf("TestDbUsers() open failed: err: %q", err)
+	}
+	defer db.Close()
+
+	users, err := NewDbUsers(db)
+	if err != nil {
+		t.Fatalf("TestDbUsers() NewDbUsers failed: err: %q", err)
+	}
+	err = users.Add("ada", "Ada Lovelace", "engine")
+	if err != nil {
+		t.Fatalf("TestDbUsers() Add failed: err: %q", err)
+	}
+
+	user, err := users.Authenticate("ada", "engine")
+	if err != nil || user.Author() != "Ada Lovelace" {
+		t.Fatalf("TestDbUsers() failed: Authenticate returned %v, %v", user, err)
+	}
+	if _, err := users.Authenticate("ada", "difference"); err != ErrBadCredentials {
+		t.Fatalf("TestDbUsers() failed: wrong password returned %v", err)
+	}
+	if _, err := users.Authenticate("bob", "engine"); err != ErrBadCredentials {
+		t.Fatalf("TestDbUsers() failed: unknown user returned %v", err)
+	}
+
+	var hash string
+	db.QueryRow("SELECT hash FROM U WHERE name = 'ada';").Scan(&hash)
+	if hash == "engine" || bcrypt.CompareHashAndPassword([]byte(hash), []byte("engine")) != nil {
+		t.Fatalf("TestDbUsers() failed: password not stored as a bcrypt hash: %q", hash)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-auth")
+	if err != nil {
+		t.Fatalf("TestHtpasswd() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("engine"), bcrypt.MinCost)
+	file := path.Join(tmp, "htpasswd")
+	body := "# users\nada:" + string(hash) + "\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	err = ioutil.WriteFile(file, []byte(body), 0600)
+	if err != nil {
+		t.Fatalf("TestHtpasswd() write failed: err: %q", err)
+	}
+
+	users := NewHtpasswd(file)
+	user, err := users.Authenticate("ada", "engine")
+	if err != nil || user.Name != "ada" {
+		t.Fatalf("TestHtpasswd() failed: Authenticate returned %v, %v", user, err)
+	}
+	if _, err := users.Authenticate("bob", "password"); err != ErrBadCredentials {
+		t.Fatalf("TestHtpasswd() failed: non-bcrypt entry returned %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+
+	sessions := NewSessions()
+	ada := &User{Name: "ada"}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://localhost:3001/login", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	err := sessions.Start(w, r, ada)
+	if err != nil {
+		t.Fatalf("TestSessions() Start failed: err: %q", err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("TestSessions() failed: bad session cookie: %v", cookies)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:3001/", nil)
+	r.AddCookie(cookies[0])
+	if user := sessions.Lookup(r); user != ada {
+		t.Fatalf("TestSessions() failed: Lookup returned %v", user)
+	}
+
+	sessions.End(httptest.NewRecorder(), r)
+	if user := sessions.Lookup(r); user != nil {
+		t.Fatalf("TestSessions() failed: Lookup after End returned %v", user)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:3001/", nil)
+	r.AddCookie(&http.Cookie{Name: SESSION_COOKIE, Value: "forged"})
+	if user := sessions.Lookup(r); user != nil {
+		t.Fatalf("TestSessions() failed: forged cookie returned %v", user)
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	t.Parallel()
+
+	idp := fakeidp.New("atlas", "s3cret")
+	defer idp.Close()
+	idp.SetClaims(map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "ada",
+		"email":              "ada@example.com",
+		"email_verified":     true,
+		"name":               "Ada Lovelace",
+		"groups":             []string{"idp-hr", "idp-other"},
+	})
+
+	provider, err := NewOIDC(OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "atlas",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://atlas.example/login/callback",
+		GroupMap:     map[string]string{"idp-hr": "hr"},
+	})
+	if err != nil {
+		t.Fatalf("TestOIDC() failed: NewOIDC: %v", err)
+	}
+
+	// send the browser to the provider, which approves at once
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://atlas.example/login", nil)
+	authUrl, err := provider.Begin(w, r, "/sub/")
+	if err != nil {
+		t.Fatalf("TestOIDC() failed: Begin: %v", err)
+	}
+	stateCookies := w.Result().Cookies()
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noFollow.Get(authUrl)
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("TestOIDC() failed: authorize: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+
+	// a callback without the browser's cookie is refused
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", callback, nil)
+	if _, _, err := provider.Finish(w, r); err != ErrBadState {
+		t.Fatalf("TestOIDC() failed: cookieless callback returned %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", callback, nil)
+	for _, c := range stateCookies {
+		r.AddCookie(c)
+	}
+	user, next, err := provider.Finish(w, r)
+	if err != nil {
+		t.Fatalf("TestOIDC() failed: Finish: %v", err)
+	}
+	if user.Name != "ada@example.com" || user.FullName != "Ada Lovelace" || len(user.Groups) != 1 || user.Groups[0] != "hr" || next != "/sub/" {
+		t.Fatalf("TestOIDC() failed: got %+v, next %q", user, next)
+	}
+
+	// users can't pick their own names, unless the atlas is set up to let them
+	for _, c := range []struct {
+		claim  string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"", map[string]interface{}{"sub": "1234", "preferred_username": "root"}, "1234"},
+		{"", map[string]interface{}{"sub": "1234", "email": "root@example.com"}, "1234"},
+		{"", map[string]interface{}{"sub": "1234", "email": "root@example.com", "email_verified": false}, "1234"},
+		{"", map[string]interface{}{"sub": "1234", "email": "ada@example.com", "email_verified": "true"}, "ada@example.com"},
+		{"email", map[string]interface{}{"sub": "1234", "email": "root@example.com"}, ""},
+		{"preferred_username", map[string]interface{}{"sub": "1234", "preferred_username": "ada"}, "ada"},
+	} {
+		provider.Config.UserClaim = c.claim
+		user, err := provider.user(c.claims)
+		if c.want == "" && err == nil {
+			t.Fatalf("TestOIDC() failed: user claim %q of %v named %q", c.claim, c.claims, user.Name)
+		}
+		if c.want != "" && (err != nil || user.Name != c.want) {
+			t.Fatalf("TestOIDC() failed: user claim %q of %v named %v, %v, not %q", c.claim, c.claims, user, err, c.want)
+		}
+	}
+	provider.Config.UserClaim = ""
+
+	// the code is good once
+	w = httptest.NewRecorder()
+	if _, _, err := provider.Finish(w, r); err != ErrBadState {
+		t.Fatalf("TestOIDC() failed: replayed callback returned %v", err)
+	}
+
+	now := time.Now().Unix()
+	good := func() map[string]interface{} {
+		return map[string]interface{}{"iss": idp.URL, "aud": "atlas", "iat": now, "exp": now + 60, "nonce": "n", "sub": "x"}
+	}
+	if _, err := provider.Verify(idp.Sign(good()), "n"); err != nil {
+		t.Fatalf("TestOIDC() failed: good token refused: %v", err)
+	}
+	for what, change := range map[string]func(map[string]interface{}){
+		"wrong nonce":    func(c map[string]interface{}) { c["nonce"] = "m" },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "http://evil.example" },
+		"expired":        func(c map[string]interface{}) { c["exp"] = now - 3600 },
+		"foreign azp":    func(c map[string]interface{}) { c["aud"] = []string{"atlas", "other"}; c["azp"] = "other" },
+	} {
+		claims := good()
+		change(claims)
+		if _, err := provider.Verify(idp.Sign(claims), "n"); err == nil {
+			t.Fatalf("TestOIDC() failed: accepted token with %s", what)
+		}
+	}
+
+	tampered := idp.Sign(good())
+	forged := idp.Sign(map[string]interface{}{"iss": idp.URL, "aud": "atlas", "iat": now, "exp": now + 60, "nonce": "n", "sub": "root"})
+	parts := strings.Split(tampered, ".")
+	forgedParts := strings.Split(forged, ".")
+	if _, err := provider.Verify(parts[0]+"."+forgedParts[1]+"."+parts[2], "n"); err != ErrBadToken {
+		t.Fatalf("TestOIDC() failed: tampered token returned %v", err)
+	}
+}
+
+// stallingTransport holds up requests for paths in stall until release is
+// closed.
+type stallingTransport struct {
+	stall   string
+	release chan struct{}
+}
+
+func (self *stallingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path == self.stall {
+		<-self.release
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestOIDCSlowKeys(t *testing.T) {
+	t.Parallel()
+
+	idp := fakeidp.New("atlas", "s3cret")
+	defer idp.Close()
+
+	transport := &stallingTransport{stall: "/jwks", release: make(chan struct{})}
+	provider, err := NewOIDC(OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "atlas",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://atlas.example/login/callback",
+		Client:       &http.Client{Transport: transport},
+	})
+	if err != nil {
+		t.Fatalf("TestOIDCSlowKeys() failed: NewOIDC: %v", err)
+	}
+
+	// logins go on while the keys are fetched, which happens once
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			provider.key("unknown")
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	began := make(chan error)
+	go func() {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://atlas.example/login", nil)
+		_, err := provider.Begin(w, r, "/")
+		began <- err
+	}()
+	select {
+	case err := <-began:
+		if err != nil {
+			t.Fatalf("TestOIDCSlowKeys() failed: Begin: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestOIDCSlowKeys() failed: Begin waited on the key fetch")
+	}
+
+	close(transport.release)
+	wg.Wait()
+	if provider.keys == nil || time.Since(provider.fetched) > time.Minute {
+		t.Fatalf("TestOIDCSlowKeys() failed: keys not fetched")
+	}
+}
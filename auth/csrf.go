@@ -0,0 +1,99 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// CSRF_COOKIE carries a random id to bind tokens to for visitors without a
+// session.
+const CSRF_COOKIE = "atlas_csrf"
+
+// CSRF_FIELD names the form field carrying tokens.
+const CSRF_FIELD = "csrf_token"
+
+// CSRF_HEADER names the header carrying tokens, for scripts.
+const CSRF_HEADER = "X-CSRF-Token"
+
+var ErrBadCSRF = errors.New("auth: missing or bad CSRF token")
+
+// CSRF issues and checks tokens proving that requests come from pages atlas
+// served. Tokens are MACs of the session token, or of CSRF_COOKIE for
+// visitors without a session, so other sites can neither read nor forge them.
+type CSRF struct {
+	key []byte
+}
+
+func NewCSRF() (*CSRF, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return &CSRF{key: key}, nil
+}
+
+// binding returns the value r's tokens are bound to, or "".
+func binding(r *http.Request) string {
+	for _, name := range []string{SESSION_COOKIE, CSRF_COOKIE} {
+		c, err := r.Cookie(name)
+		if err == nil && c.Value != "" {
+			return name + ":" + c.Value
+		}
+	}
+	return ""
+}
+
+func (self *CSRF) mac(bound string) string {
+	m := hmac.New(sha256.New, self.key)
+	m.Write([]byte(bound))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Token returns the token for pages served in answer to r, giving r's browser
+// a CSRF_COOKIE if it has nothing to bind the token to.
+func (self *CSRF) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	bound := binding(r)
+	if bound == "" {
+		id, err := newToken()
+		if err != nil {
+			return "", err
+		}
+		c := &http.Cookie{
+			Name:     CSRF_COOKIE,
+			Value:    id,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   isSecure(r),
+			SameSite: http.SameSiteLaxMode,
+		}
+		http.SetCookie(w, c)
+		// let tokens issued later in this request match
+		r.AddCookie(c)
+		bound = CSRF_COOKIE + ":" + id
+	}
+	return self.mac(bound), nil
+}
+
+// Check verifies the token r carries in CSRF_HEADER or CSRF_FIELD.
+func (self *CSRF) Check(r *http.Request) error {
+	bound := binding(r)
+	if bound == "" {
+		return ErrBadCSRF
+	}
+
+	token := r.Header.Get(CSRF_HEADER)
+	if token == "" {
+		token = r.FormValue(CSRF_FIELD)
+	}
+	if token == "" || !hmac.Equal([]byte(token), []byte(self.mac(bound))) {
+		return ErrBadCSRF
+	}
+	return nil
+}
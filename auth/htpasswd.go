@@ -0,0 +1,91 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package auth
+
+import (
+	"akamai/atlas/stat"
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Htpasswd checks users against an Apache-style htpasswd file, which it
+// rereads whenever the file changes. Only bcrypt entries (htpasswd -B) are
+// accepted.
+type Htpasswd struct {
+	Path   string
+	hashes map[string]string
+	fi     os.FileInfo
+	mu     sync.Mutex
+}
+
+func NewHtpasswd(path string) *Htpasswd {
+	return &Htpasswd{
+		Path: path,
+	}
+}
+
+func (self *Htpasswd) Authenticate(name, password string) (*User, error) {
+	hash, err := self.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkHash([]byte(hash), password)
+	if err != nil {
+		return nil, err
+	}
+	return &User{Name: name}, nil
+}
+
+func (self *Htpasswd) lookup(name string) (string, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	fi, err := os.Stat(self.Path)
+	if err != nil {
+		return "", err
+	}
+	if self.fi == nil || !stat.IsFresh(fi, self.fi) {
+		err = self.read()
+		if err != nil {
+			return "", err
+		}
+		self.fi = fi
+	}
+	return self.hashes[name], nil
+}
+
+func (self *Htpasswd) read() error {
+	f, err := os.Open(self.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if !strings.HasPrefix(fields[1], "$2") {
+			L("htpasswd %s: skipping non-bcrypt entry for %q", self.Path, fields[0])
+			continue
+		}
+		hashes[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	L("htpasswd %s: read %d users", self.Path, len(hashes))
+	self.hashes = hashes
+	return nil
+}
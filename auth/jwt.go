@@ -0,0 +1,155 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ErrBadToken is returned for ID tokens that are malformed, badly signed, or
+// signed by unknown keys.
+var ErrBadToken = errors.New("auth: bad ID token")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwk is one key of a JSON Web Key Set. Only RSA keys are understood.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// parseKeys returns the RSA signing keys of set, by key id.
+func parseKeys(set *jwks) map[string]*rsa.PublicKey {
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			L("parseKeys: key %q: bad modulus: %v", k.Kid, err)
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			L("parseKeys: key %q: bad exponent", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys
+}
+
+// parseJwt splits a compact-serialized JWT, returning its header, its decoded
+// claims, and the signing input and signature for checking.
+func parseJwt(raw string) (header *jwtHeader, claims map[string]interface{}, signed, sig []byte, err error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		err = ErrBadToken
+		return
+	}
+
+	headerBits, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		err = ErrBadToken
+		return
+	}
+	header = &jwtHeader{}
+	if err = json.Unmarshal(headerBits, header); err != nil {
+		err = ErrBadToken
+		return
+	}
+
+	claimBits, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		err = ErrBadToken
+		return
+	}
+	if err = json.Unmarshal(claimBits, &claims); err != nil {
+		err = ErrBadToken
+		return
+	}
+
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		err = ErrBadToken
+		return
+	}
+	signed = []byte(parts[0] + "." + parts[1])
+	return
+}
+
+// verifyRS256 checks sig over signed with key.
+func verifyRS256(key *rsa.PublicKey, signed, sig []byte) error {
+	sum := sha256.Sum256(signed)
+	err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+	if err != nil {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// audiences returns the aud claim, which may be a string or a list.
+func audiences(claims map[string]interface{}) []string {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var auds []string
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+		return auds
+	}
+	return nil
+}
+
+// stringsClaim returns claim as a list of strings, accepting a lone string or
+// a list.
+func stringsClaim(claims map[string]interface{}, claim string) []string {
+	switch v := claims[claim].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// numericClaim returns a NumericDate claim in seconds since the epoch.
+func numericClaim(claims map[string]interface{}, claim string) (int64, error) {
+	v, ok := claims[claim].(float64)
+	if !ok {
+		return 0, fmt.Errorf("auth: ID token lacks %q", claim)
+	}
+	return int64(v), nil
+}
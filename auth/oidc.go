@@ -0,0 +1,427 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC_COOKIE names the cookie that ties a login in progress to the browser
+// that started it.
+const OIDC_COOKIE = "atlas_oidc"
+
+// OIDC_LOGIN_TIMEOUT is how long a login may spend at the identity provider.
+const OIDC_LOGIN_TIMEOUT = 10 * time.Minute
+
+// OIDC_LEEWAY allows for clock skew when checking ID token times.
+const OIDC_LEEWAY = time.Minute
+
+// OIDC_KEY_REFRESH is the least time between fetches of the provider's keys.
+const OIDC_KEY_REFRESH = time.Minute
+
+// ErrBadState is returned for callbacks that don't match a login begun by the
+// same browser.
+var ErrBadState = errors.New("auth: unknown or expired login")
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// UserClaim names the claim holding user names. Without one, users are
+	// named by their email address if the provider has verified it, and
+	// otherwise by sub. Claims that users may change themselves, like
+	// preferred_username, are only used if named here.
+	UserClaim string
+
+	// GroupsClaim names the claim listing the user's groups.
+	GroupsClaim string
+
+	// GroupMap renames the provider's groups to atlas groups. If it has any
+	// entries, groups not in it are dropped.
+	GroupMap map[string]string
+
+	Client *http.Client
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	nonce    string
+	verifier string
+	next     string
+	expires  time.Time
+}
+
+// OIDC logs users in through an OpenID Connect provider, using the
+// authorization code flow with PKCE.
+type OIDC struct {
+	Config    OIDCConfig
+	discovery oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+	fetching  chan struct{} // closed when the key set being fetched is in
+	pending   map[string]oidcPending
+	mu        sync.Mutex
+}
+
+// NewOIDC configures a provider from its discovery document.
+func NewOIDC(config OIDCConfig) (*OIDC, error) {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	self := &OIDC{
+		Config:  config,
+		pending: map[string]oidcPending{},
+	}
+
+	discoveryUrl := strings.TrimRight(config.Issuer, "/") + "/.well-known/openid-configuration"
+	err := self.getJson(discoveryUrl, &self.discovery)
+	if err != nil {
+		return nil, err
+	}
+	if self.discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("auth: provider claims issuer %q, not %q", self.discovery.Issuer, config.Issuer)
+	}
+	if self.discovery.AuthorizationEndpoint == "" || self.discovery.TokenEndpoint == "" || self.discovery.JwksUri == "" {
+		return nil, fmt.Errorf("auth: incomplete discovery document at %q", discoveryUrl)
+	}
+	L("oidc discovered %+v", self.discovery)
+	return self, nil
+}
+
+func (self *OIDC) getJson(u string, v interface{}) error {
+	resp, err := self.Config.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth: GET %q: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Begin starts logging r's browser in, returning the provider URL to send it
+// to. next is where Finish will send it afterwards.
+func (self *OIDC) Begin(w http.ResponseWriter, r *http.Request, next string) (string, error) {
+	state, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	self.mu.Lock()
+	self.sweep()
+	self.pending[state] = oidcPending{
+		nonce:    nonce,
+		verifier: verifier,
+		next:     next,
+		expires:  time.Now().Add(OIDC_LOGIN_TIMEOUT),
+	}
+	self.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_COOKIE,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(OIDC_LOGIN_TIMEOUT / time.Second),
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {self.Config.ClientID},
+		"redirect_uri":          {self.Config.RedirectURL},
+		"scope":                 {strings.Join(self.Config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(self.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return self.discovery.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Finish completes the login r returns from the provider with, returning the
+// user and the next URL given to Begin.
+func (self *OIDC) Finish(w http.ResponseWriter, r *http.Request) (*User, string, error) {
+	q := r.URL.Query()
+	state := q.Get("state")
+
+	c, err := r.Cookie(OIDC_COOKIE)
+	if err != nil || state == "" || c.Value != state {
+		return nil, "", ErrBadState
+	}
+	http.SetCookie(w, &http.Cookie{Name: OIDC_COOKIE, Path: "/", MaxAge: -1})
+
+	self.mu.Lock()
+	p, ok := self.pending[state]
+	delete(self.pending, state)
+	self.mu.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		return nil, "", ErrBadState
+	}
+
+	if e := q.Get("error"); e != "" {
+		return nil, "", fmt.Errorf("auth: provider refused login: %s %s", e, q.Get("error_description"))
+	}
+
+	rawIdToken, err := self.exchange(q.Get("code"), p.verifier)
+	if err != nil {
+		return nil, "", err
+	}
+
+	claims, err := self.Verify(rawIdToken, p.nonce)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, err := self.user(claims)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, p.next, nil
+}
+
+// exchange trades code for an ID token at the token endpoint.
+func (self *OIDC) exchange(code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {self.Config.RedirectURL},
+		"client_id":     {self.Config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", self.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if self.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(self.Config.ClientID), url.QueryEscape(self.Config.ClientSecret))
+	}
+
+	resp, err := self.Config.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tok)
+	if err != nil {
+		return "", fmt.Errorf("auth: token endpoint: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.Error != "" {
+		return "", fmt.Errorf("auth: token endpoint: %s: %s %s", resp.Status, tok.Error, tok.ErrorDescription)
+	}
+	if tok.IdToken == "" {
+		return "", fmt.Errorf("auth: token endpoint returned no ID token")
+	}
+	return tok.IdToken, nil
+}
+
+// Verify checks an ID token's signature, issuer, audience, lifetime and
+// nonce, returning its claims.
+func (self *OIDC) Verify(raw, nonce string) (map[string]interface{}, error) {
+	header, claims, signed, sig, err := parseJwt(raw)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("auth: ID token signed with unsupported %q", header.Alg)
+	}
+
+	key, err := self.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyRS256(key, signed, sig)
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != self.Config.Issuer {
+		return nil, fmt.Errorf("auth: ID token from issuer %q", iss)
+	}
+
+	auds := audiences(claims)
+	found := false
+	for _, aud := range auds {
+		found = found || aud == self.Config.ClientID
+	}
+	if !found {
+		return nil, fmt.Errorf("auth: ID token not meant for us, but %q", auds)
+	}
+	if azp, ok := claims["azp"].(string); (len(auds) > 1 || ok) && azp != self.Config.ClientID {
+		return nil, fmt.Errorf("auth: ID token authorized for %q", azp)
+	}
+
+	now := time.Now()
+	exp, err := numericClaim(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	if now.Add(-OIDC_LEEWAY).After(time.Unix(exp, 0)) {
+		return nil, fmt.Errorf("auth: ID token expired")
+	}
+	iat, err := numericClaim(claims, "iat")
+	if err != nil {
+		return nil, err
+	}
+	if time.Unix(iat, 0).After(now.Add(OIDC_LEEWAY)) {
+		return nil, fmt.Errorf("auth: ID token issued in the future")
+	}
+
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("auth: ID token has the wrong nonce")
+	}
+	return claims, nil
+}
+
+// key returns the provider's key with id kid, refetching the key set, at most
+// every OIDC_KEY_REFRESH, when the key is new to us. The set is fetched
+// without holding mu, so a slow provider holds up only the logins that need
+// its keys, and only once.
+func (self *OIDC) key(kid string) (*rsa.PublicKey, error) {
+	self.mu.Lock()
+	for {
+		if key, ok := self.keys[kid]; ok {
+			self.mu.Unlock()
+			return key, nil
+		}
+		if self.fetching == nil {
+			break
+		}
+		fetching := self.fetching
+		self.mu.Unlock()
+		<-fetching
+		self.mu.Lock()
+	}
+	if time.Since(self.fetched) < OIDC_KEY_REFRESH {
+		self.mu.Unlock()
+		return nil, ErrBadToken
+	}
+	fetching := make(chan struct{})
+	self.fetching = fetching
+	self.mu.Unlock()
+
+	var set jwks
+	err := self.getJson(self.discovery.JwksUri, &set)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.fetching = nil
+	close(fetching)
+	if err != nil {
+		return nil, err
+	}
+	self.keys = parseKeys(&set)
+	self.fetched = time.Now()
+	L("oidc fetched %d keys", len(self.keys))
+
+	if key, ok := self.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrBadToken
+}
+
+// emailVerified reports whether the provider vouches for the email claim.
+// Some send email_verified as a string.
+func emailVerified(claims map[string]interface{}) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// user maps claims to an atlas user.
+func (self *OIDC) user(claims map[string]interface{}) (*User, error) {
+	user := &User{}
+
+	claim := self.Config.UserClaim
+	if claim == "" {
+		claim = "sub"
+		if email, _ := claims["email"].(string); email != "" && emailVerified(claims) {
+			claim = "email"
+		}
+	}
+	if claim == "email" && !emailVerified(claims) {
+		return nil, fmt.Errorf("auth: ID token's email is not verified")
+	}
+	user.Name, _ = claims[claim].(string)
+	if user.Name == "" {
+		return nil, fmt.Errorf("auth: ID token names no user")
+	}
+	user.FullName, _ = claims["name"].(string)
+
+	for _, group := range stringsClaim(claims, self.Config.GroupsClaim) {
+		if len(self.Config.GroupMap) > 0 {
+			mapped, ok := self.Config.GroupMap[group]
+			if !ok {
+				continue
+			}
+			group = mapped
+		}
+		user.Groups = append(user.Groups, group)
+	}
+
+	L("oidc user %+v", user)
+	return user, nil
+}
+
+// sweep forgets abandoned logins. Callers must hold mu.
+func (self *OIDC) sweep() {
+	now := time.Now()
+	for state, p := range self.pending {
+		if now.After(p.expires) {
+			delete(self.pending, state)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SESSION_COOKIE names the cookie that carries session tokens.
+const SESSION_COOKIE = "atlas_session"
+
+// SESSION_MAX_AGE is how long a session lasts after its last use.
+const SESSION_MAX_AGE = 7 * 24 * time.Hour
+
+type session struct {
+	user    *User
+	expires time.Time
+}
+
+// Sessions maps random, unguessable tokens to logged-in users. Sessions live
+// in memory, so restarting atlas logs everyone out.
+type Sessions struct {
+	MaxAge  time.Duration
+	entries map[string]session
+	mu      sync.Mutex
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{
+		MaxAge:  SESSION_MAX_AGE,
+		entries: map[string]session{},
+	}
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// isSecure reports whether r arrived over TLS, directly or via a proxy.
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func (self *Sessions) cookie(r *http.Request, token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Start logs user in, replacing any session r already carries.
+func (self *Sessions) Start(w http.ResponseWriter, r *http.Request, user *User) error {
+	self.End(w, r)
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	self.mu.Lock()
+	self.sweep()
+	self.entries[token] = session{
+		user:    user,
+		expires: time.Now().Add(self.MaxAge),
+	}
+	self.mu.Unlock()
+
+	L("session start for %q", user.Name)
+	http.SetCookie(w, self.cookie(r, token, int(self.MaxAge/time.Second)))
+	return nil
+}
+
+// Lookup returns the user logged in by r, or nil, and extends the session.
+func (self *Sessions) Lookup(r *http.Request) *User {
+	c, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	now := time.Now()
+	s, ok := self.entries[c.Value]
+	if !ok {
+		return nil
+	}
+	if now.After(s.expires) {
+		delete(self.entries, c.Value)
+		return nil
+	}
+	s.expires = now.Add(self.MaxAge)
+	self.entries[c.Value] = s
+	return s.user
+}
+
+// End logs r's user out.
+func (self *Sessions) End(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return
+	}
+
+	self.mu.Lock()
+	delete(self.entries, c.Value)
+	self.mu.Unlock()
+
+	http.SetCookie(w, self.cookie(r, "", -1))
+}
+
+// sweep forgets expired sessions. Callers must hold mu.
+func (self *Sessions) sweep() {
+	now := time.Now()
+	for token, s := range self.entries {
+		if now.After(s.expires) {
+			delete(self.entries, token)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package auth
+
+import (
+	"database/sql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const USERS_SCHEMA = `
+CREATE TABLE IF NOT EXISTS U (
+	name      TEXT PRIMARY KEY,
+	full_name TEXT NOT NULL DEFAULT '',
+	hash      TEXT NOT NULL
+);
+`
+
+// DbUsers keeps users and their bcrypt password hashes in a table of the
+// config database.
+type DbUsers struct {
+	db *sql.DB
+}
+
+func NewDbUsers(db *sql.DB) (*DbUsers, error) {
+	_, err := db.Exec(USERS_SCHEMA)
+	if err != nil {
+		return nil, err
+	}
+	return &DbUsers{db: db}, nil
+}
+
+// Add creates user name or replaces its full name and password.
+func (self *DbUsers) Add(name, fullName, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = self.db.Exec("INSERT OR REPLACE INTO U (name, full_name, hash) VALUES (?, ?, ?);", name, fullName, string(hash))
+	return err
+}
+
+func (self *DbUsers) Remove(name string) error {
+	_, err := self.db.Exec("DELETE FROM U WHERE name = ?;", name)
+	return err
+}
+
+func (self *DbUsers) Authenticate(name, password string) (*User, error) {
+	user := &User{Name: name}
+	var hash string
+	row := self.db.QueryRow("SELECT full_name, hash FROM U WHERE name = ?;", name)
+	err := row.Scan(&user.FullName, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	err = checkHash([]byte(hash), password)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
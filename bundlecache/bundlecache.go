@@ -0,0 +1,242 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package bundlecache concatenates and minifies static scripts and
+// stylesheets into content-hashed bundles, rebuilding a bundle whenever one
+// of its sources changes on disk.
+package bundlecache
+
+import (
+	"akamai/atlas/chartfs"
+	"akamai/atlas/precompress"
+	"akamai/atlas/stat"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("bundle "+s, v...)
+	}
+}
+
+// ErrNoBundle is returned by Make for names that are not bundles.
+var ErrNoBundle = errors.New("no such bundle")
+
+type Bundle struct {
+	Name    string
+	Sources []string
+}
+
+type BundleEnt struct {
+	Blob *precompress.Blob
+	fis  []os.FileInfo
+}
+
+type BundleCache struct {
+	FS      *chartfs.FS
+	Bundles map[string]Bundle
+	Entries map[string]BundleEnt
+	mu      sync.Mutex
+}
+
+func New(fs *chartfs.FS) *BundleCache {
+	return &BundleCache{
+		FS:      fs,
+		Bundles: map[string]Bundle{},
+		Entries: map[string]BundleEnt{},
+	}
+}
+
+func clean(name string) string {
+	return chartfs.Clean(name)
+}
+
+// Add defines a bundle called name, built from sources (paths relative to
+// FS) in the given order. The bundle's type is taken from name's extension.
+func (self *BundleCache) Add(name string, sources ...string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	name = clean(name)
+	self.Bundles[name] = Bundle{
+		Name:    name,
+		Sources: sources,
+	}
+	delete(self.Entries, name)
+}
+
+// Names returns the names of all defined bundles in sorted order.
+func (self *BundleCache) Names() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	names := []string{}
+	for name := range self.Bundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MakeAll builds every defined bundle, as at startup.
+func (self *BundleCache) MakeAll() error {
+	for _, name := range self.Names() {
+		if _, err := self.Make(name); err != nil {
+			return fmt.Errorf("bundle %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Make returns the current contents of the bundle name, rebuilding it if any
+// of its sources has changed.
+func (self *BundleCache) Make(name string) (*precompress.Blob, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	name = clean(name)
+	bundle, ok := self.Bundles[name]
+	if !ok {
+		return nil, ErrNoBundle
+	}
+
+	fis := make([]os.FileInfo, len(bundle.Sources))
+	for idx, src := range bundle.Sources {
+		fi, err := self.FS.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		fis[idx] = fi
+	}
+
+	ent, ok := self.Entries[name]
+	if ok && self.allFresh(fis, ent.fis) {
+		return ent.Blob, nil
+	}
+
+	L("make rebuilding %q from %q", name, bundle.Sources)
+	blob, err := self.build(bundle, fis)
+	if err != nil {
+		return nil, err
+	}
+
+	self.Entries[name] = BundleEnt{
+		Blob: blob,
+		fis:  fis,
+	}
+	return blob, nil
+}
+
+func (self *BundleCache) allFresh(a, b []os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if !stat.IsFresh(a[idx], b[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *BundleCache) build(bundle Bundle, fis []os.FileInfo) (*precompress.Blob, error) {
+	ext := path.Ext(bundle.Name)
+
+	var buf bytes.Buffer
+	modTime := time.Time{}
+	for idx, src := range bundle.Sources {
+		body, err := self.FS.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+
+		switch ext {
+		case ".js":
+			if !strings.Contains(src, ".min.") {
+				body = MinifyJs(body)
+			}
+			buf.Write(body)
+			// guard against sources that omit their final semicolon
+			buf.WriteString(";\n")
+		case ".css":
+			buf.Write(MinifyCss(body))
+			buf.WriteString("\n")
+		default:
+			buf.Write(body)
+		}
+
+		if fis[idx].ModTime().After(modTime) {
+			modTime = fis[idx].ModTime()
+		}
+	}
+
+	return precompress.New(buf.Bytes(), modTime, true)
+}
+
+// MinifyJs conservatively shrinks a script: it trims indentation, drops blank
+// lines, and drops whole-line // comments after the file's leading comment
+// block, which usually holds the license and is kept.
+func MinifyJs(src []byte) []byte {
+	var buf bytes.Buffer
+	header := true
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		isComment := strings.HasPrefix(line, "//")
+		if !isComment {
+			header = false
+		}
+		if isComment && !header {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteRune('\n')
+	}
+	return buf.Bytes()
+}
+
+var cssSpaceRe = regexp.MustCompile(`\s+`)
+var cssPunctRe = regexp.MustCompile(`\s*([{};,])\s*`)
+
+// MinifyCss strips comments (other than /*! ... */ notices) and collapses
+// whitespace around punctuation.
+func MinifyCss(src []byte) []byte {
+	out := stripCssComments(src)
+	out = cssSpaceRe.ReplaceAll(out, []byte(" "))
+	out = cssPunctRe.ReplaceAll(out, []byte("$1"))
+	return bytes.TrimSpace(out)
+}
+
+func stripCssComments(src []byte) []byte {
+	var buf bytes.Buffer
+	for {
+		start := bytes.Index(src, []byte("/*"))
+		if start < 0 {
+			buf.Write(src)
+			return buf.Bytes()
+		}
+		end := bytes.Index(src[start+2:], []byte("*/"))
+		if end < 0 {
+			buf.Write(src)
+			return buf.Bytes()
+		}
+		end += start + 4
+
+		buf.Write(src[:start])
+		if bytes.HasPrefix(src[start:], []byte("/*!")) {
+			buf.Write(src[start:end])
+		}
+		src = src[end:]
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package bundlecache
+
+import (
+	"akamai/atlas/chartfs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMinifyCss(t *testing.T) {
+	t.Parallel()
+	in := "/*! keep me */\n/* drop me */\na , b {\n  color: red ;\n}\n/**/ c { }\n"
+	out := string(MinifyCss([]byte(in)))
+	want := "/*! keep me */ a,b{color: red;}c{}"
+	if out != want {
+		t.Fatalf("TestMinifyCss() failed: got %q, want %q", out, want)
+	}
+}
+
+func TestBundleCacheMake(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "atlas-bundle")
+	if err != nil {
+		t.Fatalf("TestBundleCacheMake() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(root)
+
+	write := func(name, body string) {
+		err := ioutil.WriteFile(path.Join(root, name), []byte(body), 0644)
+		if err != nil {
+			t.Fatalf("TestBundleCacheMake() write failed: err: %q", err)
+		}
+	}
+	write("a.js", "// License: MIT\n\nvar a = 1;\n  // chatter\n  a++\n")
+	write("b.js", "var b = 2;\n")
+
+	cache := New(chartfs.New(root))
+	cache.Add("site.min.js", "a.js", "b.js")
+
+	if _, err := cache.Make("nope.min.js"); err != ErrNoBundle {
+		t.Fatalf("TestBundleCacheMake() unknown bundle returned %q", err)
+	}
+
+	blob, err := cache.Make("/site.min.js")
+	if err != nil {
+		t.Fatalf("TestBundleCacheMake() make failed: err: %q", err)
+	}
+	body := string(blob.Raw)
+	if body != "// License: MIT\nvar a = 1;\na++\n;\nvar b = 2;\n;\n" {
+		t.Fatalf("TestBundleCacheMake() unexpected bundle: %q", body)
+	}
+
+	again, err := cache.Make("site.min.js")
+	if err != nil || again != blob {
+		t.Fatalf("TestBundleCacheMake() remake rebuilt an unchanged bundle; err %q", err)
+	}
+
+	write("b.js", "var b = 3; // changed\n")
+	changed, err := cache.Make("site.min.js")
+	if err != nil {
+		t.Fatalf("TestBundleCacheMake() remake failed: err: %q", err)
+	}
+	if changed.Fingerprint() == blob.Fingerprint() || !strings.Contains(string(changed.Raw), "var b = 3;") {
+		t.Fatalf("TestBundleCacheMake() remake missed a source change")
+	}
+}
@@ -23,6 +23,12 @@ func init() {
 	}
 }
 
+// DB returns the config database, for packages that keep tables of their own
+// in it.
+func DB() *sql.DB {
+	return db
+}
+
 func Int(key string) (int, error) {
 	var val int
 	row := db.QueryRow("SELECT val FROM C WHERE key = ?;", key)
@@ -3,11 +3,12 @@
 package chart
 
 import (
+	"akamai/atlas/chartfs"
+	"akamai/atlas/store"
 	"github.com/golang/glog"
 	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 )
 
@@ -19,7 +20,7 @@ func L(s string, v ...interface{}) {
 
 // BUG(mistone): Chart's methods are not goroutine-safe.
 type Chart struct {
-	dsnPath string
+	store   store.Store
 	srcPath string
 	fi      os.FileInfo
 	meta    ChartMeta
@@ -33,17 +34,18 @@ type ChartMeta struct {
 	Date    string
 }
 
-func NewChart(srcPath, dsnPath string) *Chart {
+// NewChart returns the chart stored at srcPath in s.
+func NewChart(s store.Store, srcPath string) *Chart {
 	return &Chart{
-		dsnPath: dsnPath,
-		srcPath: srcPath,
+		store:   s,
+		srcPath: chartfs.Clean(srcPath),
 		fi:      nil,
 	}
 }
 
 func (self *Chart) Read() (err error) {
 	L("read path %s", self.srcPath)
-	f, err := os.Open(self.srcPath)
+	f, err := self.store.Open(self.srcPath)
 	if err != nil {
 		return
 	}
@@ -64,33 +66,64 @@ func (self *Chart) Read() (err error) {
 	}
 
 	self.bytes = body
-	self.body = string(body)
+	self.meta, self.body = Parse(string(body))
 
-	lines := strings.Split(self.body, "\n")
-	L("read found %d lines", len(lines))
+	L("read title %q", self.meta.Title)
+	L("read authors %q", self.meta.Authors)
+	L("read date %q", self.meta.Date)
+
+	return nil
+}
+
+// Parse splits chart text into its header, if it has one, and its body.
+func Parse(text string) (meta ChartMeta, body string) {
+	body = text
+
+	lines := strings.Split(text, "\n")
+	L("parse found %d lines", len(lines))
 
-	foundHeaderChars := false
 	if len(lines) > 3 {
-		foundHeaderChars = true
 		for i := 0; i < 3; i++ {
 			if len(lines[i]) < 1 || lines[i][0] != '%' {
-				foundHeaderChars = false
+				return
 			}
 		}
+		meta.Title = strings.TrimLeft(lines[0], "% ")
+		meta.Authors = strings.TrimLeft(lines[1], "% ")
+		meta.Date = strings.TrimLeft(lines[2], "% ")
+		body = strings.SplitAfterN(text, "\n", 4)[3]
+	}
+	return
+}
 
-		if foundHeaderChars {
-			self.meta.Title = strings.TrimLeft(lines[0], "% ")
-			self.meta.Authors = strings.TrimLeft(lines[1], "% ")
-			self.meta.Date = strings.TrimLeft(lines[2], "% ")
-			self.body = strings.SplitAfterN(self.body, "\n", 4)[3]
+// AddAuthor returns text with author credited on its Authors line, which
+// replaces the "Authors" placeholder that new charts start with. Text without
+// a header is returned unchanged.
+func AddAuthor(text, author string) string {
+	lines := strings.SplitN(text, "\n", 4)
+	if author == "" || len(lines) < 4 {
+		return text
+	}
+	for i := 0; i < 3; i++ {
+		if len(lines[i]) < 1 || lines[i][0] != '%' {
+			return text
 		}
 	}
 
-	L("read title %q", self.meta.Title)
-	L("read authors %q", self.meta.Authors)
-	L("read date %q", self.meta.Date)
+	authors := strings.TrimLeft(lines[1], "% ")
+	if authors == "" || authors == "Authors" {
+		authors = author
+	} else {
+		for _, a := range strings.Split(authors, ",") {
+			if strings.TrimSpace(a) == author {
+				return text
+			}
+		}
+		authors = authors + ", " + author
+	}
 
-	return nil
+	lines[1] = "% " + authors
+	return strings.Join(lines, "\n")
 }
 
 func (self *Chart) Body() string {
@@ -110,7 +143,7 @@ func (self *Chart) Make() (built bool, err error) {
 }
 
 func (self *Chart) IsChart() bool {
-	base := filepath.Base(self.srcPath)
+	base := path.Base(self.srcPath)
 
 	if base != "index.txt" && base != "index.text" {
 		return false
@@ -118,21 +151,21 @@ func (self *Chart) IsChart() bool {
 	return true
 }
 
-func Resolve(dirPath, dsnPath string) (*Chart, error) {
+func Resolve(s store.Store, dirPath string) (*Chart, error) {
 	var err error
 
-	txtPath := path.Join(dirPath, "index.txt")
-	_, err = os.Stat(txtPath)
+	txtPath := path.Join(chartfs.Clean(dirPath), "index.txt")
+	_, err = s.Stat(txtPath)
 
 	if err == nil {
-		return NewChart(txtPath, dsnPath), nil
+		return NewChart(s, txtPath), nil
 	} else {
 		if os.IsNotExist(err) {
-			textPath := path.Join(dirPath, "index.text")
-			_, err := os.Stat(textPath)
+			textPath := path.Join(chartfs.Clean(dirPath), "index.text")
+			_, err := s.Stat(textPath)
 
 			if err == nil {
-				return NewChart(textPath, dsnPath), nil
+				return NewChart(s, textPath), nil
 			}
 		}
 	}
@@ -140,17 +173,14 @@ func Resolve(dirPath, dsnPath string) (*Chart, error) {
 }
 
 func (self *Chart) Slug() string {
-	dir := filepath.Dir(self.srcPath)
-	pfx := path.Clean(self.dsnPath)
+	dir := path.Dir(self.srcPath)
 
 	L("slug srcPath: %q", self.srcPath)
-	L("slug dsnPath: %q", self.dsnPath)
 	L("slug dir : %q", dir)
-	L("slug pfx : %q", pfx)
 
 	var sfx string
-	if len(dir) > len(pfx) {
-		sfx = dir[len(pfx)+1:] + "/"
+	if dir != "." {
+		sfx = dir + "/"
 	} else {
 		sfx = ""
 	}
@@ -159,7 +189,7 @@ func (self *Chart) Slug() string {
 }
 
 func (self *Chart) Dir() string {
-	return path.Dir(self.srcPath)
+	return chartfs.Clean(path.Dir(self.srcPath))
 }
 
 func (self *Chart) Src() string {
@@ -3,6 +3,7 @@
 package chart
 
 import (
+	"akamai/atlas/store"
 	"os"
 	"path"
 	"strings"
@@ -24,7 +25,7 @@ func init() {
 
 func TestChartRead(t *testing.T) {
 	t.Parallel()
-	chart := NewChart(path.Join(chartsPath, "index.txt"), chartsPath)
+	chart := NewChart(store.NewLocal(chartsPath), "index.txt")
 
 	err := chart.Read()
 	if err != nil {
@@ -50,7 +51,7 @@ func TestChartRead(t *testing.T) {
 
 func TestChartResolve(t *testing.T) {
 	t.Parallel()
-	c1, err := Resolve(chartsPath, chartsPath)
+	c1, err := Resolve(store.NewLocal(chartsPath), "")
 
 	if err != nil {
 		t.Fatalf("TestChartResolve() Resolve returned %q for c1.", err)
@@ -62,7 +63,7 @@ func TestChartResolve(t *testing.T) {
 		t.Fatalf("TestChartResolve() failed: c1.Src() = %q, not ...", c1src)
 	}
 
-	c2, err := Resolve(path.Join(chartsPath, "subchart"), chartsPath)
+	c2, err := Resolve(store.NewLocal(chartsPath), "subchart")
 	if err != nil {
 		t.Fatalf("TestChartResolve() Resolve returned %q for c1.", err)
 	}
@@ -73,3 +74,18 @@ func TestChartResolve(t *testing.T) {
 		t.Fatalf("TestChartResolve() failed: c2.Src() = %q, not ...", c2src)
 	}
 }
+
+func TestAddAuthor(t *testing.T) {
+	t.Parallel()
+	cases := []struct{ in, author, want string }{
+		{"% T\n% Authors\n% D\n\nbody\n", "Ada", "% T\n% Ada\n% D\n\nbody\n"},
+		{"% T\n% Bob\n% D\n\nbody\n", "Ada", "% T\n% Bob, Ada\n% D\n\nbody\n"},
+		{"% T\n% Bob, Ada\n% D\n\nbody\n", "Ada", "% T\n% Bob, Ada\n% D\n\nbody\n"},
+		{"no header\nat all\n\n", "Ada", "no header\nat all\n\n"},
+	}
+	for _, c := range cases {
+		if got := AddAuthor(c.in, c.author); got != c.want {
+			t.Fatalf("TestAddAuthor() failed: AddAuthor(%q, %q) = %q, want %q", c.in, c.author, got, c.want)
+		}
+	}
+}
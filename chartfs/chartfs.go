@@ -0,0 +1,261 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package chartfs confines file access to a single directory tree.
+//
+// Every name handed to an FS is a slash-separated path relative to the FS's
+// root; leading slashes and ".." elements are cleaned away, and names that
+// would reach outside the root by way of symbolic links are rejected with
+// ErrEscape.
+package chartfs
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("chartfs "+s, v...)
+	}
+}
+
+// ErrEscape is returned for names that resolve outside of the root.
+var ErrEscape = errors.New("chartfs: path escapes root")
+
+type FS struct {
+	Root string
+}
+
+func New(root string) *FS {
+	return &FS{
+		Root: root,
+	}
+}
+
+// Clean canonicalizes name to the slash-separated, root-relative form used
+// as a key throughout atlas; the root itself is "".
+func Clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Resolve returns the OS path of name, or ErrEscape if it, or the nearest
+// existing ancestor it would be created under, lies outside of the root once
+// symbolic links are followed.
+func (self *FS) Resolve(name string) (string, error) {
+	full, _, err := self.resolve(name)
+	return full, err
+}
+
+// Real returns the name, relative to the root, that name refers to once
+// symbolic links are followed, or ErrEscape as Resolve does.
+func (self *FS) Real(name string) (string, error) {
+	_, real, err := self.resolve(name)
+	return real, err
+}
+
+// resolve returns the OS path of name and the root-relative name it really
+// refers to.
+func (self *FS) resolve(name string) (string, string, error) {
+	name = Clean(name)
+
+	root, err := filepath.Abs(self.Root)
+	if err != nil {
+		return "", "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", "", err
+	}
+
+	full := filepath.Join(root, filepath.FromSlash(name))
+
+	// Find the longest prefix of full that exists and see where it really
+	// lives. Missing components can't be links, unless they are dangling
+	// ones, which we refuse to create through.
+	existing := full
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if real != realRoot && !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+				L("resolve %q -> %q escapes %q", name, real, realRoot)
+				return "", "", ErrEscape
+			}
+			real = filepath.Join(real, full[len(existing):])
+			return full, Clean(filepath.ToSlash(real[len(realRoot):])), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		if _, lerr := os.Lstat(existing); lerr == nil {
+			L("resolve %q crosses dangling link %q", name, existing)
+			return "", "", ErrEscape
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing || len(parent) < len(root) {
+			return "", "", err
+		}
+		existing = parent
+	}
+}
+
+func (self *FS) Open(name string) (*os.File, error) {
+	p, err := self.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (self *FS) Stat(name string) (os.FileInfo, error) {
+	p, err := self.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (self *FS) ReadDir(name string) ([]os.FileInfo, error) {
+	p, err := self.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(p)
+}
+
+func (self *FS) ReadFile(name string) ([]byte, error) {
+	p, err := self.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+func (self *FS) MkdirAll(name string) error {
+	p, err := self.Resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+// Create opens name for writing, making its parent directories as needed.
+// The new contents replace the old only once the returned File is closed.
+func (self *FS) Create(name string) (*File, error) {
+	err := self.MkdirAll(path.Dir(Clean(name)))
+	if err != nil {
+		return nil, err
+	}
+	p, err := self.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(p); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	err = tmp.Chmod(mode)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &File{tmp: tmp, path: p}, nil
+}
+
+// File is a file being written by Create. What is written goes to a
+// temporary file beside it, which Close syncs and renames into place, so
+// that a failed write never leaves a truncated file behind.
+type File struct {
+	tmp  *os.File
+	path string
+	done bool
+}
+
+func (self *File) Write(p []byte) (int, error) {
+	return self.tmp.Write(p)
+}
+
+// Close replaces the file with what was written, or, failing that, leaves
+// it as it was.
+func (self *File) Close() error {
+	if self.done {
+		return nil
+	}
+	self.done = true
+
+	err := self.tmp.Sync()
+	if cerr := self.tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(self.tmp.Name(), self.path)
+	}
+	if err != nil {
+		os.Remove(self.tmp.Name())
+		return err
+	}
+
+	// make the rename itself durable
+	dir, err := os.Open(filepath.Dir(self.path))
+	if err != nil {
+		L("Close(): unable to sync the directory of %q: %v", self.path, err)
+		return nil
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		L("Close(): unable to sync the directory of %q: %v", self.path, err)
+	}
+	return nil
+}
+
+// Abort discards what was written, leaving the file as it was. It does
+// nothing once the file is closed.
+func (self *File) Abort() error {
+	if self.done {
+		return nil
+	}
+	self.done = true
+
+	self.tmp.Close()
+	return os.Remove(self.tmp.Name())
+}
+
+func (self *FS) RemoveAll(name string) error {
+	if Clean(name) == "" {
+		return ErrEscape
+	}
+	p, err := self.Resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (self *FS) Rename(oldName, newName string) error {
+	if Clean(oldName) == "" || Clean(newName) == "" {
+		return ErrEscape
+	}
+	oldPath, err := self.Resolve(oldName)
+	if err != nil {
+		return err
+	}
+	err = self.MkdirAll(path.Dir(Clean(newName)))
+	if err != nil {
+		return err
+	}
+	newPath, err := self.Resolve(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
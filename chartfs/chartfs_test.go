@@ -0,0 +1,143 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package chartfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	t.Parallel()
+	cases := map[string]string{
+		"":                 "",
+		"/":                "",
+		"a/b":              "a/b",
+		"/a/b/":            "a/b",
+		"../../etc/passwd": "etc/passwd",
+		"a/../../b":        "b",
+	}
+	for in, want := range cases {
+		if got := Clean(in); got != want {
+			t.Fatalf("TestClean() failed: Clean(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFSEscape(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-chartfs")
+	if err != nil {
+		t.Fatalf("TestFSEscape() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := path.Join(tmp, "root")
+	outside := path.Join(tmp, "outside")
+	for _, dir := range []string{path.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("TestFSEscape() mkdir failed: err: %q", err)
+		}
+	}
+	err = ioutil.WriteFile(path.Join(outside, "secret"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatalf("TestFSEscape() write failed: err: %q", err)
+	}
+
+	links := map[string]string{
+		"out":      outside,
+		"sub/up":   "../..",
+		"inside":   "sub",
+		"dangling": path.Join(outside, "new"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, path.Join(root, name)); err != nil {
+			t.Fatalf("TestFSEscape() symlink failed: err: %q", err)
+		}
+	}
+
+	fs := New(root)
+
+	for _, name := range []string{"out/secret", "sub/up/outside/secret", "out", "dangling", "out/new/file"} {
+		if _, err := fs.Resolve(name); err != ErrEscape {
+			t.Fatalf("TestFSEscape() failed: Resolve(%q) returned %v, not ErrEscape", name, err)
+		}
+	}
+	if _, err := fs.ReadFile("out/secret"); err != ErrEscape {
+		t.Fatalf("TestFSEscape() failed: ReadFile escaped through a link: %v", err)
+	}
+	if _, err := fs.Create("dangling"); err != ErrEscape {
+		t.Fatalf("TestFSEscape() failed: Create followed a dangling link: %v", err)
+	}
+	if _, err := os.Stat(path.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Fatalf("TestFSEscape() failed: Create wrote outside the root")
+	}
+	if _, err := fs.ReadFile("../outside/secret"); !os.IsNotExist(err) {
+		t.Fatalf("TestFSEscape() failed: ../ was not confined to the root: %v", err)
+	}
+
+	f, err := fs.Create("inside/new/index.txt")
+	if err != nil {
+		t.Fatalf("TestFSEscape() failed: Create through an inner link: %v", err)
+	}
+	f.Close()
+	if _, err := os.Stat(path.Join(root, "sub/new/index.txt")); err != nil {
+		t.Fatalf("TestFSEscape() failed: Create did not write through the inner link: %v", err)
+	}
+
+	for name, want := range map[string]string{"": "", "sub": "sub", "inside/new/index.txt": "sub/new/index.txt", "inside/missing/x": "sub/missing/x"} {
+		if real, err := fs.Real(name); err != nil || real != want {
+			t.Fatalf("TestFSEscape() failed: Real(%q) returned %q, %v, not %q", name, real, err, want)
+		}
+	}
+
+	if err := fs.RemoveAll("/"); err != ErrEscape {
+		t.Fatalf("TestFSEscape() failed: RemoveAll of the root returned %v", err)
+	}
+}
+
+func TestFSCreate(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-chartfs")
+	if err != nil {
+		t.Fatalf("TestFSCreate() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	fs := New(tmp)
+	p := path.Join(tmp, "sub/index.txt")
+	os.MkdirAll(path.Dir(p), 0755)
+	ioutil.WriteFile(p, []byte("old"), 0640)
+
+	f, err := fs.Create("sub/index.txt")
+	if err != nil {
+		t.Fatalf("TestFSCreate() failed: Create: %v", err)
+	}
+	f.Write([]byte("new"))
+	if data, _ := ioutil.ReadFile(p); string(data) != "old" {
+		t.Fatalf("TestFSCreate() failed: unclosed write visible: %q", data)
+	}
+	f.Abort()
+	if data, _ := ioutil.ReadFile(p); string(data) != "old" {
+		t.Fatalf("TestFSCreate() failed: aborted write visible: %q", data)
+	}
+
+	f, _ = fs.Create("sub/index.txt")
+	f.Write([]byte("new"))
+	if err := f.Close(); err != nil {
+		t.Fatalf("TestFSCreate() failed: Close: %v", err)
+	}
+	fi, err := os.Stat(p)
+	if data, _ := ioutil.ReadFile(p); string(data) != "new" || err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("TestFSCreate() failed: wrote %q with mode %v", data, fi.Mode())
+	}
+
+	// no temporary files are left behind
+	if fis, _ := ioutil.ReadDir(path.Dir(p)); len(fis) != 1 {
+		t.Fatalf("TestFSCreate() failed: left %d files", len(fis))
+	}
+}
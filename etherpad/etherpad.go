@@ -0,0 +1,273 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package etherpad is a client for the parts of the etherpad-lite HTTP API
+// that atlas uses to edit charts.
+package etherpad
+
+import (
+	"github.com/golang/glog"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("etherpad "+s, v...)
+	}
+}
+
+// API_VERSION is the version of the API spoken.
+const API_VERSION = "1.2.7"
+
+// TIMEOUT bounds each call, on top of any deadline of its context.
+const TIMEOUT = 10 * time.Second
+
+// Codes etherpad answers calls with.
+const (
+	CODE_OK          = 0 // success
+	CODE_BAD_PARAMS  = 1 // bad parameters, like a pad that does or doesn't exist
+	CODE_INTERNAL    = 2 // etherpad failed
+	CODE_NO_FUNCTION = 3 // no such API method
+	CODE_BAD_KEY     = 4 // wrong API key
+)
+
+// Errors that Error matches with errors.Is.
+var (
+	ErrPadExists = errors.New("etherpad: pad already exists")
+	ErrNoPad     = errors.New("etherpad: no such pad")
+)
+
+// Error is a failed call: either etherpad couldn't be reached or understood,
+// in which case Err says why, or it answered with a Code other than CODE_OK.
+type Error struct {
+	Method  string
+	Status  int // the HTTP status, if etherpad answered at all
+	Code    int
+	Message string
+	Err     error
+}
+
+func (self *Error) Error() string {
+	if self.Err != nil {
+		return fmt.Sprintf("etherpad: %s: %v", self.Method, self.Err)
+	}
+	return fmt.Sprintf("etherpad: %s: code %d: %s", self.Method, self.Code, self.Message)
+}
+
+func (self *Error) Unwrap() error {
+	return self.Err
+}
+
+func (self *Error) Is(target error) bool {
+	if self.Err != nil || self.Code != CODE_BAD_PARAMS {
+		return false
+	}
+	switch target {
+	case ErrPadExists:
+		return self.Message == "padID does already exist"
+	case ErrNoPad:
+		return self.Message == "padID does not exist"
+	}
+	return false
+}
+
+// Client calls the API at Url, like http://localhost:9001/api.
+type Client struct {
+	Url    *url.URL
+	ApiKey string
+	HTTP   *http.Client
+}
+
+func New(apiUrl *url.URL, apiKey string) *Client {
+	return &Client{
+		Url:    apiUrl,
+		ApiKey: apiKey,
+		HTTP:   &http.Client{Timeout: TIMEOUT},
+	}
+}
+
+type response struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// call posts params to method and decodes the data of the answer into data,
+// unless it is nil. Parameters go in the body, where neither the API key nor
+// pad texts end up in access logs or against URL length limits.
+func (self *Client) call(ctx context.Context, method string, params url.Values, data interface{}) error {
+	fail := func(status int, err error) error {
+		return &Error{Method: method, Status: status, Err: err}
+	}
+
+	u := *self.Url
+	u.Path = path.Join(u.Path, API_VERSION, method)
+
+	body := url.Values{"apikey": {self.ApiKey}}
+	for k, v := range params {
+		body[k] = v
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), strings.NewReader(body.Encode()))
+	if err != nil {
+		return fail(0, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := self.HTTP.Do(req)
+	if err != nil {
+		return fail(0, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return fail(resp.StatusCode, fmt.Errorf("HTTP status %s", resp.Status))
+	}
+
+	epResp := &response{}
+	err = json.NewDecoder(resp.Body).Decode(epResp)
+	if err != nil {
+		return fail(resp.StatusCode, err)
+	}
+	L("call %s(%s): code %d: %s", method, params.Get("padID"), epResp.Code, epResp.Message)
+	if epResp.Code != CODE_OK {
+		return &Error{Method: method, Status: resp.StatusCode, Code: epResp.Code, Message: epResp.Message}
+	}
+
+	if data != nil {
+		if len(epResp.Data) == 0 || string(epResp.Data) == "null" {
+			return fail(resp.StatusCode, errors.New("no data"))
+		}
+		err = json.Unmarshal(epResp.Data, data)
+		if err != nil {
+			return fail(resp.StatusCode, err)
+		}
+	}
+	return nil
+}
+
+// CreatePad creates padID holding text. It fails with an error matching
+// ErrPadExists if the pad exists.
+func (self *Client) CreatePad(ctx context.Context, padID string, text string) error {
+	return self.call(ctx, "createPad", url.Values{"padID": {padID}, "text": {text}}, nil)
+}
+
+// GetText returns the text of padID at revision rev, or at its latest
+// revision if rev is negative.
+func (self *Client) GetText(ctx context.Context, padID string, rev int) (string, error) {
+	params := url.Values{"padID": {padID}}
+	if rev >= 0 {
+		params.Set("rev", strconv.Itoa(rev))
+	}
+	data := &struct {
+		Text *string `json:"text"`
+	}{}
+	err := self.call(ctx, "getText", params, data)
+	if err == nil && data.Text == nil {
+		err = &Error{Method: "getText", Status: http.StatusOK, Err: errors.New("no text")}
+	}
+	if err != nil {
+		return "", err
+	}
+	return *data.Text, nil
+}
+
+// SetText replaces the text of padID.
+func (self *Client) SetText(ctx context.Context, padID string, text string) error {
+	return self.call(ctx, "setText", url.Values{"padID": {padID}, "text": {text}}, nil)
+}
+
+// GetRevisionsCount returns the latest revision of padID.
+func (self *Client) GetRevisionsCount(ctx context.Context, padID string) (int, error) {
+	data := &struct {
+		Revisions *int `json:"revisions"`
+	}{}
+	err := self.call(ctx, "getRevisionsCount", url.Values{"padID": {padID}}, data)
+	if err == nil && data.Revisions == nil {
+		err = &Error{Method: "getRevisionsCount", Status: http.StatusOK, Err: errors.New("no revisions")}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return *data.Revisions, nil
+}
+
+// DeletePad deletes padID.
+func (self *Client) DeletePad(ctx context.Context, padID string) error {
+	return self.call(ctx, "deletePad", url.Values{"padID": {padID}}, nil)
+}
+
+// GetLastEdited returns when padID was last edited.
+func (self *Client) GetLastEdited(ctx context.Context, padID string) (time.Time, error) {
+	data := &struct {
+		LastEdited *int64 `json:"lastEdited"`
+	}{}
+	err := self.call(ctx, "getLastEdited", url.Values{"padID": {padID}}, data)
+	if err == nil && data.LastEdited == nil {
+		err = &Error{Method: "getLastEdited", Status: http.StatusOK, Err: errors.New("no lastEdited")}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	ms := *data.LastEdited
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)), nil
+}
+
+// ListAuthorsOfPad returns the ids of the authors who edited padID.
+func (self *Client) ListAuthorsOfPad(ctx context.Context, padID string) ([]string, error) {
+	data := &struct {
+		AuthorIDs []string `json:"authorIDs"`
+	}{}
+	err := self.call(ctx, "listAuthorsOfPad", url.Values{"padID": {padID}}, data)
+	if err != nil {
+		return nil, err
+	}
+	return data.AuthorIDs, nil
+}
+
+// PadUser is someone connected to a pad, under the name they gave
+// etherpad, if any.
+type PadUser struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// PadUsers returns who is connected to padID now.
+func (self *Client) PadUsers(ctx context.Context, padID string) ([]PadUser, error) {
+	data := &struct {
+		PadUsers []PadUser `json:"padUsers"`
+	}{}
+	err := self.call(ctx, "padUsers", url.Values{"padID": {padID}}, data)
+	if err != nil {
+		return nil, err
+	}
+	return data.PadUsers, nil
+}
+
+// PadUrl returns the URL of the page editing padID, with atlas's preferred
+// editor options.
+func (self *Client) PadUrl(padID string) url.URL {
+	u := *self.Url
+	u.Path = path.Join(path.Dir(u.Path), "p", padID)
+	u.RawQuery = url.Values{
+		"showControls":     {"true"},
+		"showChat":         {"true"},
+		"showLineNumbers":  {"true"},
+		"useMonospaceFont": {"true"},
+	}.Encode()
+	return u
+}
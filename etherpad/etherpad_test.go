@@ -0,0 +1,126 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package etherpad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	var posted url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("TestClient() failed: %s %s", r.Method, r.URL)
+		}
+		r.ParseForm()
+		posted = r.PostForm
+		if r.PostForm.Get("apikey") != "key" {
+			fmt.Fprint(w, `{"code":4,"message":"no or wrong API Key","data":null}`)
+			return
+		}
+		switch r.URL.Path {
+		default:
+			fmt.Fprint(w, `{"code":3,"message":"no such function","data":null}`)
+		case "/api/1.2.7/createPad":
+			fmt.Fprint(w, `{"code":1,"message":"padID does already exist","data":null}`)
+		case "/api/1.2.7/setText":
+			fmt.Fprint(w, `{"code":0,"message":"ok","data":null}`)
+		case "/api/1.2.7/getRevisionsCount":
+			fmt.Fprint(w, `{"code":0,"message":"ok","data":{"revisions":7}}`)
+		case "/api/1.2.7/getText":
+			fmt.Fprintf(w, `{"code":0,"message":"ok","data":{"text":"rev %s"}}`, r.PostForm.Get("rev"))
+		case "/api/1.2.7/getLastEdited":
+			fmt.Fprint(w, `{"code":0,"message":"ok","data":{"lastEdited":1391169600500}}`)
+		case "/api/1.2.7/listAuthorsOfPad":
+			fmt.Fprint(w, `{"code":0,"message":"ok","data":{"authorIDs":["a.1","a.2"]}}`)
+		case "/api/1.2.7/padUsers":
+			fmt.Fprint(w, `{"code":0,"message":"ok","data":{"padUsers":[{"colorId":"#ffc7c7","name":"Ada","timestamp":1391169600500,"id":"a.1"}]}}`)
+		case "/api/1.2.7/deletePad":
+			fmt.Fprint(w, `{"code":1,"message":"padID does not exist","data":null}`)
+		case "/api/1.2.7/slow":
+			<-r.Context().Done()
+		case "/api/1.2.7/broken":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/api")
+	client := New(u, "key")
+	ctx := context.Background()
+
+	err := client.CreatePad(ctx, "p", "text")
+	if !errors.Is(err, ErrPadExists) || errors.Is(err, ErrNoPad) {
+		t.Fatalf("TestClient() failed: CreatePad: err: %v", err)
+	}
+
+	long := strings.Repeat("x", 1<<16)
+	err = client.SetText(ctx, "p", long)
+	if err != nil || posted.Get("text") != long || posted.Get("padID") != "p" {
+		t.Fatalf("TestClient() failed: SetText: err: %v", err)
+	}
+
+	rev, err := client.GetRevisionsCount(ctx, "p")
+	if err != nil || rev != 7 {
+		t.Fatalf("TestClient() failed: GetRevisionsCount: %d, err: %v", rev, err)
+	}
+	text, err := client.GetText(ctx, "p", rev)
+	if err != nil || text != "rev 7" {
+		t.Fatalf("TestClient() failed: GetText: %q, err: %v", text, err)
+	}
+	text, err = client.GetText(ctx, "p", -1)
+	if err != nil || text != "rev " {
+		t.Fatalf("TestClient() failed: GetText latest: %q, err: %v", text, err)
+	}
+
+	edited, err := client.GetLastEdited(ctx, "p")
+	if want := time.Date(2014, 1, 31, 12, 0, 0, 5e8, time.UTC); err != nil || !edited.Equal(want) {
+		t.Fatalf("TestClient() failed: GetLastEdited: %v, err: %v", edited, err)
+	}
+	authors, err := client.ListAuthorsOfPad(ctx, "p")
+	if err != nil || len(authors) != 2 || authors[1] != "a.2" {
+		t.Fatalf("TestClient() failed: ListAuthorsOfPad: %q, err: %v", authors, err)
+	}
+
+	users, err := client.PadUsers(ctx, "p")
+	if err != nil || len(users) != 1 || users[0].ID != "a.1" || users[0].Name != "Ada" {
+		t.Fatalf("TestClient() failed: PadUsers: %+v, err: %v", users, err)
+	}
+
+	err = client.DeletePad(ctx, "p")
+	if !errors.Is(err, ErrNoPad) {
+		t.Fatalf("TestClient() failed: DeletePad: err: %v", err)
+	}
+
+	var epErr *Error
+	err = client.call(ctx, "broken", nil, nil)
+	if !errors.As(err, &epErr) || epErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("TestClient() failed: broken: err: %v", err)
+	}
+	err = New(u, "wrong").SetText(ctx, "p", "")
+	if !errors.As(err, &epErr) || epErr.Code != CODE_BAD_KEY {
+		t.Fatalf("TestClient() failed: wrong key: err: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = client.call(cancelled, "slow", nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestClient() failed: cancelled: err: %v", err)
+	}
+
+	pad := client.PadUrl("p")
+	if pad.Path != "/p/p" || pad.Query().Get("showChat") != "true" {
+		t.Fatalf("TestClient() failed: PadUrl: %v", pad.String())
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package events fans out news of changes to the atlas to the pages showing
+// it, which follow them as Server-Sent Events.
+package events
+
+import (
+	"github.com/golang/glog"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("events "+s, v...)
+	}
+}
+
+// Kinds of events.
+const (
+	SITE  = "site"  // the list of charts or the search index changed
+	CHART = "chart" // a file of a chart changed
+)
+
+// BUFFER is how many events a subscriber may fall behind by before further
+// events are dropped.
+const BUFFER = 64
+
+type Event struct {
+	Kind  string `json:"-"`
+	Chart string `json:"chart,omitempty"` // the slug of the chart
+	Name  string `json:"name,omitempty"`  // the file that changed
+}
+
+// WriteTo writes ev to w in the text/event-stream format.
+func (self *Event) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", self.Kind, data)
+	return int64(n), err
+}
+
+// Broker passes published events to its subscribers.
+type Broker struct {
+	mu   sync.Mutex
+	subs map[chan Event]bool
+}
+
+func New() *Broker {
+	return &Broker{subs: map[chan Event]bool{}}
+}
+
+// Subscribe returns a channel of the events published until stop is closed,
+// after which it is closed.
+func (self *Broker) Subscribe(stop <-chan struct{}) <-chan Event {
+	ch := make(chan Event, BUFFER)
+
+	self.mu.Lock()
+	self.subs[ch] = true
+	self.mu.Unlock()
+
+	go func() {
+		<-stop
+		self.mu.Lock()
+		delete(self.subs, ch)
+		close(ch)
+		self.mu.Unlock()
+	}()
+	return ch
+}
+
+// Publish passes ev to every subscriber with room for it.
+func (self *Broker) Publish(ev Event) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	L("Publish(): %s %q %q to %d", ev.Kind, ev.Chart, ev.Name, len(self.subs))
+	for ch := range self.subs {
+		select {
+		case ch <- ev:
+		default:
+			L("Publish(): dropped %s %q for a slow subscriber", ev.Kind, ev.Name)
+		}
+	}
+}
+
+// Slug returns the slug of the chart that file name belongs to: the
+// directory holding it.
+func Slug(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return ""
+	}
+	return name[:i+1]
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package events
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	t.Parallel()
+
+	broker := New()
+	stop := make(chan struct{})
+	evs := broker.Subscribe(stop)
+
+	broker.Publish(Event{Kind: CHART, Chart: "sub/", Name: "sub/index.txt"})
+	ev := <-evs
+	if ev.Kind != CHART || ev.Name != "sub/index.txt" {
+		t.Fatalf("TestBroker() failed: got %+v", ev)
+	}
+
+	// slow subscribers lose events rather than holding up the rest
+	for i := 0; i < BUFFER+1; i++ {
+		broker.Publish(Event{Kind: SITE})
+	}
+	if len(evs) != BUFFER {
+		t.Fatalf("TestBroker() failed: %d events buffered", len(evs))
+	}
+
+	close(stop)
+	for range evs {
+	}
+
+	var buf bytes.Buffer
+	ev.WriteTo(&buf)
+	if buf.String() != "event: chart\ndata: {\"chart\":\"sub/\",\"name\":\"sub/index.txt\"}\n\n" {
+		t.Fatalf("TestBroker() failed: wrote %q", buf.String())
+	}
+
+	for name, slug := range map[string]string{"index.txt": "", "sub/index.txt": "sub/", "a/b/c.svg": "a/b/"} {
+		if s := Slug(name); s != slug {
+			t.Fatalf("TestBroker() failed: Slug(%q) = %q", name, s)
+		}
+	}
+}
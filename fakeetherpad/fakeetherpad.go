@@ -0,0 +1,268 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package fakeetherpad is a stand-in etherpad-lite for tests and
+// development.
+//
+// It keeps pads in memory and speaks the subset of the HTTP API that package
+// etherpad calls. Its pad pages, at /p/<pad>, are plain forms rather than
+// collaborative editors, but they save each edit as a new revision just as
+// etherpad does.
+package fakeetherpad
+
+import (
+	"github.com/golang/glog"
+
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("fakeetherpad "+s, v...)
+	}
+}
+
+// DEFAULT_TEXT is what createPad fills new pads with when given no text,
+// like etherpad's welcome text.
+const DEFAULT_TEXT = "Welcome to the fake etherpad!\n"
+
+type revision struct {
+	text   string
+	author string
+	time   time.Time
+}
+
+type pad struct {
+	revs  []revision
+	users map[string]string // names of the connected authors, by id
+}
+
+func (self *pad) head() revision {
+	return self.revs[len(self.revs)-1]
+}
+
+// Pads is the fake etherpad: an http.Handler serving the API under /api and
+// pad pages under /p.
+type Pads struct {
+	ApiKey string
+
+	pads map[string]*pad
+	mu   sync.Mutex
+}
+
+func NewPads(apiKey string) *Pads {
+	return &Pads{
+		ApiKey: apiKey,
+		pads:   map[string]*pad{},
+	}
+}
+
+// Server is a running fake etherpad. Its API is at URL+"/api".
+type Server struct {
+	*httptest.Server
+	*Pads
+}
+
+// New starts a fake etherpad on a local port.
+func New(apiKey string) *Server {
+	pads := NewPads(apiKey)
+	return &Server{
+		Server: httptest.NewServer(pads),
+		Pads:   pads,
+	}
+}
+
+// Text returns the latest text of padID, and whether it exists.
+func (self *Pads) Text(padID string) (string, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	p, found := self.pads[padID]
+	if !found {
+		return "", false
+	}
+	return p.head().text, true
+}
+
+// Edit adds a revision by author to padID, creating it if need be, as if
+// someone had typed in it.
+func (self *Pads) Edit(padID string, text string, author string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	p, found := self.pads[padID]
+	if !found {
+		p = &pad{}
+		self.pads[padID] = p
+	}
+	p.revs = append(p.revs, revision{text: text, author: author, time: time.Now()})
+}
+
+// Connect adds author, named name, to the users connected to padID, as if
+// they had opened it. The pad must exist.
+func (self *Pads) Connect(padID string, author string, name string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	p := self.pads[padID]
+	if p.users == nil {
+		p.users = map[string]string{}
+	}
+	p.users[author] = name
+}
+
+// Disconnect removes author from the users connected to padID.
+func (self *Pads) Disconnect(padID string, author string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if p, found := self.pads[padID]; found {
+		delete(p.users, author)
+	}
+}
+
+func (self *Pads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	default:
+		http.NotFound(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		self.serveApi(w, r)
+	case strings.HasPrefix(r.URL.Path, "/p/"):
+		self.servePad(w, r, strings.TrimPrefix(r.URL.Path, "/p/"))
+	}
+}
+
+type response struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+// serveApi answers /api/<version>/<method>, by GET or POST, like etherpad:
+// always with status 200, and failures told apart by code.
+func (self *Pads) serveApi(w http.ResponseWriter, r *http.Request) {
+	fields := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+	method := fields[len(fields)-1]
+
+	code, message, data := self.call(method, r)
+	L("api %s(%s): code %d: %s", method, r.FormValue("padID"), code, message)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&response{Code: code, Message: message, Data: data})
+}
+
+func (self *Pads) call(method string, r *http.Request) (int, string, interface{}) {
+	if r.FormValue("apikey") != self.ApiKey {
+		return 4, "no or wrong API Key", nil
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	padID := r.FormValue("padID")
+	p, found := self.pads[padID]
+	if method != "createPad" && !found {
+		switch method {
+		case "getText", "setText", "getRevisionsCount", "deletePad", "getLastEdited", "listAuthorsOfPad", "padUsers":
+			return 1, "padID does not exist", nil
+		}
+	}
+
+	switch method {
+	case "createPad":
+		if padID == "" {
+			return 1, "padID is required", nil
+		}
+		if found {
+			return 1, "padID does already exist", nil
+		}
+		text := DEFAULT_TEXT
+		if _, given := r.Form["text"]; given {
+			text = r.FormValue("text")
+		}
+		self.pads[padID] = &pad{revs: []revision{{text: text, time: time.Now()}}}
+		return 0, "ok", nil
+	case "getText":
+		rev := p.head()
+		if s := r.FormValue("rev"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return 1, "rev is not a number", nil
+			}
+			if n >= len(p.revs) {
+				return 1, "rev is higher than the head revision of the pad", nil
+			}
+			rev = p.revs[n]
+		}
+		return 0, "ok", map[string]string{"text": rev.text}
+	case "setText":
+		p.revs = append(p.revs, revision{text: r.FormValue("text"), time: time.Now()})
+		return 0, "ok", nil
+	case "getRevisionsCount":
+		return 0, "ok", map[string]int{"revisions": len(p.revs) - 1}
+	case "deletePad":
+		delete(self.pads, padID)
+		return 0, "ok", nil
+	case "getLastEdited":
+		return 0, "ok", map[string]int64{"lastEdited": p.head().time.UnixNano() / int64(time.Millisecond)}
+	case "listAuthorsOfPad":
+		authors := []string{}
+		seen := map[string]bool{}
+		for _, rev := range p.revs {
+			if rev.author != "" && !seen[rev.author] {
+				seen[rev.author] = true
+				authors = append(authors, rev.author)
+			}
+		}
+		return 0, "ok", map[string][]string{"authorIDs": authors}
+	case "padUsers":
+		ids := []string{}
+		for id := range p.users {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		users := []map[string]interface{}{}
+		for _, id := range ids {
+			users = append(users, map[string]interface{}{"id": id, "name": p.users[id], "colorId": "#ffc7c7", "timestamp": time.Now().UnixNano() / int64(time.Millisecond)})
+		}
+		return 0, "ok", map[string]interface{}{"padUsers": users}
+	}
+	return 3, "no such function", nil
+}
+
+var padPage = template.Must(template.New("pad").Parse(`<!doctype html>
+<html>
+<head><title>{{.ID}}</title></head>
+<body>
+<form method="post" action="">
+<textarea name="text" rows="40" cols="100">{{.Text}}</textarea>
+<input type="submit" value="Save revision"></input>
+</form>
+</body>
+</html>
+`))
+
+// servePad shows padID in a form whose posts add revisions, standing in for
+// etherpad's editor.
+func (self *Pads) servePad(w http.ResponseWriter, r *http.Request, padID string) {
+	if r.Method == "POST" {
+		self.Edit(padID, r.FormValue("text"), "a.fake")
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	text, found := self.Text(padID)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	padPage.Execute(w, map[string]string{"ID": padID, "Text": text})
+}
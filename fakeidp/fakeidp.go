@@ -0,0 +1,247 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package fakeidp is a stand-in OpenID Connect provider for tests and
+// development.
+//
+// It speaks just enough of discovery, the authorization code flow with PKCE,
+// and JWKS to log in whoever SetClaims names, without asking anything.
+package fakeidp
+
+import (
+	"github.com/golang/glog"
+
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("fakeidp "+s, v...)
+	}
+}
+
+// KEY_ID names the provider's only signing key.
+const KEY_ID = "fakeidp"
+
+type grant struct {
+	redirectUri string
+	challenge   string
+	nonce       string
+	claims      map[string]interface{}
+}
+
+// Server is a running provider. Its issuer is its URL.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	// claims go in the ID token of every login, beside the standard ones
+	claims map[string]interface{}
+
+	key    *rsa.PrivateKey
+	grants map[string]grant
+	mu     sync.Mutex
+}
+
+// New starts a provider that knows one client.
+func New(clientId, clientSecret string) *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	self := &Server{
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		claims:       map[string]interface{}{"sub": "nobody"},
+		key:          key,
+		grants:       map[string]grant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", self.handleDiscovery)
+	mux.HandleFunc("/authorize", self.handleAuthorize)
+	mux.HandleFunc("/token", self.handleToken)
+	mux.HandleFunc("/jwks", self.handleJwks)
+	self.Server = httptest.NewServer(mux)
+	return self
+}
+
+// SetClaims chooses who the next logins are for.
+func (self *Server) SetClaims(claims map[string]interface{}) {
+	self.mu.Lock()
+	self.claims = claims
+	self.mu.Unlock()
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func oauthError(w http.ResponseWriter, code int, e string) {
+	L("error %s", e)
+	writeJson(w, code, map[string]string{"error": e})
+}
+
+func (self *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                self.URL,
+		"authorization_endpoint":                self.URL + "/authorize",
+		"token_endpoint":                        self.URL + "/token",
+		"jwks_uri":                              self.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// handleAuthorize approves every well-formed request at once, redirecting
+// back with a code.
+func (self *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != self.ClientID {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	back := redirect.Query()
+	back.Set("state", q.Get("state"))
+	switch {
+	case q.Get("response_type") != "code":
+		back.Set("error", "unsupported_response_type")
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		back.Set("error", "invalid_request")
+	default:
+		code := newToken()
+		self.mu.Lock()
+		self.grants[code] = grant{
+			redirectUri: redirect.String(),
+			challenge:   q.Get("code_challenge"),
+			nonce:       q.Get("nonce"),
+			claims:      self.claims,
+		}
+		self.mu.Unlock()
+		back.Set("code", code)
+	}
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (self *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		oauthError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+
+	clientId, secret, ok := r.BasicAuth()
+	if ok {
+		clientId, _ = url.QueryUnescape(clientId)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientId, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if clientId != self.ClientID || secret != self.ClientSecret {
+		oauthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	code := r.FormValue("code")
+	self.mu.Lock()
+	g, found := self.grants[code]
+	delete(self.grants, code)
+	self.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	switch {
+	case r.FormValue("grant_type") != "authorization_code":
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	case !found || g.redirectUri != r.FormValue("redirect_uri"):
+		oauthError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		oauthError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss": self.URL,
+		"aud": self.ClientID,
+		"iat": now,
+		"exp": now + 300,
+	}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	for k, v := range g.claims {
+		claims[k] = v
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"access_token": newToken(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     self.Sign(claims),
+	})
+}
+
+func (self *Server) handleJwks(w http.ResponseWriter, r *http.Request) {
+	pub := self.key.PublicKey
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KEY_ID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// Sign returns claims as an ID token signed by the provider, so tests can
+// forge tokens of their own.
+func (self *Server) Sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": KEY_ID})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, self.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newToken() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package htmlsafe filters the raw HTML embedded in charts through an
+// allow-list of elements, attributes, and URL schemes.
+package htmlsafe
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/glog"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("htmlsafe "+s, v...)
+	}
+}
+
+// Policy says which raw HTML survives sanitization.
+type Policy struct {
+	Name string
+	// Elements maps each allowed element to its allowed attributes.
+	Elements map[string][]string
+	// GlobalAttrs are allowed on every allowed element.
+	GlobalAttrs []string
+	// UrlAttrs are attributes whose values must pass Schemes.
+	UrlAttrs []string
+	// Schemes are the allowed URL prefixes, like "https:" or "data:tkt,".
+	// Relative URLs are always allowed.
+	Schemes []string
+	// ImageSchemes are additionally allowed in <img src>.
+	ImageSchemes []string
+	// DropContent lists elements whose content is dropped along with them.
+	DropContent []string
+}
+
+var schemes = []string{"http:", "https:", "ftp:", "mailto:", "data:tkt,"}
+
+var imageSchemes = []string{"data:image/png;", "data:image/gif;", "data:image/jpeg;"}
+
+var dropContent = []string{"script", "style", "iframe", "object", "embed", "noscript", "template", "textarea", "title", "xmp", "svg", "math"}
+
+// Strict allows no raw HTML at all, as blackfriday.HTML_SKIP_HTML did.
+var Strict = &Policy{
+	Name:         "strict",
+	Elements:     map[string][]string{},
+	Schemes:      schemes,
+	ImageSchemes: imageSchemes,
+	DropContent:  dropContent,
+}
+
+// Default allows the formatting markup chart authors ask for: sized images,
+// disclosure widgets, super- and subscripts, and tables with spans.
+var Default = &Policy{
+	Name: "default",
+	Elements: map[string][]string{
+		"a":          {"href", "name"},
+		"abbr":       nil,
+		"b":          nil,
+		"blockquote": {"cite"},
+		"br":         nil,
+		"caption":    nil,
+		"cite":       nil,
+		"code":       nil,
+		"col":        {"span", "width"},
+		"colgroup":   {"span", "width"},
+		"dd":         nil,
+		"del":        {"cite", "datetime"},
+		"details":    {"open"},
+		"dfn":        nil,
+		"div":        {"align"},
+		"dl":         nil,
+		"dt":         nil,
+		"em":         nil,
+		"figcaption": nil,
+		"figure":     nil,
+		"h1":         nil,
+		"h2":         nil,
+		"h3":         nil,
+		"h4":         nil,
+		"h5":         nil,
+		"h6":         nil,
+		"hr":         nil,
+		"i":          nil,
+		"img":        {"src", "alt", "width", "height", "align"},
+		"ins":        {"cite", "datetime"},
+		"kbd":        nil,
+		"li":         {"value"},
+		"mark":       nil,
+		"ol":         {"start", "type", "reversed"},
+		"p":          {"align"},
+		"pre":        nil,
+		"q":          {"cite"},
+		"s":          nil,
+		"samp":       nil,
+		"small":      nil,
+		"span":       nil,
+		"strike":     nil,
+		"strong":     nil,
+		"sub":        nil,
+		"summary":    nil,
+		"sup":        nil,
+		"table":      {"border", "cellpadding", "cellspacing", "width"},
+		"tbody":      {"align", "valign"},
+		"td":         {"colspan", "rowspan", "align", "valign", "width"},
+		"tfoot":      {"align", "valign"},
+		"th":         {"colspan", "rowspan", "align", "valign", "width", "scope"},
+		"thead":      {"align", "valign"},
+		"tr":         {"align", "valign"},
+		"tt":         nil,
+		"u":          nil,
+		"ul":         {"type"},
+		"var":        nil,
+	},
+	GlobalAttrs:  []string{"title", "class", "lang", "dir"},
+	UrlAttrs:     []string{"href", "src", "cite"},
+	Schemes:      schemes,
+	ImageSchemes: imageSchemes,
+	DropContent:  dropContent,
+}
+
+var policies = map[string]*Policy{
+	Strict.Name:  Strict,
+	Default.Name: Default,
+}
+
+// Lookup returns the named policy.
+func Lookup(name string) (*Policy, error) {
+	policy, ok := policies[name]
+	if !ok {
+		return nil, fmt.Errorf("htmlsafe: unknown policy %q", name)
+	}
+	return policy, nil
+}
+
+// Names lists the registered policies.
+func Names() []string {
+	names := []string{}
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Policy) allowAttr(elt, attr string) bool {
+	return contains(self.GlobalAttrs, attr) || contains(self.Elements[elt], attr)
+}
+
+var schemeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+var ctlRe = regexp.MustCompile(`[\x00-\x20\x7f]+`)
+
+func (self *Policy) allowUrl(elt, val string) bool {
+	// browsers ignore embedded whitespace and control characters in schemes
+	v := strings.ToLower(ctlRe.ReplaceAllString(val, ""))
+	if !schemeRe.MatchString(v) {
+		return true
+	}
+	for _, scheme := range self.Schemes {
+		if strings.HasPrefix(v, scheme) {
+			return true
+		}
+	}
+	if elt == "img" {
+		for _, scheme := range self.ImageSchemes {
+			if strings.HasPrefix(v, scheme) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type attr struct {
+	name string
+	val  string
+}
+
+type tag struct {
+	name  string
+	end   bool
+	attrs []attr
+}
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*`)
+var attrRe = regexp.MustCompile(`^\s*([^\s"'<>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+
+// parseTag parses the tag at the start of src, which begins with '<', and
+// returns it with its length, or a nil tag if src does not start a tag.
+func parseTag(src []byte) (*tag, int) {
+	i := 1
+	t := &tag{}
+	if i < len(src) && src[i] == '/' {
+		t.end = true
+		i++
+	}
+	name := nameRe.Find(src[i:])
+	if name == nil {
+		return nil, 0
+	}
+	t.name = strings.ToLower(string(name))
+	i += len(name)
+
+	for i < len(src) {
+		switch src[i] {
+		case '>':
+			return t, i + 1
+		case '/', ' ', '\t', '\n', '\r', '\f':
+			i++
+			continue
+		}
+		m := attrRe.FindSubmatch(src[i:])
+		if m == nil {
+			return nil, 0
+		}
+		val := string(m[2]) + string(m[3]) + string(m[4])
+		t.attrs = append(t.attrs, attr{
+			name: strings.ToLower(string(m[1])),
+			val:  html.UnescapeString(val),
+		})
+		i += len(m[0])
+	}
+	return nil, 0
+}
+
+// Sanitize filters an HTML fragment through policy. Disallowed tags are
+// removed but their text is kept, except for DropContent elements, whose
+// content goes too. Comments, doctypes, and processing instructions are
+// removed, and stray '<' characters are escaped.
+func (self *Policy) Sanitize(src []byte) []byte {
+	var out bytes.Buffer
+	dropping := ""
+
+	for len(src) > 0 {
+		lt := bytes.IndexByte(src, '<')
+		if lt < 0 {
+			if dropping == "" {
+				out.Write(src)
+			}
+			break
+		}
+		if dropping == "" {
+			out.Write(src[:lt])
+		}
+		src = src[lt:]
+
+		if bytes.HasPrefix(src, []byte("<!--")) {
+			end := bytes.Index(src, []byte("-->"))
+			if end < 0 {
+				break
+			}
+			src = src[end+3:]
+			continue
+		}
+		if bytes.HasPrefix(src, []byte("<!")) || bytes.HasPrefix(src, []byte("<?")) {
+			end := bytes.IndexByte(src, '>')
+			if end < 0 {
+				break
+			}
+			src = src[end+1:]
+			continue
+		}
+
+		t, n := parseTag(src)
+		if t == nil {
+			if dropping == "" {
+				out.WriteString("&lt;")
+			}
+			src = src[1:]
+			continue
+		}
+		src = src[n:]
+
+		if dropping != "" {
+			if t.end && t.name == dropping {
+				dropping = ""
+			}
+			continue
+		}
+
+		if contains(self.DropContent, t.name) {
+			L("sanitize dropping <%s> and its content", t.name)
+			if !t.end {
+				dropping = t.name
+			}
+			continue
+		}
+
+		if _, ok := self.Elements[t.name]; !ok {
+			L("sanitize dropping <%s>", t.name)
+			continue
+		}
+
+		self.write(&out, t)
+	}
+
+	return out.Bytes()
+}
+
+func (self *Policy) write(out *bytes.Buffer, t *tag) {
+	if t.end {
+		out.WriteString("</" + t.name + ">")
+		return
+	}
+
+	out.WriteString("<" + t.name)
+	for _, a := range t.attrs {
+		if !self.allowAttr(t.name, a.name) {
+			L("sanitize dropping %s on <%s>", a.name, t.name)
+			continue
+		}
+		if contains(self.UrlAttrs, a.name) && !self.allowUrl(t.name, a.val) {
+			L("sanitize dropping %s=%q on <%s>", a.name, a.val, t.name)
+			continue
+		}
+		out.WriteString(" " + a.name + `="` + html.EscapeString(a.val) + `"`)
+	}
+	out.WriteString(">")
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package htmlsafe
+
+import (
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		policy *Policy
+		in     string
+		want   string
+	}{
+		{Default, `<img src="x.svg" width=200 onerror="alert(1)">`, `<img src="x.svg" width="200">`},
+		{Default, `<details open><summary>More</summary>hidden</details>`, `<details open=""><summary>More</summary>hidden</details>`},
+		{Default, `E = mc<sup>2</sup>`, `E = mc<sup>2</sup>`},
+		{Default, `<td colspan="2" rowspan='3' style="color: red">x</td>`, `<td colspan="2" rowspan="3">x</td>`},
+		{Default, `<script>alert(1)</script>after`, `after`},
+		{Default, `<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{Default, `<a href="&#106;ava&#x09;script:alert(1)">x</a>`, `<a>x</a>`},
+		{Default, `<a href=" data:tkt,owner=me&amp;next=x">t</a>`, `<a href=" data:tkt,owner=me&amp;next=x">t</a>`},
+		{Default, `<a href="data:text/html,<script>">t</a>`, `<a>t</a>`},
+		{Default, `<img src="data:image/png;base64,AAAA">`, `<img src="data:image/png;base64,AAAA">`},
+		{Default, `<iframe src="http://evil.example/"></iframe><blink>x</blink>`, `x`},
+		{Default, `<!-- <script>alert(1)</script> -->ok`, `ok`},
+		{Default, `1 < 2 <3`, `1 &lt; 2 &lt;3`},
+		{Default, `<a title='"><script>'>x</a>`, `<a title="&#34;&gt;&lt;script&gt;">x</a>`},
+		{Strict, `<sup>2</sup><script>x</script>`, `2`},
+	}
+
+	for _, c := range cases {
+		got := string(c.policy.Sanitize([]byte(c.in)))
+		if got != c.want {
+			t.Fatalf("TestSanitize() failed: %s.Sanitize(%q) = %q, want %q", c.policy.Name, c.in, got, c.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	t.Parallel()
+	if p, err := Lookup("default"); err != nil || p != Default {
+		t.Fatalf("TestLookup() failed: Lookup(default) = (%v, %q)", p, err)
+	}
+	if _, err := Lookup("lax"); err == nil {
+		t.Fatalf("TestLookup() failed: Lookup(lax) succeeded")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package htmlsafe
+
+import (
+	"bytes"
+	"github.com/russross/blackfriday"
+)
+
+// Renderer wraps a blackfriday renderer so that the raw HTML blocks and tags
+// it is handed, and the URLs of Markdown links and images, pass through
+// Policy on their way out.
+type Renderer struct {
+	blackfriday.Renderer
+	Policy *Policy
+}
+
+func NewRenderer(renderer blackfriday.Renderer, policy *Policy) *Renderer {
+	return &Renderer{
+		Renderer: renderer,
+		Policy:   policy,
+	}
+}
+
+func (self *Renderer) BlockHtml(out *bytes.Buffer, text []byte) {
+	self.Renderer.BlockHtml(out, self.Policy.Sanitize(text))
+}
+
+func (self *Renderer) RawHtmlTag(out *bytes.Buffer, tag []byte) {
+	self.Renderer.RawHtmlTag(out, self.Policy.Sanitize(tag))
+}
+
+// Link renders Markdown links whose URLs Policy rejects as plain text.
+func (self *Renderer) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	if !self.Policy.allowUrl("a", string(link)) {
+		L("renderer dropping link %q", link)
+		out.Write(content)
+		return
+	}
+	self.Renderer.Link(out, link, title, content)
+}
+
+// Image drops Markdown images whose URLs Policy rejects.
+func (self *Renderer) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+	if !self.Policy.allowUrl("img", string(link)) {
+		L("renderer dropping image %q", link)
+		return
+	}
+	self.Renderer.Image(out, link, title, alt)
+}
@@ -9,11 +9,25 @@
 package main
 
 import (
+	"akamai/atlas/acl"
+	"akamai/atlas/audit"
+	"akamai/atlas/auth"
+	"akamai/atlas/cfg"
+	"akamai/atlas/fakeetherpad"
+	"akamai/atlas/htmlsafe"
+	"akamai/atlas/padsync"
+	"akamai/atlas/resumes"
+	"akamai/atlas/store"
+	"akamai/atlas/trash"
 	"akamai/atlas/web"
+	"bufio"
 	"flag"
+	"fmt"
 	"github.com/golang/glog"
+	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"runtime"
 	"strings"
 	"time"
@@ -36,12 +50,62 @@ var chartsRoot = flag.String("chartsroot", "charts", "charts app url prefix")
 // chartsPath tells us where to look for charts to render
 var chartsPath = flag.String("charts", "charts/", "path to atlas charts")
 
+// chartsStore tells us which backend keeps the charts
+var chartsStore = flag.String("store", "local", "chart storage backend: "+strings.Join(store.KINDS, ", "))
+
+// chartsSqlite tells the sqlite backend where to find its database
+var chartsSqlite = flag.String("store.sqlite", "charts.db", "path to the charts database for -store=sqlite")
+
+// authMode tells us where to look up users: the config database, an
+// htpasswd file, an OpenID Connect provider, or nowhere, letting anyone edit
+var authMode = flag.String("auth", "local", "authentication: local, htpasswd, oidc, none")
+
+// htpasswdPath tells us where to find users for -auth=htpasswd
+var htpasswdPath = flag.String("htpasswd", "atlas.htpasswd", "path to the htpasswd file for -auth=htpasswd")
+
+// addUser adds or updates a user in the config database, reading the password
+// from stdin, and exits
+var addUser = flag.String("adduser", "", "add the user name[:Full Name] to the config database, reading the password from stdin, and exit")
+
+// setAcl grants permissions on a subtree in the config database, and exits
+var setAcl = flag.String("acl", "", "grant \"subtree principal perms\" in the config database, where perms is a comma-separated list of read, edit, upload, admin or none, and exit")
+
+// addGroup adds a user to a group in the config database, and exits
+var addGroup = flag.String("addgroup", "", "add the user to the group, given as group:user, in the config database, and exit")
+
+// auditPath tells us where to record changes to the atlas
+var auditPath = flag.String("audit", "audit.jsonl", "path to the append-only audit log, or empty to keep none")
+
 // etherpadApiUrlStr tells us where to access etherpads for chart editing
 var etherpadApiUrlStr = flag.String("etherpadApiUrl", "http://localhost:9001/api", "etherpad API url")
 
 // etherpadApiSecretPath tells us where to look for the etherpad API key
 var etherpadApiSecretPath = flag.String("etherpadApiSecretPath", "eplite/APIKEY.txt", "path to the etherpad API secret")
 
+// fakeEtherpad serves chart editing from an in-memory stand-in for etherpad,
+// for development without etherpad-lite
+var fakeEtherpad = flag.Bool("fake-etherpad", false, "edit charts with an in-memory fake etherpad instead of -etherpadApiUrl")
+
+// txtEditor chooses how charts are edited
+var txtEditor = flag.String("txtEditor", "", "chart editor: etherpad, native, or empty for etherpad when it is configured and native otherwise")
+
+// padSync is how long a pad must go unedited before it is saved to its chart
+var padSync = flag.Duration("padSync", padsync.QUIET, "save etherpad edits to charts once the pad has been quiet this long, or 0 to save only by hand")
+
+// trashRetention is how long deleted charts are kept before being purged
+var trashRetention = flag.Duration("trashRetention", trash.RETENTION, "how long to keep deleted charts in the trash before purging them")
+
+// resumeTimeout and resumeMemory bound each tool run to convert a resume
+var resumeTimeout = flag.Duration("resumeTimeout", resumes.TIMEOUT, "how long each step of converting a resume may take")
+var resumeMemory = flag.Int64("resumeMemory", 0, "bytes of memory each tool converting a resume may use, enforced with prlimit, or 0 for no limit")
+
+// sanitizeSvg tells the web controller to strip unsafe content from SVG
+// files as it serves them, for drawings saved before saves were sanitized
+var sanitizeSvg = flag.Bool("sanitizeSvg", false, "sanitize SVG files when serving them")
+
+// htmlPolicy names the policy that filters raw HTML in charts
+var htmlPolicy = flag.String("htmlPolicy", "default", "raw HTML policy for charts: "+strings.Join(htmlsafe.Names(), ", "))
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -55,18 +119,88 @@ func main() {
 		}
 	}()
 
-	etherpadApiSecretRaw, err := ioutil.ReadFile(*etherpadApiSecretPath)
+	if *addUser != "" {
+		err := doAddUser(*addUser)
+		if err != nil {
+			glog.Fatalf("unable to add user %q: %v", *addUser, err)
+		}
+		return
+	}
+
+	if *setAcl != "" {
+		err := doSetAcl(*setAcl)
+		if err != nil {
+			glog.Fatalf("unable to set acl %q: %v", *setAcl, err)
+		}
+		return
+	}
+
+	if *addGroup != "" {
+		err := doAddGroup(*addGroup)
+		if err != nil {
+			glog.Fatalf("unable to add to group %q: %v", *addGroup, err)
+		}
+		return
+	}
+
+	authenticator, err := newAuthenticator(*authMode)
 	if err != nil {
 		panic(err)
 	}
 
-	etherpadApiSecret := strings.Trim(string(etherpadApiSecretRaw), " \t\n")
+	var sso *auth.OIDC
+	if *authMode == "oidc" {
+		sso, err = auth.NewOIDC(oidcConfig())
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	etherpadApiUrl, err := url.Parse(*etherpadApiUrlStr)
+	var rules *acl.Db
+	if *authMode != "none" {
+		rules, err = acl.NewDb(cfg.DB())
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	etherpadApiUrl, etherpadApiSecret, err := etherpadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	switch *txtEditor {
+	case "", web.TXT_EDITOR_ETHERPAD, web.TXT_EDITOR_NATIVE:
+	default:
+		panic(fmt.Errorf("unknown chart editor %q", *txtEditor))
+	}
+
+	policy, err := htmlsafe.Lookup(*htmlPolicy)
+	if err != nil {
+		panic(err)
+	}
+
+	var auditLog *audit.Log
+	if *auditPath != "" {
+		auditLog, err = audit.Open(*auditPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	storePath := *chartsPath
+	if *chartsStore == "sqlite" {
+		storePath = *chartsSqlite
+	}
+	charts, err := store.New(*chartsStore, storePath)
 	if err != nil {
 		panic(err)
 	}
 
+	converters := resumes.New()
+	converters.Limits.Timeout = *resumeTimeout
+	converters.Limits.Memory = *resumeMemory
+
 	web := &web.App{
 		HtmlPath:          *htmlPath,
 		StaticPath:        *staticPath,
@@ -75,7 +209,150 @@ func main() {
 		ChartsPath:        *chartsPath,
 		EtherpadApiUrl:    etherpadApiUrl,
 		EtherpadApiSecret: etherpadApiSecret,
+		TxtEditor:         *txtEditor,
+		PadSyncQuiet:      *padSync,
+		TrashRetention:    *trashRetention,
+		Resumes:           converters,
+		SanitizeSvg:       *sanitizeSvg,
+		HtmlPolicy:        policy,
+		Store:             charts,
+		Auth:              authenticator,
+		OIDC:              sso,
+		ACL:               rules,
+		Audit:             auditLog,
 	}
 
 	web.Serve()
 }
+
+// etherpadConfig returns where to find etherpad and its API key, starting
+// the fake etherpad if asked to. Without a key, chart editing is disabled
+// rather than atlas refusing to start.
+func etherpadConfig() (*url.URL, string, error) {
+	if *fakeEtherpad {
+		fake := fakeetherpad.New("fake")
+		glog.Warningf("editing charts with the fake etherpad at %s", fake.URL)
+		apiUrl, err := url.Parse(fake.URL + "/api")
+		return apiUrl, fake.ApiKey, err
+	}
+
+	etherpadApiSecretRaw, err := ioutil.ReadFile(*etherpadApiSecretPath)
+	if err != nil {
+		glog.Warningf("chart editing disabled: unable to read the etherpad API key: %v", err)
+		return nil, "", nil
+	}
+	etherpadApiSecret := strings.Trim(string(etherpadApiSecretRaw), " \t\n")
+
+	etherpadApiUrl, err := url.Parse(*etherpadApiUrlStr)
+	if err != nil {
+		return nil, "", err
+	}
+	return etherpadApiUrl, etherpadApiSecret, nil
+}
+
+func newAuthenticator(mode string) (auth.Authenticator, error) {
+	switch mode {
+	case "local":
+		return auth.NewDbUsers(cfg.DB())
+	case "htpasswd":
+		return auth.NewHtpasswd(*htpasswdPath), nil
+	case "oidc":
+		return nil, nil
+	case "none":
+		glog.Warningf("authentication disabled; anyone may edit charts")
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown auth mode %q", mode)
+}
+
+// oidcConfig reads the oidc.* keys of the config database. Issuer, client id
+// and redirect url are required; oidc.group_map takes a comma-separated list
+// of provider=atlas group pairs.
+func oidcConfig() auth.OIDCConfig {
+	config := auth.OIDCConfig{
+		Issuer:      cfg.MustString("oidc.issuer"),
+		ClientID:    cfg.MustString("oidc.client_id"),
+		RedirectURL: cfg.MustString("oidc.redirect_url"),
+	}
+	config.ClientSecret, _ = cfg.String("oidc.client_secret")
+	config.UserClaim, _ = cfg.String("oidc.user_claim")
+	config.GroupsClaim, _ = cfg.String("oidc.groups_claim")
+
+	if scopes, err := cfg.String("oidc.scopes"); err == nil {
+		config.Scopes = strings.Fields(scopes)
+	}
+
+	if groupMap, err := cfg.String("oidc.group_map"); err == nil {
+		config.GroupMap = map[string]string{}
+		for _, pair := range strings.Split(groupMap, ",") {
+			fields := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(fields) == 2 {
+				config.GroupMap[fields[0]] = fields[1]
+			}
+		}
+	}
+	return config
+}
+
+func doAddUser(spec string) error {
+	fields := strings.SplitN(spec, ":", 2)
+	name := fields[0]
+	fullName := ""
+	if len(fields) > 1 {
+		fullName = fields[1]
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+
+	users, err := auth.NewDbUsers(cfg.DB())
+	if err != nil {
+		return err
+	}
+	return users.Add(name, fullName, password)
+}
+
+func doSetAcl(spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) == 2 {
+		// the root may be given as an empty subtree
+		fields = append([]string{""}, fields...)
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("want \"subtree principal perms\"")
+	}
+
+	var perms acl.Perm
+	if fields[2] != "none" {
+		var err error
+		perms, err = acl.ParsePerms(fields[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := acl.NewDb(cfg.DB())
+	if err != nil {
+		return err
+	}
+	return db.Set(fields[0], fields[1], perms)
+}
+
+func doAddGroup(spec string) error {
+	fields := strings.SplitN(spec, ":", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("want group:user")
+	}
+
+	db, err := acl.NewDb(cfg.DB())
+	if err != nil {
+		return err
+	}
+	return db.AddMember(strings.TrimPrefix(fields[0], "@"), fields[1])
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package merge merges concurrent edits of text, line by line, in the manner
+// of diff3.
+package merge
+
+import (
+	"strings"
+)
+
+// Markers around conflicting lines in merged text.
+const (
+	MARK_YOURS  = "<<<<<<< yours\n"
+	MARK_SPLIT  = "=======\n"
+	MARK_THEIRS = ">>>>>>> saved\n"
+)
+
+// lines splits text after each newline.
+func lines(text string) []string {
+	ls := strings.SplitAfter(text, "\n")
+	if ls[len(ls)-1] == "" {
+		ls = ls[:len(ls)-1]
+	}
+	return ls
+}
+
+// MAX_MATCH bounds the table match fills to pair lines, which grows with the
+// product of the numbers of lines that differ. Past it, the differing lines
+// are left unpaired, so merging them is a single conflict.
+const MAX_MATCH = 1 << 22
+
+// match returns, for each line of a, the index of the line of b it is paired
+// with in a longest common subsequence of the two, or -1.
+func match(a, b []string) []int {
+	m := make([]int, len(a))
+
+	// lines shared at the ends pair without a table
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		m[p] = p
+		p++
+	}
+	s := 0
+	for s < len(a)-p && s < len(b)-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		m[len(a)-1-s] = len(b) - 1 - s
+		s++
+	}
+	a, b = a[p:len(a)-s], b[p:len(b)-s]
+
+	if (len(a)+1)*(len(b)+1) > MAX_MATCH {
+		for i := range a {
+			m[p+i] = -1
+		}
+		return m
+	}
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) {
+		switch {
+		case j < len(b) && a[i] == b[j]:
+			m[p+i] = p + j
+			i, j = i+1, j+1
+		case j < len(b) && lcs[i][j+1] > lcs[i+1][j]:
+			j++
+		default:
+			m[p+i] = -1
+			i++
+		}
+	}
+	return m
+}
+
+// Common returns the lines a and b have in common, in order: a stand-in base
+// for merging texts whose common ancestor is unknown.
+func Common(a, b string) string {
+	al := lines(a)
+	var common []string
+	for i, j := range match(al, lines(b)) {
+		if j >= 0 {
+			common = append(common, al[i])
+		}
+	}
+	return strings.Join(common, "")
+}
+
+// Merge applies the changes yours and theirs each made to base. Where they
+// changed the same lines differently, both versions are kept between
+// conflict markers, and counted in conflicts.
+func Merge(base, yours, theirs string) (merged string, conflicts int) {
+	b, y, t := lines(base), lines(yours), lines(theirs)
+	my, mt := match(b, y), match(b, t)
+
+	var out []string
+	chunk := func(b, y, t []string) {
+		same := func(p, q []string) bool {
+			return strings.Join(p, "") == strings.Join(q, "")
+		}
+		switch {
+		case same(y, b):
+			out = append(out, t...)
+		case same(t, b), same(y, t):
+			out = append(out, y...)
+		default:
+			conflicts++
+			out = append(out, MARK_YOURS)
+			out = append(out, y...)
+			if len(y) > 0 && !strings.HasSuffix(y[len(y)-1], "\n") {
+				out = append(out, "\n")
+			}
+			out = append(out, MARK_SPLIT)
+			out = append(out, t...)
+			if len(t) > 0 && !strings.HasSuffix(t[len(t)-1], "\n") {
+				out = append(out, "\n")
+			}
+			out = append(out, MARK_THEIRS)
+		}
+	}
+
+	i, j, k := 0, 0, 0
+	for i < len(b) || j < len(y) || k < len(t) {
+		// copy lines all three agree on
+		n := 0
+		for i+n < len(b) && my[i+n] == j+n && mt[i+n] == k+n {
+			n++
+		}
+		if n > 0 {
+			out = append(out, b[i:i+n]...)
+			i, j, k = i+n, j+n, k+n
+			continue
+		}
+
+		// then merge up to the next line all three share
+		o := i
+		for o < len(b) && (my[o] < 0 || mt[o] < 0) {
+			o++
+		}
+		if o == len(b) {
+			chunk(b[i:], y[j:], t[k:])
+			break
+		}
+		chunk(b[i:o], y[j:my[o]], t[k:mt[o]])
+		i, j, k = o, my[o], mt[o]
+	}
+	return strings.Join(out, ""), conflicts
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package merge
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	base := "a\nb\nc\nd\n"
+	for i, c := range []struct {
+		yours, theirs string
+		merged        string
+		conflicts     int
+	}{
+		{base, base, base, 0},
+		{"a\nB\nc\nd\n", base, "a\nB\nc\nd\n", 0},
+		{base, "a\nb\nc\nD\n", "a\nb\nc\nD\n", 0},
+		{"a\nB\nc\nd\n", "a\nb\nc\nD\n", "a\nB\nc\nD\n", 0},
+		{"x\na\nb\nc\nd\n", "a\nb\nc\nd\ny\n", "x\na\nb\nc\nd\ny\n", 0},
+		{"a\nc\nd\n", "a\nb\nc\nd\ne\n", "a\nc\nd\ne\n", 0},
+		{"a\nB\nc\nd\n", "a\nB\nc\nd\n", "a\nB\nc\nd\n", 0},
+		{"a\nY\nc\nd\n", "a\nT\nc\nd\n", "a\n" + MARK_YOURS + "Y\n" + MARK_SPLIT + "T\n" + MARK_THEIRS + "c\nd\n", 1},
+		{"a\nb\nc\nd\nY", "a\nb\nc\nd\nT", "a\nb\nc\nd\n" + MARK_YOURS + "Y\n" + MARK_SPLIT + "T\n" + MARK_THEIRS, 1},
+	} {
+		merged, conflicts := Merge(base, c.yours, c.theirs)
+		if merged != c.merged || conflicts != c.conflicts {
+			t.Fatalf("TestMerge() failed: case %d: got %q with %d conflicts, want %q with %d", i, merged, conflicts, c.merged, c.conflicts)
+		}
+	}
+
+	if common := Common("a\nb\nc\n", "a\nx\nc\n"); common != "a\nc\n" {
+		t.Fatalf("TestMerge() failed: Common: %q", common)
+	}
+	merged, conflicts := Merge(Common("a\nb\nc\n", "a\nx\nc\n"), "a\nb\nc\n", "a\nx\nc\n")
+	if conflicts != 1 || merged != "a\n"+MARK_YOURS+"b\n"+MARK_SPLIT+"x\n"+MARK_THEIRS+"c\n" {
+		t.Fatalf("TestMerge() failed: two-way merge: %q", merged)
+	}
+}
+
+func TestMergeLarge(t *testing.T) {
+	t.Parallel()
+
+	numbered := func(n int, format string) string {
+		var ls []string
+		for i := 0; i < n; i++ {
+			ls = append(ls, fmt.Sprintf(format, i))
+		}
+		return strings.Join(ls, "")
+	}
+
+	// too many differing lines to pair: the middle conflicts whole
+	yours, theirs := numbered(5000, "y%d\n"), numbered(5000, "t%d\n")
+	base := "top\n" + numbered(5000, "b%d\n") + "bottom\n"
+	merged, conflicts := Merge(base, "top\n"+yours+"bottom\n", "top\n"+theirs+"bottom\n")
+	want := "top\n" + MARK_YOURS + yours + MARK_SPLIT + theirs + MARK_THEIRS + "bottom\n"
+	if conflicts != 1 || merged != want {
+		t.Fatalf("TestMergeLarge() failed: got %d conflicts", conflicts)
+	}
+
+	// long texts that differ in a line still merge
+	base = numbered(100000, "%d\n")
+	yours = strings.Replace(base, "\n10\n", "\nY\n", 1)
+	theirs = strings.Replace(base, "\n99990\n", "\nT\n", 1)
+	want = strings.Replace(yours, "\n99990\n", "\nT\n", 1)
+	merged, conflicts = Merge(base, yours, theirs)
+	if conflicts != 0 || merged != want {
+		t.Fatalf("TestMergeLarge() failed: got %d conflicts merging long texts", conflicts)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package padsync saves the etherpad pads that charts are being edited in
+// back to the charts, in the background, so that edits aren't lost or left to
+// diverge when nobody clicks save.
+//
+// A Syncer polls the pads of the charts it tracks. Once a pad has gone quiet
+// after an edit, its text is written over the chart, unless the chart was
+// changed some other way since the pad last matched it; then the pad is in
+// conflict, and waits for someone to save or reload it by hand.
+package padsync
+
+import (
+	"akamai/atlas/store"
+
+	"github.com/golang/glog"
+
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("padsync "+s, v...)
+	}
+}
+
+// States of a tracked pad.
+const (
+	UNKNOWN  = "unknown"  // not polled yet
+	SYNCED   = "synced"   // the chart holds the pad's latest revision
+	UNSAVED  = "unsaved"  // the pad has edits the chart doesn't have yet
+	CONFLICT = "conflict" // the chart changed behind the pad's back
+)
+
+// ErrChanged is what Save returns when the chart is no longer the one it was
+// told to replace.
+var ErrChanged = errors.New("chart changed")
+
+// Defaults for Syncer's timings.
+const (
+	POLL  = 5 * time.Second  // how often pads are polled
+	QUIET = 30 * time.Second // how long a pad must go unedited to be saved
+	IDLE  = 10 * time.Minute // how long a pad is tracked after it was last asked about
+)
+
+// Pads is the part of the etherpad API a Syncer uses. *etherpad.Client
+// implements it.
+type Pads interface {
+	GetRevisionsCount(ctx context.Context, padID string) (int, error)
+	GetText(ctx context.Context, padID string, rev int) (string, error)
+	GetLastEdited(ctx context.Context, padID string) (time.Time, error)
+}
+
+// Status is what a Syncer knows of a chart's pad.
+type Status struct {
+	State  string    `json:"state"`
+	Rev    int       `json:"rev"`  // the pad revision the chart holds, or -1 if unknown
+	Head   int       `json:"head"` // the pad's latest revision
+	Edited time.Time `json:"edited"`
+	Saved  time.Time `json:"saved"` // when the Syncer last wrote the chart
+	Error  string    `json:"error,omitempty"`
+
+	// Base is the chart as the pad last matched it: the content a save
+	// from the pad replaces. It is nil while Rev is unknown.
+	Base []byte `json:"-"`
+}
+
+type entry struct {
+	Status
+	name string
+	pad  string
+	seen time.Time
+	gen  int
+}
+
+// Syncer tracks the pads of charts in Store.
+type Syncer struct {
+	Pads  Pads
+	Store store.Store
+
+	// Save writes text, the latest revision of the pad, over chart name,
+	// provided the chart is still base; otherwise it returns ErrChanged.
+	Save func(name string, base []byte, text string) error
+
+	Poll  time.Duration
+	Quiet time.Duration
+	Idle  time.Duration
+
+	entries map[string]*entry
+	mu      sync.Mutex
+}
+
+func New(pads Pads, s store.Store, save func(name string, base []byte, text string) error) *Syncer {
+	return &Syncer{
+		Pads:    pads,
+		Store:   s,
+		Save:    save,
+		Poll:    POLL,
+		Quiet:   QUIET,
+		Idle:    IDLE,
+		entries: map[string]*entry{},
+	}
+}
+
+// Track starts syncing chart name with padID, as the chart is now. A rev of
+// 0 or more says the pad's revision rev holds the chart, as after a save or
+// reload, and clears any conflict; a negative rev says nothing about the pad
+// and leaves a chart already tracked alone. A chart tracked from an unknown
+// revision isn't saved to until a poll finds the pad holding it.
+func (self *Syncer) Track(name string, padID string, rev int) error {
+	var base []byte
+	if rev >= 0 {
+		var err error
+		base, err = store.ReadFile(self.Store, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	e, found := self.entries[name]
+	if found && rev < 0 {
+		e.seen = time.Now()
+		return nil
+	}
+	if !found {
+		e = &entry{name: name}
+		self.entries[name] = e
+	}
+	e.Status = Status{State: UNKNOWN, Rev: rev, Head: rev, Saved: e.Saved, Base: base}
+	if rev >= 0 {
+		e.State = SYNCED
+	}
+	e.pad = padID
+	e.seen = time.Now()
+	e.gen++
+	L("Track(%q, %q, %d)", name, padID, rev)
+	return nil
+}
+
+// Status returns the status of chart name's pad, and whether it is tracked.
+// Asking keeps the pad tracked.
+func (self *Syncer) Status(name string) (Status, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	e, found := self.entries[name]
+	if !found {
+		return Status{}, false
+	}
+	e.seen = time.Now()
+	return e.Status, true
+}
+
+// Names returns the names of the tracked charts, sorted.
+func (self *Syncer) Names() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	names := make([]string, 0, len(self.entries))
+	for name := range self.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run syncs every Poll until stop is closed.
+func (self *Syncer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(self.Poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			self.Sync(context.Background())
+		}
+	}
+}
+
+// Sync polls each tracked pad once, saving those that have gone quiet, and
+// stops tracking the settled pads nobody has asked about for Idle.
+func (self *Syncer) Sync(ctx context.Context) {
+	for _, name := range self.Names() {
+		self.mu.Lock()
+		e, found := self.entries[name]
+		if !found {
+			self.mu.Unlock()
+			continue
+		}
+		if e.State != UNSAVED && time.Since(e.seen) > self.Idle {
+			L("Sync(): no longer tracking %q", name)
+			delete(self.entries, name)
+			self.mu.Unlock()
+			continue
+		}
+		snapshot := *e
+		self.mu.Unlock()
+
+		status := self.sync(ctx, &snapshot)
+
+		self.mu.Lock()
+		// a Track while we polled knows better
+		if e.gen == snapshot.gen {
+			e.Status = status
+		}
+		self.mu.Unlock()
+	}
+}
+
+// sync polls e's pad and returns its new status, saving the pad if it is
+// quiet.
+func (self *Syncer) sync(ctx context.Context, e *entry) Status {
+	status := e.Status
+	status.Error = ""
+
+	head, err := self.Pads.GetRevisionsCount(ctx, e.pad)
+	if err != nil {
+		return self.failed(e, status, err)
+	}
+	status.Head = head
+	if status.State == CONFLICT {
+		return status
+	}
+	if status.Rev < 0 {
+		return self.resolve(ctx, e, status)
+	}
+	if head == status.Rev {
+		status.State = SYNCED
+		return status
+	}
+
+	status.Edited, err = self.Pads.GetLastEdited(ctx, e.pad)
+	if err != nil {
+		return self.failed(e, status, err)
+	}
+	status.State = UNSAVED
+	if time.Since(status.Edited) < self.Quiet {
+		return status
+	}
+
+	text, err := self.Pads.GetText(ctx, e.pad, head)
+	if err != nil {
+		return self.failed(e, status, err)
+	}
+	current, err := store.ReadFile(self.Store, e.name)
+	if err != nil && !os.IsNotExist(err) {
+		return self.failed(e, status, err)
+	}
+
+	switch {
+	case string(current) == text:
+		// saved by hand, or edited back
+	case err != nil || !bytes.Equal(current, status.Base):
+		glog.Warningf("padsync: %q changed since its pad %s last matched it; not saving rev %d", e.name, e.pad, head)
+		status.State = CONFLICT
+		return status
+	default:
+		err = self.Save(e.name, current, text)
+		if errors.Is(err, ErrChanged) {
+			glog.Warningf("padsync: %q changed while saving its pad %s; not saving rev %d", e.name, e.pad, head)
+			status.State = CONFLICT
+			return status
+		}
+		if err != nil {
+			return self.failed(e, status, err)
+		}
+		glog.Infof("padsync: saved rev %d of pad %s to %q", head, e.pad, e.name)
+		status.Saved = time.Now()
+	}
+	status.State = SYNCED
+	status.Rev = head
+	status.Base = []byte(text)
+	return status
+}
+
+// resolve finds whether the latest revision of e's pad, whose relation to
+// the chart is unknown, holds the chart. If it does, the pad is synced from
+// there; if not, nobody can tell which is newer, and the pad is in conflict.
+func (self *Syncer) resolve(ctx context.Context, e *entry, status Status) Status {
+	text, err := self.Pads.GetText(ctx, e.pad, status.Head)
+	if err != nil {
+		return self.failed(e, status, err)
+	}
+	current, err := store.ReadFile(self.Store, e.name)
+	if err != nil && !os.IsNotExist(err) {
+		return self.failed(e, status, err)
+	}
+
+	status.Rev = status.Head
+	status.Base = []byte(text)
+	if err != nil || string(current) != text {
+		glog.Warningf("padsync: pad %s doesn't hold %q; not saving it", e.pad, e.name)
+		status.State = CONFLICT
+		return status
+	}
+	status.State = SYNCED
+	return status
+}
+
+func (self *Syncer) failed(e *entry, status Status, err error) Status {
+	glog.Errorf("padsync: unable to sync %q with pad %s: %v", e.name, e.pad, err)
+	status.Error = err.Error()
+	return status
+}
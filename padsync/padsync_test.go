@@ -0,0 +1,141 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package padsync
+
+import (
+	"akamai/atlas/etherpad"
+	"akamai/atlas/fakeetherpad"
+	"akamai/atlas/store"
+
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSyncer(t *testing.T) {
+	t.Parallel()
+
+	fake := fakeetherpad.New("key")
+	defer fake.Close()
+	apiUrl, _ := url.Parse(fake.URL + "/api")
+	client := etherpad.New(apiUrl, "key")
+	ctx := context.Background()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("one\n"))
+	client.CreatePad(ctx, "p", "one\n")
+
+	saves := 0
+	var meddle func()
+	syncer := New(client, charts, func(name string, base []byte, text string) error {
+		if meddle != nil {
+			meddle()
+		}
+		if current, _ := store.ReadFile(charts, name); !bytes.Equal(current, base) {
+			return ErrChanged
+		}
+		saves++
+		return store.WriteFile(charts, name, []byte(text))
+	})
+	syncer.Quiet = time.Hour
+
+	expect := func(what string, state string, rev int) {
+		status, found := syncer.Status("index.txt")
+		if !found || status.State != state || status.Rev != rev || status.Error != "" {
+			t.Fatalf("TestSyncer() failed: %s: status %+v, found %v", what, status, found)
+		}
+	}
+
+	err := syncer.Track("index.txt", "p", 0)
+	if err != nil {
+		t.Fatalf("TestSyncer() failed: Track: %v", err)
+	}
+	syncer.Sync(ctx)
+	expect("fresh pad", SYNCED, 0)
+
+	// edits are left alone until the pad goes quiet
+	fake.Edit("p", "two\n", "a.1")
+	syncer.Sync(ctx)
+	expect("edited pad", UNSAVED, 0)
+	if saves != 0 {
+		t.Fatalf("TestSyncer() failed: saved a busy pad")
+	}
+
+	syncer.Quiet = 0
+	syncer.Sync(ctx)
+	expect("quiet pad", SYNCED, 1)
+	if text, _ := store.ReadFile(charts, "index.txt"); string(text) != "two\n" || saves != 1 {
+		t.Fatalf("TestSyncer() failed: saved %q in %d saves", text, saves)
+	}
+
+	// a chart changed behind the pad's back isn't overwritten
+	store.WriteFile(charts, "index.txt", []byte("disk\n"))
+	fake.Edit("p", "three\n", "a.1")
+	syncer.Sync(ctx)
+	expect("changed chart", CONFLICT, 1)
+	if text, _ := store.ReadFile(charts, "index.txt"); string(text) != "disk\n" || saves != 1 {
+		t.Fatalf("TestSyncer() failed: conflict saved %q", text)
+	}
+
+	// until it is resolved by hand
+	fake.Edit("p", "disk\n", "a.1")
+	syncer.Track("index.txt", "p", 3)
+	syncer.Sync(ctx)
+	expect("resolved", SYNCED, 3)
+
+	// retracking an unknown pad doesn't forget where it was
+	syncer.Track("index.txt", "p", -1)
+	expect("retracked", SYNCED, 3)
+
+	// pads picked up at an unknown revision are saved only if they hold
+	// the chart
+	store.WriteFile(charts, "held.txt", []byte("same\n"))
+	client.CreatePad(ctx, "q", "same\n")
+	store.WriteFile(charts, "stale.txt", []byte("newer\n"))
+	client.CreatePad(ctx, "r", "older\n")
+	syncer.Track("held.txt", "q", -1)
+	syncer.Track("stale.txt", "r", -1)
+	if status, _ := syncer.Status("stale.txt"); status.State != UNKNOWN || status.Base != nil {
+		t.Fatalf("TestSyncer() failed: unknown pad: status %+v", status)
+	}
+	syncer.Sync(ctx)
+	if status, _ := syncer.Status("held.txt"); status.State != SYNCED || status.Rev != 0 {
+		t.Fatalf("TestSyncer() failed: pad holding its chart: status %+v", status)
+	}
+	if status, _ := syncer.Status("stale.txt"); status.State != CONFLICT || string(status.Base) != "older\n" {
+		t.Fatalf("TestSyncer() failed: stale pad: status %+v", status)
+	}
+	if text, _ := store.ReadFile(charts, "stale.txt"); string(text) != "newer\n" {
+		t.Fatalf("TestSyncer() failed: stale pad saved %q", text)
+	}
+
+	// a chart changed as the pad is saved isn't overwritten either
+	meddle = func() { store.WriteFile(charts, "held.txt", []byte("meddled\n")) }
+	fake.Edit("q", "edited\n", "a.1")
+	syncer.Sync(ctx)
+	meddle = nil
+	if status, _ := syncer.Status("held.txt"); status.State != CONFLICT {
+		t.Fatalf("TestSyncer() failed: meddled chart: status %+v", status)
+	}
+	if text, _ := store.ReadFile(charts, "held.txt"); string(text) != "meddled\n" {
+		t.Fatalf("TestSyncer() failed: meddled chart saved %q", text)
+	}
+
+	// settled pads nobody asks about are forgotten
+	syncer.Idle = 0
+	syncer.Sync(ctx)
+	if names := syncer.Names(); len(names) != 0 {
+		t.Fatalf("TestSyncer() failed: still tracking %q", names)
+	}
+
+	// failures are reported, leaving the state as it was
+	syncer.Idle = time.Hour
+	syncer.Track("index.txt", "p", -1)
+	fake.Close()
+	syncer.Sync(ctx)
+	if status, _ := syncer.Status("index.txt"); status.State != UNKNOWN || status.Error == "" {
+		t.Fatalf("TestSyncer() failed: etherpad down: status %+v", status)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package precompress holds HTTP response bodies together with their
+// content-hash ETags and gzip and deflate encodings, so that frequently
+// served bodies are compressed once rather than once per request.
+package precompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/golang/glog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("precompress "+s, v...)
+	}
+}
+
+const (
+	IDENTITY = ""
+	GZIP     = "gzip"
+	DEFLATE  = "deflate"
+)
+
+// MIN_SIZE is the smallest body worth compressing.
+const MIN_SIZE = 512
+
+type Blob struct {
+	Raw     []byte
+	Gzip    []byte
+	Deflate []byte
+	Hash    string
+	ModTime time.Time
+}
+
+// New hashes raw and, if compress is set, precomputes its gzip and deflate
+// encodings. Encodings that fail to shrink the body are dropped.
+func New(raw []byte, modTime time.Time, compress bool) (*Blob, error) {
+	sum := sha1.Sum(raw)
+	blob := &Blob{
+		Raw:     raw,
+		Hash:    hex.EncodeToString(sum[:]),
+		ModTime: modTime,
+	}
+
+	if !compress || len(raw) < MIN_SIZE {
+		return blob, nil
+	}
+
+	var gzBuf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&gzBuf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = gz.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	if gzBuf.Len() < len(raw) {
+		blob.Gzip = gzBuf.Bytes()
+	}
+
+	var zBuf bytes.Buffer
+	z, err := zlib.NewWriterLevel(&zBuf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = z.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = z.Close(); err != nil {
+		return nil, err
+	}
+	if zBuf.Len() < len(raw) {
+		blob.Deflate = zBuf.Bytes()
+	}
+
+	L("new hash %s raw %d gzip %d deflate %d", blob.Hash, len(raw), len(blob.Gzip), len(blob.Deflate))
+	return blob, nil
+}
+
+// Fingerprint returns a short prefix of Hash suitable for cache-busting URLs.
+func (self *Blob) Fingerprint() string {
+	return self.Hash[:16]
+}
+
+// ETag returns the entity tag of the given encoding of the body.
+func (self *Blob) ETag(encoding string) string {
+	if encoding == IDENTITY {
+		return `"` + self.Hash + `"`
+	}
+	return `"` + self.Hash + "-" + encoding + `"`
+}
+
+// Variant returns the body in the given encoding, or nil if we lack it.
+func (self *Blob) Variant(encoding string) []byte {
+	switch encoding {
+	case GZIP:
+		return self.Gzip
+	case DEFLATE:
+		return self.Deflate
+	case IDENTITY:
+		return self.Raw
+	}
+	return nil
+}
+
+// Encodings lists the non-identity encodings available for the body.
+func (self *Blob) Encodings() []string {
+	encs := []string{}
+	if self.Gzip != nil {
+		encs = append(encs, GZIP)
+	}
+	if self.Deflate != nil {
+		encs = append(encs, DEFLATE)
+	}
+	return encs
+}
+
+// Negotiate picks the most preferred of the available encodings according to
+// an Accept-Encoding header value, returning IDENTITY if none is acceptable.
+// Earlier entries in available win ties.
+func Negotiate(acceptEncoding string, available []string) string {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		qs[coding] = q
+	}
+
+	best, bestQ := IDENTITY, 0.0
+	for _, enc := range available {
+		q, ok := qs[enc]
+		if !ok {
+			q, ok = qs["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// Serve writes the best encoding of the body that the client accepts,
+// honoring conditional and range requests via http.ServeContent. If
+// contentType is empty, it is guessed from name and then from the body.
+func (self *Blob) Serve(w http.ResponseWriter, r *http.Request, name string, contentType string) {
+	encoding := Negotiate(r.Header.Get("Accept-Encoding"), self.Encodings())
+
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(self.Raw)
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	h.Set("Content-Type", contentType)
+	h.Set("ETag", self.ETag(encoding))
+	if encoding != IDENTITY {
+		h.Set("Content-Encoding", encoding)
+	}
+
+	http.ServeContent(w, r, name, self.ModTime, bytes.NewReader(self.Variant(encoding)))
+}
+
+// ServeBytes compresses and serves a one-off body such as a computed delta.
+func ServeBytes(w http.ResponseWriter, r *http.Request, name string, contentType string, modTime time.Time, raw []byte) error {
+	blob, err := New(raw, modTime, true)
+	if err != nil {
+		return err
+	}
+	blob.Serve(w, r, name, contentType)
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package precompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+
+	both := []string{GZIP, DEFLATE}
+	cases := []struct {
+		header    string
+		available []string
+		want      string
+	}{
+		{"", both, IDENTITY},
+		{"gzip, deflate", both, GZIP},
+		{"deflate", both, DEFLATE},
+		{"gzip;q=0.5, deflate", both, DEFLATE},
+		{"gzip;q=0, deflate;q=0", both, IDENTITY},
+		{"*", both, GZIP},
+		{"*;q=0.1, gzip;q=0", both, DEFLATE},
+		{"GZIP", both, GZIP},
+		{"gzip", nil, IDENTITY},
+	}
+
+	for _, c := range cases {
+		got := Negotiate(c.header, c.available)
+		if got != c.want {
+			t.Fatalf("TestNegotiate() failed: Negotiate(%q, %q) = %q, want %q", c.header, c.available, got, c.want)
+		}
+	}
+}
+
+func TestBlobServe(t *testing.T) {
+	t.Parallel()
+
+	raw := []byte(strings.Repeat("atlas charts compress well. ", 100))
+	blob, err := New(raw, time.Now(), true)
+	if err != nil {
+		t.Fatalf("TestBlobServe() failed: New returned %q", err)
+	}
+	if blob.Gzip == nil || blob.Deflate == nil {
+		t.Fatalf("TestBlobServe() failed: missing compressed variants")
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/x.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	blob.Serve(w, r, "x.txt", "")
+	if w.Code != 200 {
+		t.Fatalf("TestBlobServe() failed: response code %d != 200", w.Code)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("TestBlobServe() failed: Content-Encoding %q != gzip", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("TestBlobServe() failed: bad gzip body: %q", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil || !bytes.Equal(body, raw) {
+		t.Fatalf("TestBlobServe() failed: gzip body does not round-trip; err %q", err)
+	}
+
+	etag := w.Header().Get("ETag")
+	w = httptest.NewRecorder()
+	r.Header.Set("If-None-Match", etag)
+	blob.Serve(w, r, "x.txt", "")
+	if w.Code != 304 {
+		t.Fatalf("TestBlobServe() failed: revalidation code %d != 304", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/x.txt", nil)
+	blob.Serve(w, r, "x.txt", "")
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), raw) {
+		t.Fatalf("TestBlobServe() failed: identity response was encoded")
+	}
+}
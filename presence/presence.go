@@ -0,0 +1,136 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package presence keeps track of who is viewing or editing which charts.
+//
+// Pages showing a chart send heartbeats; a visitor is present until its
+// heartbeats stop for longer than the Tracker's TTL.
+package presence
+
+import (
+	"github.com/golang/glog"
+
+	"sort"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("presence "+s, v...)
+	}
+}
+
+// What visitors are doing.
+const (
+	VIEWING = "viewing"
+	EDITING = "editing"
+)
+
+// TTL is how long a heartbeat keeps a visitor present by default.
+const TTL = 45 * time.Second
+
+// Visitor is someone looking at a chart.
+type Visitor struct {
+	Name   string    `json:"name"` // "" for anonymous visitors
+	Action string    `json:"action"`
+	Seen   time.Time `json:"seen"`
+}
+
+// Tracker maps charts to their visitors, each known by a key that tells
+// visitors apart, like a user name or a browser tab.
+type Tracker struct {
+	TTL time.Duration
+
+	charts map[string]map[string]Visitor
+	mu     sync.Mutex
+}
+
+func New() *Tracker {
+	return &Tracker{
+		TTL:    TTL,
+		charts: map[string]map[string]Visitor{},
+	}
+}
+
+// Beat notes that visitor key is present at chart now.
+func (self *Tracker) Beat(chart string, key string, v Visitor) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	visitors, found := self.charts[chart]
+	if !found {
+		visitors = map[string]Visitor{}
+		self.charts[chart] = visitors
+	}
+	v.Seen = time.Now()
+	visitors[key] = v
+	L("Beat(%q, %q): %s", chart, key, v.Action)
+}
+
+// Leave notes that visitor key has left chart.
+func (self *Tracker) Leave(chart string, key string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	delete(self.charts[chart], key)
+}
+
+// Visitors returns who is present at chart, apart from the visitor except,
+// editors first and then by name. Named visitors present under several keys
+// are listed once, as editing if they are editing anywhere.
+func (self *Tracker) Visitors(chart string, except string) []Visitor {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.prune()
+
+	present := []Visitor{}
+	named := map[string]int{}
+	for key, v := range self.charts[chart] {
+		if key == except {
+			continue
+		}
+		i, found := named[v.Name]
+		switch {
+		case v.Name == "" || !found:
+			if v.Name != "" {
+				named[v.Name] = len(present)
+			}
+			present = append(present, v)
+		default:
+			if v.Action == EDITING {
+				present[i].Action = EDITING
+			}
+			if v.Seen.After(present[i].Seen) {
+				present[i].Seen = v.Seen
+			}
+		}
+	}
+	Sort(present)
+	return present
+}
+
+// prune forgets the visitors whose heartbeats have stopped.
+func (self *Tracker) prune() {
+	for chart, visitors := range self.charts {
+		for key, v := range visitors {
+			if time.Since(v.Seen) > self.TTL {
+				delete(visitors, key)
+			}
+		}
+		if len(visitors) == 0 {
+			delete(self.charts, chart)
+		}
+	}
+}
+
+// Sort orders visitors editors first, then by name.
+func Sort(visitors []Visitor) {
+	sort.SliceStable(visitors, func(i, j int) bool {
+		a, b := visitors[i], visitors[j]
+		if a.Action != b.Action {
+			return a.Action == EDITING
+		}
+		return a.Name < b.Name
+	})
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	t.Parallel()
+
+	tracker := New()
+	tracker.Beat("a/index.txt", "tab1", Visitor{Name: "Ada", Action: VIEWING})
+	tracker.Beat("a/index.txt", "tab2", Visitor{Name: "Ada", Action: EDITING})
+	tracker.Beat("a/index.txt", "tab3", Visitor{Name: "Bob", Action: VIEWING})
+	tracker.Beat("a/index.txt", "tab4", Visitor{Action: VIEWING})
+	tracker.Beat("b/index.txt", "tab5", Visitor{Name: "Cy", Action: EDITING})
+
+	visitors := tracker.Visitors("a/index.txt", "")
+	if len(visitors) != 3 || visitors[0].Name != "Ada" || visitors[0].Action != EDITING || visitors[1].Name != "" || visitors[2].Name != "Bob" {
+		t.Fatalf("TestTracker() failed: visitors %+v", visitors)
+	}
+
+	visitors = tracker.Visitors("a/index.txt", "tab2")
+	if len(visitors) != 3 || visitors[1].Name != "Ada" || visitors[1].Action != VIEWING {
+		t.Fatalf("TestTracker() failed: visitors but tab2 %+v", visitors)
+	}
+
+	tracker.Leave("a/index.txt", "tab3")
+	if visitors := tracker.Visitors("a/index.txt", ""); len(visitors) != 2 {
+		t.Fatalf("TestTracker() failed: visitors after leaving %+v", visitors)
+	}
+
+	tracker.TTL = -time.Second
+	if visitors := tracker.Visitors("b/index.txt", ""); len(visitors) != 0 {
+		t.Fatalf("TestTracker() failed: expired visitors %+v", visitors)
+	}
+}
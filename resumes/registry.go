@@ -0,0 +1,343 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package resumes
+
+import (
+	"github.com/golang/glog"
+
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TIMEOUT is how long a step of a conversion may run by default.
+const TIMEOUT = 2 * time.Minute
+
+// MAX_PAGES is how many pages of a resume are converted by default.
+const MAX_PAGES = 50
+
+// MAX_STEP_OUTPUT bounds how much of what a tool prints is kept in reports.
+const MAX_STEP_OUTPUT = 4096
+
+// PRLIMIT is the tool that holds other tools to Limits.Memory and CPU.
+const PRLIMIT = "prlimit"
+
+// ErrNoTool is returned by steps needing tools that aren't installed.
+var ErrNoTool = errors.New("resumes: tool not installed")
+
+// Converter turns files with one of the extensions Inputs into a file with
+// extension Output, running the external programs Tools.
+type Converter struct {
+	Name    string
+	Inputs  []string
+	Output  string
+	Tools   []string
+	Convert func(job *Job, src string, dst string) error
+}
+
+// Limits bound the resources a conversion's tools may use. Zero Memory or
+// CPU leaves them unbounded.
+type Limits struct {
+	Timeout  time.Duration // per step
+	Memory   int64         // bytes of address space per tool
+	CPU      time.Duration // per tool
+	MaxPages int
+}
+
+// Registry knows the converters available, and the tools they need.
+type Registry struct {
+	Converters []*Converter
+	Limits     Limits
+
+	// tools maps the tools found to their paths.
+	tools map[string]string
+	mu    sync.Mutex
+}
+
+func NewRegistry(converters ...*Converter) *Registry {
+	return &Registry{
+		Converters: converters,
+		Limits: Limits{
+			Timeout:  TIMEOUT,
+			MaxPages: MAX_PAGES,
+		},
+		tools: map[string]string{},
+	}
+}
+
+// Register adds c to the converters, after those already known.
+func (self *Registry) Register(c *Converter) {
+	self.Converters = append(self.Converters, c)
+}
+
+// Probe looks for the tools needed by the converters and the page steps,
+// and for PRLIMIT if limits call for it, returning those missing.
+func (self *Registry) Probe() []string {
+	wanted := append([]string(nil), PAGE_TOOLS...)
+	for _, c := range self.Converters {
+		wanted = append(wanted, c.Tools...)
+	}
+	if self.limited() {
+		wanted = append(wanted, PRLIMIT)
+	}
+
+	var missing []string
+	for _, tool := range wanted {
+		if _, err := self.lookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		glog.Warningf("resumes: missing tools %q; some resumes won't be converted", missing)
+	}
+	return missing
+}
+
+// lookPath returns the path of tool, probing for it if need be. Tools found
+// are remembered; missing ones are probed for again, so that installing one
+// takes effect without a restart.
+func (self *Registry) lookPath(tool string) (string, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	p, found := self.tools[tool]
+	if !found {
+		var err error
+		p, err = exec.LookPath(tool)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", ErrNoTool, tool)
+		}
+		self.tools[tool] = p
+	}
+	return p, nil
+}
+
+// limited reports whether Limits call for tools to be run under PRLIMIT.
+func (self *Registry) limited() bool {
+	return self.Limits.Memory > 0 || self.Limits.CPU > 0
+}
+
+// Missing returns the tools c needs that aren't installed, counting PRLIMIT
+// if limits call for it.
+func (self *Registry) Missing(c *Converter) []string {
+	tools := c.Tools
+	if self.limited() {
+		tools = append(append([]string(nil), tools...), PRLIMIT)
+	}
+
+	var missing []string
+	for _, tool := range tools {
+		if _, err := self.lookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	return missing
+}
+
+// Inputs returns the extensions of the files the registry can convert to
+// output, and those it knows of but lacks the tools for.
+func (self *Registry) Inputs(output string) (usable []string, unusable []string) {
+	seen := map[string]bool{}
+	for _, c := range self.Converters {
+		for _, ext := range c.Inputs {
+			if seen[ext] {
+				continue
+			}
+			seen[ext] = true
+			_, err := self.Plan(ext, output)
+			if err == nil {
+				usable = append(usable, ext)
+			} else {
+				unusable = append(unusable, ext)
+			}
+		}
+	}
+	sort.Strings(usable)
+	sort.Strings(unusable)
+	return
+}
+
+// Plan returns the shortest chain of one or more converters whose tools are
+// installed that turns files with extension input into ones with extension
+// output.
+func (self *Registry) Plan(input string, output string) ([]*Converter, error) {
+	type path struct {
+		ext   string
+		chain []*Converter
+	}
+	queue := []path{{ext: input}}
+	seen := map[string]bool{}
+	known := false
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if p.ext == output && len(p.chain) > 0 {
+			return p.chain, nil
+		}
+		for _, c := range self.Converters {
+			if !accepts(c, p.ext) || seen[c.Output] {
+				continue
+			}
+			known = true
+			if len(self.Missing(c)) > 0 {
+				continue
+			}
+			seen[c.Output] = true
+			chain := append(append([]*Converter(nil), p.chain...), c)
+			queue = append(queue, path{ext: c.Output, chain: chain})
+		}
+	}
+	if known {
+		return nil, fmt.Errorf("%w: converting %s files to %s needs tools that are missing", ErrNoTool, input, output)
+	}
+	return nil, fmt.Errorf("resumes: no converter for %s files", input)
+}
+
+func accepts(c *Converter, ext string) bool {
+	for _, in := range c.Inputs {
+		if strings.EqualFold(in, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Step is the result of one step of a conversion.
+type Step struct {
+	Name     string        `json:"name"`
+	Command  []string      `json:"command,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Output   string        `json:"output,omitempty"` // the end of what the tool printed
+	Error    string        `json:"error,omitempty"`
+}
+
+// Report lists the steps of a conversion.
+type Report struct {
+	Input string  `json:"input"`
+	Steps []*Step `json:"steps"`
+}
+
+// Failed returns the steps that failed.
+func (self *Report) Failed() []*Step {
+	var failed []*Step
+	for _, step := range self.Steps {
+		if step.Error != "" {
+			failed = append(failed, step)
+		}
+	}
+	return failed
+}
+
+func (self *Report) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "conversion of %s:\n", self.Input)
+	for _, step := range self.Steps {
+		status := "ok"
+		if step.Error != "" {
+			status = "failed: " + step.Error
+		}
+		fmt.Fprintf(&buf, "  %s (%v): %s\n", step.Name, step.Duration.Round(time.Millisecond), status)
+	}
+	return buf.String()
+}
+
+// Job is a conversion under way, recording its steps in Report.
+type Job struct {
+	Context  context.Context
+	Registry *Registry
+	Report   *Report
+}
+
+// Do runs fn as the step name.
+func (self *Job) Do(name string, fn func(step *Step) error) error {
+	step := &Step{Name: name}
+	self.Report.Steps = append(self.Report.Steps, step)
+
+	start := time.Now()
+	err := fn(step)
+	step.Duration = time.Since(start)
+	if err != nil {
+		step.Error = err.Error()
+		L("Job.Do(): step %s failed: %v", name, err)
+	}
+	return err
+}
+
+// Run runs tool with args as the step name, within the registry's limits.
+func (self *Job) Run(name string, tool string, args ...string) error {
+	return self.Do(name, func(step *Step) error {
+		step.Command = append([]string{tool}, args...)
+		return self.run(step, tool, args)
+	})
+}
+
+func (self *Job) run(step *Step, tool string, args []string) error {
+	limits := self.Registry.Limits
+
+	p, err := self.Registry.lookPath(tool)
+	if err != nil {
+		return err
+	}
+	if self.Registry.limited() {
+		limiter, err := self.Registry.lookPath(PRLIMIT)
+		if err != nil {
+			return err
+		}
+		var bounds []string
+		if limits.Memory > 0 {
+			bounds = append(bounds, "--as="+strconv.FormatInt(limits.Memory, 10))
+		}
+		if limits.CPU > 0 {
+			bounds = append(bounds, "--cpu="+strconv.Itoa(int((limits.CPU+time.Second-1)/time.Second)))
+		}
+		args = append(append(bounds, "--", p), args...)
+		p = limiter
+	}
+
+	ctx := self.Context
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
+	out := &tailBuffer{max: MAX_STEP_OUTPUT}
+	cmd := exec.CommandContext(ctx, p, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.WaitDelay = time.Second
+	L("Job.run(): %s", cmd)
+
+	err = cmd.Run()
+	step.Output = out.String()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %v", tool, limits.Timeout)
+	}
+	return err
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (self *tailBuffer) Write(p []byte) (int, error) {
+	self.buf = append(self.buf, p...)
+	if len(self.buf) > self.max {
+		self.buf = self.buf[len(self.buf)-self.max:]
+	}
+	return len(p), nil
+}
+
+func (self *tailBuffer) String() string {
+	return string(self.buf)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package resumes
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shConverter converts by running script with sh, given src and dst.
+func shConverter(name string, inputs []string, output string, script string) *Converter {
+	return &Converter{
+		Name:   name,
+		Inputs: inputs,
+		Output: output,
+		Tools:  []string{"sh"},
+		Convert: func(job *Job, src, dst string) error {
+			return job.Run(name, "sh", "-c", script, "sh", src, dst)
+		},
+	}
+}
+
+func TestRegistryPlan(t *testing.T) {
+	t.Parallel()
+
+	registry := NewRegistry(PDF,
+		shConverter("markdown", []string{".md"}, ".html", `cp "$1" "$2"`),
+		shConverter("html", []string{".html"}, ".pdf", `cp "$1" "$2"`),
+		&Converter{Name: "missing", Inputs: []string{".odt"}, Output: ".pdf", Tools: []string{"atlas-no-such-tool"}})
+
+	if missing := registry.Probe(); !strings.Contains(strings.Join(missing, " "), "atlas-no-such-tool") {
+		t.Fatalf("TestRegistryPlan() failed: Probe missed a tool: %q", missing)
+	}
+
+	cases := map[string]string{".pdf": "pdf", ".md": "markdown html", ".html": "html"}
+	for ext, want := range cases {
+		plan, err := registry.Plan(ext, ".pdf")
+		var names []string
+		for _, c := range plan {
+			names = append(names, c.Name)
+		}
+		if err != nil || strings.Join(names, " ") != want {
+			t.Fatalf("TestRegistryPlan() failed: Plan(%q) = %q, %v", ext, names, err)
+		}
+	}
+
+	if _, err := registry.Plan(".odt", ".pdf"); !errors.Is(err, ErrNoTool) {
+		t.Fatalf("TestRegistryPlan() failed: planned without a tool: %v", err)
+	}
+	if _, err := registry.Plan(".exe", ".pdf"); err == nil || errors.Is(err, ErrNoTool) {
+		t.Fatalf("TestRegistryPlan() failed: planned an unknown input: %v", err)
+	}
+
+	usable, unusable := registry.Inputs(".pdf")
+	if strings.Join(usable, " ") != ".html .md .pdf" || strings.Join(unusable, " ") != ".odt" {
+		t.Fatalf("TestRegistryPlan() failed: Inputs() = %q, %q", usable, unusable)
+	}
+
+	// limits need PRLIMIT as much as the converters' own tools
+	registry.Limits.Memory = 1 << 30
+	_, err := registry.Plan(".md", ".pdf")
+	if _, found := exec.LookPath(PRLIMIT); (found == nil) != (err == nil) {
+		t.Fatalf("TestRegistryPlan() failed: limited Plan: %v", err)
+	}
+}
+
+func TestRegistryLookPath(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-resumes-tools")
+	if err != nil {
+		t.Fatalf("TestRegistryLookPath() failed: tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// tools installed after they were found missing are found
+	registry := NewRegistry()
+	tool := path.Join(tmp, "tool")
+	if _, err := registry.lookPath(tool); !errors.Is(err, ErrNoTool) {
+		t.Fatalf("TestRegistryLookPath() failed: found a missing tool: %v", err)
+	}
+	ioutil.WriteFile(tool, []byte("#!/bin/sh\n"), 0755)
+	if p, err := registry.lookPath(tool); err != nil || p != tool {
+		t.Fatalf("TestRegistryLookPath() failed: installed tool: %q, %v", p, err)
+	}
+}
+
+func TestJobRun(t *testing.T) {
+	t.Parallel()
+
+	registry := NewRegistry()
+	job := &Job{Context: context.Background(), Registry: registry, Report: &Report{Input: "x"}}
+
+	err := job.Run("fail", "sh", "-c", "echo printed; exit 3")
+	step := job.Report.Steps[0]
+	if err == nil || step.Error == "" || step.Output != "printed\n" || step.Command[0] != "sh" {
+		t.Fatalf("TestJobRun() failed: failing step: %+v, %v", step, err)
+	}
+
+	registry.Limits.Timeout = 50 * time.Millisecond
+	err = job.Run("slow", "sh", "-c", "sleep 5")
+	step = job.Report.Steps[1]
+	if err == nil || !strings.Contains(step.Error, "timed out") || step.Duration > 4*time.Second {
+		t.Fatalf("TestJobRun() failed: slow step: %+v, %v", step, err)
+	}
+
+	err = job.Run("missing", "atlas-no-such-tool")
+	if !errors.Is(err, ErrNoTool) {
+		t.Fatalf("TestJobRun() failed: missing tool: %v", err)
+	}
+
+	registry.Limits.Timeout = TIMEOUT
+	registry.Limits.Memory = 1 << 30
+	err = job.Run("limited", "sh", "-c", "exit 0")
+	if _, found := exec.LookPath(PRLIMIT); found == nil && err != nil {
+		t.Fatalf("TestJobRun() failed: limited step: %v", err)
+	}
+
+	if failed := job.Report.Failed(); len(failed) < 3 || !strings.Contains(job.Report.String(), "slow") {
+		t.Fatalf("TestJobRun() failed: report:\n%s", job.Report)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-resumes")
+	if err != nil {
+		t.Fatalf("TestConvert() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	input := path.Join(tmp, "resume.md")
+	ioutil.WriteFile(input, []byte("%PDF-1.4 pretend\n"), 0644)
+
+	registry := NewRegistry(shConverter("markdown", []string{".md"}, ".pdf", `cp "$1" "$2"`))
+	chart := path.Join(tmp, "chart")
+	report, err := registry.Convert(context.Background(), input, chart, "resume")
+	if err != nil || report.Steps[0].Name != "markdown" || report.Steps[0].Error != "" {
+		t.Fatalf("TestConvert() failed: Convert: %v\n%s", err, report)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(chart, "input.pdf")); string(data) != "%PDF-1.4 pretend\n" {
+		t.Fatalf("TestConvert() failed: made PDF %q", data)
+	}
+	text, err := ioutil.ReadFile(path.Join(chart, "index.txt"))
+	if err != nil || !strings.HasPrefix(string(text), "% Resume: resume\n") {
+		t.Fatalf("TestConvert() failed: made chart %q, %v", text, err)
+	}
+	if _, err := os.Stat(path.Join(chart, REPORT_NAME)); err != nil {
+		t.Fatalf("TestConvert() failed: no report: %v", err)
+	}
+
+	// inputs that can't be made into PDFs make no chart
+	registry = NewRegistry(shConverter("broken", []string{".md"}, ".pdf", "exit 1"))
+	chart = path.Join(tmp, "broken")
+	if report, err := registry.Convert(context.Background(), input, chart, "resume"); err == nil || len(report.Failed()) != 1 {
+		t.Fatalf("TestConvert() failed: broken conversion: %v\n%s", err, report)
+	}
+	if _, err := os.Stat(path.Join(chart, "index.txt")); !os.IsNotExist(err) {
+		t.Fatalf("TestConvert() failed: broken conversion made a chart: %v", err)
+	}
+}
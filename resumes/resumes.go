@@ -1,17 +1,27 @@
 // Copyright (c) 2013, 2014 Akamai Technologies, Inc.
 
+// Package resumes turns resumes into charts, one SVG drawing per page.
+//
+// Resumes are first made into PDFs by a chain of Converters chosen from a
+// Registry by their input and output types, then split into pages.
 package resumes
 
 import (
+	"akamai/atlas/svgtext"
+
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/golang/glog"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,14 +31,44 @@ func L(s string, v ...interface{}) {
 	}
 }
 
-func handlePdf(src, fn, dst string) error {
-	L("handlePdf(): src: %q, fn: %q, dst: %q", src, fn, dst)
-	cmd := exec.Command("cp", "-f", src, dst)
-	L("handlePdf: %s", cmd)
-	return cmd.Run()
+// PDF copies PDF files, which need no converting.
+var PDF = &Converter{
+	Name:   "pdf",
+	Inputs: []string{".pdf"},
+	Output: ".pdf",
+	Convert: func(job *Job, src, dst string) error {
+		return job.Do("copy", func(step *Step) error {
+			return copyFile(src, dst)
+		})
+	},
+}
+
+// LIBREOFFICE converts word processor documents to PDF.
+var LIBREOFFICE = &Converter{
+	Name:    "libreoffice",
+	Inputs:  []string{".doc", ".docx", ".odt", ".rtf"},
+	Output:  ".pdf",
+	Tools:   []string{"libreoffice"},
+	Convert: runLibreOffice,
+}
+
+// PAGE_TOOLS are the tools that split PDFs into editable pages.
+var PAGE_TOOLS = []string{"gs", "pdftk", "inkscape"}
+
+// New returns a registry of the built-in converters.
+func New() *Registry {
+	return NewRegistry(PDF, LIBREOFFICE)
 }
 
-func runLibreOffice(src, dst string) error {
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
+
+func runLibreOffice(job *Job, src, dst string) error {
 	dstDir := path.Dir(dst)
 	tmpDir, err := ioutil.TempDir(dstDir, "atlas")
 	if err != nil {
@@ -37,18 +77,14 @@ func runLibreOffice(src, dst string) error {
 	}
 	defer os.RemoveAll(tmpDir)
 
-	cmd := exec.Command("libreoffice",
+	err = job.Run("libreoffice", "libreoffice",
 		"--headless",
 		"--convert-to",
 		"pdf:writer_pdf_Export",
 		"--outdir",
 		tmpDir,
 		src)
-
-	L("runLibreOffice: %s", cmd)
-	err = cmd.Run()
 	if err != nil {
-		L("runLibreOffice: warning: %q", err)
 		return err
 	}
 
@@ -58,83 +94,27 @@ func runLibreOffice(src, dst string) error {
 		return err
 	}
 	if len(matches) != 1 {
-		L("runLibreOffice: warning: len(%q) != 1", matches)
-		return err
+		return fmt.Errorf("libreoffice made %d PDFs, not 1", len(matches))
 	}
 	L("runLibreOffice: rename %q -> %q", matches[0], dst)
-	err = os.Rename(matches[0], dst)
-
-	return err
-}
-
-func runGhostScriptClip(dst string) error {
-	cmd := exec.Command("gs",
-		"-sDEVICE=bbox",
-		"-dNOPAUSE",
-		"-dSAFER",
-		"-dBATCH",
-		"-f",
-		dst)
-	L("runGhostScriptClip: %s", cmd)
-	return cmd.Run()
-}
-
-func handleDoc(src, fn, dst string) error {
-	L("handleDoc(): src: %q, fn: %q, dst: %q", src, fn, dst)
-	return runLibreOffice(src, dst)
+	return os.Rename(matches[0], dst)
 }
 
-func handleDocx(src, fn, dst string) error {
-	L("handleDocx(): src: %q, fn: %q, dst: %q", src, fn, dst)
-	return runLibreOffice(src, dst)
-}
-
-func runPdftkBurst(src, pagesDir string) error {
-	cmd := exec.Command("pdftk",
-		src,
-		"burst",
-		"output",
-		path.Join(pagesDir, "%02d.pdf"))
-	L("runPdftkBurst: %s", cmd)
-	return cmd.Run()
-}
-
-func runInkscape(src, dst string) error {
-	cmd := exec.Command("inkscape",
-		"-l",
-		dst,
-		src)
-	L("runInkscape: %s", cmd)
-	return cmd.Run()
-}
-
-func convertPdfPages(fn string, chart string, chartFile *os.File, svgPagesDir string, walkPath string, info os.FileInfo, walkErr error) error {
-	L("convertPdfPages: fn: %q, walkPath: %q, walkErr: %q ", fn, walkPath, walkErr)
-	if walkErr != nil {
-		return walkErr
-	}
-
-	ext := filepath.Ext(walkPath)
-	if ext == "" {
-		return nil
-	}
-
-	base := filepath.Base(walkPath)
-
+// convertPdfPage converts the PDF page of the resume fn at pagePath to SVG
+// in svgPagesDir, adding it to chartFile. Pages that fail to convert are
+// still linked, so that the chart shows what is missing.
+func convertPdfPage(job *Job, fn string, chartFile *os.File, svgPagesDir string, pagePath string) {
+	ext := filepath.Ext(pagePath)
+	base := filepath.Base(pagePath)
 	pageFn := base[:len(base)-len(ext)]
 
 	dst := path.Join(svgPagesDir, pageFn+".svg")
-
-	err := runInkscape(walkPath, dst)
-	if err != nil {
-		L("convertPdfPages: inkscape warning: %s", err)
-	}
-
-	origSvgDst := path.Join(svgPagesDir, pageFn+".orig.svg")
-	cmd := exec.Command("cp", "-f", dst, origSvgDst)
-	err = cmd.Run()
-	if err != nil {
-		L("convertPdfPages: cp warning: %s", err)
+	err := job.Run("page "+pageFn, "inkscape", "-l", dst, pagePath)
+	if err == nil {
+		origSvgDst := path.Join(svgPagesDir, pageFn+".orig.svg")
+		job.Do("copy page "+pageFn, func(step *Step) error {
+			return copyFile(dst, origSvgDst)
+		})
 	}
 
 	origSvg := path.Join("svg_pages", fn, pageFn+".orig.svg")
@@ -144,69 +124,89 @@ func convertPdfPages(fn string, chart string, chartFile *os.File, svgPagesDir st
 	fmt.Fprintf(chartFile, "([edit page %s](%s), [see original copy](%s))\n", pageFn, pageEditor, origSvg)
 	fmt.Fprintf(chartFile, "![](%s)\n", pageSvg)
 	chartFile.WriteString("\n")
+}
 
-	return nil
+// sanitizeSvgs strips scripts, event handlers and external references from
+// the drawings conversion left in chart, which are served from the site's
+// own origin. Drawings that aren't well-formed are removed.
+func sanitizeSvgs(job *Job, chart string) {
+	var svgs []string
+	filepath.Walk(chart, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.EqualFold(filepath.Ext(p), ".svg") {
+			svgs = append(svgs, p)
+		}
+		return nil
+	})
+
+	for _, p := range svgs {
+		rel, _ := filepath.Rel(chart, p)
+		job.Do("sanitize "+rel, func(step *Step) error {
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			clean, report, err := svgtext.Sanitize(data)
+			if err != nil {
+				os.Remove(p)
+				return err
+			}
+			if report.Clean() {
+				return nil
+			}
+			glog.Warningf("convert: removed unsafe content from %q:\n%s", rel, report)
+			step.Output = report.String()
+			return ioutil.WriteFile(p, clean, 0644)
+		})
+	}
 }
 
-func convert(inputPath, safeName, outputPath, displayName string) error {
-	L("convert: inputPath: %q, safeName: %q, outputPath: %q, displayName", inputPath, safeName, outputPath, displayName)
+// REPORT_NAME is the file beside a converted chart that reports how its
+// conversion went.
+const REPORT_NAME = "conversion.json"
+
+// Convert makes a chart in outputPath of the resume at inputPath, unless
+// there is one already. Failures to make a PDF of the resume are returned;
+// later steps are best-effort, and the report says which of them failed.
+func (self *Registry) Convert(ctx context.Context, inputPath, outputPath, displayName string) (*Report, error) {
+	safeName := SimplifyName(path.Base(inputPath))
+	L("convert: inputPath: %q, safeName: %q, outputPath: %q, displayName: %q", inputPath, safeName, outputPath, displayName)
+
+	job := &Job{
+		Context:  ctx,
+		Registry: self,
+		Report:   &Report{Input: safeName},
+	}
 
 	safeExt := filepath.Ext(safeName)
 	if safeExt == "" {
-		L("convert: safeName: %q has no extension; skipping.", safeName)
-		return nil
+		return job.Report, fmt.Errorf("resumes: %q has no extension", safeName)
+	}
+	plan, err := self.Plan(strings.ToLower(safeExt), ".pdf")
+	if err != nil {
+		return job.Report, err
 	}
 
-	err := os.MkdirAll(outputPath, 0755)
+	err = os.MkdirAll(outputPath, 0755)
 	if err != nil {
-		L("convert: warning: unable to make chart dir %q, err: %q; skipping", outputPath, err)
-		return err
+		return job.Report, err
 	}
 
 	chart := outputPath
-
 	chartPath := path.Join(chart, "index.txt")
 
 	_, err = os.Stat(chartPath)
 	if err == nil {
 		L("convert: warning: skipping input %q since chart %q already exists.", safeName, chartPath)
-		return nil
+		return job.Report, nil
 	}
 
-	chartFile, err := os.Create(chartPath)
-	if err != nil {
-		L("convert: warning:  unable to create chartPath: %q", chartPath)
-		return nil
-	}
-	defer chartFile.Close()
-
 	dstPdf := path.Join(chart, "input.pdf")
-
-	_, err = os.Stat(dstPdf)
+	err = self.ingest(job, plan, inputPath, dstPdf)
 	if err != nil {
-		if os.IsNotExist(err) {
-			switch safeExt {
-			default:
-				L("walkInput: skipping %s", inputPath)
-			case ".pdf":
-				err = handlePdf(inputPath, safeName, dstPdf)
-			case ".doc":
-				err = handleDoc(inputPath, safeName, dstPdf)
-			case ".docx":
-				err = handleDocx(inputPath, safeName, dstPdf)
-			}
-			if err != nil {
-				L("walkInput: ingest warning: %s", err)
-			}
-		} else {
-			L("walkInput: stat warning: %s", err)
-		}
+		return job.Report, err
 	}
 
-	err = runGhostScriptClip(dstPdf)
-	if err != nil {
-		L("walkInput: gs warning: %s", err)
-	}
+	job.Run("check", "gs", "-sDEVICE=bbox", "-dNOPAUSE", "-dSAFER", "-dBATCH", "-f", dstPdf)
 
 	pdfPagesDir := path.Join(chart, "pdf_pages", safeName)
 	os.MkdirAll(pdfPagesDir, 0755)
@@ -214,10 +214,22 @@ func convert(inputPath, safeName, outputPath, displayName string) error {
 	svgPagesDir := path.Join(chart, "svg_pages", safeName)
 	os.MkdirAll(svgPagesDir, 0755)
 
-	err = runPdftkBurst(dstPdf, pdfPagesDir)
+	job.Run("burst", "pdftk", dstPdf, "burst", "output", path.Join(pdfPagesDir, "%02d.pdf"))
+
+	pages, _ := filepath.Glob(path.Join(pdfPagesDir, "*.pdf"))
+	sort.Strings(pages)
+	if max := self.Limits.MaxPages; max > 0 && len(pages) > max {
+		job.Do("pages", func(step *Step) error {
+			return fmt.Errorf("only the first %d of %d pages were converted", max, len(pages))
+		})
+		pages = pages[:max]
+	}
+
+	chartFile, err := os.Create(chartPath)
 	if err != nil {
-		L("walkInput: pdftk warning: %s", err)
+		return job.Report, err
 	}
+	defer chartFile.Close()
 
 	now := time.Now()
 	date := fmt.Sprintf("%s %0.2d, %d", now.Month().String(), now.Day(), now.Year())
@@ -231,11 +243,46 @@ func convert(inputPath, safeName, outputPath, displayName string) error {
 	chartFile.WriteString("# Resume\n")
 	chartFile.WriteString("\n")
 
-	filepath.Walk(pdfPagesDir+"/",
-		func(walkPath string, info os.FileInfo, walkErr error) error {
-			return convertPdfPages(safeName, chart, chartFile, svgPagesDir, walkPath, info, walkErr)
-		})
+	for _, page := range pages {
+		convertPdfPage(job, safeName, chartFile, svgPagesDir, page)
+	}
+	sanitizeSvgs(job, chart)
+
+	if failed := job.Report.Failed(); len(failed) > 0 {
+		fmt.Fprintf(chartFile, "(%d steps of converting this resume failed; see [the report](%s).)\n", len(failed), REPORT_NAME)
+	}
+
+	report, err := json.MarshalIndent(job.Report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(chart, REPORT_NAME), report, 0644)
+	}
+	if err != nil {
+		glog.Errorf("convert: unable to save the report of %q: %v", safeName, err)
+	}
+
+	return job.Report, chartFile.Close()
+}
 
+// ingest runs the converters of plan in turn to make dstPdf of src.
+func (self *Registry) ingest(job *Job, plan []*Converter, src, dstPdf string) error {
+	tmpDir, err := ioutil.TempDir(path.Dir(dstPdf), "atlas-ingest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i, c := range plan {
+		dst := dstPdf
+		if i < len(plan)-1 {
+			dst = path.Join(tmpDir, strconv.Itoa(i)+c.Output)
+		}
+		L("ingest: %s %q -> %q", c.Name, src, dst)
+		err = c.Convert(job, src, dst)
+		if err != nil {
+			return fmt.Errorf("resumes: %s failed: %v", c.Name, err)
+		}
+		src = dst
+	}
 	return nil
 }
 
@@ -245,12 +292,6 @@ func SimplifyName(name string) string {
 	return renameRegexp.ReplaceAllString(name, "")
 }
 
-func Convert(inputPath, outputPath, displayName string) error {
-	inputName := path.Base(inputPath)
-	safeName := SimplifyName(inputName)
-	return convert(inputPath, safeName, outputPath, displayName)
-}
-
 var outputPath = flag.String("o", "./charts", "output dir")
 
 func main() {
@@ -267,10 +308,17 @@ func main() {
 		return
 	}
 
+	registry := New()
+	registry.Probe()
+
 	originalInputs := flag.Args()
 
 	for _, inputPath := range originalInputs {
 		displayName := SimplifyName(path.Base(inputPath))
-		Convert(inputPath, *outputPath, displayName)
+		report, err := registry.Convert(context.Background(), inputPath, *outputPath, displayName)
+		if err != nil {
+			L("convert: %s", err)
+		}
+		L("convert: %s", report)
 	}
 }
@@ -3,9 +3,13 @@
 package sitejsoncache
 
 import (
+	"akamai/atlas/chart"
+	"akamai/atlas/chartfs"
 	"akamai/atlas/linker"
+	"akamai/atlas/precompress"
 	"akamai/atlas/sitelistcache"
 	"akamai/atlas/stat"
+	"akamai/atlas/store"
 	"akamai/atlas/svgtext"
 	"bytes"
 	"encoding/json"
@@ -14,7 +18,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,55 +30,158 @@ func L(s string, v ...interface{}) {
 	}
 }
 
+// MAX_TOMBSTONES bounds how many removed slugs we remember for Delta().
+// Clients asking about versions older than the oldest forgotten tombstone
+// receive a full copy of the site instead.
+const MAX_TOMBSTONES = 1000
+
 type Dep struct {
 	name string
 	fi   os.FileInfo
 }
 
+// Ent is the text of a chart, followed by that of the drawings it links to.
 type Ent struct {
+	text    string
+	svgs    []svgEnt
+	deps    []Dep
+	version int64
+}
+
+type svgEnt struct {
+	name string
 	text string
-	deps []Dep
+}
+
+func (self Ent) Text() string {
+	text := self.text
+	for _, svg := range self.svgs {
+		text = text + "\n" + svg.text
+	}
+	return text
 }
 
 func (self Ent) MarshalJSON() ([]byte, error) {
-	return json.Marshal(self.text)
+	return json.Marshal(self.Text())
+}
+
+// Filter returns a copy of self without the text of the drawings whose names
+// keep is false for. Drawings may lie in subtrees other than their chart's.
+func (self Ent) Filter(keep func(name string) bool) Ent {
+	out := self
+	out.svgs = nil
+	for _, svg := range self.svgs {
+		if keep(svg.name) {
+			out.svgs = append(out.svgs, svg)
+		}
+	}
+	return out
+}
+
+// Delta describes how to bring a client's copy of site.json from version
+// Since up to Version. When Full is set, Changed holds every entry and the
+// client should discard whatever it had.
+type Delta struct {
+	Since   int64          `json:"since"`
+	Version int64          `json:"version"`
+	Full    bool           `json:"full"`
+	Changed map[string]Ent `json:"changed"`
+	Removed []string       `json:"removed"`
 }
 
+// Filter returns a copy of self without the slugs, and the drawings, for
+// which keep is false. Changed slugs that keep is false for are listed as
+// removed, since a client may hold them from when it could read them.
+func (self *Delta) Filter(keep func(slug string) bool) *Delta {
+	out := &Delta{
+		Since:   self.Since,
+		Version: self.Version,
+		Full:    self.Full,
+		Changed: map[string]Ent{},
+		Removed: []string{},
+	}
+	for slug, ent := range self.Changed {
+		if keep(slug) {
+			out.Changed[slug] = ent.Filter(keep)
+		} else if !self.Full {
+			out.Removed = append(out.Removed, slug)
+		}
+	}
+	for _, slug := range self.Removed {
+		if keep(slug) {
+			out.Removed = append(out.Removed, slug)
+		}
+	}
+	sort.Strings(out.Removed)
+	return out
+}
+
+// SiteJsonCache holds the text of every chart, for searching.
+//
+// Callers must hold Lock() across Make() and any use of the fields or Delta().
+// Make() takes the SiteListCache's lock in turn, so never take them in the
+// other order.
 type SiteJsonCache struct {
 	*sitelistcache.SiteListCache
-	ModTime time.Time
-	Entries map[string]Ent
-	Json    []byte
+	ModTime  time.Time
+	Entries  map[string]Ent
+	Json     []byte
+	Blob     *precompress.Blob
+	Version  int64
+	removed  map[string]int64
+	floor    int64
+	eventSeq int64
+	mu       sync.Mutex
 }
 
 func New(siteListCache *sitelistcache.SiteListCache) *SiteJsonCache {
+	// Versions start at the current time so that clients holding a version
+	// from a previous server process are detected and sent a full copy.
+	version := time.Now().UnixNano()
 	return &SiteJsonCache{
 		SiteListCache: siteListCache,
 		ModTime:       time.Time{},
 		Json:          nil,
 		Entries:       map[string]Ent{},
+		Version:       version,
+		removed:       map[string]int64{},
+		floor:         version,
 	}
 }
 
+func (self *SiteJsonCache) Lock() {
+	self.mu.Lock()
+}
+
+func (self *SiteJsonCache) Unlock() {
+	self.mu.Unlock()
+}
+
 func (self *SiteJsonCache) Make() (built bool, err error) {
 	L("make starting")
 	built = false
 	err = nil
 
-	fresh, err := self.allFresh()
-	L("make allFresh returned fresh %t, err %v", fresh, err)
+	self.SiteListCache.Lock()
+	defer self.SiteListCache.Unlock()
+
+	_, err = self.SiteListCache.Make()
 	if err != nil {
-		L("make exiting; allFresh returned err %v", err)
+		L("make exiting; SiteListCache.Make returned err %v", err)
 		return
 	}
 
-	if !fresh {
-		built = true
+	built = self.rebuild()
 
-		L("make rebuilding")
-		err = self.rebuild()
+	if built || self.Json == nil {
+		self.Json, err = json.Marshal(self.Entries)
+		L("make produced json: %q", string(self.Json))
+		if err != nil {
+			return
+		}
+
+		self.Blob, err = precompress.New(self.Json, self.ModTime, true)
 		if err != nil {
-			L("make exiting; rebuild returned err %v", err)
 			return
 		}
 	}
@@ -80,37 +189,96 @@ func (self *SiteJsonCache) Make() (built bool, err error) {
 	return
 }
 
+// Delta reports the entries changed and removed after version since.
+func (self *SiteJsonCache) Delta(since int64) *Delta {
+	delta := &Delta{
+		Since:   since,
+		Version: self.Version,
+		Changed: map[string]Ent{},
+		Removed: []string{},
+	}
+
+	if since < self.floor || since > self.Version {
+		delta.Full = true
+		for key, ent := range self.Entries {
+			delta.Changed[key] = ent
+		}
+		return delta
+	}
+
+	for key, ent := range self.Entries {
+		if ent.version > since {
+			delta.Changed[key] = ent
+		}
+	}
+	for key, version := range self.removed {
+		if version > since {
+			delta.Removed = append(delta.Removed, key)
+		}
+	}
+	sort.Strings(delta.Removed)
+
+	return delta
+}
+
+// Reset starts a new version that every client holding an older one is sent
+// a full copy to replace, as when what clients may see has changed.
+func (self *SiteJsonCache) Reset() {
+	self.Version++
+	self.floor = self.Version
+}
+
 func (self *SiteJsonCache) isFresh(a, b os.FileInfo) bool {
 	return stat.IsFresh(a, b)
 }
 
-func (self *SiteJsonCache) allFresh() (fresh bool, err error) {
-	L("allFresh")
-	fresh = false
-	err = nil
+func (self *SiteJsonCache) entFresh(ent Ent) bool {
+	for _, dep := range ent.deps {
+		fi, err := self.SiteListCache.Store.Stat(dep.name)
+		if err != nil {
+			L("entFresh dep %q err %v", dep.name, err)
+			return false
+		}
+		if !self.isFresh(fi, dep.fi) {
+			return false
+		}
+	}
+	return true
+}
 
-	if built, err := self.SiteListCache.Make(); built || err != nil {
-		return false, err
+// forget drops entries for charts that the SiteListCache reports as deleted
+// or renamed since we last looked.
+func (self *SiteJsonCache) forget(version int64) bool {
+	forgot := false
+	for _, ev := range self.SiteListCache.EventsSince(self.eventSeq) {
+		L("forget event %v", ev)
+		if _, ok := self.Entries[ev.Slug]; ok {
+			self.remove(ev.Slug, version)
+			forgot = true
+		}
+		self.eventSeq = ev.Seq
 	}
+	return forgot
+}
 
-	for _, ent := range self.Entries {
-		for _, dep := range ent.deps {
-			var fi os.FileInfo
-			fi, err = os.Stat(dep.name)
-			if err != nil {
-				if os.IsNotExist(err) {
-					err = nil
-				}
-				return
-			}
-			fresh = self.isFresh(fi, dep.fi)
-			if !fresh {
-				return
+func (self *SiteJsonCache) remove(key string, version int64) {
+	L("remove key %s version %d", key, version)
+	delete(self.Entries, key)
+	self.removed[key] = version
+	self.updateModTime(time.Now())
+
+	if len(self.removed) > MAX_TOMBSTONES {
+		oldestKey, oldest := "", int64(0)
+		for k, v := range self.removed {
+			if oldestKey == "" || v < oldest {
+				oldestKey, oldest = k, v
 			}
 		}
+		delete(self.removed, oldestKey)
+		if oldest > self.floor {
+			self.floor = oldest
+		}
 	}
-
-	return
 }
 
 func (self *SiteJsonCache) updateModTime(depModTime time.Time) bool {
@@ -121,9 +289,15 @@ func (self *SiteJsonCache) updateModTime(depModTime time.Time) bool {
 	return false
 }
 
-func (self *SiteJsonCache) rebuild() (err error) {
+// rebuild re-renders only those charts whose dependencies have changed and
+// reports whether any entry was added, changed or removed.
+func (self *SiteJsonCache) rebuild() (changed bool) {
 	L("rebuild starting")
-	self.Entries = map[string]Ent{}
+	version := self.Version + 1
+
+	changed = self.forget(version)
+
+	seen := map[string]bool{}
 
 	for name, slEnt := range self.SiteListCache.Entries {
 		chart := slEnt.Chart
@@ -135,101 +309,141 @@ func (self *SiteJsonCache) rebuild() (err error) {
 		key := chart.Slug()
 		L("rebuild found key %s", key)
 
-		err = chart.Read()
+		old, ok := self.Entries[key]
+		if ok && self.entFresh(old) {
+			seen[key] = true
+			continue
+		}
+
+		ent, err := self.render(chart)
 		if err != nil {
-			L("rebuild warning after read: %s", err)
+			L("rebuild warning after render: %s", err)
 			continue
 		}
+		seen[key] = true
 
-		chartBytes := chart.Bytes()
-
-		dep := Dep{
-			name: chart.Src(),
-			fi:   chart.FileInfo(),
-		}
-
-		ent := Ent{}
-		ent.text = string(chartBytes)
-		ent.deps = []Dep{dep}
-
-		if glog.V(2) {
-			glog.Infof("HandleSiteJsonGet(): found body: %q", ent.text)
-		}
-
-		self.updateModTime(dep.fi.ModTime())
-
-		linkRenderer := linker.NewLinkRenderer()
-		extFlags := 0
-		extFlags |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
-		extFlags |= blackfriday.EXTENSION_TABLES
-		extFlags |= blackfriday.EXTENSION_FENCED_CODE
-		extFlags |= blackfriday.EXTENSION_AUTOLINK
-		extFlags |= blackfriday.EXTENSION_STRIKETHROUGH
-		extFlags |= blackfriday.EXTENSION_SPACE_HEADERS
-		blackfriday.Markdown([]byte(chart.Body()), linkRenderer, extFlags)
-		L("rebuild found links: %s", linkRenderer.Links)
-
-		for _, link := range linkRenderer.Links {
-			// BUG(mistone): directory traversal
-			sfx := strings.HasSuffix(link.Href, "svg")
-			if sfx {
-				svgPath := path.Clean(path.Join(chart.Dir(), link.Href))
-				L("rebuild found svg: %s", svgPath)
-
-				svgFile, err := os.Open(svgPath)
-				if err != nil {
-					L("rebuild warning: unable to open svg: %q, err %v", svgPath, err)
-					continue
-				}
-				defer svgFile.Close()
-
-				svgFI, err := svgFile.Stat()
-				if err != nil {
-					L("rebuild warning: unable to stat svg: %q, err %v", svgPath, err)
-					continue
-				}
-
-				svgBody, err := ioutil.ReadAll(svgFile)
-				if err != nil {
-					L("rebuild warning: unable to read svg: %s, error: %s", svgPath, err)
-					continue
-				}
-
-				cdata, err := svgtext.GetCData(svgBody)
-				if err != nil {
-					L("rebuild warning: unable to parse svg: %s, error: %s", svgPath, err)
-					continue
-				}
-				L("rebuild found svg cdata items: %d", len(cdata))
-				//L("rebuild found svg cdata: %s", cdata)
-				L("rebuild done with svg: %s", svgPath)
-
-				var buf bytes.Buffer
-				for _, datum := range cdata {
-					buf.WriteString("svg: ")
-					buf.WriteString(datum)
-					buf.WriteRune('\n')
-				}
-
-				ent.text = ent.text + "\n" + buf.String()
-				ent.deps = append(ent.deps, Dep{
-					name: svgPath,
-					fi:   svgFI,
-				})
-				self.updateModTime(svgFI.ModTime())
-			}
+		if ok && ent.Text() == old.Text() {
+			old.deps = ent.deps
+			self.Entries[key] = old
+			continue
 		}
 
+		L("rebuild updated key %s", key)
+		ent.version = version
 		self.Entries[key] = ent
+		delete(self.removed, key)
+		changed = true
 	}
 
-	L("rebuild produced cache: %q", self.Entries)
+	for key := range self.Entries {
+		if !seen[key] {
+			self.remove(key, version)
+			changed = true
+		}
+	}
+
+	if changed {
+		self.Version = version
+	}
+
+	if glog.V(2) {
+		glog.Infof("sjc rebuild produced cache: %q", self.Entries)
+	}
+
+	return
+}
 
-	self.Json, err = json.Marshal(self.Entries)
-	L("rebuild produced json: %q", string(self.Json))
+func (self *SiteJsonCache) render(chart *chart.Chart) (ent Ent, err error) {
+	err = chart.Read()
 	if err != nil {
 		return
 	}
 
-	return
+	chartBytes := chart.Bytes()
+
+	dep := Dep{
+		name: chart.Src(),
+		fi:   chart.FileInfo(),
+	}
+
+	ent.text = string(chartBytes)
+	ent.deps = []Dep{dep}
+
+	if glog.V(2) {
+		glog.Infof("HandleSiteJsonGet(): found body: %q", ent.text)
+	}
+
+	self.updateModTime(dep.fi.ModTime())
+
+	linkRenderer := linker.NewLinkRenderer()
+	extFlags := 0
+	extFlags |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
+	extFlags |= blackfriday.EXTENSION_TABLES
+	extFlags |= blackfriday.EXTENSION_FENCED_CODE
+	extFlags |= blackfriday.EXTENSION_AUTOLINK
+	extFlags |= blackfriday.EXTENSION_STRIKETHROUGH
+	extFlags |= blackfriday.EXTENSION_SPACE_HEADERS
+	blackfriday.Markdown([]byte(chart.Body()), linkRenderer, extFlags)
+	L("render found links: %s", linkRenderer.Links)
+
+	for _, link := range linkRenderer.Links {
+		sfx := strings.HasSuffix(link.Href, "svg")
+		if sfx {
+			// svgPath is confined to the store, however many ".." the href
+			// contains.
+			svgPath := chartfs.Clean(path.Join(chart.Dir(), link.Href))
+			L("render found svg: %s", svgPath)
+
+			svgText, svgFI, err := readSvgText(self.SiteListCache.Store, svgPath)
+			if err != nil {
+				L("render warning: unable to index svg: %q, err %v", svgPath, err)
+				continue
+			}
+
+			ent.svgs = append(ent.svgs, svgEnt{
+				name: svgPath,
+				text: svgText,
+			})
+			ent.deps = append(ent.deps, Dep{
+				name: svgPath,
+				fi:   svgFI,
+			})
+			self.updateModTime(svgFI.ModTime())
+		}
+	}
+
+	return ent, nil
+}
+
+func readSvgText(s store.Store, svgPath string) (string, os.FileInfo, error) {
+	svgFile, err := s.Open(svgPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer svgFile.Close()
+
+	svgFI, err := svgFile.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+
+	svgBody, err := ioutil.ReadAll(svgFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cdata, err := svgtext.GetCData(svgBody)
+	if err != nil {
+		return "", nil, err
+	}
+	L("readSvgText found svg cdata items: %d", len(cdata))
+
+	var buf bytes.Buffer
+	for _, datum := range cdata {
+		buf.WriteString("svg: ")
+		buf.WriteString(datum)
+		buf.WriteRune('\n')
+	}
+
+	return buf.String(), svgFI, nil
 }
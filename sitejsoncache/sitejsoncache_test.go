@@ -0,0 +1,99 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package sitejsoncache
+
+import (
+	"akamai/atlas/sitelistcache"
+	"akamai/atlas/store"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeTestChart(t *testing.T, dir string, title string, body string) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("writeTestChart() mkdir failed: err: %q", err)
+	}
+	text := "% " + title + "\n% Test\n% Today\n\n" + body + "\n"
+	err = ioutil.WriteFile(path.Join(dir, "index.txt"), []byte(text), 0644)
+	if err != nil {
+		t.Fatalf("writeTestChart() write failed: err: %q", err)
+	}
+}
+
+func TestSiteJsonCacheDelta(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "atlas-sitejson")
+	if err != nil {
+		t.Fatalf("TestSiteJsonCacheDelta() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeTestChart(t, root, "Root", "root")
+	writeTestChart(t, path.Join(root, "a"), "A", "first")
+	writeTestChart(t, path.Join(root, "b"), "B", "doomed")
+
+	cache := New(sitelistcache.New(store.NewLocal(root)))
+	built, err := cache.Make()
+	if err != nil {
+		t.Fatalf("TestSiteJsonCacheDelta() make failed: err: %q", err)
+	}
+	if !built {
+		t.Fatalf("TestSiteJsonCacheDelta() make did not build")
+	}
+	v1 := cache.Version
+
+	full := cache.Delta(0)
+	if !full.Full || len(full.Changed) != 3 {
+		t.Fatalf("TestSiteJsonCacheDelta() Delta(0) not full: %v", full)
+	}
+
+	built, err = cache.Make()
+	if err != nil || built {
+		t.Fatalf("TestSiteJsonCacheDelta() idle remake built %t err %q", built, err)
+	}
+
+	writeTestChart(t, path.Join(root, "a"), "A", "second and longer")
+	err = os.RemoveAll(path.Join(root, "b"))
+	if err != nil {
+		t.Fatalf("TestSiteJsonCacheDelta() remove failed: err: %q", err)
+	}
+
+	built, err = cache.Make()
+	if err != nil || !built {
+		t.Fatalf("TestSiteJsonCacheDelta() remake built %t err %q", built, err)
+	}
+
+	delta := cache.Delta(v1)
+	if delta.Full {
+		t.Fatalf("TestSiteJsonCacheDelta() Delta(v1) unexpectedly full")
+	}
+	if _, ok := delta.Changed["a/"]; !ok || len(delta.Changed) != 1 {
+		t.Fatalf("TestSiteJsonCacheDelta() Delta(v1) changed %v, want only a/", delta.Changed)
+	}
+	if len(delta.Removed) != 1 || delta.Removed[0] != "b/" {
+		t.Fatalf("TestSiteJsonCacheDelta() Delta(v1) removed %v, want [b/]", delta.Removed)
+	}
+
+	empty := cache.Delta(cache.Version)
+	if empty.Full || len(empty.Changed) != 0 || len(empty.Removed) != 0 {
+		t.Fatalf("TestSiteJsonCacheDelta() Delta(Version) not empty: %v", empty)
+	}
+
+	hidden := delta.Filter(func(slug string) bool { return slug != "a/" })
+	if len(hidden.Changed) != 0 || len(hidden.Removed) != 2 || hidden.Removed[0] != "a/" {
+		t.Fatalf("TestSiteJsonCacheDelta() Filter() did not remove a/: %v", hidden)
+	}
+
+	v2 := cache.Version
+	cache.Reset()
+	if reset := cache.Delta(v2); !reset.Full {
+		t.Fatalf("TestSiteJsonCacheDelta() Delta(v2) after Reset() not full")
+	}
+	if reset := cache.Delta(cache.Version); reset.Full {
+		t.Fatalf("TestSiteJsonCacheDelta() Delta(Version) after Reset() full")
+	}
+}
@@ -5,10 +5,13 @@ package sitelistcache
 import (
 	"akamai/atlas/chart"
 	"akamai/atlas/stat"
+	"akamai/atlas/store"
+	"akamai/atlas/trash"
 	"github.com/golang/glog"
-	"io/ioutil"
 	"os"
 	"path"
+	"sync"
+	"time"
 )
 
 func L(s string, v ...interface{}) {
@@ -17,23 +20,59 @@ func L(s string, v ...interface{}) {
 	}
 }
 
+const (
+	DELETED = iota // chart removed from the tree
+	RENAMED        // chart moved to NewName
+)
+
+// MAX_EVENTS bounds how many removal events a SiteListCache remembers.
+const MAX_EVENTS = 1000
+
+// Event records the disappearance of a chart so that consumers like the
+// Atom feed and the site.json search index can forget about it.
+type Event struct {
+	Seq     int64
+	Kind    int
+	Name    string
+	Slug    string
+	NewName string
+	NewSlug string
+	When    time.Time
+}
+
 type SiteEnt struct {
 	Chart *chart.Chart
 	fi    os.FileInfo
 }
 
+// SiteListCache maps the name of every directory in Store to the chart it
+// contains, if any. The root itself is named "".
+//
+// Callers must hold Lock() across Make() and any use of Entries, Events and
+// the charts in them.
 type SiteListCache struct {
 	Entries map[string]SiteEnt
-	Root    string
+	Events  []Event
+	Store   store.Store
+	seq     int64
+	mu      sync.Mutex
 }
 
-func New(root string) *SiteListCache {
+func New(s store.Store) *SiteListCache {
 	return &SiteListCache{
 		Entries: map[string]SiteEnt{},
-		Root:    root,
+		Store:   s,
 	}
 }
 
+func (self *SiteListCache) Lock() {
+	self.mu.Lock()
+}
+
+func (self *SiteListCache) Unlock() {
+	self.mu.Unlock()
+}
+
 func (self *SiteListCache) Make() (built bool, err error) {
 	L("Make() starting")
 	var fi os.FileInfo
@@ -46,24 +85,44 @@ func (self *SiteListCache) Make() (built bool, err error) {
 	if !fresh {
 		built = true
 
-		fi, err = os.Stat(self.Root)
+		fi, err = self.Store.Stat("")
 		if err != nil {
 			return
 		}
 
-		err = self.rechart(self.Root, fi, SiteEnt{}, false)
+		seen := map[string]bool{"": true}
+
+		err = self.rechart("", fi, SiteEnt{}, false)
 		if err != nil {
 			return
 		}
-		err = self.rebuild(self.Root)
+		err = self.rebuild("", seen)
 		if err != nil {
 			return
 		}
+
+		self.prune(seen)
 	}
 
 	return
 }
 
+// EventsSince returns the retained events whose sequence numbers are greater
+// than seq, oldest first.
+func (self *SiteListCache) EventsSince(seq int64) []Event {
+	for idx, ev := range self.Events {
+		if ev.Seq > seq {
+			return self.Events[idx:]
+		}
+	}
+	return nil
+}
+
+// Seq returns the sequence number of the most recent event.
+func (self *SiteListCache) Seq() int64 {
+	return self.seq
+}
+
 func (self *SiteListCache) allFresh() (fresh bool, err error) {
 	fresh = false
 	err = nil
@@ -73,8 +132,12 @@ func (self *SiteListCache) allFresh() (fresh bool, err error) {
 	}
 
 	for key, ent := range self.Entries {
-		fi, err := os.Stat(key)
+		fi, err := self.Store.Stat(key)
 		if err != nil {
+			if os.IsNotExist(err) {
+				L("allFresh %q vanished", key)
+				return false, nil
+			}
 			return fresh, err
 		}
 
@@ -91,8 +154,8 @@ func (self *SiteListCache) isFresh(a, b os.FileInfo) bool {
 	return stat.IsFresh(a, b)
 }
 
-func (self *SiteListCache) rebuild(name string) (err error) {
-	fis, err := ioutil.ReadDir(name)
+func (self *SiteListCache) rebuild(name string, seen map[string]bool) (err error) {
+	fis, err := self.Store.List(name)
 	if err != nil {
 		L("rebuild ReadDir -> %v", err)
 		return
@@ -102,24 +165,29 @@ func (self *SiteListCache) rebuild(name string) (err error) {
 		L("rebuild name %q idx %d fi %v", name, idx, fi)
 
 		childName := path.Join(name, fi.Name())
+		if trash.Contains(childName) {
+			continue
+		}
 
 		ent, ok := self.Entries[childName]
 		L("rebuild child %q ent %q ok %t", childName, ent, ok)
 		if ok && self.isFresh(fi, ent.fi) {
+			seen[childName] = true
 			L("rebuild recurse %q", childName)
-			err = self.rebuild(childName)
+			err = self.rebuild(childName, seen)
 			if err != nil {
 				return
 			}
 		} else {
 			if fi.IsDir() {
+				seen[childName] = true
 				L("rebuild rechart %q", childName)
 				err = self.rechart(childName, fi, ent, ok)
 				if err != nil {
 					return
 				}
 				L("rebuild recurse %q", childName)
-				err = self.rebuild(childName)
+				err = self.rebuild(childName, seen)
 				if err != nil {
 					return
 				}
@@ -132,20 +200,29 @@ func (self *SiteListCache) rebuild(name string) (err error) {
 func (self *SiteListCache) rechart(name string, fi os.FileInfo, ent SiteEnt, ok bool) (err error) {
 	L("rechart name %q fi %v ent %v ok %t", name, fi, ent, ok)
 	newChart := ent.Chart
-	if !ok {
-		newChart, err = chart.Resolve(name, self.Root)
-	} else {
-		if newChart != nil {
-			_, err = ent.Chart.Make()
-		} else {
-			newChart, err = chart.Resolve(name, self.Root)
+	if ok && newChart != nil {
+		_, err = newChart.Make()
+		if err != nil && os.IsNotExist(err) {
+			newChart = nil
 		}
 	}
+	if newChart == nil {
+		newChart, err = chart.Resolve(self.Store, name)
+	}
 
 	if err != nil && os.IsNotExist(err) {
 		err = nil
 	}
 
+	if ok && ent.Chart != nil && newChart == nil {
+		self.record(Event{
+			Kind: DELETED,
+			Name: name,
+			Slug: ent.Chart.Slug(),
+			When: time.Now(),
+		})
+	}
+
 	newEnt := SiteEnt{
 		Chart: newChart,
 		fi:    fi,
@@ -156,3 +233,48 @@ func (self *SiteListCache) rechart(name string, fi os.FileInfo, ent SiteEnt, ok
 
 	return
 }
+
+// prune drops entries that rebuild() did not visit and records an event for
+// each chart among them. A dropped chart whose directory reappears elsewhere
+// in the tree is reported as RENAMED.
+func (self *SiteListCache) prune(seen map[string]bool) {
+	now := time.Now()
+	for name, ent := range self.Entries {
+		if seen[name] {
+			continue
+		}
+		L("prune dropping %q", name)
+		delete(self.Entries, name)
+
+		if ent.Chart == nil {
+			continue
+		}
+
+		ev := Event{
+			Kind: DELETED,
+			Name: name,
+			Slug: ent.Chart.Slug(),
+			When: now,
+		}
+		for newName, newEnt := range self.Entries {
+			if newEnt.Chart != nil && store.SameFile(ent.fi, newEnt.fi) {
+				ev.Kind = RENAMED
+				ev.NewName = newName
+				ev.NewSlug = newEnt.Chart.Slug()
+				break
+			}
+		}
+		self.record(ev)
+	}
+}
+
+func (self *SiteListCache) record(ev Event) {
+	self.seq++
+	ev.Seq = self.seq
+	L("record event %v", ev)
+
+	self.Events = append(self.Events, ev)
+	if len(self.Events) > MAX_EVENTS {
+		self.Events = self.Events[len(self.Events)-MAX_EVENTS:]
+	}
+}
@@ -3,6 +3,8 @@
 package sitelistcache
 
 import (
+	"akamai/atlas/store"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -23,7 +25,7 @@ func init() {
 
 	chartsPath = path.Join(testPath, "test/charts")
 
-	siteListCache = New(chartsPath)
+	siteListCache = New(store.NewLocal(chartsPath))
 }
 
 func TestSiteListCacheMake(t *testing.T) {
@@ -50,3 +52,74 @@ func TestSiteListCacheMake(t *testing.T) {
 		log.Printf("TestSiteListCacheMake(): ent %q -> %v", k, v)
 	}
 }
+
+func writeTestChart(t *testing.T, dir string, title string) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("writeTestChart() mkdir failed: err: %q", err)
+	}
+	body := "% " + title + "\n% Test\n% Today\n\nbody\n"
+	err = ioutil.WriteFile(path.Join(dir, "index.txt"), []byte(body), 0644)
+	if err != nil {
+		t.Fatalf("writeTestChart() write failed: err: %q", err)
+	}
+}
+
+func TestSiteListCacheRemove(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "atlas-sitelist")
+	if err != nil {
+		t.Fatalf("TestSiteListCacheRemove() tempdir failed: err: %q", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeTestChart(t, root, "Root")
+	writeTestChart(t, path.Join(root, "gone"), "Gone")
+	writeTestChart(t, path.Join(root, "old"), "Old")
+
+	cache := New(store.NewLocal(root))
+	_, err = cache.Make()
+	if err != nil {
+		t.Fatalf("TestSiteListCacheRemove() make failed: err: %q", err)
+	}
+
+	err = os.RemoveAll(path.Join(root, "gone"))
+	if err != nil {
+		t.Fatalf("TestSiteListCacheRemove() remove failed: err: %q", err)
+	}
+	err = os.Rename(path.Join(root, "old"), path.Join(root, "new"))
+	if err != nil {
+		t.Fatalf("TestSiteListCacheRemove() rename failed: err: %q", err)
+	}
+
+	built, err := cache.Make()
+	if err != nil {
+		t.Fatalf("TestSiteListCacheRemove() remake failed: err: %q", err)
+	}
+	if !built {
+		t.Fatalf("TestSiteListCacheRemove() remake did not notice removals")
+	}
+
+	if _, ok := cache.Entries["gone"]; ok {
+		t.Fatalf("TestSiteListCacheRemove() stale entry for gone/ survived")
+	}
+	if _, ok := cache.Entries["old"]; ok {
+		t.Fatalf("TestSiteListCacheRemove() stale entry for old/ survived")
+	}
+
+	kinds := map[string]Event{}
+	for _, ev := range cache.EventsSince(0) {
+		kinds[ev.Slug] = ev
+	}
+	if ev, ok := kinds["gone/"]; !ok || ev.Kind != DELETED {
+		t.Fatalf("TestSiteListCacheRemove() no DELETED event for gone/: %v", cache.Events)
+	}
+	if ev, ok := kinds["old/"]; !ok || ev.Kind != RENAMED || ev.NewSlug != "new/" {
+		t.Fatalf("TestSiteListCacheRemove() no RENAMED event for old/: %v", cache.Events)
+	}
+
+	if evs := cache.EventsSince(cache.Seq()); len(evs) != 0 {
+		t.Fatalf("TestSiteListCacheRemove() EventsSince(Seq()) returned %v", evs)
+	}
+}
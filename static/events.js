@@ -0,0 +1,76 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Follows changes to the atlas as they are saved: chart pages re-render the
+// sections that changed, the list of charts updates, and the search box
+// refreshes its index (see searchbox.js, which listens for 'atlas:site').
+$(function() {
+  var url = $('meta[name=atlas-events]').attr('content');
+  if (!url || !window.EventSource) {
+    return;
+  }
+
+  var source = new EventSource(url);
+  source.addEventListener('site', function() {
+    $(document).trigger('atlas:site');
+  });
+  source.addEventListener('chart', function(e) {
+    $(document).trigger('atlas:chart', [JSON.parse(e.data)]);
+  });
+
+  // fetchPage calls done with the elements of this page as now served.
+  var fetchPage = function(done) {
+    $.ajax({url: location.href, dataType: 'html', cache: false, success: function(html) {
+      done($('<div/>').append($.parseHTML(html)));
+    }});
+  };
+
+  $(document).on('atlas:chart', function(ev, change) {
+    var body = $('#chartBody');
+    if (!body.length) {
+      return;
+    }
+
+    // drawings are reloaded in place
+    if (/\.svg$/.test(change.name)) {
+      var file = change.name.slice(change.name.lastIndexOf('/') + 1);
+      body.find('img').each(function() {
+        var src = $(this).attr('src').split('?')[0];
+        if (src.slice(src.lastIndexOf('/') + 1) === file) {
+          $(this).attr('src', src + '?v=' + Date.now());
+        }
+      });
+      return;
+    }
+    if (!/\.te?xt$/.test(change.name)) {
+      return;
+    }
+
+    fetchPage(function(page) {
+      $.each(['span.author', 'span.date', 'h1.title > a'], function(i, sel) {
+        $(sel).text(page.find(sel).text());
+      });
+      document.title = page.find('title').text() || document.title;
+
+      var fresh = page.find('#chartBody').children();
+      var stale = body.children();
+      if (fresh.length !== stale.length) {
+        body.empty().append(fresh);
+        return;
+      }
+      stale.each(function(i) {
+        if (this.outerHTML !== fresh[i].outerHTML) {
+          $(this).replaceWith(fresh[i]);
+        }
+      });
+    });
+  });
+
+  $(document).on('atlas:site', function() {
+    var list = $('#chartList');
+    if (list.length) {
+      fetchPage(function(page) {
+        list.html(page.find('#chartList').html());
+      });
+    }
+  });
+});
@@ -0,0 +1,66 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Tells who else is viewing or editing the chart on this page.
+$(function() {
+  var badge = $('#presence');
+  if (!badge.length) {
+    return;
+  }
+
+  // How often to send heartbeats, in ms; the server forgets pages that
+  // miss a few.
+  var beatInterval = 15000;
+
+  var tab = Math.random().toString(36).slice(2) + Date.now().toString(36);
+  var url = badge.data('presence-url');
+  var token = badge.data('csrf-token');
+
+  var describe = function(visitors) {
+    var editors = [], viewers = [], anonymous = 0;
+    $.each(visitors, function(i, v) {
+      if (!v.name) {
+        anonymous++;
+      } else if (v.action === 'editing') {
+        editors.push(v.name);
+      } else {
+        viewers.push(v.name);
+      }
+    });
+    var parts = [];
+    if (editors.length) {
+      parts.push('editing: ' + editors.join(', '));
+    }
+    if (viewers.length) {
+      parts.push('viewing: ' + viewers.join(', '));
+    }
+    if (anonymous) {
+      parts.push(anonymous + ' anonymous');
+    }
+    return parts.join('; ');
+  };
+
+  var beat = function() {
+    $.ajax({
+      type: 'POST',
+      url: url,
+      data: {action: badge.data('action'), tab: tab},
+      headers: {'X-CSRF-Token': token},
+      dataType: 'json',
+      success: function(status) {
+        var text = describe(status.visitors);
+        var editing = $.grep(status.visitors, function(v) { return v.action === 'editing'; }).length > 0;
+        badge.text(text ? 'Also here — ' + text : '').toggleClass('editing', editing);
+      },
+      complete: function() {
+        setTimeout(beat, beatInterval);
+      }
+    });
+  };
+  beat();
+
+  $(window).on('unload', function() {
+    if (navigator.sendBeacon) {
+      navigator.sendBeacon(url, new URLSearchParams({action: 'leave', tab: tab, csrf_token: token}));
+    }
+  });
+});
@@ -52,16 +52,63 @@ $(document).ready(function(){
   // Updated by doSearch(); read by doSubmit().
   var matchingChartnames = [];
 
+  // Version of site.json that site reflects; see X-Atlas-Version.
+  var siteVersion = null;
+
+  // How often to ask the server for site.json changes, in ms.
+  var siteRefreshInterval = 30000;
+
+  // Fetch changes since siteVersion and fold them into site.
+  var refreshSite;
+
+  // The pending call of refreshSite.
+  var refreshTimer = null;
+
   // Use XHR to attempt to fill the site-ref.
-  // $.getJSON('@APPROOT@' + '/site.json', function(data){
-  $.getJSON('/site.json', function(data){
+  // $.getJSON('@APPROOT@' + '/_/site.json', function(data){
+  $.getJSON('/_/site.json', function(data, status, xhr){
     site = data;
+    siteVersion = xhr.getResponseHeader("X-Atlas-Version");
     $("#searchfind").attr("disabled", false);
     $("#searchgrep").attr("disabled", false);
     $("#searchbar").css("display", "inline-block");
     loadFragment();
+    refreshTimer = setTimeout(refreshSite, siteRefreshInterval);
+  });
+
+  // Refresh at once when told the site changed; see events.js.
+  $(document).on('atlas:site', function(){
+    if (siteVersion !== null) {
+      clearTimeout(refreshTimer);
+      refreshSite();
+    }
   });
 
+  refreshSite = function(){
+    $.getJSON('/_/site.json', {"since": siteVersion}, function(delta){
+      var dirty = delta.full;
+      if (delta.full) {
+        site = {};
+      }
+      $.each(delta.changed, function(k, v){
+        site[k] = v;
+        dirty = true;
+      });
+      $.each(delta.removed, function(idx, k){
+        delete site[k];
+        dirty = true;
+      });
+      siteVersion = delta.version;
+      var searching = $("#searchfind").val() || $("#searchgrep").val();
+      if (dirty && searching) {
+        doSearch();
+      }
+    }).always(function(){
+      clearTimeout(refreshTimer);
+      refreshTimer = setTimeout(refreshSite, siteRefreshInterval);
+    });
+  };
+
   makeLinkData = function(k, v) {
     var text = v.split(/\n/)[0].replace(/^% /, '');
     //var link = "@APPROOT@" + k;
@@ -13,23 +13,41 @@
 
 svgEditor.addExtension("server_opensave", {
   callback: function() {
-    var uploadIframe = $('<iframe name="output_frame" src="#"/>').hide().appendTo('body');
     svgEditor.setCustomHandlers({
       save: function(win, data) {
         //var formTarget = window.parent.document.location;
-        var formTarget = window.document.location;
+        var formTarget = window.document.location.href;
         var svg = "<?xml version=\"1.0\"?>\n" + data.replace(/&nbsp;/g, "&#160;");
         var b64_svg = svgedit.utilities.encode64(svg);
-        var form = $('<form>').attr({
-          method: 'post',
-          action: formTarget,
-          target: 'output_frame'
-        })  .append('<input type="hidden" name="filepath" value="' + b64_svg + '">')
-            .append('<input type="hidden" name="filename" value="drawing.svg">')
-            .append('<input type="hidden" name="contenttype" value="application/x-svgdraw">')
-            .appendTo('body')
-            .submit().remove();
-        alert("Saved!");
+        // name the version this drawing replaces, so that saves can't
+        // silently undo someone else's
+        var version = $('meta[name="atlas-version"]');
+        var headers = {
+          'X-CSRF-Token': $('meta[name="csrf-token"]').attr('content')
+        };
+        if (version.attr('content')) {
+          headers['If-Match'] = '"' + version.attr('content') + '"';
+        } else {
+          headers['If-None-Match'] = '*';
+        }
+        $.ajax({
+          type: 'POST',
+          url: formTarget,
+          headers: headers,
+          data: {
+            filepath: b64_svg,
+            filename: 'drawing.svg',
+            contenttype: 'application/x-svgdraw'
+          }
+        }).done(function(data, status, xhr){
+          var etag = xhr.getResponseHeader('ETag');
+          if (etag) {
+            version.attr('content', etag.replace(/^"|"$/g, ''));
+          }
+          alert("Saved!");
+        }).fail(function(xhr){
+          alert("Not saved!\n\n" + xhr.responseText);
+        });
       },
     });
   },
@@ -0,0 +1,47 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Tells whether the pad's edits have been saved to the chart yet.
+$(function() {
+  var indicator = $('#txtEditorSync');
+  var version = $('#txtEditorVersion');
+  if (!indicator.length) {
+    return;
+  }
+
+  // How often to ask, in ms.
+  var pollInterval = 5000;
+
+  var describe = function(status) {
+    switch (status.state) {
+    case 'synced':
+      return 'All edits saved.';
+    case 'unsaved':
+      var since = status.rev >= 0 ? ' since revision ' + status.rev : '';
+      return 'Unsaved edits' + since + '; saving when editing pauses.';
+    case 'conflict':
+      return 'The chart changed outside this pad; save to merge, or reload from disk.';
+    }
+    return 'Checking for unsaved edits…';
+  };
+
+  var poll = function() {
+    $.ajax({
+      url: indicator.data('sync-url'),
+      dataType: 'json',
+      cache: false,
+      success: function(status) {
+        indicator.removeClass('synced unsaved conflict').addClass(status.state);
+        indicator.text(describe(status) + (status.error ? ' (The editor service is not answering.)' : ''));
+        // saves by hand replace what background saves wrote
+        version.val(status.version);
+      },
+      error: function() {
+        indicator.text('Unable to tell whether edits are saved.');
+      },
+      complete: function() {
+        setTimeout(poll, pollInterval);
+      }
+    });
+  };
+  poll();
+});
@@ -0,0 +1,33 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Keeps the native chart editor's preview in step with its text.
+$(function() {
+  var form = $('#txtNativeEditorForm');
+  var text = $('#txtNativeEditorText');
+  var preview = $('#txtNativeEditorPreview');
+  if (!text.length) {
+    return;
+  }
+
+  text.autosize();
+
+  // How long typing must pause before the preview is redrawn, in ms.
+  var previewDelay = 300;
+  var timer = null;
+
+  text.on('input', function() {
+    clearTimeout(timer);
+    timer = setTimeout(function() {
+      $.ajax({
+        type: 'POST',
+        url: form.attr('action'),
+        data: {action: 'preview', text: text.val()},
+        headers: {'X-CSRF-Token': form.find('input[name=csrf_token]').val()},
+        dataType: 'html',
+        success: function(html) {
+          preview.html(html);
+        }
+      });
+    }, previewDelay);
+  });
+});
@@ -0,0 +1,96 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package staticcache
+
+import (
+	"akamai/atlas/chartfs"
+	"akamai/atlas/precompress"
+	"akamai/atlas/stat"
+	"errors"
+	"github.com/golang/glog"
+	"os"
+	"path"
+	"sync"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("static "+s, v...)
+	}
+}
+
+// MAX_STATIC_SIZE bounds the files we are willing to hold in memory.
+const MAX_STATIC_SIZE = 16 << 20
+
+// ErrUncacheable is returned for directories and oversized files, which
+// callers should serve straight from disk.
+var ErrUncacheable = errors.New("static asset not cacheable")
+
+// compressible lists the extensions of text formats worth compressing.
+var compressible = map[string]bool{
+	".css":  true,
+	".html": true,
+	".js":   true,
+	".json": true,
+	".svg":  true,
+	".txt":  true,
+	".xml":  true,
+}
+
+type StaticEnt struct {
+	Blob *precompress.Blob
+	fi   os.FileInfo
+}
+
+type StaticCache struct {
+	FS      *chartfs.FS
+	Entries map[string]StaticEnt
+	mu      sync.Mutex
+}
+
+func New(fs *chartfs.FS) *StaticCache {
+	return &StaticCache{
+		FS:      fs,
+		Entries: map[string]StaticEnt{},
+	}
+}
+
+// Make returns the precompressed contents of the static asset name, a
+// slash-separated path relative to FS, rereading it if it has
+// changed on disk.
+func (self *StaticCache) Make(name string) (*precompress.Blob, error) {
+	name = path.Clean("/" + name)
+
+	fi, err := self.FS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() || fi.Size() > MAX_STATIC_SIZE {
+		return nil, ErrUncacheable
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	ent, ok := self.Entries[name]
+	if ok && stat.IsFresh(fi, ent.fi) {
+		return ent.Blob, nil
+	}
+
+	L("make reading %q", name)
+	body, err := self.FS.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := precompress.New(body, fi.ModTime(), compressible[path.Ext(name)])
+	if err != nil {
+		return nil, err
+	}
+
+	self.Entries[name] = StaticEnt{
+		Blob: blob,
+		fi:   fi,
+	}
+	return blob, nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package store
+
+import (
+	"akamai/atlas/chartfs"
+	"akamai/atlas/stat"
+	"os"
+	"path"
+	"time"
+)
+
+// POLL_INTERVAL is how often Local rescans watched trees, since the files
+// may also change behind atlas's back.
+const POLL_INTERVAL = 2 * time.Second
+
+// Local keeps charts as files beneath a directory.
+type Local struct {
+	FS           *chartfs.FS
+	PollInterval time.Duration
+}
+
+func NewLocal(root string) *Local {
+	return &Local{
+		FS:           chartfs.New(root),
+		PollInterval: POLL_INTERVAL,
+	}
+}
+
+func (self *Local) List(name string) ([]os.FileInfo, error) {
+	return self.FS.ReadDir(name)
+}
+
+func (self *Local) Stat(name string) (os.FileInfo, error) {
+	return self.FS.Stat(name)
+}
+
+func (self *Local) Real(name string) (string, error) {
+	return self.FS.Real(name)
+}
+
+func (self *Local) Open(name string) (File, error) {
+	f, err := self.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (self *Local) Create(name string) (Writer, error) {
+	f, err := self.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (self *Local) Remove(name string) error {
+	if clean(name) == "" {
+		return ErrRoot
+	}
+	_, err := self.FS.Stat(name)
+	if err != nil {
+		return err
+	}
+	return self.FS.RemoveAll(name)
+}
+
+func (self *Local) Rename(oldName, newName string) error {
+	if clean(oldName) == "" || clean(newName) == "" {
+		return ErrRoot
+	}
+	return self.FS.Rename(oldName, newName)
+}
+
+func (self *Local) Watch(name string, stop <-chan struct{}) <-chan Event {
+	name = clean(name)
+	ch := make(chan Event, WATCH_BUFFER)
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(self.PollInterval)
+		defer ticker.Stop()
+
+		old := self.scan(name)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			cur := self.scan(name)
+			var evs []Event
+			for n, fi := range cur {
+				if ofi, ok := old[n]; !ok || !stat.IsFresh(fi, ofi) {
+					evs = append(evs, Event{Op: WRITE, Name: n})
+				}
+			}
+			for n := range old {
+				if _, ok := cur[n]; !ok {
+					evs = append(evs, Event{Op: REMOVE, Name: n})
+				}
+			}
+			old = cur
+
+			for _, ev := range evs {
+				select {
+				case ch <- ev:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// scan stats everything at or beneath name.
+func (self *Local) scan(name string) map[string]os.FileInfo {
+	fis := map[string]os.FileInfo{}
+
+	fi, err := self.FS.Stat(name)
+	if err != nil {
+		return fis
+	}
+	fis[name] = fi
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		children, err := self.FS.ReadDir(dir)
+		if err != nil {
+			L("scan %q: %v", dir, err)
+			return
+		}
+		for _, child := range children {
+			childName := path.Join(dir, child.Name())
+			fis[childName] = child
+			if child.IsDir() {
+				walk(childName)
+			}
+		}
+	}
+	if fi.IsDir() {
+		walk(name)
+	}
+	return fis
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+)
+
+// ErrNotDir is returned when a file stands where a directory is needed.
+var ErrNotDir = errors.New("store: not a directory")
+
+type memNode struct {
+	fileInfo
+	data []byte
+}
+
+// Memory keeps charts in memory. It is meant for tests.
+type Memory struct {
+	nodes  map[string]*memNode
+	nextId int64
+	mu     sync.RWMutex
+	clock
+	hub
+}
+
+func NewMemory() *Memory {
+	self := &Memory{
+		nodes: map[string]*memNode{},
+	}
+	self.nodes[""] = self.node("", true, nil)
+	return self
+}
+
+func (self *Memory) node(name string, dir bool, data []byte) *memNode {
+	self.nextId++
+	return &memNode{
+		fileInfo: fileInfo{
+			id:      self.nextId,
+			name:    name,
+			size:    int64(len(data)),
+			dir:     dir,
+			modTime: self.now(),
+		},
+		data: data,
+	}
+}
+
+// info returns a snapshot of n, since n itself changes under the lock.
+func (self *Memory) info(n *memNode) os.FileInfo {
+	fi := n.fileInfo
+	return &fi
+}
+
+func (self *Memory) List(name string) ([]os.FileInfo, error) {
+	name = clean(name)
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	n, ok := self.nodes[name]
+	if !ok {
+		return nil, notExist("list", name)
+	}
+	if !n.dir {
+		return nil, &os.PathError{Op: "list", Path: name, Err: ErrNotDir}
+	}
+
+	fis := []os.FileInfo{}
+	for childName, child := range self.nodes {
+		if childName != "" && parent(childName) == name {
+			fis = append(fis, self.info(child))
+		}
+	}
+	return sortByName(fis), nil
+}
+
+func (self *Memory) Stat(name string) (os.FileInfo, error) {
+	name = clean(name)
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	n, ok := self.nodes[name]
+	if !ok {
+		return nil, notExist("stat", name)
+	}
+	return self.info(n), nil
+}
+
+func (self *Memory) Open(name string) (File, error) {
+	name = clean(name)
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	n, ok := self.nodes[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	// data is replaced, never modified, so readers may keep the old slice
+	return &byteFile{
+		Reader: bytes.NewReader(n.data),
+		fi:     self.info(n),
+	}, nil
+}
+
+func (self *Memory) Create(name string) (Writer, error) {
+	name = clean(name)
+	if name == "" {
+		return nil, ErrRoot
+	}
+
+	return &byteWriter{
+		commit: func(data []byte) error {
+			return self.write(name, append([]byte(nil), data...))
+		},
+	}, nil
+}
+
+func (self *Memory) write(name string, data []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	err := self.mkdirs(parent(name))
+	if err != nil {
+		return err
+	}
+
+	n, ok := self.nodes[name]
+	if ok {
+		if n.dir {
+			return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+		}
+		n.data = data
+		n.size = int64(len(data))
+		n.modTime = self.now()
+	} else {
+		self.nodes[name] = self.node(name, false, data)
+		self.touch(parent(name))
+	}
+
+	self.publish(Event{Op: WRITE, Name: name})
+	return nil
+}
+
+func (self *Memory) mkdirs(name string) error {
+	n, ok := self.nodes[name]
+	if ok {
+		if !n.dir {
+			return &os.PathError{Op: "mkdir", Path: name, Err: ErrNotDir}
+		}
+		return nil
+	}
+
+	err := self.mkdirs(parent(name))
+	if err != nil {
+		return err
+	}
+	self.nodes[name] = self.node(name, true, nil)
+	self.touch(parent(name))
+	self.publish(Event{Op: WRITE, Name: name})
+	return nil
+}
+
+func (self *Memory) touch(name string) {
+	if n, ok := self.nodes[name]; ok {
+		n.modTime = self.now()
+	}
+}
+
+func (self *Memory) Remove(name string) error {
+	name = clean(name)
+	if name == "" {
+		return ErrRoot
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.nodes[name]; !ok {
+		return notExist("remove", name)
+	}
+	for n := range self.nodes {
+		if within(name, n) {
+			delete(self.nodes, n)
+		}
+	}
+	self.touch(parent(name))
+
+	self.publish(Event{Op: REMOVE, Name: name})
+	return nil
+}
+
+func (self *Memory) Rename(oldName, newName string) error {
+	oldName = clean(oldName)
+	newName = clean(newName)
+	if oldName == "" || newName == "" {
+		return ErrRoot
+	}
+	if oldName == newName {
+		return nil
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.nodes[oldName]; !ok {
+		return notExist("rename", oldName)
+	}
+	if within(oldName, newName) {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrInvalid}
+	}
+	if n, ok := self.nodes[newName]; ok {
+		if n.dir {
+			return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+		}
+		delete(self.nodes, newName)
+	}
+
+	err := self.mkdirs(parent(newName))
+	if err != nil {
+		return err
+	}
+
+	moved := map[string]*memNode{}
+	for name, n := range self.nodes {
+		if within(oldName, name) {
+			delete(self.nodes, name)
+			n.name = newName + name[len(oldName):]
+			moved[n.name] = n
+		}
+	}
+	for name, n := range moved {
+		self.nodes[name] = n
+	}
+	self.touch(parent(oldName))
+	self.touch(parent(newName))
+
+	self.publish(Event{Op: REMOVE, Name: oldName})
+	self.publish(Event{Op: WRITE, Name: newName})
+	return nil
+}
+
+func (self *Memory) Watch(name string, stop <-chan struct{}) <-chan Event {
+	return self.hub.watch(name, stop)
+}
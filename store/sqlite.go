@@ -0,0 +1,331 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"sync"
+	"time"
+)
+
+const SQLITE_SCHEMA = `
+CREATE TABLE IF NOT EXISTS files (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	name     TEXT NOT NULL UNIQUE,
+	parent   TEXT NOT NULL,
+	dir      INTEGER NOT NULL,
+	data     BLOB,
+	mod_time INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_parent ON files (parent);
+`
+
+// Sqlite keeps charts in a sqlite database, so that atlas can run without a
+// writable filesystem of its own.
+type Sqlite struct {
+	db *sql.DB
+	mu sync.Mutex
+	clock
+	hub
+}
+
+func NewSqlite(dsn string) (*Sqlite, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// every writer holds mu anyway, and one connection keeps the database
+	// from being locked against itself
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(SQLITE_SCHEMA)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO files (name, parent, dir, mod_time) VALUES ('', '', 1, ?);", time.Now().UnixNano())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Sqlite{db: db}, nil
+}
+
+func (self *Sqlite) Close() error {
+	return self.db.Close()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInfo(row scanner) (*fileInfo, error) {
+	fi := &fileInfo{}
+	var modTime int64
+	err := row.Scan(&fi.id, &fi.name, &fi.dir, &fi.size, &modTime)
+	fi.modTime = time.Unix(0, modTime)
+	return fi, err
+}
+
+const infoColumns = "id, name, dir, ifnull(length(data), 0), mod_time"
+
+func (self *Sqlite) stat(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, op, name string) (*fileInfo, error) {
+	fi, err := scanInfo(q.QueryRow("SELECT "+infoColumns+" FROM files WHERE name = ?;", name))
+	if err == sql.ErrNoRows {
+		return nil, notExist(op, name)
+	}
+	return fi, err
+}
+
+func (self *Sqlite) List(name string) ([]os.FileInfo, error) {
+	name = clean(name)
+
+	fi, err := self.stat(self.db, "list", name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.dir {
+		return nil, &os.PathError{Op: "list", Path: name, Err: ErrNotDir}
+	}
+
+	rows, err := self.db.Query("SELECT "+infoColumns+" FROM files WHERE parent = ? AND name != '' ORDER BY name;", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fis := []os.FileInfo{}
+	for rows.Next() {
+		fi, err := scanInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return sortByName(fis), rows.Err()
+}
+
+func (self *Sqlite) Stat(name string) (os.FileInfo, error) {
+	fi, err := self.stat(self.db, "stat", clean(name))
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (self *Sqlite) Open(name string) (File, error) {
+	name = clean(name)
+
+	fi := &fileInfo{}
+	var data []byte
+	var modTime int64
+	row := self.db.QueryRow("SELECT id, name, dir, data, mod_time FROM files WHERE name = ?;", name)
+	err := row.Scan(&fi.id, &fi.name, &fi.dir, &data, &modTime)
+	if err == sql.ErrNoRows {
+		return nil, notExist("open", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi.size = int64(len(data))
+	fi.modTime = time.Unix(0, modTime)
+
+	return &byteFile{
+		Reader: bytes.NewReader(data),
+		fi:     fi,
+	}, nil
+}
+
+func (self *Sqlite) Create(name string) (Writer, error) {
+	name = clean(name)
+	if name == "" {
+		return nil, ErrRoot
+	}
+
+	return &byteWriter{
+		commit: func(data []byte) error {
+			return self.write(name, data)
+		},
+	}, nil
+}
+
+// update runs fn in a transaction while holding mu, then publishes evs if
+// the transaction committed.
+func (self *Sqlite) update(fn func(tx *sql.Tx) error, evs ...Event) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range evs {
+		self.publish(ev)
+	}
+	return nil
+}
+
+func (self *Sqlite) write(name string, data []byte) error {
+	return self.update(func(tx *sql.Tx) error {
+		err := self.mkdirs(tx, parent(name))
+		if err != nil {
+			return err
+		}
+
+		fi, err := self.stat(tx, "create", name)
+		if err == nil {
+			if fi.dir {
+				return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+			}
+			_, err = tx.Exec("UPDATE files SET data = ?, mod_time = ? WHERE id = ?;", data, self.now().UnixNano(), fi.id)
+			return err
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO files (name, parent, dir, data, mod_time) VALUES (?, ?, 0, ?, ?);", name, parent(name), data, self.now().UnixNano())
+		if err != nil {
+			return err
+		}
+		return self.touch(tx, parent(name))
+	}, Event{Op: WRITE, Name: name})
+}
+
+func (self *Sqlite) mkdirs(tx *sql.Tx, name string) error {
+	fi, err := self.stat(tx, "mkdir", name)
+	if err == nil {
+		if !fi.dir {
+			return &os.PathError{Op: "mkdir", Path: name, Err: ErrNotDir}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = self.mkdirs(tx, parent(name))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO files (name, parent, dir, mod_time) VALUES (?, ?, 1, ?);", name, parent(name), self.now().UnixNano())
+	if err != nil {
+		return err
+	}
+	return self.touch(tx, parent(name))
+}
+
+func (self *Sqlite) touch(tx *sql.Tx, name string) error {
+	_, err := tx.Exec("UPDATE files SET mod_time = ? WHERE name = ?;", self.now().UnixNano(), name)
+	return err
+}
+
+// subtree selects name and everything beneath it without trusting LIKE
+// with names that contain wildcards.
+const subtree = "(name = ? OR substr(name, 1, length(?) + 1) = ? || '/')"
+
+func (self *Sqlite) Remove(name string) error {
+	name = clean(name)
+	if name == "" {
+		return ErrRoot
+	}
+
+	return self.update(func(tx *sql.Tx) error {
+		_, err := self.stat(tx, "remove", name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM files WHERE "+subtree+";", name, name, name)
+		if err != nil {
+			return err
+		}
+		return self.touch(tx, parent(name))
+	}, Event{Op: REMOVE, Name: name})
+}
+
+func (self *Sqlite) Rename(oldName, newName string) error {
+	oldName = clean(oldName)
+	newName = clean(newName)
+	if oldName == "" || newName == "" {
+		return ErrRoot
+	}
+	if oldName == newName {
+		return nil
+	}
+	if within(oldName, newName) {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrInvalid}
+	}
+
+	return self.update(func(tx *sql.Tx) error {
+		_, err := self.stat(tx, "rename", oldName)
+		if err != nil {
+			return err
+		}
+
+		fi, err := self.stat(tx, "rename", newName)
+		if err == nil {
+			if fi.dir {
+				return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+			}
+			_, err = tx.Exec("DELETE FROM files WHERE id = ?;", fi.id)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err = self.mkdirs(tx, parent(newName))
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query("SELECT id, name FROM files WHERE "+subtree+";", oldName, oldName, oldName)
+		if err != nil {
+			return err
+		}
+		moved := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var name string
+			err = rows.Scan(&id, &name)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			moved[id] = newName + name[len(oldName):]
+		}
+		rows.Close()
+
+		for id, name := range moved {
+			_, err = tx.Exec("UPDATE files SET name = ?, parent = ? WHERE id = ?;", name, parent(name), id)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = self.touch(tx, parent(oldName))
+		if err != nil {
+			return err
+		}
+		return self.touch(tx, parent(newName))
+	}, Event{Op: REMOVE, Name: oldName}, Event{Op: WRITE, Name: newName})
+}
+
+func (self *Sqlite) Watch(name string, stop <-chan struct{}) <-chan Event {
+	return self.hub.watch(name, stop)
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package store abstracts where charts and the files that accompany them
+// live.
+//
+// Entries in a Store are named by slash-separated paths relative to the
+// store's root, which is itself named "". Directories spring into being as
+// files are created beneath them.
+package store
+
+import (
+	"akamai/atlas/chartfs"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("store "+s, v...)
+	}
+}
+
+const (
+	WRITE  = iota // entry created or changed
+	REMOVE        // entry removed or renamed away
+)
+
+// WATCH_BUFFER is how many events a watcher may fall behind by before
+// further events are dropped.
+const WATCH_BUFFER = 64
+
+// ErrRoot is returned by attempts to remove or rename the root.
+var ErrRoot = errors.New("store: can't remove or rename the root")
+
+type Event struct {
+	Op   int
+	Name string
+}
+
+// File is an open, read-only entry.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// Writer is a file being written by Create. Close commits what was written;
+// Abort discards it, leaving the file as it was, and does nothing after
+// Close.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+type Store interface {
+	// List returns the entries of directory name, sorted by name.
+	List(name string) ([]os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (File, error)
+	// Create creates or replaces file name, and its parent directories.
+	// What is written becomes visible, all at once, at Close.
+	Create(name string) (Writer, error)
+	// Remove deletes name along with everything beneath it.
+	Remove(name string) error
+	Rename(oldName, newName string) error
+	// Watch reports changes at or beneath name until stop is closed, after
+	// which the returned channel is closed.
+	Watch(name string, stop <-chan struct{}) <-chan Event
+}
+
+// Aliaser is implemented by stores in which one name can refer to another,
+// as local ones can by symbolic links.
+type Aliaser interface {
+	// Real returns the name that name really refers to.
+	Real(name string) (string, error)
+}
+
+// Real returns the name that name really refers to in s, which is name
+// itself unless s is an Aliaser.
+func Real(s Store, name string) (string, error) {
+	if a, ok := s.(Aliaser); ok {
+		return a.Real(name)
+	}
+	return clean(name), nil
+}
+
+// KINDS lists the names accepted by New.
+var KINDS = []string{"local", "memory", "sqlite"}
+
+// New opens a store of the given kind: a directory tree at path for
+// "local", a database file at path for "sqlite", or an empty tree for
+// "memory".
+func New(kind, path string) (Store, error) {
+	switch kind {
+	case "local":
+		return NewLocal(path), nil
+	case "memory":
+		return NewMemory(), nil
+	case "sqlite":
+		return NewSqlite(path)
+	}
+	return nil, fmt.Errorf("store: unknown kind %q; want one of %s", kind, strings.Join(KINDS, ", "))
+}
+
+func ReadFile(s Store, name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func WriteFile(s Store, name string, data []byte) error {
+	w, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// CopyIn copies the regular files beneath the OS directory dir into s
+// beneath name.
+func CopyIn(s Store, name, dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		L("copyin %q -> %q", p, path.Join(name, filepath.ToSlash(rel)))
+		return WriteFile(s, path.Join(name, filepath.ToSlash(rel)), data)
+	})
+}
+
+// SameFile reports whether a and b describe the same entry, following it
+// across renames.
+func SameFile(a, b os.FileInfo) bool {
+	ia, ok := a.(*fileInfo)
+	if !ok {
+		return os.SameFile(a, b)
+	}
+	ib, ok := b.(*fileInfo)
+	return ok && ia.id == ib.id
+}
+
+func clean(name string) string {
+	return chartfs.Clean(name)
+}
+
+func parent(name string) string {
+	if !strings.Contains(name, "/") {
+		return ""
+	}
+	return path.Dir(name)
+}
+
+// within reports whether name is prefix or lies beneath it.
+func within(prefix, name string) bool {
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// fileInfo describes entries of the stores that keep no real files.
+type fileInfo struct {
+	id      int64
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (self *fileInfo) Name() string {
+	if self.name == "" {
+		return "."
+	}
+	return path.Base(self.name)
+}
+
+func (self *fileInfo) Size() int64 { return self.size }
+
+func (self *fileInfo) Mode() os.FileMode {
+	if self.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (self *fileInfo) ModTime() time.Time { return self.modTime }
+func (self *fileInfo) IsDir() bool        { return self.dir }
+func (self *fileInfo) Sys() interface{}   { return nil }
+
+type byName []os.FileInfo
+
+func (self byName) Len() int           { return len(self) }
+func (self byName) Less(i, j int) bool { return self[i].Name() < self[j].Name() }
+func (self byName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func sortByName(fis []os.FileInfo) []os.FileInfo {
+	sort.Sort(byName(fis))
+	return fis
+}
+
+// byteFile is an open entry of the stores that keep no real files.
+type byteFile struct {
+	*bytes.Reader
+	fi os.FileInfo
+}
+
+func (self *byteFile) Close() error               { return nil }
+func (self *byteFile) Stat() (os.FileInfo, error) { return self.fi, nil }
+
+// byteWriter buffers a new file's contents until it is closed.
+type byteWriter struct {
+	bytes.Buffer
+	commit func([]byte) error
+	done   bool
+}
+
+func (self *byteWriter) Close() error {
+	if self.done {
+		return nil
+	}
+	self.done = true
+	return self.commit(self.Bytes())
+}
+
+func (self *byteWriter) Abort() error {
+	self.done = true
+	return nil
+}
+
+// clock hands out strictly increasing modification times, so that stat.IsFresh
+// notices back-to-back writes.
+type clock struct {
+	last time.Time
+}
+
+func (self *clock) now() time.Time {
+	now := time.Now().Round(0)
+	if !now.After(self.last) {
+		now = self.last.Add(time.Nanosecond)
+	}
+	self.last = now
+	return now
+}
+
+// hub fans out events from the stores that see every change themselves.
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan Event]string
+}
+
+func (self *hub) watch(name string, stop <-chan struct{}) <-chan Event {
+	ch := make(chan Event, WATCH_BUFFER)
+
+	self.mu.Lock()
+	if self.subs == nil {
+		self.subs = map[chan Event]string{}
+	}
+	self.subs[ch] = clean(name)
+	self.mu.Unlock()
+
+	go func() {
+		<-stop
+		self.mu.Lock()
+		delete(self.subs, ch)
+		close(ch)
+		self.mu.Unlock()
+	}()
+	return ch
+}
+
+func (self *hub) publish(ev Event) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for ch, prefix := range self.subs {
+		if !within(prefix, ev.Name) {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			L("hub dropped event %v for %q", ev, prefix)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// withStores runs fn against a fresh store of every kind.
+func withStores(t *testing.T, test string, fn func(t *testing.T, kind string, s Store)) {
+	tmp, err := ioutil.TempDir("", "atlas-store")
+	if err != nil {
+		t.Fatalf("%s() tempdir failed: err: %q", test, err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, kind := range KINDS {
+		p := path.Join(tmp, kind)
+		if kind == "local" {
+			os.MkdirAll(p, 0755)
+		}
+		s, err := New(kind, p)
+		if err != nil {
+			t.Fatalf("%s() New(%q) failed: err: %q", test, kind, err)
+		}
+		if l, ok := s.(*Local); ok {
+			l.PollInterval = 10 * time.Millisecond
+		}
+		fn(t, kind, s)
+	}
+}
+
+func TestStoreReadWrite(t *testing.T) {
+	t.Parallel()
+	withStores(t, "TestStoreReadWrite", func(t *testing.T, kind string, s Store) {
+		err := WriteFile(s, "a/b/index.txt", []byte("hello"))
+		if err != nil {
+			t.Fatalf("TestStoreReadWrite() %s: write failed: err: %q", kind, err)
+		}
+
+		body, err := ReadFile(s, "/a/b/../b/index.txt")
+		if err != nil || string(body) != "hello" {
+			t.Fatalf("TestStoreReadWrite() %s: read returned %q, %v", kind, body, err)
+		}
+
+		fi, err := s.Stat("a")
+		if err != nil || !fi.IsDir() {
+			t.Fatalf("TestStoreReadWrite() %s: parent not created: %v, %v", kind, fi, err)
+		}
+		fi, err = s.Stat("a/b/index.txt")
+		if err != nil || fi.IsDir() || fi.Size() != 5 || fi.Name() != "index.txt" {
+			t.Fatalf("TestStoreReadWrite() %s: bad stat: %v, %v", kind, fi, err)
+		}
+
+		WriteFile(s, "a/c.svg", []byte("<svg/>"))
+		fis, err := s.List("a")
+		if err != nil || len(fis) != 2 || fis[0].Name() != "b" || fis[1].Name() != "c.svg" {
+			t.Fatalf("TestStoreReadWrite() %s: bad listing: %v, %v", kind, fis, err)
+		}
+
+		// writes land whole at Close, or not at all
+		w, _ := s.Create("a/c.svg")
+		w.Write([]byte("<svg"))
+		if body, _ := ReadFile(s, "a/c.svg"); string(body) != "<svg/>" {
+			t.Fatalf("TestStoreReadWrite() %s: unclosed write visible: %q", kind, body)
+		}
+		w.Abort()
+		w.Close()
+		if body, _ := ReadFile(s, "a/c.svg"); string(body) != "<svg/>" {
+			t.Fatalf("TestStoreReadWrite() %s: aborted write visible: %q", kind, body)
+		}
+		if fis, _ := s.List("a"); len(fis) != 2 {
+			t.Fatalf("TestStoreReadWrite() %s: aborted write left %v", kind, fis)
+		}
+
+		if _, err := s.Stat("nope"); !os.IsNotExist(err) {
+			t.Fatalf("TestStoreReadWrite() %s: stat of missing entry returned %v", kind, err)
+		}
+		if _, err := s.Open("nope"); !os.IsNotExist(err) {
+			t.Fatalf("TestStoreReadWrite() %s: open of missing entry returned %v", kind, err)
+		}
+		if err := WriteFile(s, "a/c.svg/x", nil); err == nil {
+			t.Fatalf("TestStoreReadWrite() %s: created a file beneath a file", kind)
+		}
+	})
+}
+
+func TestStoreRemoveRename(t *testing.T) {
+	t.Parallel()
+	withStores(t, "TestStoreRemoveRename", func(t *testing.T, kind string, s Store) {
+		WriteFile(s, "old/index.txt", []byte("old"))
+		WriteFile(s, "old/pic.svg", []byte("pic"))
+		WriteFile(s, "gone/index.txt", []byte("gone"))
+
+		root, _ := s.Stat("")
+		before, _ := s.Stat("old")
+
+		err := s.Rename("old", "sub/new")
+		if err != nil {
+			t.Fatalf("TestStoreRemoveRename() %s: rename failed: err: %q", kind, err)
+		}
+		if _, err := s.Stat("old"); !os.IsNotExist(err) {
+			t.Fatalf("TestStoreRemoveRename() %s: old name survived: %v", kind, err)
+		}
+		body, err := ReadFile(s, "sub/new/pic.svg")
+		if err != nil || string(body) != "pic" {
+			t.Fatalf("TestStoreRemoveRename() %s: renamed child returned %q, %v", kind, body, err)
+		}
+		after, _ := s.Stat("sub/new")
+		if !SameFile(before, after) {
+			t.Fatalf("TestStoreRemoveRename() %s: rename not followed by SameFile", kind)
+		}
+
+		err = s.Remove("gone")
+		if err != nil {
+			t.Fatalf("TestStoreRemoveRename() %s: remove failed: err: %q", kind, err)
+		}
+		if _, err := s.Stat("gone/index.txt"); !os.IsNotExist(err) {
+			t.Fatalf("TestStoreRemoveRename() %s: removed child survived: %v", kind, err)
+		}
+		if err := s.Remove("gone"); !os.IsNotExist(err) {
+			t.Fatalf("TestStoreRemoveRename() %s: second remove returned %v", kind, err)
+		}
+		if err := s.Remove(""); err != ErrRoot {
+			t.Fatalf("TestStoreRemoveRename() %s: removing the root returned %v", kind, err)
+		}
+
+		if fi, _ := s.Stat(""); fi.ModTime().Equal(root.ModTime()) && kind != "local" {
+			t.Fatalf("TestStoreRemoveRename() %s: root mod time unchanged", kind)
+		}
+	})
+}
+
+func TestStoreWatch(t *testing.T) {
+	t.Parallel()
+	withStores(t, "TestStoreWatch", func(t *testing.T, kind string, s Store) {
+		WriteFile(s, "a/index.txt", []byte("one"))
+
+		stop := make(chan struct{})
+		events := s.Watch("a", stop)
+		// give Local a chance to take its first snapshot
+		time.Sleep(30 * time.Millisecond)
+
+		WriteFile(s, "b/index.txt", []byte("elsewhere"))
+		WriteFile(s, "a/index.txt", []byte("two"))
+
+		timeout := time.After(5 * time.Second)
+		for found := false; !found; {
+			select {
+			case ev := <-events:
+				if !within("a", ev.Name) {
+					t.Fatalf("TestStoreWatch() %s: event outside of a: %v", kind, ev)
+				}
+				found = ev.Op == WRITE && ev.Name == "a/index.txt"
+			case <-timeout:
+				t.Fatalf("TestStoreWatch() %s: no event for a/index.txt", kind)
+			}
+		}
+
+		close(stop)
+		for _ = range events {
+		}
+	})
+}
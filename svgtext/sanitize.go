@@ -0,0 +1,247 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package svgtext
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Report lists what Sanitize removed from a document.
+type Report struct {
+	Removed []string
+}
+
+func (self *Report) add(format string, v ...interface{}) {
+	self.Removed = append(self.Removed, fmt.Sprintf(format, v...))
+}
+
+// Clean reports whether Sanitize left the document untouched.
+func (self *Report) Clean() bool {
+	return len(self.Removed) == 0
+}
+
+func (self *Report) String() string {
+	return strings.Join(self.Removed, "\n")
+}
+
+// forbiddenElements are dropped along with everything inside them.
+var forbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"handler":       true,
+	"listener":      true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"base":          true,
+}
+
+// animationElements can rewrite other elements' attributes, so they are
+// dropped when they target links or event handlers.
+var animationElements = map[string]bool{
+	"set":          true,
+	"animate":      true,
+	"animatecolor": true,
+}
+
+var urlFuncRe = regexp.MustCompile(`(?i)url\s*\(\s*['"]?\s*([^'")\s]*)`)
+var spaceRe = regexp.MustCompile(`[\s\x00]+`)
+
+// dangerousScheme reports whether val, once whitespace is squeezed out as
+// browsers do, names a scriptable URL scheme.
+func dangerousScheme(val string) bool {
+	v := strings.ToLower(spaceRe.ReplaceAllString(val, ""))
+	return strings.Contains(v, "javascript:") ||
+		strings.Contains(v, "vbscript:") ||
+		strings.Contains(v, "expression(")
+}
+
+// externalUrlFunc reports whether val contains a CSS url(...) that points
+// anywhere other than a fragment of this document.
+func externalUrlFunc(val string) bool {
+	for _, m := range urlFuncRe.FindAllStringSubmatch(val, -1) {
+		if !strings.HasPrefix(m[1], "#") {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(val), "@import")
+}
+
+var rasterDataRe = regexp.MustCompile(`(?i)^data:image/(png|gif|jpeg);`)
+var linkRe = regexp.MustCompile(`(?i)^(https?:|mailto:|[^:]*$)`)
+
+// safeHref reports whether an href on element elt is acceptable: fragment
+// references and inline raster images anywhere, plus ordinary links on <a>.
+func safeHref(elt string, val string) bool {
+	v := strings.TrimSpace(val)
+	if strings.HasPrefix(v, "#") || rasterDataRe.MatchString(v) {
+		return true
+	}
+	return elt == "a" && linkRe.MatchString(v) && !dangerousScheme(v)
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;",
+	"\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func qname(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// Sanitize rewrites an SVG document without scripts, event handler
+// attributes, javascript: URLs, external references, or foreignObject
+// content. It returns the cleaned document and a report of what was
+// removed, or an error if data is not well-formed XML.
+func Sanitize(data []byte) ([]byte, *Report, error) {
+	report := &Report{}
+
+	var out bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var stack []string
+	skipDepth := 0   // >0 while inside a dropped element
+	pending := false // a start tag awaits its '>' or '/>'
+	inStyle := false
+
+	closePending := func() {
+		if pending {
+			out.WriteString(">")
+			pending = false
+		}
+	}
+
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			local := strings.ToLower(t.Name.Local)
+			stack = append(stack, qname(t.Name))
+
+			if skipDepth > 0 {
+				skipDepth++
+				continue
+			}
+
+			drop := forbiddenElements[local]
+			if animationElements[local] {
+				for _, attr := range t.Attr {
+					target := strings.ToLower(attr.Value)
+					if attr.Name.Local == "attributeName" && (strings.HasSuffix(target, "href") || strings.HasPrefix(target, "on")) {
+						drop = true
+					}
+				}
+			}
+			if drop {
+				report.add("removed element <%s>", qname(t.Name))
+				skipDepth = 1
+				continue
+			}
+
+			closePending()
+			out.WriteString("<" + qname(t.Name))
+			for _, attr := range t.Attr {
+				name := qname(attr.Name)
+				attrLocal := strings.ToLower(attr.Name.Local)
+				switch {
+				case strings.HasPrefix(attrLocal, "on"):
+					report.add("removed event handler %s on <%s>", name, qname(t.Name))
+					continue
+				case dangerousScheme(attr.Value):
+					report.add("removed scriptable %s on <%s>", name, qname(t.Name))
+					continue
+				case (attrLocal == "href" || attrLocal == "src") && !safeHref(local, attr.Value):
+					report.add("removed external reference %s=%q on <%s>", name, attr.Value, qname(t.Name))
+					continue
+				case externalUrlFunc(attr.Value):
+					report.add("removed external url() in %s on <%s>", name, qname(t.Name))
+					continue
+				}
+				out.WriteString(" " + name + `="`)
+				attrEscaper.WriteString(&out, attr.Value)
+				out.WriteString(`"`)
+			}
+			pending = true
+			inStyle = local == "style"
+
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1] != qname(t.Name) {
+				return nil, nil, fmt.Errorf("svgtext: unexpected </%s>", qname(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+			inStyle = false
+
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+
+			if pending {
+				out.WriteString("/>")
+				pending = false
+			} else {
+				out.WriteString("</" + qname(t.Name) + ">")
+			}
+
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if inStyle && (dangerousScheme(string(t)) || externalUrlFunc(string(t))) {
+				report.add("removed stylesheet with external or scriptable content")
+				continue
+			}
+			closePending()
+			textEscaper.WriteString(&out, string(t))
+
+		case xml.Comment:
+			if skipDepth > 0 {
+				continue
+			}
+			closePending()
+			out.WriteString("<!--")
+			out.Write(bytes.Replace(t, []byte("--"), []byte("- -"), -1))
+			out.WriteString("-->")
+
+		case xml.ProcInst:
+			if skipDepth > 0 {
+				continue
+			}
+			if t.Target != "xml" {
+				report.add("removed processing instruction <?%s?>", t.Target)
+				continue
+			}
+			closePending()
+			out.WriteString("<?xml ")
+			out.Write(t.Inst)
+			out.WriteString("?>")
+
+		case xml.Directive:
+			if skipDepth > 0 {
+				continue
+			}
+			report.add("removed directive <!%s>", strings.SplitN(string(t), " ", 2)[0])
+		}
+	}
+
+	if len(stack) != 0 {
+		return nil, nil, fmt.Errorf("svgtext: unclosed <%s>", stack[len(stack)-1])
+	}
+
+	return out.Bytes(), report, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package svgtext
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeClean(t *testing.T) {
+	t.Parallel()
+	text, err := ioutil.ReadFile(path.Join(svgtextPath, "hades.svg"))
+	if err != nil {
+		t.Fatalf("TestSanitizeClean() failed: unable to read hades.svg: %s", err)
+	}
+
+	clean, report, err := Sanitize(text)
+	if err != nil {
+		t.Fatalf("TestSanitizeClean() failed: unable to sanitize hades.svg: %s", err)
+	}
+	if !report.Clean() {
+		t.Fatalf("TestSanitizeClean() failed: hades.svg reported unsafe:\n%s", report)
+	}
+
+	cdata, err := GetCData(clean)
+	if err != nil {
+		t.Fatalf("TestSanitizeClean() failed: sanitized output does not parse: %s", err)
+	}
+	if !strings.Contains(strings.Join(cdata, "\n"), "browser") {
+		t.Fatalf("TestSanitizeClean() failed: sanitized output lost text 'browser'")
+	}
+	if !strings.Contains(string(clean), `xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape"`) {
+		t.Fatalf("TestSanitizeClean() failed: sanitized output mangled namespaces")
+	}
+}
+
+func TestSanitizeDirty(t *testing.T) {
+	t.Parallel()
+	dirty := `<?xml version="1.0"?>
+<?xml-stylesheet href="http://evil.example/x.css"?>
+<!DOCTYPE svg [<!ENTITY x "y">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)">
+ <script>alert(2)</script>
+ <foreignObject><body xmlns="http://www.w3.org/1999/xhtml"><iframe src="x"/></body></foreignObject>
+ <a xlink:href=" java&#x09;script:alert(3)"><text>bad link</text></a>
+ <a href="../other/"><text>good link</text></a>
+ <image xlink:href="http://evil.example/track.png"/>
+ <use xlink:href="#shape"/>
+ <rect id="shape" fill="url(#grad)" style="fill: url(http://evil.example/)" onClick="x()"/>
+ <set attributeName="xlink:href" to="javascript:alert(4)"/>
+ <style>rect { fill: red }</style>
+ <style>@import url(http://evil.example/x.css);</style>
+</svg>
+`
+	clean, report, err := Sanitize([]byte(dirty))
+	if err != nil {
+		t.Fatalf("TestSanitizeDirty() failed: unable to sanitize: %s", err)
+	}
+	if report.Clean() {
+		t.Fatalf("TestSanitizeDirty() failed: report is clean")
+	}
+
+	out := string(clean)
+	for _, bad := range []string{"alert", "script", "foreignObject", "iframe", "evil.example", "onload", "onClick", "ENTITY", "<set"} {
+		if strings.Contains(out, bad) {
+			t.Fatalf("TestSanitizeDirty() failed: output still contains %q:\n%s", bad, out)
+		}
+	}
+	for _, good := range []string{`href="../other/"`, `xlink:href="#shape"`, `fill="url(#grad)"`, "rect { fill: red }", "good link", "bad link"} {
+		if !strings.Contains(out, good) {
+			t.Fatalf("TestSanitizeDirty() failed: output lost %q:\n%s", good, out)
+		}
+	}
+
+	_, err = GetCData(clean)
+	if err != nil {
+		t.Fatalf("TestSanitizeDirty() failed: sanitized output does not parse: %s", err)
+	}
+}
+
+func TestSanitizeMalformed(t *testing.T) {
+	t.Parallel()
+	_, _, err := Sanitize([]byte(`<svg><g></svg>`))
+	if err == nil {
+		t.Fatalf("TestSanitizeMalformed() failed: mismatched tags accepted")
+	}
+}
@@ -30,6 +30,9 @@ type TemplateEnt struct {
 type TemplateCache struct {
 	HtmlPath string
 	Entries  map[string]TemplateEnt
+	// Funcs are made available to every template; set them before the
+	// first Make().
+	Funcs template.FuncMap
 }
 
 func New(htmlPath string) *TemplateCache {
@@ -179,7 +182,7 @@ func (self *TemplateCache) reread(templateName string, fileName string, fi os.Fi
 
 	text := string(body)
 
-	treeSet, err := parse.Parse(templateName, text, "", "")
+	treeSet, err := parse.Parse(templateName, text, "", "", self.Funcs)
 	L("reread got treeSet: %t, err: %t", treeSet, err)
 	if err != nil {
 		return
@@ -200,7 +203,7 @@ func (self *TemplateCache) reread(templateName string, fileName string, fi os.Fi
 	}
 	L("reread FOUND DEPS: %q", deps)
 
-	htmlTmpl, err := template.New("").Parse("")
+	htmlTmpl, err := template.New("").Funcs(self.Funcs).Parse("")
 	if err != nil {
 		L("reread failed to initialize empty root template: %s", err)
 		return
@@ -0,0 +1,264 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+// Package trash keeps deleted charts for a while, so that they can be
+// restored, before purging them for good.
+//
+// A deleted chart's directory is moved, along with everything beneath it, to
+// ROOT/<id> in its store, beside ROOT/<id>.json, which says where it came
+// from, who deleted it, and when.
+package trash
+
+import (
+	"akamai/atlas/chartfs"
+	"akamai/atlas/store"
+
+	"github.com/golang/glog"
+
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func L(s string, v ...interface{}) {
+	if glog.V(1) {
+		glog.Infof("trash "+s, v...)
+	}
+}
+
+// ROOT is where the trash lives in a store.
+const ROOT = ".trash"
+
+// RETENTION is how long deleted charts are kept by default.
+const RETENTION = 30 * 24 * time.Hour
+
+// ErrExists is returned by attempts to restore a chart over another.
+var ErrExists = errors.New("trash: something already exists there")
+
+// ErrName is returned for names that can't be deleted or restored to: the
+// root and the trash itself.
+var ErrName = errors.New("trash: can't delete or restore to the root or the trash")
+
+// Item is a deleted chart.
+type Item struct {
+	ID      string    `json:"-"`
+	Name    string    `json:"name"` // where the chart was
+	User    string    `json:"user"` // "" for anonymous users
+	Deleted time.Time `json:"deleted"`
+}
+
+// Trash holds the charts deleted from Store.
+type Trash struct {
+	Store     store.Store
+	Retention time.Duration
+
+	mu sync.Mutex
+}
+
+func New(s store.Store) *Trash {
+	return &Trash{
+		Store:     s,
+		Retention: RETENTION,
+	}
+}
+
+// Contains reports whether name lies in the trash.
+func Contains(name string) bool {
+	name = chartfs.Clean(name)
+	return name == ROOT || strings.HasPrefix(name, ROOT+"/")
+}
+
+func itemName(id string) string {
+	return path.Join(ROOT, id)
+}
+
+func metaName(id string) string {
+	return path.Join(ROOT, id+".json")
+}
+
+// Delete moves the chart directory name to the trash on behalf of user.
+func (self *Trash) Delete(name string, user string) (*Item, error) {
+	name = chartfs.Clean(name)
+	if name == "" || Contains(name) {
+		return nil, ErrName
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	fi, err := self.Store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "delete", Path: name, Err: errors.New("not a chart directory")}
+	}
+
+	// ids sort by when their charts were deleted
+	now := time.Now().UTC()
+	id := strconv.FormatInt(now.UnixNano(), 10)
+	for {
+		_, err := self.Store.Stat(metaName(id))
+		if err != nil {
+			break
+		}
+		id += "x"
+	}
+
+	item := &Item{ID: id, Name: name, User: user, Deleted: now}
+	meta, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	err = store.WriteFile(self.Store, metaName(id), meta)
+	if err != nil {
+		return nil, err
+	}
+	err = self.Store.Rename(name, itemName(id))
+	if err != nil {
+		self.Store.Remove(metaName(id))
+		return nil, err
+	}
+	L("Delete(%q): now %s", name, id)
+	return item, nil
+}
+
+// List returns the items in the trash, most recently deleted first.
+func (self *Trash) List() ([]*Item, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.list()
+}
+
+func (self *Trash) list() ([]*Item, error) {
+	fis, err := self.Store.List(ROOT)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*Item
+	for _, fi := range fis {
+		if fi.IsDir() || path.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		item, err := self.get(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			glog.Warningf("trash: skipping %q: %v", fi.Name(), err)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Deleted.After(items[j].Deleted)
+	})
+	return items, nil
+}
+
+// Get returns item id.
+func (self *Trash) Get(id string) (*Item, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.get(id)
+}
+
+func (self *Trash) get(id string) (*Item, error) {
+	if id == "" || strings.Contains(id, "/") || id != chartfs.Clean(id) {
+		return nil, &os.PathError{Op: "get", Path: id, Err: os.ErrNotExist}
+	}
+	meta, err := store.ReadFile(self.Store, metaName(id))
+	if err != nil {
+		return nil, err
+	}
+	_, err = self.Store.Stat(itemName(id))
+	if err != nil {
+		return nil, err
+	}
+
+	item := &Item{}
+	err = json.Unmarshal(meta, item)
+	if err != nil {
+		return nil, err
+	}
+	item.ID = id
+	return item, nil
+}
+
+// Restore moves item id back out of the trash to name, which must not exist.
+func (self *Trash) Restore(id string, name string) (*Item, error) {
+	name = chartfs.Clean(name)
+	if name == "" || Contains(name) {
+		return nil, ErrName
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	item, err := self.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = self.Store.Stat(name)
+	if err == nil {
+		return nil, ErrExists
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = self.Store.Rename(itemName(id), name)
+	if err != nil {
+		return nil, err
+	}
+	err = self.Store.Remove(metaName(id))
+	if err != nil {
+		glog.Errorf("trash: restored %s to %q, but unable to remove its record: %v", id, name, err)
+	}
+	L("Restore(%s): now %q", id, name)
+	return item, nil
+}
+
+// Expires returns when item is due to be purged.
+func (self *Trash) Expires(item *Item) time.Time {
+	return item.Deleted.Add(self.Retention)
+}
+
+// Purge removes for good the items deleted before the retention period,
+// returning them.
+func (self *Trash) Purge() ([]*Item, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	items, err := self.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []*Item
+	cutoff := time.Now().Add(-self.Retention)
+	for _, item := range items {
+		if !item.Deleted.Before(cutoff) {
+			continue
+		}
+		err = self.Store.Remove(itemName(item.ID))
+		if err == nil {
+			err = self.Store.Remove(metaName(item.ID))
+		}
+		if err != nil {
+			return purged, err
+		}
+		L("Purge(): purged %s, once %q", item.ID, item.Name)
+		purged = append(purged, item)
+	}
+	return purged, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package trash
+
+import (
+	"akamai/atlas/store"
+
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "a/index.txt", []byte("% A\n"))
+	store.WriteFile(charts, "a/b/index.txt", []byte("% B\n"))
+	store.WriteFile(charts, "c/index.txt", []byte("% C\n"))
+	trash := New(charts)
+
+	for _, name := range []string{"", "/", ".trash", ".trash/x", "a/index.txt", "nope"} {
+		if _, err := trash.Delete(name, "alice"); err == nil {
+			t.Fatalf("TestTrash() failed: deleted %q", name)
+		}
+	}
+
+	item, err := trash.Delete("/a/", "alice")
+	if err != nil || item.Name != "a" || item.User != "alice" {
+		t.Fatalf("TestTrash() failed: Delete: %+v, %v", item, err)
+	}
+	if _, err := charts.Stat("a/b/index.txt"); !os.IsNotExist(err) {
+		t.Fatalf("TestTrash() failed: deleted chart still there: %v", err)
+	}
+	trash.Delete("c", "")
+
+	items, err := trash.List()
+	if err != nil || len(items) != 2 || items[0].Name != "c" || items[1].ID != item.ID {
+		t.Fatalf("TestTrash() failed: List: %+v, %v", items, err)
+	}
+
+	// restores don't overwrite
+	store.WriteFile(charts, "a/index.txt", []byte("% New A\n"))
+	if _, err := trash.Restore(item.ID, "a"); err != ErrExists {
+		t.Fatalf("TestTrash() failed: restore over a chart returned %v", err)
+	}
+	if _, err := trash.Restore(item.ID, "old/a"); err != nil {
+		t.Fatalf("TestTrash() failed: Restore: %v", err)
+	}
+	if text, _ := store.ReadFile(charts, "old/a/b/index.txt"); string(text) != "% B\n" {
+		t.Fatalf("TestTrash() failed: restored %q", text)
+	}
+	if _, err := trash.Restore(item.ID, "again"); !os.IsNotExist(err) {
+		t.Fatalf("TestTrash() failed: restored twice: %v", err)
+	}
+
+	// items are kept until they expire
+	if purged, err := trash.Purge(); err != nil || len(purged) != 0 {
+		t.Fatalf("TestTrash() failed: purged %+v, %v", purged, err)
+	}
+	trash.Retention = -time.Second
+	if purged, err := trash.Purge(); err != nil || len(purged) != 1 || purged[0].Name != "c" {
+		t.Fatalf("TestTrash() failed: purged %+v, %v", purged, err)
+	}
+	if fis, _ := charts.List(ROOT); len(fis) != 0 {
+		t.Fatalf("TestTrash() failed: purge left %v", fis)
+	}
+}
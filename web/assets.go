@@ -0,0 +1,100 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/bundlecache"
+
+	"github.com/golang/glog"
+
+	"html/template"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// siteScripts are loaded by every page, in order, as site.min.js.
+var siteScripts = []string{
+	"jquery-1.9.0.min.js",
+	"jquery.ba-bbq-1.2.1.min.js",
+	"jquery.autosize-1.15.3.js",
+	"jquery.chosen-0.9.11-12-ga0ca7da.min.js",
+	"searchbox.js",
+	"presence.js",
+	"events.js",
+}
+
+// siteStyles are loaded by every page, after the page's own stylesheet, as
+// site.min.css.
+var siteStyles = []string{
+	"chosen-0.9.11-12-ga0ca7da.css",
+}
+
+// pageStyles are stylesheets that pages share, loaded before the page's own.
+var pageStyles = map[string][]string{
+	"txt_native_editor": {"chart.css"},
+}
+
+// AddBundles defines site.min.js and site.min.css plus a <page>.min.css or
+// <page>.min.js bundle for each page stylesheet or script in StaticFS, and
+// builds them all.
+func (self *App) AddBundles() error {
+	self.BundleCache.Add("site.min.js", siteScripts...)
+	self.BundleCache.Add("site.min.css", siteStyles...)
+
+	shared := map[string]bool{}
+	for _, name := range append(siteScripts, siteStyles...) {
+		shared[name] = true
+	}
+
+	fis, err := self.StaticFS.ReadDir("")
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		ext := path.Ext(name)
+		if fi.IsDir() || (ext != ".css" && ext != ".js") {
+			continue
+		}
+		if shared[name] || strings.Contains(name, ".min.") {
+			continue
+		}
+		page := strings.TrimSuffix(name, ext)
+		if ext == ".css" {
+			self.BundleCache.Add(page+".min"+ext, append(pageStyles[page], name)...)
+		} else {
+			self.BundleCache.Add(page+".min"+ext, name)
+		}
+	}
+
+	glog.Infof("AddBundles(): bundles: %q", self.BundleCache.Names())
+	return self.BundleCache.MakeAll()
+}
+
+// GetAssetUrl returns the fingerprinted URL of the bundle whose name is the
+// concatenation of parts, or "" if there is no such bundle, so that templates
+// can write {{with asset .PageName ".min.js"}}.
+func (self *App) GetAssetUrl(parts ...string) (string, error) {
+	name := strings.Join(parts, "")
+
+	blob, err := self.BundleCache.Make(name)
+	if err == bundlecache.ErrNoBundle {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	u := url.URL{
+		Path:     path.Clean(path.Join("/", self.StaticRoot, name)),
+		RawQuery: url.Values{"v": {blob.Fingerprint()}}.Encode(),
+	}
+	return u.String(), nil
+}
+
+func (self *App) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"asset": self.GetAssetUrl,
+	}
+}
@@ -5,10 +5,10 @@ package web
 import (
 	"akamai/atlas/atom"
 	"akamai/atlas/cfg"
+	"akamai/atlas/precompress"
 
 	"github.com/golang/glog"
 
-	"bytes"
 	"encoding/xml"
 	"net/http"
 	"net/url"
@@ -52,11 +52,17 @@ func (self *App) GetAbsoluteBaseUrl() (*url.URL, error) {
 func HandleSiteAtomGet(self *App, w http.ResponseWriter, r *http.Request) {
 	glog.Infof("HandleSiteAtomGet()")
 
+	self.SiteListCache.Lock()
+	defer self.SiteListCache.Unlock()
+
 	_, err := self.SiteListCache.Make()
 	checkHTTP(err)
 
 	title, _ := cfg.String("atom.title")
-	id := cfg.MustString("atom.id")
+	id, err := cfg.String("atom.id")
+	if err != nil {
+		panic(newHTTPError(http.StatusNotFound, err, "This atlas has no feed; set atom.id to publish one."))
+	}
 
 	baseUrl, err := self.GetAbsoluteBaseUrl()
 	checkHTTP(err)
@@ -69,8 +75,10 @@ func HandleSiteAtomGet(self *App, w http.ResponseWriter, r *http.Request) {
 		ID:      id,
 	}
 
+	readable := self.Readable(r)
+
 	for name, ent := range self.SiteListCache.Entries {
-		if ent.Chart != nil {
+		if ent.Chart != nil && readable(ent.Chart.Slug()) {
 			err = ent.Chart.Read()
 			if err != nil {
 				glog.Errorf("unable to read chart %q, err %q", name, err)
@@ -103,6 +111,29 @@ func HandleSiteAtomGet(self *App, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	for _, ev := range self.SiteListCache.Events {
+		if !readable(ev.Slug) {
+			continue
+		}
+
+		link, err := self.GetSlugUrl(ev.Slug)
+		if err != nil {
+			glog.Errorf("unable to get deleted chart url %q, err %q", ev.Slug, err)
+			continue
+		}
+
+		absLink := baseUrl.ResolveReference(&link)
+
+		feed.Deleted = append(feed.Deleted, &atom.DeletedEntry{
+			Ref:  absLink.String(),
+			When: atom.Time(ev.When),
+		})
+
+		if lastUpdated.Before(ev.When) {
+			lastUpdated = ev.When
+		}
+	}
+
 	sort.Sort(EntriesByDate(feed.Entry))
 
 	feed.Updated = atom.Time(lastUpdated)
@@ -110,5 +141,6 @@ func HandleSiteAtomGet(self *App, w http.ResponseWriter, r *http.Request) {
 	bits, err := xml.Marshal(&feed)
 	checkHTTP(err)
 
-	http.ServeContent(w, r, "atom.xml", lastUpdated, bytes.NewReader(bits))
+	err = precompress.ServeBytes(w, r, "atom.xml", "application/atom+xml", lastUpdated, bits)
+	checkHTTP(err)
 }
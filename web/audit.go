@@ -0,0 +1,214 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/audit"
+	"akamai/atlas/chartfs"
+	"akamai/atlas/store"
+
+	"github.com/golang/glog"
+
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+const ADMIN_ROOT = "/admin"
+const AUDIT_PATH = ADMIN_ROOT + "/audit"
+const AUDIT_EXPORT_PATH = AUDIT_PATH + ".jsonl"
+
+// AUDIT_PAGE_SIZE is how many records the audit page shows by default.
+const AUDIT_PAGE_SIZE = 200
+
+var auditActions = []string{audit.CREATE, audit.SAVE, audit.SYNC, audit.RELOAD, audit.UPLOAD, audit.DELETE, audit.RESTORE, audit.PURGE}
+
+// contentOf returns the content of name, or nil if it can't be read.
+func (self *App) contentOf(name string) []byte {
+	data, err := store.ReadFile(self.Store, name)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// record notes in the audit log that r did action to name, changing its
+// content from before to after. Failures are logged, since the change has
+// already been made.
+func (self *App) record(r *http.Request, name string, action string, before []byte, after []byte) {
+	if self.Audit == nil {
+		return
+	}
+
+	rec := &audit.Record{
+		Addr:   r.RemoteAddr,
+		Path:   chartfs.Clean(name),
+		Action: action,
+		Before: audit.Hash(before),
+		After:  audit.Hash(after),
+	}
+	if user := CurrentUser(r); user != nil {
+		rec.User = user.Name
+	}
+	self.appendRecord(rec)
+}
+
+// appendRecord appends rec to the audit log, if any.
+func (self *App) appendRecord(rec *audit.Record) {
+	if self.Audit == nil {
+		return
+	}
+
+	err := self.Audit.Append(rec)
+	if err != nil {
+		glog.Errorf("appendRecord(): unable to audit %s of %q by %q: %v", rec.Action, rec.Path, rec.User, err)
+	}
+}
+
+type vAuditAction struct {
+	Name     string
+	Selected bool
+}
+
+type vAudit struct {
+	*vRoot
+	Filter    *audit.Filter
+	Since     string
+	Until     string
+	Actions   []vAuditAction
+	Records   []*audit.Record
+	More      bool
+	Shown     int
+	ExportUrl string
+}
+
+type vHistory struct {
+	*vRoot
+	Name    string
+	FileUrl string
+	Records []*audit.Record
+	More    bool
+	Shown   int
+}
+
+// parseAuditTime accepts dates and RFC 3339 times. Dates given as until
+// include the whole day.
+func parseAuditTime(s string, until bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		if until {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// auditFilter reads a filter from r's query.
+func auditFilter(r *http.Request) *audit.Filter {
+	q := r.URL.Query()
+	filter := &audit.Filter{
+		User:   q.Get("user"),
+		Path:   q.Get("path"),
+		Action: q.Get("action"),
+	}
+
+	var err error
+	filter.Since, err = parseAuditTime(q.Get("since"), false)
+	if err == nil {
+		filter.Until, err = parseAuditTime(q.Get("until"), true)
+	}
+	if err != nil {
+		panic(newHTTPError(http.StatusBadRequest, err, "Give since and until as YYYY-MM-DD or RFC 3339 times."))
+	}
+	return filter
+}
+
+func (self *App) HandleAuditGet(w http.ResponseWriter, r *http.Request) {
+	if self.Audit == nil {
+		panic(errNotFound())
+	}
+	filter := auditFilter(r)
+
+	limit := AUDIT_PAGE_SIZE
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+
+	recs, err := self.Audit.Query(filter, limit+1)
+	checkHTTP(err)
+
+	more := len(recs) > limit
+	if more {
+		recs = recs[:limit]
+	}
+
+	var actions []vAuditAction
+	for _, action := range auditActions {
+		actions = append(actions, vAuditAction{action, action == filter.Action})
+	}
+
+	export := url.URL{Path: AUDIT_EXPORT_PATH, RawQuery: r.URL.RawQuery}
+	view := &vAudit{
+		vRoot:     newVRoot(self, "audit", "Audit Log", "", ""),
+		Filter:    filter,
+		Since:     r.URL.Query().Get("since"),
+		Until:     r.URL.Query().Get("until"),
+		Actions:   actions,
+		Records:   recs,
+		More:      more,
+		Shown:     len(recs),
+		ExportUrl: export.String(),
+	}
+	self.renderTemplate(w, "audit", view)
+}
+
+// HandleAuditExportGet serves the records matching the filter as JSON lines,
+// oldest first.
+func (self *App) HandleAuditExportGet(w http.ResponseWriter, r *http.Request) {
+	if self.Audit == nil {
+		panic(errNotFound())
+	}
+	filter := auditFilter(r)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	err := self.Audit.Export(w, filter)
+	if err != nil {
+		glog.Errorf("HandleAuditExportGet(): export failed: %v", err)
+	}
+}
+
+// HandleHistoryGet shows the changes recorded to a file, without the
+// addresses they came from.
+func (self *App) HandleHistoryGet(w http.ResponseWriter, r *http.Request) {
+	if self.Audit == nil {
+		panic(errNotFound())
+	}
+
+	name := ChartName(r)
+
+	// one more than a page tells whether there are more
+	recs, err := self.Audit.Query(&audit.Filter{Path: name, Exact: true}, AUDIT_PAGE_SIZE+1)
+	checkHTTP(err)
+
+	more := len(recs) > AUDIT_PAGE_SIZE
+	if more {
+		recs = recs[:AUDIT_PAGE_SIZE]
+	}
+
+	view := &vHistory{
+		vRoot:   newVRoot(self, "history", "History of "+name, "", ""),
+		Name:    name,
+		FileUrl: path.Dir(path.Clean(r.URL.Path)),
+		Records: recs,
+		More:    more,
+		Shown:   len(recs),
+	}
+	self.renderTemplate(w, "history", view)
+}
@@ -4,10 +4,16 @@ package web
 
 import (
 	"akamai/atlas/chart"
+	"akamai/atlas/htmlsafe"
+	"akamai/atlas/presence"
+	"akamai/atlas/store"
+	"akamai/atlas/svgtext"
 
 	"github.com/golang/glog"
 	"github.com/russross/blackfriday"
 
+	"bytes"
+	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
@@ -21,11 +27,15 @@ type vChart struct {
 	FullPath  string
 	Url       string
 	EditorUrl url.URL
+	DeleteUrl string // "" for the root chart, which can't be deleted
 	Html      template.HTML
 }
 
 func (self *App) GetChartUrl(chart *chart.Chart) (url.URL, error) {
-	slug := chart.Slug()
+	return self.GetSlugUrl(chart.Slug())
+}
+
+func (self *App) GetSlugUrl(slug string) (url.URL, error) {
 	url := url.URL{}
 	if slug != "" {
 		url.Path = path.Clean(path.Join("/", self.ChartsRoot, slug)) + "/"
@@ -35,85 +45,72 @@ func (self *App) GetChartUrl(chart *chart.Chart) (url.URL, error) {
 	return url, nil
 }
 
+// RenderChartHtml renders a chart body to HTML, passing any raw HTML it
+// contains through self.HtmlPolicy.
+func (self *App) RenderChartHtml(body string) []byte {
+	htmlFlags := 0
+	//htmlFlags |= blackfriday.HTML_USE_XHTML
+	htmlFlags |= blackfriday.HTML_TOC
+
+	htmlRenderer := htmlsafe.NewRenderer(blackfriday.HtmlRenderer(htmlFlags, "", ""), self.HtmlPolicy)
+
+	extFlags := 0
+	extFlags |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
+	extFlags |= blackfriday.EXTENSION_TABLES
+	extFlags |= blackfriday.EXTENSION_FENCED_CODE
+	extFlags |= blackfriday.EXTENSION_AUTOLINK
+	extFlags |= blackfriday.EXTENSION_STRIKETHROUGH
+	extFlags |= blackfriday.EXTENSION_SPACE_HEADERS
+
+	return blackfriday.Markdown([]byte(body), htmlRenderer, extFlags)
+}
+
 func (self *App) HandleChartPost(w http.ResponseWriter, r *http.Request) {
-	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.ChartsRoot)
-	checkHTTP(err)
-	glog.Infof("HandleChartPost(): fp: %v\n", fp)
+	name := ChartName(r)
+	glog.Infof("HandleChartPost(): name: %v\n", name)
 
-	if strings.HasPrefix(fp, "resumes/") {
-		self.HandleResumePost(w, r)
+	if !strings.HasPrefix(name, "resumes/") {
+		panic(errMethod("GET", "HEAD"))
 	}
+	self.HandleResumePost(w, r)
 }
 
 func (self *App) HandleChartGet(w http.ResponseWriter, r *http.Request) {
 	chartUrl := path.Clean(r.URL.Path)
 	glog.Infof("HandleChartGet(): chartUrl: %v\n", chartUrl)
 
-	fullPath := path.Join(self.ChartsPath, chartUrl)
-
-	if chartUrl == "/atom.xml" {
-		switch r.Method {
-		default:
-			panic("method")
-		case "GET":
-			HandleSiteAtomGet(self, w, r)
-		}
-		return
-	}
+	fullPath := ChartName(r)
 
-	if chartUrl == "/site.json" {
-		switch r.Method {
-		default:
-			panic("method")
-		case "GET":
-			HandleSiteJsonGet(self, w, r)
-		}
-		return
-	}
-
-	if chartUrl == "/pages" {
-		switch r.Method {
-		default:
-			panic("method")
-		case "GET":
-			HandleChartSetGet(self, w, r)
+	// site views used to live among the charts; send old links on unless
+	// a chart has taken their place
+	if to, ok := legacySiteViews[chartUrl]; ok {
+		if _, err := self.Store.Stat(fullPath); os.IsNotExist(err) {
+			http.Redirect(w, r, to, http.StatusMovedPermanently)
+			return
 		}
-		return
 	}
 
 	// anyway, assuming it's a chart, find the index.txt
-	fi, err := os.Stat(fullPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		} else {
-			checkHTTP(err)
-		}
-	}
+	fi, err := self.Store.Stat(fullPath)
+	checkHTTP(err)
 
 	if !fi.IsDir() {
 		fp3 := fullPath
+		if self.SanitizeSvg && path.Ext(fp3) == ".svg" {
+			self.serveSanitizedSvg(w, r, fp3, fi)
+			return
+		}
+		content, err := store.ReadFile(self.Store, fp3)
+		checkHTTP(err)
 		// BUG(mistone): don't set Content-Type blindly; also need to check Accept header
 		// BUG(mistone): do we really want to sniff mime-types here?
-		http.ServeFile(w, r, fp3)
+		w.Header().Set("ETag", etagOf(versionOf(content)))
+		http.ServeContent(w, r, path.Base(fp3), fi.ModTime(), bytes.NewReader(content))
 		return
 	} else {
-		txtFile := "index.txt"
-		name := path.Join(fullPath, txtFile)
-		if _, err := os.Stat(name); os.IsNotExist(err) {
-			txtFile = "index.text"
-			name = path.Join(fullPath, txtFile)
-			_, err = os.Stat(name)
-			if err != nil && os.IsNotExist(err) {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			} else {
-				checkHTTP(err)
-			}
-		}
-
-		chart := chart.NewChart(name, self.ChartsPath)
+		chart, err := chart.Resolve(self.Store, fullPath)
+		checkHTTP(err)
+		txtFile := path.Base(chart.Src())
 
 		err = chart.Read()
 		checkHTTP(err)
@@ -125,22 +122,7 @@ func (self *App) HandleChartGet(w http.ResponseWriter, r *http.Request) {
 		// attempt to parse header lines
 		meta := chart.Meta()
 
-		htmlFlags := 0
-		//htmlFlags |= blackfriday.HTML_USE_XHTML
-		htmlFlags |= blackfriday.HTML_TOC
-		htmlFlags |= blackfriday.HTML_SKIP_HTML // disable script tags!
-
-		htmlRenderer := blackfriday.HtmlRenderer(htmlFlags, "", "")
-
-		extFlags := 0
-		extFlags |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
-		extFlags |= blackfriday.EXTENSION_TABLES
-		extFlags |= blackfriday.EXTENSION_FENCED_CODE
-		extFlags |= blackfriday.EXTENSION_AUTOLINK
-		extFlags |= blackfriday.EXTENSION_STRIKETHROUGH
-		extFlags |= blackfriday.EXTENSION_SPACE_HEADERS
-
-		html := blackfriday.Markdown([]byte(chart.Body()), htmlRenderer, extFlags)
+		html := self.RenderChartHtml(chart.Body())
 		view := &vChart{
 			vRoot: newVRoot(self, "chart", meta.Title, meta.Authors, meta.Date),
 			//Url:          chartUrl.String(),
@@ -149,55 +131,52 @@ func (self *App) HandleChartGet(w http.ResponseWriter, r *http.Request) {
 			Html:      template.HTML(html),
 			EditorUrl: editorUrl,
 		}
+		view.PresenceUrl = path.Join(path.Dir(editorUrl.Path), "presence")
+		view.PresenceAction = presence.VIEWING
+		view.CSRFToken = self.csrfToken(w, r)
+		view.EventsUrl = chartEventsUrl(chart.Slug())
+		if chart.Slug() != "" {
+			view.DeleteUrl = path.Join(path.Dir(editorUrl.Path), "delete")
+		}
 
 		self.renderTemplate(w, "chart", view)
 	}
 }
 
-func (self *App) HandleChart(w http.ResponseWriter, r *http.Request) {
-	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.ChartsRoot)
+// HandleRawGet serves the source of a file as plain text, so that even
+// drawings and pages can be read without being rendered.
+func (self *App) HandleRawGet(w http.ResponseWriter, r *http.Request) {
+	name := ChartName(r)
+
+	fi, err := self.Store.Stat(name)
 	checkHTTP(err)
-	glog.Infof("HandleChart: file path: %v", fp)
+	if fi.IsDir() {
+		panic(errNotFound())
+	}
 
-	base := path.Base(fp)
-	ext := path.Ext(path.Dir(fp))
+	content, err := store.ReadFile(self.Store, name)
+	checkHTTP(err)
 
-	glog.Infof("HandleChart: base: %s, ext: %s", base, ext)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etagOf(versionOf(content)))
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(content))
+}
 
-	isSvgEditor := (base == "editor") && (ext == ".svg")
-	isTxtEditor := (base == "editor") && ((ext == ".txt") || (ext == ".text"))
+// serveSanitizedSvg serves an SVG written before saves were sanitized, minus
+// any unsafe content it may contain.
+func (self *App) serveSanitizedSvg(w http.ResponseWriter, r *http.Request, svgPath string, fi os.FileInfo) {
+	svgBody, err := store.ReadFile(self.Store, svgPath)
+	checkHTTP(err)
 
-	if isSvgEditor {
-		switch r.Method {
-		default:
-			panic("method")
-		case "GET":
-			self.HandleSvgEditorGet(w, r)
-		case "POST":
-			self.HandleSvgEditorPost(w, r)
-		}
-		return
+	clean, report, err := svgtext.Sanitize(svgBody)
+	if err != nil {
+		panic(newHTTPError(http.StatusInternalServerError, fmt.Errorf("malformed svg %q: %w", svgPath, err), "This drawing is malformed, so it can't be shown."))
 	}
-
-	if isTxtEditor {
-		switch r.Method {
-		default:
-			panic("method")
-		case "GET":
-			self.HandleTxtEditorGet(w, r)
-		case "POST":
-			self.HandleTxtEditorPost(w, r)
-		}
-		return
+	if !report.Clean() {
+		glog.Warningf("serveSanitizedSvg(): sanitized %q:\n%s", svgPath, report)
 	}
 
-	switch r.Method {
-	default:
-		panic("method")
-	case "GET":
-		self.HandleChartGet(w, r)
-	case "POST":
-		self.HandleChartPost(w, r)
-	}
-	return
+	w.Header().Set("Content-Type", "image/svg+xml")
+	http.ServeContent(w, r, path.Base(svgPath), fi.ModTime(), bytes.NewReader(clean))
 }
@@ -44,11 +44,16 @@ func HandleChartSetGet(self *App, w http.ResponseWriter, r *http.Request) {
 
 	var charts vChartLinkList = nil
 
+	self.SiteListCache.Lock()
+	defer self.SiteListCache.Unlock()
+
 	_, err := self.SiteListCache.Make()
 	checkHTTP(err)
 
+	readable := self.Readable(r)
+
 	for name, ent := range self.SiteListCache.Entries {
-		if ent.Chart != nil {
+		if ent.Chart != nil && readable(ent.Chart.Slug()) {
 			err = ent.Chart.Read()
 			if err != nil {
 				glog.Infof("HandleChartSetGet(): warning: unable to read chart %q err %v", name, err)
@@ -0,0 +1,65 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/auth"
+
+	"github.com/golang/glog"
+
+	"net/http"
+	"net/url"
+)
+
+// isSafeMethod reports whether requests with method change nothing.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// checkCSRF refuses state-changing requests that don't carry a token from
+// one of our pages. It reports whether it has answered r.
+func (self *App) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return false
+	}
+	if r.Header.Get(auth.CSRF_HEADER) == "" {
+		parseForm(r)
+	}
+	err := self.CSRF.Check(r)
+	if err != nil {
+		glog.Warningf("checkCSRF(): refusing %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		self.renderError(w, r, errForbidden("The form token is missing or stale; reload the page and try again."))
+		return true
+	}
+	return false
+}
+
+// csrfToken returns the token for forms on the page answering r.
+func (self *App) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	token, err := self.CSRF.Token(w, r)
+	checkHTTP(err)
+	return token
+}
+
+// sameOrigin reports whether r's Origin, or failing that its Referer, names
+// the host r was sent to. Requests with neither fail.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Referer()
+	}
+	u, err := url.Parse(source)
+	if source == "" || err != nil {
+		return false
+	}
+
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = fwd
+	}
+	return u.Host == host
+}
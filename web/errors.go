@@ -0,0 +1,215 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/chartfs"
+	"akamai/atlas/store"
+
+	"github.com/golang/glog"
+
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// MAX_BODY_SIZE bounds request bodies, uploads included.
+const MAX_BODY_SIZE = 32 << 20
+
+// MAX_FORM_MEMORY bounds how much of a multipart form is held in memory; the
+// rest of it goes to temporary files.
+const MAX_FORM_MEMORY = 1 << 20
+
+// HTTPError is an error that knows how to answer the request that caused it.
+// Handlers raise them with checkHTTP or panic; recoverHTTP renders them.
+type HTTPError struct {
+	Code int
+
+	// Message is shown to the user. Err, which may hold internal details
+	// such as paths, is only logged.
+	Message string
+	Err     error
+
+	// Allow lists the methods to offer in answer to StatusMethodNotAllowed.
+	Allow []string
+}
+
+func (self *HTTPError) Error() string {
+	if self.Err != nil {
+		return fmt.Sprintf("%d %s: %v", self.Code, self.Message, self.Err)
+	}
+	return fmt.Sprintf("%d %s", self.Code, self.Message)
+}
+
+func newHTTPError(code int, err error, format string, v ...interface{}) *HTTPError {
+	return &HTTPError{
+		Code:    code,
+		Message: fmt.Sprintf(format, v...),
+		Err:     err,
+	}
+}
+
+func errNotFound() *HTTPError {
+	return newHTTPError(http.StatusNotFound, nil, "There is nothing here.")
+}
+
+// errMethod refuses a method, offering those in allow instead.
+func errMethod(allow ...string) *HTTPError {
+	e := newHTTPError(http.StatusMethodNotAllowed, nil, "This page only supports %s.", strings.Join(allow, ", "))
+	e.Allow = allow
+	return e
+}
+
+func errBadRequest(format string, v ...interface{}) *HTTPError {
+	return newHTTPError(http.StatusBadRequest, nil, format, v...)
+}
+
+// errLoginRequired refuses anonymous users what they might do once logged in.
+func errLoginRequired() *HTTPError {
+	return newHTTPError(http.StatusUnauthorized, nil, "Log in first.")
+}
+
+func errForbidden(format string, v ...interface{}) *HTTPError {
+	return newHTTPError(http.StatusForbidden, nil, format, v...)
+}
+
+// errPreconditionRequired refuses saves that don't say which version they
+// replace.
+func errPreconditionRequired() *HTTPError {
+	return newHTTPError(http.StatusPreconditionRequired, nil, "Saves must say which version they replace, with If-Match.")
+}
+
+func errTooLarge() *HTTPError {
+	return newHTTPError(http.StatusRequestEntityTooLarge, nil, "That is too large; the limit is %d bytes.", MAX_BODY_SIZE)
+}
+
+// errBadGateway reports that a service atlas relies on, such as etherpad,
+// failed.
+func errBadGateway(err error, format string, v ...interface{}) *HTTPError {
+	return newHTTPError(http.StatusBadGateway, err, format, v...)
+}
+
+// etherpadFailed reports a failed or unexpected etherpad API call, with
+// details for the log.
+func etherpadFailed(format string, v ...interface{}) *HTTPError {
+	return errBadGateway(fmt.Errorf(format, v...), "The chart editor service is unavailable; try again shortly.")
+}
+
+// checkEtherpad raises errBadGateway for errors talking to etherpad.
+func checkEtherpad(err error) {
+	if err != nil {
+		panic(errBadGateway(err, "The chart editor service is unavailable; try again shortly."))
+	}
+}
+
+// asHTTPError classifies err, hiding the details of errors not meant for
+// users behind a generic message.
+func asHTTPError(err error) *HTTPError {
+	var he *HTTPError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &he):
+		return he
+	case errors.As(err, &tooLarge):
+		return errTooLarge()
+	case os.IsNotExist(err) || errors.Is(err, chartfs.ErrEscape):
+		e := errNotFound()
+		e.Err = err
+		return e
+	case errors.Is(err, store.ErrRoot):
+		return newHTTPError(http.StatusBadRequest, err, "That can't be done to the root.")
+	}
+	return newHTTPError(http.StatusInternalServerError, err, "Something went wrong; the details have been logged.")
+}
+
+type vError struct {
+	*vRoot
+	Code       int
+	StatusText string
+	Message    string
+}
+
+// renderError answers r with e, on an error page when the templates allow.
+func (self *App) renderError(w http.ResponseWriter, r *http.Request, e *HTTPError) {
+	if e.Code == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", strings.Join(e.Allow, ", "))
+	}
+
+	if self.TemplateCache != nil {
+		if _, err := self.TemplateCache.Make("error"); err == nil {
+			view := &vError{
+				vRoot:      newVRoot(self, "error", http.StatusText(e.Code), "", ""),
+				Code:       e.Code,
+				StatusText: http.StatusText(e.Code),
+				Message:    e.Message,
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(e.Code)
+			err = self.TemplateCache.Entries["error"].Template.ExecuteTemplate(w, "error", view)
+			if err != nil {
+				glog.Errorf("renderError(): unable to render error page: %v", err)
+			}
+			return
+		}
+	}
+	http.Error(w, e.Message, e.Code)
+}
+
+// recoverHTTP answers requests whose handlers panicked. Nothing a request
+// does may stop the server, so it catches everything.
+func (self *App) recoverHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if rec == http.ErrAbortHandler {
+		// net/http quietly drops the connection for us
+		panic(rec)
+	}
+
+	var e *HTTPError
+	switch err := rec.(type) {
+	case error:
+		e = asHTTPError(err)
+	default:
+		e = newHTTPError(http.StatusInternalServerError, fmt.Errorf("%v", err), "Something went wrong; the details have been logged.")
+	}
+
+	if e.Code >= http.StatusInternalServerError {
+		glog.Errorf("error: %v, req: %s %s", e, r.Method, r.URL)
+		if e.Code == http.StatusInternalServerError {
+			debug.PrintStack()
+		}
+	} else {
+		glog.Infof("error: %v, req: %s %s", e, r.Method, r.URL)
+	}
+	self.renderError(w, r, e)
+}
+
+// isMultipart reports whether r's body is a multipart form.
+func isMultipart(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "multipart/form-data"
+}
+
+// parseForm parses r's form, multipart or not, raising errTooLarge for
+// oversized bodies.
+func parseForm(r *http.Request) {
+	var err error
+	if isMultipart(r) {
+		err = r.ParseMultipartForm(MAX_FORM_MEMORY)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			panic(errTooLarge())
+		}
+		panic(errBadRequest("The form is malformed."))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/acl"
+	"akamai/atlas/chartfs"
+	"akamai/atlas/events"
+	"akamai/atlas/trash"
+
+	"github.com/golang/glog"
+
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const EVENTS_PATH = SITE_ROOT + "/events"
+
+// EVENTS_PING is how often quiet event streams send a comment, so that
+// proxies don't take them for dead.
+const EVENTS_PING = 30 * time.Second
+
+// EVENTS_RETRY is how long browsers wait to reconnect dropped streams.
+const EVENTS_RETRY = 5 * time.Second
+
+// SITE_SETTLE is how long changes must pause before pages are told to
+// refresh their lists of charts and search indexes.
+const SITE_SETTLE = time.Second
+
+// chartEventsUrl returns where the page of the chart slug follows changes.
+func chartEventsUrl(slug string) string {
+	return EVENTS_PATH + "?" + url.Values{"chart": {slug}}.Encode()
+}
+
+// WatchCharts publishes the changes to Store until stop is closed: each as a
+// CHART event, and each burst of them as a SITE event, since the caches of
+// the chart list and search index are stale until they are next made.
+func (self *App) WatchCharts(stop <-chan struct{}) {
+	changes := self.Store.Watch("", stop)
+
+	settle := time.NewTimer(SITE_SETTLE)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			if change.Name == "" || trash.Contains(change.Name) {
+				continue
+			}
+			self.Events.Publish(events.Event{Kind: events.CHART, Chart: events.Slug(change.Name), Name: change.Name})
+			settle.Reset(SITE_SETTLE)
+		case <-settle.C:
+			self.Events.Publish(events.Event{Kind: events.SITE})
+		}
+	}
+}
+
+// HandleEventsGet streams Server-Sent Events: SITE events always and, given
+// ?chart=<slug>, the CHART events of that chart.
+func (self *App) HandleEventsGet(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		checkHTTP(fmt.Errorf("HandleEventsGet(): %T can't stream", w))
+	}
+
+	slugs, watching := r.URL.Query()["chart"]
+	slug := ""
+	if watching {
+		slug = chartfs.Clean(slugs[0])
+		if slug != "" {
+			slug += "/"
+		}
+		if !self.Allow(w, r, slug, acl.READ) {
+			return
+		}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	evs := self.Events.Subscribe(stop)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", EVENTS_RETRY/time.Millisecond)
+	flusher.Flush()
+
+	ping := time.NewTicker(EVENTS_PING)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case ev := <-evs:
+			if ev.Kind == events.CHART && (!watching || ev.Chart != slug) {
+				continue
+			}
+			_, err = ev.WriteTo(w)
+		}
+		if err != nil {
+			glog.Infof("HandleEventsGet(): stream to %s ended: %v", r.RemoteAddr, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
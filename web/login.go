@@ -0,0 +1,198 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/acl"
+	"akamai/atlas/auth"
+
+	"github.com/golang/glog"
+
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const LOGIN_PATH = "/login"
+const LOGOUT_PATH = "/logout"
+
+// OIDC_CALLBACK_PATH is where the identity provider returns users to; the
+// oidc.redirect_url config key must name it.
+const OIDC_CALLBACK_PATH = "/login/callback"
+
+type userKey struct{}
+
+type vLogin struct {
+	*vRoot
+	Next  string
+	Error string
+}
+
+// CurrentUser returns the user logged in by r, or nil.
+func CurrentUser(r *http.Request) *auth.User {
+	user, _ := r.Context().Value(userKey{}).(*auth.User)
+	return user
+}
+
+// Author returns the name to credit for changes made by r.
+func (self *App) Author(r *http.Request) string {
+	user := CurrentUser(r)
+	if user == nil {
+		return ""
+	}
+	return user.Author()
+}
+
+// authEnabled reports whether anyone must log in, by password or single
+// sign-on.
+func (self *App) authEnabled() bool {
+	return self.Auth != nil || self.OIDC != nil
+}
+
+// authenticate attaches r's user, if any, to r.
+func (self *App) authenticate(r *http.Request) *http.Request {
+	user := self.Sessions.Lookup(r)
+	if user != nil {
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+	}
+	return r
+}
+
+// Rules returns the access rules in force.
+func (self *App) Rules() *acl.Rules {
+	if self.ACL != nil {
+		rules, err := self.ACL.Rules()
+		checkHTTP(err)
+		return rules
+	}
+	if !self.authEnabled() {
+		return acl.OPEN
+	}
+	return acl.NewRules(acl.DEFAULT, nil)
+}
+
+// Allow reports whether r's user holds perm on name. If not, it answers r:
+// anonymous visitors are sent to log in, and everyone else is refused.
+func (self *App) Allow(w http.ResponseWriter, r *http.Request, name string, perm acl.Perm) bool {
+	user := CurrentUser(r)
+	if self.Rules().Allowed(user, name, perm) {
+		return true
+	}
+
+	glog.Infof("Allow(): denied %v on %q to %v", perm, name, user)
+	switch {
+	case user != nil:
+		self.renderError(w, r, errForbidden("You may not do that here."))
+	case r.Method == "GET" || r.Method == "HEAD":
+		q := url.Values{"next": {r.URL.RequestURI()}}
+		http.Redirect(w, r, LOGIN_PATH+"?"+q.Encode(), http.StatusSeeOther)
+	default:
+		self.renderError(w, r, errLoginRequired())
+	}
+	return false
+}
+
+// Readable returns a predicate reporting which chart slugs r's user may read.
+func (self *App) Readable(r *http.Request) func(slug string) bool {
+	user := CurrentUser(r)
+	rules := self.Rules()
+	if rules.ReadsAll(user) {
+		return func(string) bool { return true }
+	}
+	return func(slug string) bool {
+		return rules.Allowed(user, slug, acl.READ)
+	}
+}
+
+// safeNext returns next if it names a page on this site, or the charts root.
+func (self *App) safeNext(next string) string {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+	return path.Clean(self.ChartsRoot + "/")
+}
+
+// HandleLoginGet shows the login form or, with single sign-on, sends the
+// browser to the identity provider.
+func (self *App) HandleLoginGet(w http.ResponseWriter, r *http.Request) {
+	if !self.authEnabled() {
+		panic(errNotFound())
+	}
+	next := self.safeNext(r.FormValue("next"))
+
+	if self.OIDC != nil {
+		authUrl, err := self.OIDC.Begin(w, r, next)
+		checkHTTP(err)
+		http.Redirect(w, r, authUrl, http.StatusSeeOther)
+		return
+	}
+
+	view := &vLogin{
+		vRoot: newVRoot(self, "login", "Log In", "", ""),
+		Next:  next,
+	}
+	view.CSRFToken = self.csrfToken(w, r)
+	self.renderTemplate(w, "login", view)
+}
+
+// HandleOIDCCallbackGet logs in the user the identity provider vouches for.
+func (self *App) HandleOIDCCallbackGet(w http.ResponseWriter, r *http.Request) {
+	if self.OIDC == nil {
+		panic(errNotFound())
+	}
+	user, next, err := self.OIDC.Finish(w, r)
+	if err != nil {
+		panic(newHTTPError(http.StatusUnauthorized, fmt.Errorf("failed login from %s: %w", r.RemoteAddr, err), "Login failed."))
+	}
+
+	err = self.Sessions.Start(w, r, user)
+	checkHTTP(err)
+
+	glog.Infof("HandleOIDCCallbackGet(): %q logged in from %s, groups %q", user.Name, r.RemoteAddr, user.Groups)
+	http.Redirect(w, r, self.safeNext(next), http.StatusSeeOther)
+}
+
+// HandleLogoutPost ends r's session. Like every POST, it needs a form token,
+// so other sites can't log users out.
+func (self *App) HandleLogoutPost(w http.ResponseWriter, r *http.Request) {
+	if !self.authEnabled() {
+		panic(errNotFound())
+	}
+	self.Sessions.End(w, r)
+	http.Redirect(w, r, path.Clean(self.ChartsRoot+"/"), http.StatusSeeOther)
+}
+
+func (self *App) HandleLoginPost(w http.ResponseWriter, r *http.Request) {
+	if self.Auth == nil {
+		if !self.authEnabled() {
+			panic(errNotFound())
+		}
+		panic(errMethod("GET", "HEAD"))
+	}
+
+	name := r.FormValue("name")
+	next := self.safeNext(r.FormValue("next"))
+
+	user, err := self.Auth.Authenticate(name, r.FormValue("password"))
+	if err != nil {
+		glog.Warningf("HandleLoginPost(): failed login for %q from %s: %v", name, r.RemoteAddr, err)
+		view := &vLogin{
+			vRoot: newVRoot(self, "login", "Log In", "", ""),
+			Next:  next,
+			Error: "Unknown user name or wrong password.",
+		}
+		view.CSRFToken = self.csrfToken(w, r)
+		w.WriteHeader(http.StatusUnauthorized)
+		self.renderTemplate(w, "login", view)
+		return
+	}
+
+	err = self.Sessions.Start(w, r, user)
+	checkHTTP(err)
+
+	glog.Infof("HandleLoginPost(): %q logged in from %s", user.Name, r.RemoteAddr)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
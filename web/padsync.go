@@ -0,0 +1,118 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/audit"
+	"akamai/atlas/chartfs"
+	"akamai/atlas/padsync"
+
+	"github.com/golang/glog"
+
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+type vPadSync struct {
+	State   string    `json:"state"`
+	Rev     int       `json:"rev"`
+	Head    int       `json:"head"`
+	Edited  time.Time `json:"edited"`
+	Saved   time.Time `json:"saved"`
+	Version string    `json:"version"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// newPadSync returns a Syncer saving the pads of self's charts after quiet.
+func (self *App) newPadSync(quiet time.Duration) *padsync.Syncer {
+	syncer := padsync.New(self.Etherpad, self.Store, self.syncPad)
+	syncer.Quiet = quiet
+	return syncer
+}
+
+// syncPad writes text, synced from the pad editing txtName, over the chart,
+// unless a save has replaced base, the chart the pad last matched, since.
+func (self *App) syncPad(txtName string, base []byte, text string) error {
+	defer self.lockSave(txtName)()
+	before := self.contentOf(txtName)
+	if !bytes.Equal(before, base) {
+		return padsync.ErrChanged
+	}
+
+	txtFile, err := self.TxtEditFile(txtName)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(txtFile, text)
+	if err != nil {
+		txtFile.Abort()
+		return err
+	}
+	err = txtFile.Close()
+	if err != nil {
+		return err
+	}
+
+	self.appendRecord(&audit.Record{
+		Path:   chartfs.Clean(txtName),
+		Action: audit.SYNC,
+		Before: audit.Hash(before),
+		After:  audit.Hash([]byte(text)),
+	})
+	return nil
+}
+
+// trackPad has PadSync, if any, sync txtName with padName from revision rev,
+// or from wherever it was if rev is negative.
+func (self *App) trackPad(txtName string, padName string, rev int) {
+	if self.PadSync == nil {
+		return
+	}
+	err := self.PadSync.Track(txtName, padName, rev)
+	if err != nil {
+		glog.Errorf("trackPad(): unable to track %q: %v", txtName, err)
+	}
+}
+
+// HandlePadSyncGet answers with the sync status of a chart's pad, which the
+// etherpad editor polls to say whether edits are saved yet.
+func (self *App) HandlePadSyncGet(w http.ResponseWriter, r *http.Request) {
+	if self.PadSync == nil || self.nativeTxtEditor() {
+		panic(errNotFound())
+	}
+
+	txtName := ChartName(r)
+
+	// pads are tracked from opening the editor, not from asking about them
+	status, found := self.PadSync.Status(txtName)
+	if !found {
+		panic(errNotFound())
+	}
+
+	view := &vPadSync{
+		State:   status.State,
+		Rev:     status.Rev,
+		Head:    status.Head,
+		Edited:  status.Edited,
+		Saved:   status.Saved,
+		Version: versionOf(status.Base),
+		Error:   status.Error,
+	}
+	bits, err := json.Marshal(view)
+	checkHTTP(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(bits)
+}
+
+// syncStatus returns the sync status of txtName's pad, if PadSync tracks it.
+func (self *App) syncStatus(txtName string) (padsync.Status, bool) {
+	if self.PadSync == nil {
+		return padsync.Status{}, false
+	}
+	return self.PadSync.Status(txtName)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/etherpad"
+	"akamai/atlas/presence"
+
+	"github.com/golang/glog"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// MAX_TAB_SIZE bounds the ids pages name themselves by in heartbeats.
+const MAX_TAB_SIZE = 64
+
+type vPresence struct {
+	Visitors []presence.Visitor `json:"visitors"`
+}
+
+// presenceName returns the chart text named by the presence URL of r.
+func (self *App) presenceName(r *http.Request) string {
+	return ChartName(r)
+}
+
+// HandlePresenceGet lists who is viewing or editing a chart.
+func (self *App) HandlePresenceGet(w http.ResponseWriter, r *http.Request) {
+	txtName := self.presenceName(r)
+	self.renderPresence(w, r, txtName, self.Presence.Visitors(txtName, ""))
+}
+
+// HandlePresencePost records a heartbeat from a page showing a chart, which
+// names itself with a tab id and says whether it is an editor, and lists who
+// else is there. Pages being closed post action "leave".
+func (self *App) HandlePresencePost(w http.ResponseWriter, r *http.Request) {
+	txtName := self.presenceName(r)
+
+	parseForm(r)
+	tab := r.FormValue("tab")
+	if tab == "" || len(tab) > MAX_TAB_SIZE {
+		panic(errBadRequest("Heartbeats need a tab id of at most %d bytes.", MAX_TAB_SIZE))
+	}
+
+	visitor := presence.Visitor{Name: self.Author(r)}
+	switch action := r.FormValue("action"); action {
+	case presence.VIEWING, presence.EDITING:
+		visitor.Action = action
+	case "leave":
+		self.Presence.Leave(txtName, tab)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		panic(errBadRequest("Unknown presence action %q.", action))
+	}
+	self.Presence.Beat(txtName, tab, visitor)
+
+	// your other pages aren't someone else
+	var others []presence.Visitor
+	for _, v := range self.Presence.Visitors(txtName, tab) {
+		if v.Name == "" || v.Name != visitor.Name {
+			others = append(others, v)
+		}
+	}
+	self.renderPresence(w, r, txtName, others)
+}
+
+// renderPresence answers with visitors of txtName, plus whoever is in its pad
+// without an atlas page open.
+func (self *App) renderPresence(w http.ResponseWriter, r *http.Request, txtName string, visitors []presence.Visitor) {
+	if !self.nativeTxtEditor() && self.Etherpad != nil {
+		visitors = self.addPadUsers(r, txtName, visitors)
+	}
+	if visitors == nil {
+		visitors = []presence.Visitor{}
+	}
+
+	bits, err := json.Marshal(&vPresence{Visitors: visitors})
+	checkHTTP(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(bits)
+}
+
+// addPadUsers adds the users connected to txtName's pad to visitors, as
+// editors, unless they are among them already.
+func (self *App) addPadUsers(r *http.Request, txtName string, visitors []presence.Visitor) []presence.Visitor {
+	users, err := self.Etherpad.PadUsers(r.Context(), padFor(txtName))
+	if errors.Is(err, etherpad.ErrNoPad) {
+		return visitors
+	}
+	if err != nil {
+		glog.Errorf("addPadUsers(): unable to list the users of %q's pad: %v", txtName, err)
+		return visitors
+	}
+
+	known := map[string]bool{self.Author(r): true}
+	for _, v := range visitors {
+		known[v.Name] = true
+	}
+	for _, user := range users {
+		if user.Name != "" && known[user.Name] {
+			continue
+		}
+		visitors = append(visitors, presence.Visitor{Name: user.Name, Action: presence.EDITING, Seen: time.Now()})
+	}
+	presence.Sort(visitors)
+	return visitors
+}
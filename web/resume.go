@@ -3,72 +3,121 @@
 package web
 
 import (
+	"akamai/atlas/audit"
 	"akamai/atlas/chart"
 	"akamai/atlas/resumes"
+	"akamai/atlas/store"
 
 	"github.com/golang/glog"
 
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 )
 
+// RESUME_FIELD is the field of multipart uploads that holds the resume.
+const RESUME_FIELD = "resume"
+
+// HandleResumePost makes a chart of the resume posted to resumes/<name>.<ext>,
+// either as the whole body or as the RESUME_FIELD file of a multipart form.
 func (self *App) HandleResumePost(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.ChartsRoot)
-	checkHTTP(err)
-	glog.Infof("HandleResumePost(): fp: %v\n", fp)
-
-	ext := path.Ext(fp)
-
-	switch ext {
-	default:
-		glog.Fatalf("HandleResumePost(): bad ext: %q", ext)
-	case ".doc":
-		break
-	case ".docx":
-		break
-	case ".pdf":
-		break
+	name := ChartName(r)
+	glog.Infof("HandleResumePost(): name: %v\n", name)
+
+	ext := path.Ext(name)
+
+	_, err := self.Resumes.Plan(strings.ToLower(ext), ".pdf")
+	if errors.Is(err, resumes.ErrNoTool) {
+		panic(newHTTPError(http.StatusServiceUnavailable, err, "This atlas can't convert %q resumes yet.", ext))
+	}
+	if err != nil {
+		usable, _ := self.Resumes.Inputs(".pdf")
+		panic(errBadRequest("Resumes must be %s files, not %q.", strings.Join(usable, ", "), ext))
 	}
 
-	// BUG(mistone): other name validation?
-	dstPath := path.Join(self.ChartsPath, fp, "upload"+ext)
-	dstDir := path.Dir(dstPath)
+	// The converters shell out to tools that need real files, so convert
+	// in a scratch directory and copy the resulting chart into the store.
+	tmpDir, err := ioutil.TempDir("", "atlas-resume")
+	checkHTTP(err)
+	defer os.RemoveAll(tmpDir)
 
+	dstDir := filepath.Join(tmpDir, "chart")
 	err = os.MkdirAll(dstDir, 0755)
 	checkHTTP(err)
 
+	dstPath := filepath.Join(dstDir, "upload"+ext)
 	dstFile, err := os.Create(dstPath)
 	checkHTTP(err)
 	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, r.Body)
+	upload := io.Reader(r.Body)
+	if isMultipart(r) {
+		parseForm(r)
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, err := r.FormFile(RESUME_FIELD)
+		if err != nil {
+			panic(newHTTPError(http.StatusBadRequest, err, "Multipart uploads must hold the resume in a %q field.", RESUME_FIELD))
+		}
+		defer file.Close()
+		upload = file
+	}
+
+	_, err = io.Copy(dstFile, upload)
+	checkHTTP(err)
+	err = dstFile.Close()
 	checkHTTP(err)
 
-	displayName := resumes.SimplifyName(path.Base(fp[:len(fp)-len(ext)]))
+	chartName := path.Join(name, "index.txt")
 
-	glog.Infof("HandleResumePost(): attempting to convert: %q -> %q", dstPath, dstDir)
-	err = resumes.Convert(dstPath, dstDir, displayName)
+	// like resumes.Convert, leave existing charts be and just keep the upload
+	_, err = self.Store.Stat(chartName)
+	if err != nil {
+		displayName := resumes.SimplifyName(path.Base(name[:len(name)-len(ext)]))
+
+		glog.Infof("HandleResumePost(): attempting to convert: %q -> %q", dstPath, dstDir)
+		report, err := self.Resumes.Convert(r.Context(), dstPath, dstDir, displayName)
+		glog.Infof("HandleResumePost(): %s", report)
+		if err != nil {
+			// the report, with its commands and paths, stays in the log
+			var failed []string
+			for _, step := range report.Failed() {
+				failed = append(failed, step.Name)
+			}
+			if len(failed) == 0 {
+				panic(newHTTPError(http.StatusUnprocessableEntity, err, "Unable to convert the resume."))
+			}
+			panic(newHTTPError(http.StatusUnprocessableEntity, err, "Unable to convert the resume; these steps failed: %s.", strings.Join(failed, ", ")))
+		}
+	}
+
+	uploadName := path.Join(name, "upload"+ext)
+	before := self.contentOf(uploadName)
+
+	err = store.CopyIn(self.Store, name, dstDir)
 	checkHTTP(err)
 
-	chartName := path.Join(dstDir, "index.txt")
-	chart := chart.NewChart(chartName, self.ChartsPath)
+	self.record(r, uploadName, audit.UPLOAD, before, self.contentOf(uploadName))
+
+	chart := chart.NewChart(self.Store, chartName)
 
 	if !chart.IsChart() {
-		glog.Fatalf("HandleResumePost(): missing chart: %q", chartName)
+		panic(fmt.Errorf("HandleResumePost(): conversion made no chart %q", chartName))
 	}
 
 	err = chart.Read()
-	if err != nil {
-		glog.Fatalf("HandleResumePost(): bad chart: %q", chartName)
-	}
+	checkHTTP(err)
 
 	link, err := self.GetChartUrl(chart)
+	checkHTTP(err)
 
-	if err == nil {
-		http.Redirect(w, r, link.String(), http.StatusSeeOther)
-	}
+	http.Redirect(w, r, link.String(), http.StatusSeeOther)
 }
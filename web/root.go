@@ -14,6 +14,15 @@ type vRoot struct {
 	Date       string
 	StaticUrl  string
 	ChartsRoot string
+	CSRFToken  string
+
+	// PresenceUrl, if set, is where the page reports that it is
+	// PresenceAction its chart, and learns who else is.
+	PresenceUrl    string
+	PresenceAction string
+
+	// EventsUrl is where the page follows changes to the atlas.
+	EventsUrl string
 }
 
 func newVRoot(self *App, pageName string, title string, authors string, date string) *vRoot {
@@ -24,6 +33,7 @@ func newVRoot(self *App, pageName string, title string, authors string, date str
 		Date:       date,
 		StaticUrl:  self.StaticRoot,
 		ChartsRoot: path.Clean(self.ChartsRoot + "/"),
+		EventsUrl:  EVENTS_PATH,
 	}
 }
 
@@ -0,0 +1,338 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/acl"
+	"akamai/atlas/chartfs"
+	"akamai/atlas/store"
+	"akamai/atlas/trash"
+
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SITE_ROOT is the namespace of the views of the whole site, kept apart so
+// that they can't collide with charts.
+const SITE_ROOT = "/_"
+
+// legacySiteViews maps where the site views used to live to where they live
+// now. Old links are redirected unless a chart has since taken the name.
+var legacySiteViews = map[string]string{
+	"/pages":     SITE_ROOT + "/pages",
+	"/atom.xml":  SITE_ROOT + "/atom.xml",
+	"/site.json": SITE_ROOT + "/site.json",
+}
+
+// Route maps requests to a handler.
+//
+// Site routes match Path exactly or, if Prefix is set, Path and everything
+// beneath it. Chart routes, those with empty Path, match charts and their
+// files; those with an Action match instead the URLs formed by appending
+// "/"+Action to a file with one of Exts, or with any extension if Exts is
+// nil.
+type Route struct {
+	Name    string
+	Methods []string
+	Path    string
+	Prefix  bool
+	Action  string
+	Exts    []string
+
+	// Perm is needed on the chart or file, or on the root for site routes,
+	// before Handler is called.
+	Perm acl.Perm
+
+	Doc     string
+	Handler func(w http.ResponseWriter, r *http.Request)
+}
+
+func (self *Route) matchPath(p string) bool {
+	if p == self.Path {
+		return true
+	}
+	return self.Prefix && strings.HasPrefix(p, strings.TrimSuffix(self.Path, "/")+"/")
+}
+
+func (self *Route) matchAction(fp string) bool {
+	if path.Base(fp) != self.Action || path.Dir(fp) == "." {
+		return false
+	}
+	ext := path.Ext(path.Dir(fp))
+	if self.Exts == nil {
+		return ext != ""
+	}
+	for _, e := range self.Exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Route) allows(method string) bool {
+	for _, m := range self.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Router is a route table. Site routes and reserved namespaces are consulted
+// first; what remains beneath ChartsRoot goes to the chart routes.
+type Router struct {
+	ChartsRoot string
+
+	// Namespaces are reserved to the site. Paths in them never reach the
+	// chart routes, so no chart can be made or viewed there.
+	Namespaces []string
+
+	Routes []*Route
+}
+
+// Reserved reports whether URL path p lies in a reserved namespace.
+func (self *Router) Reserved(p string) bool {
+	p = path.Clean("/" + p)
+	for _, ns := range self.Namespaces {
+		ns = path.Clean("/" + ns)
+		if p == ns || strings.HasPrefix(p, ns+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// chartName returns the chart path named by URL path p.
+func (self *Router) chartName(p string) (string, bool) {
+	root := path.Clean("/" + self.ChartsRoot)
+	switch {
+	case p == root:
+		return "", true
+	case root == "/":
+		return p[1:], true
+	case strings.HasPrefix(p, root+"/"):
+		return p[len(root)+1:], true
+	}
+	return "", false
+}
+
+// pick returns the route among candidates allowing r's method, or the error
+// to answer r with.
+func pick(r *http.Request, candidates []*Route) (*Route, error) {
+	if len(candidates) == 0 {
+		return nil, errNotFound()
+	}
+
+	seen := map[string]bool{}
+	var allow []string
+	for _, route := range candidates {
+		if route.allows(r.Method) {
+			return route, nil
+		}
+		for _, m := range route.Methods {
+			if !seen[m] {
+				seen[m] = true
+				allow = append(allow, m)
+			}
+		}
+	}
+	sort.Strings(allow)
+	return nil, errMethod(allow...)
+}
+
+// Match finds the route for r and the chart or file it concerns.
+func (self *Router) Match(r *http.Request) (*Route, string, error) {
+	p := path.Clean("/" + r.URL.Path)
+
+	var candidates []*Route
+	for _, route := range self.Routes {
+		if route.Path != "" && route.matchPath(p) {
+			candidates = append(candidates, route)
+		}
+	}
+	if len(candidates) > 0 || self.Reserved(p) {
+		route, err := pick(r, candidates)
+		return route, "", err
+	}
+
+	fp, ok := self.chartName(p)
+	if !ok {
+		return nil, "", errNotFound()
+	}
+
+	for _, route := range self.Routes {
+		if route.Path == "" && route.Action != "" && route.matchAction(fp) {
+			candidates = append(candidates, route)
+		}
+	}
+	if len(candidates) > 0 {
+		route, err := pick(r, candidates)
+		return route, path.Dir(fp), err
+	}
+
+	for _, route := range self.Routes {
+		if route.Path == "" && route.Action == "" {
+			candidates = append(candidates, route)
+		}
+	}
+	route, err := pick(r, candidates)
+	return route, fp, err
+}
+
+// routes returns the route table of self.
+func (self *App) routes() *Router {
+	editorExts := []string{".svg", ".txt", ".text"}
+	get := []string{"GET", "HEAD"}
+
+	router := &Router{
+		ChartsRoot: self.ChartsRoot,
+		Namespaces: []string{self.StaticRoot, SITE_ROOT, ADMIN_ROOT, LOGIN_PATH, LOGOUT_PATH, path.Join("/", self.ChartsRoot, trash.ROOT)},
+	}
+	router.Routes = []*Route{
+		{Name: "static", Methods: get, Path: self.StaticRoot, Prefix: true,
+			Doc: "scripts, styles and other static files", Handler: self.HandleStatic},
+
+		{Name: "pages", Methods: get, Path: SITE_ROOT + "/pages",
+			Doc: "list of charts", Handler: self.handlerFunc(HandleChartSetGet)},
+		{Name: "atom", Methods: get, Path: SITE_ROOT + "/atom.xml",
+			Doc: "Atom feed of chart changes", Handler: self.handlerFunc(HandleSiteAtomGet)},
+		{Name: "site.json", Methods: get, Path: SITE_ROOT + "/site.json",
+			Doc: "search index", Handler: self.handlerFunc(HandleSiteJsonGet)},
+
+		{Name: "events", Methods: get, Path: EVENTS_PATH,
+			Doc: "changes to the site, or with ?chart=<slug> to a chart too, as Server-Sent Events", Handler: self.HandleEventsGet},
+
+		{Name: "login", Methods: get, Path: LOGIN_PATH,
+			Doc: "login form, or single sign-on", Handler: self.HandleLoginGet},
+		{Name: "login", Methods: []string{"POST"}, Path: LOGIN_PATH,
+			Doc: "password login", Handler: self.HandleLoginPost},
+		{Name: "login callback", Methods: get, Path: OIDC_CALLBACK_PATH,
+			Doc: "return from the identity provider", Handler: self.HandleOIDCCallbackGet},
+		{Name: "logout", Methods: []string{"POST"}, Path: LOGOUT_PATH,
+			Doc: "end the session", Handler: self.HandleLogoutPost},
+
+		{Name: "audit", Methods: get, Path: AUDIT_PATH, Perm: acl.ADMIN,
+			Doc: "audit log", Handler: self.HandleAuditGet},
+		{Name: "audit export", Methods: get, Path: AUDIT_EXPORT_PATH, Perm: acl.ADMIN,
+			Doc: "audit log as JSON lines", Handler: self.HandleAuditExportGet},
+		{Name: "trash", Methods: get, Path: TRASH_PATH, Perm: acl.ADMIN,
+			Doc: "deleted charts", Handler: self.HandleTrashGet},
+		{Name: "trash", Methods: []string{"POST"}, Path: TRASH_PATH, Perm: acl.ADMIN,
+			Doc: "restore a deleted chart", Handler: self.HandleTrashPost},
+		{Name: "routes", Methods: get, Path: ROUTES_PATH, Perm: acl.ADMIN,
+			Doc: "this table", Handler: self.HandleRoutesGet},
+
+		{Name: "svg editor", Methods: get, Action: "editor", Exts: []string{".svg"}, Perm: acl.EDIT,
+			Doc: "edit a drawing, creating it if need be", Handler: self.HandleSvgEditorGet},
+		{Name: "svg editor", Methods: []string{"POST"}, Action: "editor", Exts: []string{".svg"}, Perm: acl.EDIT,
+			Doc: "save a drawing", Handler: self.HandleSvgEditorPost},
+		{Name: "txt editor", Methods: get, Action: "editor", Exts: editorExts[1:], Perm: acl.EDIT,
+			Doc: "edit a chart, creating it if need be", Handler: self.HandleTxtEditorGet},
+		{Name: "txt editor", Methods: []string{"POST"}, Action: "editor", Exts: editorExts[1:], Perm: acl.EDIT,
+			Doc: "save or reload a chart", Handler: self.HandleTxtEditorPost},
+		{Name: "pad sync", Methods: get, Action: "sync", Exts: editorExts[1:], Perm: acl.EDIT,
+			Doc: "whether a chart's pad is saved yet, as JSON", Handler: self.HandlePadSyncGet},
+		{Name: "presence", Methods: get, Action: "presence", Exts: editorExts[1:], Perm: acl.READ,
+			Doc: "who is viewing or editing a chart, as JSON", Handler: self.HandlePresenceGet},
+		{Name: "presence", Methods: []string{"POST"}, Action: "presence", Exts: editorExts[1:], Perm: acl.READ,
+			Doc: "heartbeat from a page showing a chart", Handler: self.HandlePresencePost},
+		{Name: "delete", Methods: get, Action: "delete", Exts: editorExts[1:], Perm: acl.ADMIN,
+			Doc: "ask whether to move a chart to the trash", Handler: self.HandleDeleteGet},
+		{Name: "delete", Methods: []string{"POST"}, Action: "delete", Exts: editorExts[1:], Perm: acl.ADMIN,
+			Doc: "move a chart, and those beneath it, to the trash", Handler: self.HandleDeletePost},
+		{Name: "raw", Methods: get, Action: "raw", Perm: acl.READ,
+			Doc: "a file's source, as plain text", Handler: self.HandleRawGet},
+		{Name: "history", Methods: get, Action: "history", Perm: acl.READ,
+			Doc: "changes made to a file", Handler: self.HandleHistoryGet},
+
+		{Name: "chart", Methods: get, Perm: acl.READ,
+			Doc: "a chart, or a file of one", Handler: self.HandleChartGet},
+		{Name: "resume upload", Methods: []string{"POST"}, Perm: acl.UPLOAD,
+			Doc: "convert a resume into a chart", Handler: self.HandleChartPost},
+	}
+	return router
+}
+
+// handlerFunc adapts the site view handlers, which take the App first.
+func (self *App) handlerFunc(h func(*App, http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(self, w, r)
+	}
+}
+
+type nameKey struct{}
+
+// ChartName returns the chart or file, relative to ChartsRoot, that the route
+// table matched r to: the one whose permissions were checked. Handlers must
+// use it rather than work the name out again from r's URL.
+func ChartName(r *http.Request) string {
+	name, _ := r.Context().Value(nameKey{}).(string)
+	return name
+}
+
+// route answers r with the handler the route table chooses.
+func (self *App) route(w http.ResponseWriter, r *http.Request) {
+	route, name, err := self.Router.Match(r)
+	checkHTTP(err)
+
+	name = chartfs.Clean(name)
+	if route.Perm != 0 && !self.Allow(w, r, name, route.Perm) {
+		return
+	}
+	// a link may lead into a subtree with rules of its own
+	if real, err := store.Real(self.Store, name); route.Perm != 0 && err == nil && real != name && !self.Allow(w, r, real, route.Perm) {
+		return
+	}
+	route.Handler(w, r.WithContext(context.WithValue(r.Context(), nameKey{}, name)))
+}
+
+const ROUTES_PATH = ADMIN_ROOT + "/routes"
+
+type vRoute struct {
+	Name    string
+	Methods string
+	Pattern string
+	Perm    string
+	Doc     string
+}
+
+type vRoutes struct {
+	*vRoot
+	Namespaces []string
+	Routes     []vRoute
+}
+
+// HandleRoutesGet shows the route table.
+func (self *App) HandleRoutesGet(w http.ResponseWriter, r *http.Request) {
+	chartsRoot := strings.TrimSuffix(path.Clean("/"+self.ChartsRoot), "/")
+
+	view := &vRoutes{
+		vRoot:      newVRoot(self, "routes", "Routes", "", ""),
+		Namespaces: self.Router.Namespaces,
+	}
+	for _, route := range self.Router.Routes {
+		pattern := route.Path
+		switch {
+		case route.Path != "" && route.Prefix:
+			pattern = strings.TrimSuffix(route.Path, "/") + "/..."
+		case route.Action != "" && route.Exts == nil:
+			pattern = chartsRoot + "/.../file.*/" + route.Action
+		case route.Action != "":
+			pattern = chartsRoot + "/.../file{" + strings.Join(route.Exts, ",") + "}/" + route.Action
+		case route.Path == "":
+			pattern = chartsRoot + "/..."
+		}
+		view.Routes = append(view.Routes, vRoute{
+			Name:    route.Name,
+			Methods: strings.Join(route.Methods, ", "),
+			Pattern: pattern,
+			Perm:    route.Perm.String(),
+			Doc:     route.Doc,
+		})
+	}
+	self.renderTemplate(w, "routes", view)
+}
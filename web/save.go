@@ -0,0 +1,85 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/store"
+
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"unicode/utf8"
+)
+
+// checkedFile holds what is written to a chart file until Close, which
+// writes it only if check accepts it. Otherwise, or if anything fails on the
+// way, the file is left as it was.
+type checkedFile struct {
+	w     store.Writer
+	buf   bytes.Buffer
+	check func([]byte) error
+	done  bool
+}
+
+func newCheckedFile(w store.Writer, check func([]byte) error) *checkedFile {
+	return &checkedFile{w: w, check: check}
+}
+
+func (self *checkedFile) Write(p []byte) (int, error) {
+	return self.buf.Write(p)
+}
+
+func (self *checkedFile) Close() error {
+	if self.done {
+		return nil
+	}
+	self.done = true
+
+	err := self.check(self.buf.Bytes())
+	if err == nil {
+		_, err = self.w.Write(self.buf.Bytes())
+	}
+	if err != nil {
+		self.w.Abort()
+		return err
+	}
+	return self.w.Close()
+}
+
+func (self *checkedFile) Abort() error {
+	if self.done {
+		return nil
+	}
+	self.done = true
+	return self.w.Abort()
+}
+
+// checkTxt accepts chart texts, which must be UTF-8.
+func checkTxt(data []byte) error {
+	if !utf8.Valid(data) {
+		return errBadRequest("Charts must be UTF-8 text.")
+	}
+	return nil
+}
+
+// checkSvg accepts drawings, which must be well-formed XML.
+func checkSvg(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	root := false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF && root {
+			return nil
+		}
+		if err == io.EOF {
+			return errBadRequest("Drawings must have a root element.")
+		}
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, err, "Drawings must be well-formed XML.")
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			root = true
+		}
+	}
+}
@@ -3,17 +3,82 @@
 package web
 
 import (
+	"akamai/atlas/precompress"
+	"akamai/atlas/sitejsoncache"
+
 	"github.com/golang/glog"
 
-	"bytes"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// HandleSiteJsonGet serves the search index. Plain requests receive the whole
+// slug -> text map; requests carrying ?since=<version> receive a
+// sitejsoncache.Delta. Either way, the X-Atlas-Version header names the
+// version the response brings the client up to. Charts and drawings the viewer
+// may not read are left out, and listed as removed in deltas; once the ACL
+// changes, every client is sent a full copy.
 func HandleSiteJsonGet(self *App, w http.ResponseWriter, r *http.Request) {
 	glog.Infof("HandleSiteJsonGet(): start")
 
+	self.SiteJsonCache.Lock()
+	defer self.SiteJsonCache.Unlock()
+
 	_, err := self.SiteJsonCache.Make()
 	checkHTTP(err)
 
-	http.ServeContent(w, r, "site.json", self.SiteJsonCache.ModTime, bytes.NewReader(self.SiteJsonCache.Json))
+	// clients may hold charts they can no longer read
+	rules := self.Rules()
+	if gen := rules.Gen(); gen != self.aclGen {
+		self.SiteJsonCache.Reset()
+		self.aclGen = gen
+	}
+
+	version := strconv.FormatInt(self.SiteJsonCache.Version, 10)
+	w.Header().Set("X-Atlas-Version", version)
+
+	readable := self.Readable(r)
+	readsAll := rules.ReadsAll(CurrentUser(r))
+
+	sinceStr := r.URL.Query().Get("since")
+	if sinceStr == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+		if readsAll {
+			self.SiteJsonCache.Blob.Serve(w, r, "site.json", "application/json")
+			return
+		}
+
+		entries := map[string]sitejsoncache.Ent{}
+		for slug, ent := range self.SiteJsonCache.Entries {
+			if readable(slug) {
+				entries[slug] = ent.Filter(readable)
+			}
+		}
+		bits, err := json.Marshal(entries)
+		checkHTTP(err)
+
+		err = precompress.ServeBytes(w, r, "site.json", "application/json", self.SiteJsonCache.ModTime, bits)
+		checkHTTP(err)
+		return
+	}
+
+	since, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil {
+		panic(newHTTPError(http.StatusBadRequest, err, "Give since as a version from X-Atlas-Version."))
+	}
+
+	delta := self.SiteJsonCache.Delta(since)
+	if !readsAll {
+		delta = delta.Filter(readable)
+	}
+	glog.Infof("HandleSiteJsonGet(): delta since %d -> %d: full %t, changed %d, removed %d", since, delta.Version, delta.Full, len(delta.Changed), len(delta.Removed))
+
+	bits, err := json.Marshal(delta)
+	checkHTTP(err)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	err = precompress.ServeBytes(w, r, "site.json", "application/json", time.Time{}, bits)
+	checkHTTP(err)
 }
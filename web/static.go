@@ -3,16 +3,83 @@
 package web
 
 import (
+	"akamai/atlas/acl"
+	"akamai/atlas/bundlecache"
+	"akamai/atlas/staticcache"
+
 	"github.com/golang/glog"
+
 	"net/http"
+	"net/url"
 	"path"
 )
 
-// BUG(mistone): HandleStatic() directory traversal?
+// STATIC_MAX_AGE is how long browsers may cache fingerprinted static URLs.
+const STATIC_MAX_AGE = "public, max-age=31536000"
 
 func (self *App) HandleStatic(w http.ResponseWriter, r *http.Request) {
 	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.StaticRoot)
 	checkHTTP(err)
 	glog.Infof("HandleStatic: file path: %v", fp)
-	http.ServeFile(w, r, path.Join(self.StaticPath, fp))
+
+	// Bundles hold only the site's own scripts and styles, which even the
+	// login page needs; anything else in StaticPath is for readers.
+	blob, err := self.BundleCache.Make(fp)
+	if err == bundlecache.ErrNoBundle {
+		if !self.Allow(w, r, "", acl.READ) {
+			return
+		}
+		blob, err = self.StaticCache.Make(fp)
+	}
+	if err == staticcache.ErrUncacheable {
+		self.serveStaticFile(w, r, fp)
+		return
+	}
+	checkHTTP(err)
+
+	// Fingerprinted URLs (see GetStaticUrl, GetAssetUrl) never change meaning, so they
+	// may be cached indefinitely; anything else must be revalidated.
+	if v := r.URL.Query().Get("v"); v != "" && v == blob.Fingerprint() {
+		w.Header().Set("Cache-Control", STATIC_MAX_AGE)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	blob.Serve(w, r, fp, "")
+}
+
+// serveStaticFile serves an asset too large to cache straight from StaticFS.
+// Directories are not listed.
+func (self *App) serveStaticFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := self.StaticFS.Open(name)
+	checkHTTP(err)
+	defer f.Close()
+
+	fi, err := f.Stat()
+	checkHTTP(err)
+	if fi.IsDir() {
+		panic(errNotFound())
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, path.Base(name), fi.ModTime(), f)
+}
+
+// GetStaticUrl returns the URL of the static asset name, fingerprinted with
+// a hash of its current contents when it is cacheable.
+func (self *App) GetStaticUrl(name string) (url.URL, error) {
+	u := url.URL{
+		Path: path.Clean(path.Join("/", self.StaticRoot, name)),
+	}
+
+	blob, err := self.StaticCache.Make(name)
+	if err == staticcache.ErrUncacheable {
+		return u, nil
+	}
+	if err != nil {
+		return u, err
+	}
+
+	u.RawQuery = url.Values{"v": {blob.Fingerprint()}}.Encode()
+	return u, nil
 }
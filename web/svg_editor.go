@@ -3,6 +3,10 @@
 package web
 
 import (
+	"akamai/atlas/audit"
+	"akamai/atlas/store"
+	"akamai/atlas/svgtext"
+
 	"github.com/golang/glog"
 
 	"bytes"
@@ -11,49 +15,73 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
-	"strings"
 	"time"
 )
 
-func (self *App) SvgEditFile(svgName string) (*os.File, error) {
-	if strings.HasPrefix(svgName, "..") {
-		panic(fmt.Sprintf("SvgEditFile(): directory traversal: %s", svgName))
+// SvgEditFile opens the drawing svgName for writing. What is written
+// replaces the drawing at Close if it is well-formed XML; Abort, or any
+// failure, leaves the drawing as it was.
+func (self *App) SvgEditFile(svgName string) (store.Writer, error) {
+	glog.Infof("SvgEditFile(): got svg name: %s", svgName)
+	w, err := self.Store.Create(svgName)
+	if err != nil {
+		return nil, err
 	}
-
-	svgDir := path.Dir(svgName)
-	glog.Infof("SvgEditFile(): got svg dir: %s", svgDir)
-
-	realSvgDir := path.Join(self.ChartsPath, svgDir)
-	err := os.MkdirAll(realSvgDir, 0755)
-	checkHTTP(err)
-
-	realSvgName := path.Join(self.ChartsPath, svgName)
-	return os.Create(realSvgName)
+	return newCheckedFile(w, checkSvg), nil
 }
 
-// BUG(mistone): XSS Safety for SVG editor?
+// HandleSvgEditorPost saves a drawing posted by svg-edit. Drawings that are
+// not well-formed or that contain scripts, event handlers, or external
+// references are rejected with a report of the offending content.
 func (self *App) HandleSvgEditorPost(w http.ResponseWriter, r *http.Request) {
-	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.ChartsRoot)
-	checkHTTP(err)
-
-	svgName := path.Clean(path.Dir(fp))
+	svgName := ChartName(r)
 	glog.Infof("HandleSvgEditorPost(): got svg: %s", svgName)
 
+	// svg-edit saves by XHR, which always says where it comes from
+	if !sameOrigin(r) {
+		glog.Warningf("HandleSvgEditorPost(): refusing cross-origin save of %s from %q", svgName, r.Header.Get("Origin"))
+		panic(errForbidden("Drawings can only be saved from this site's editor."))
+	}
+
+	parseForm(r)
 	svgBodyB64 := r.FormValue("filepath")
 	glog.Infof("HandleSvgEditorPost(): got svg body b64: %s", svgBodyB64)
 
-	reader := base64.NewDecoder(base64.StdEncoding, bytes.NewBufferString(svgBodyB64))
+	svgBody, err := base64.StdEncoding.DecodeString(svgBodyB64)
+	if err != nil {
+		panic(newHTTPError(http.StatusBadRequest, err, "The drawing is not valid base64."))
+	}
+
+	_, report, err := svgtext.Sanitize(svgBody)
+	if err != nil {
+		panic(newHTTPError(http.StatusBadRequest, err, "The drawing is not well-formed: %v", err))
+	}
+	if !report.Clean() {
+		glog.Warningf("HandleSvgEditorPost(): rejecting unsafe svg %s from %s:\n%s", svgName, r.RemoteAddr, report)
+		panic(newHTTPError(http.StatusUnprocessableEntity, nil, "The drawing was rejected; it contains unsafe content:\n%s", report))
+	}
+
+	defer self.lockSave(svgName)()
+	before := self.contentOf(svgName)
+	if !checkVersion(r, versionOf(before)) {
+		glog.Infof("HandleSvgEditorPost(): conflicting save of %s by %q", svgName, self.Author(r))
+		w.Header().Set("ETag", etagOf(versionOf(before)))
+		panic(newHTTPError(http.StatusConflict, nil, "Someone else saved this diagram after you opened it, so your changes were not saved. Reload the editor to see theirs, then make your changes again."))
+	}
 
 	svgFile, err := self.SvgEditFile(svgName)
 	checkHTTP(err)
-	defer svgFile.Close()
+	defer svgFile.Abort()
 
-	written, err := io.Copy(svgFile, reader)
+	written, err := io.Copy(svgFile, bytes.NewReader(svgBody))
+	checkHTTP(err)
+	err = svgFile.Close()
 	checkHTTP(err)
 
 	glog.Infof("HandleSvgEditorPost(): wrote %d bytes of svg body", written)
+	self.record(r, svgName, audit.SAVE, before, svgBody)
+	w.Header().Set("ETag", etagOf(versionOf(svgBody)))
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -61,6 +89,7 @@ type vSvgEditor struct {
 	*vRoot
 	SvgEditorUrl     url.URL
 	StaticSvgEditUrl url.URL
+	Version          string
 }
 
 func (self *App) GetSvgEditorUrl() (url.URL, error) {
@@ -80,9 +109,8 @@ func (self *App) GetStaticSvgEditUrl() (url.URL, error) {
 func (self *App) InitializeSvg(svgName string) error {
 	svgFile, err := self.SvgEditFile(svgName)
 	checkHTTP(err)
-	defer svgFile.Close()
 
-	_, err = svgFile.WriteString(`<?xml version="1.0"?>
+	_, err = io.WriteString(svgFile, `<?xml version="1.0"?>
 <svg width="800" height="600" xmlns="http://www.w3.org/2000/svg">
  <metadata id="metadata7">image/svg+xml</metadata>
  <g>
@@ -90,23 +118,22 @@ func (self *App) InitializeSvg(svgName string) error {
  </g>
 </svg>
 `)
-	return err
+	if err != nil {
+		svgFile.Abort()
+		return err
+	}
+	return svgFile.Close()
 }
 
 func (self *App) HandleSvgEditorGet(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("HandleSvgEditorGet(): starting")
 
-	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.ChartsRoot)
-	checkHTTP(err)
-
-	svgName := path.Clean(path.Dir(fp))
+	svgName := ChartName(r)
 	glog.Infof("HandleSvgEditorGet(): handling svgName: %s", svgName)
 
-	realSvgName := path.Join(self.ChartsPath, svgName)
-	_, err = os.Stat(realSvgName)
-	if err != nil && os.IsNotExist(err) {
-		err = self.InitializeSvg(svgName)
-	}
+	self.createMissing(r, svgName, func() error {
+		return self.InitializeSvg(svgName)
+	})
 
 	now := time.Now()
 	date := fmt.Sprintf("%s %0.2d, %d", now.Month().String(), now.Day(), now.Year())
@@ -121,7 +148,9 @@ func (self *App) HandleSvgEditorGet(w http.ResponseWriter, r *http.Request) {
 		vRoot:            newVRoot(self, "svg_editor", "SVG Editor", "Michael Stone", date),
 		SvgEditorUrl:     editorUrl,
 		StaticSvgEditUrl: staticSvgEditUrl,
+		Version:          versionOf(self.contentOf(svgName)),
 	}
+	view.CSRFToken = self.csrfToken(w, r)
 	glog.Infof("HandleSvgEditorGet(): view: %s", view)
 
 	self.renderTemplate(w, "svg_editor", view)
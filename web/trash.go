@@ -0,0 +1,191 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/acl"
+	"akamai/atlas/audit"
+	"akamai/atlas/chartfs"
+	"akamai/atlas/trash"
+
+	"github.com/golang/glog"
+
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const TRASH_PATH = ADMIN_ROOT + "/trash"
+
+// TRASH_PURGE_INTERVAL is how often the trash is checked for charts kept
+// longer than its retention period.
+const TRASH_PURGE_INTERVAL = time.Hour
+
+type vDelete struct {
+	*vRoot
+	Name      string
+	ChartUrl  string
+	Retention string
+}
+
+type vTrashItem struct {
+	*trash.Item
+	Expires time.Time
+	Restore string // where to offer to restore the item to
+	Error   string
+}
+
+type vTrash struct {
+	*vRoot
+	Retention string
+	Items     []*vTrashItem
+}
+
+// retention describes how long d is, in days.
+func retention(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	if days == 1 {
+		return "1 day"
+	}
+	return strconv.Itoa(days) + " days"
+}
+
+// deleteName returns the directory of the chart whose text is named by the
+// delete URL of r, refusing the root chart and charts with subtrees beneath
+// them that r's user doesn't administer.
+func (self *App) deleteName(r *http.Request) (string, string) {
+	txtName := ChartName(r)
+
+	_, err := self.Store.Stat(txtName)
+	if os.IsNotExist(err) {
+		panic(errNotFound())
+	}
+	checkHTTP(err)
+
+	name := chartfs.Clean(path.Dir(txtName))
+	if name == "" {
+		panic(errBadRequest("The root chart can't be deleted."))
+	}
+	if !self.Rules().AllowedBeneath(CurrentUser(r), name, acl.ADMIN) {
+		panic(errForbidden("Some of the charts beneath %s have permissions you don't administer, so it can't be deleted.", name))
+	}
+	return txtName, name
+}
+
+// HandleDeleteGet asks whether to move a chart, and the charts beneath it,
+// to the trash.
+func (self *App) HandleDeleteGet(w http.ResponseWriter, r *http.Request) {
+	_, name := self.deleteName(r)
+
+	chartUrl, err := self.GetSlugUrl(name)
+	checkHTTP(err)
+
+	view := &vDelete{
+		vRoot:     newVRoot(self, "delete", "Delete "+name, "", ""),
+		Name:      name,
+		ChartUrl:  chartUrl.String(),
+		Retention: retention(self.Trash.Retention),
+	}
+	view.CSRFToken = self.csrfToken(w, r)
+	self.renderTemplate(w, "delete", view)
+}
+
+// HandleDeletePost moves a chart, and the charts beneath it, to the trash.
+func (self *App) HandleDeletePost(w http.ResponseWriter, r *http.Request) {
+	txtName, name := self.deleteName(r)
+
+	// keep saves beneath the chart from landing mid-move
+	defer self.lockTree(name)()
+	before := self.contentOf(txtName)
+	item, err := self.Trash.Delete(name, self.Author(r))
+	checkHTTP(err)
+
+	glog.Infof("HandleDeletePost(): %q moved %q to the trash as %s", self.Author(r), name, item.ID)
+	self.record(r, name, audit.DELETE, before, nil)
+
+	listUrl, err := self.GetSlugUrl("")
+	checkHTTP(err)
+	http.Redirect(w, r, listUrl.String(), http.StatusSeeOther)
+}
+
+// HandleTrashGet lists the deleted charts.
+func (self *App) HandleTrashGet(w http.ResponseWriter, r *http.Request) {
+	self.renderTrash(w, r, http.StatusOK, "", "", "")
+}
+
+// HandleTrashPost restores a deleted chart to where it was, or to where the
+// form says. Restores over existing charts are refused.
+func (self *App) HandleTrashPost(w http.ResponseWriter, r *http.Request) {
+	parseForm(r)
+	id := r.FormValue("id")
+	name := chartfs.Clean(r.FormValue("name"))
+
+	item, err := self.Trash.Restore(id, name)
+	switch {
+	case err == trash.ErrExists:
+		self.renderTrash(w, r, http.StatusConflict, id, name, "Something is already at "+name+"; restore the chart elsewhere, or move that first.")
+		return
+	case err == trash.ErrName:
+		panic(errBadRequest("Charts can't be restored to %q.", name))
+	case os.IsNotExist(err):
+		panic(errNotFound())
+	}
+	checkHTTP(err)
+
+	glog.Infof("HandleTrashPost(): %q restored %s, once %q, to %q", self.Author(r), id, item.Name, name)
+	self.record(r, name, audit.RESTORE, nil, nil)
+
+	chartUrl, err := self.GetSlugUrl(name)
+	checkHTTP(err)
+	http.Redirect(w, r, chartUrl.String(), http.StatusSeeOther)
+}
+
+// renderTrash shows the trash, with msg, if any, beside item id and name
+// offered as where to restore it.
+func (self *App) renderTrash(w http.ResponseWriter, r *http.Request, code int, id string, name string, msg string) {
+	items, err := self.Trash.List()
+	checkHTTP(err)
+
+	view := &vTrash{
+		vRoot:     newVRoot(self, "trash", "Trash", "", ""),
+		Retention: retention(self.Trash.Retention),
+	}
+	view.CSRFToken = self.csrfToken(w, r)
+	for _, item := range items {
+		vItem := &vTrashItem{Item: item, Expires: self.Trash.Expires(item), Restore: item.Name}
+		if item.ID == id {
+			vItem.Restore = name
+			vItem.Error = msg
+		}
+		view.Items = append(view.Items, vItem)
+	}
+
+	w.WriteHeader(code)
+	self.renderTemplate(w, "trash", view)
+}
+
+// PurgeTrash purges the charts kept in the trash longer than its retention
+// period, now and then until stop is closed.
+func (self *App) PurgeTrash(stop <-chan struct{}) {
+	ticker := time.NewTicker(TRASH_PURGE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		purged, err := self.Trash.Purge()
+		for _, item := range purged {
+			glog.Infof("PurgeTrash(): purged %s, deleted from %q by %q at %v", item.ID, item.Name, item.User, item.Deleted)
+			self.appendRecord(&audit.Record{Path: item.Name, Action: audit.PURGE})
+		}
+		if err != nil {
+			glog.Errorf("PurgeTrash(): unable to purge the trash: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,31 +3,32 @@
 package web
 
 import (
+	"akamai/atlas/audit"
 	"akamai/atlas/chart"
+	"akamai/atlas/etherpad"
+	"akamai/atlas/presence"
+	"akamai/atlas/store"
 
 	"github.com/golang/glog"
 
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
-	"strings"
 	"time"
 )
 
-func (self *App) InitializeTxt(txtName string) error {
+// InitializeTxt writes a new chart crediting author, when known.
+func (self *App) InitializeTxt(txtName string, author string) error {
 	txtFile, err := self.TxtEditFile(txtName)
 	checkHTTP(err)
-	defer txtFile.Close()
 
-	_, err = txtFile.WriteString(`% Title
+	_, err = io.WriteString(txtFile, chart.AddAuthor(`% Title
 % Authors
 % Date
 
@@ -51,8 +52,12 @@ func (self *App) InitializeTxt(txtName string) error {
 
 ## Controls          [ ](data:tkt,owner=&next_action=)
 
-`)
-	return err
+`, author))
+	if err != nil {
+		txtFile.Abort()
+		return err
+	}
+	return txtFile.Close()
 }
 
 func (self *App) GetTxtEditorUrl() (url.URL, error) {
@@ -63,264 +68,166 @@ func (self *App) GetStaticTxtEditUrl() (url.URL, error) {
 	return url.URL{}, nil
 }
 
-func (self *App) TxtEditFile(txtName string) (*os.File, error) {
-	if strings.HasPrefix(txtName, "..") {
-		panic(fmt.Sprintf("TxtEditFile(): directory traversal: %s", txtName))
+// TxtEditFile opens the chart text txtName for writing. What is written
+// replaces the chart at Close if it is UTF-8; Abort, or any failure, leaves
+// the chart as it was.
+func (self *App) TxtEditFile(txtName string) (store.Writer, error) {
+	glog.Infof("TxtEditFile(): got txt name: %s", txtName)
+	w, err := self.Store.Create(txtName)
+	if err != nil {
+		return nil, err
 	}
-
-	txtDir := path.Dir(txtName)
-	glog.Infof("TxtEditFile(): got txt dir: %s", txtDir)
-
-	realTxtDir := path.Join(self.ChartsPath, txtDir)
-	err := os.MkdirAll(realTxtDir, 0755)
-	checkHTTP(err)
-
-	realTxtName := path.Join(self.ChartsPath, txtName)
-	return os.Create(realTxtName)
+	return newCheckedFile(w, checkTxt), nil
 }
 
-func (self *App) TxtOpenFile(txtName string) (*os.File, error) {
-	if strings.HasPrefix(txtName, "..") {
-		panic(fmt.Sprintf("TxtEditFile(): directory traversal: %s", txtName))
-	}
+func (self *App) TxtOpenFile(txtName string) (store.File, error) {
+	return self.Store.Open(txtName)
+}
 
-	realTxtName := path.Join(self.ChartsPath, txtName)
-	return os.Open(realTxtName)
+// padFor returns the name of the pad editing txtName.
+func padFor(txtName string) string {
+	hash := sha1.New()
+	hash.Write([]byte(txtName))
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
-type epResponse struct {
-	Code    int                    `json:"code"`
-	Message string                 `json:"message"`
-	Data    map[string]interface{} `json:"data"`
+// etherpad returns the client of the etherpad editing charts.
+func (self *App) etherpad() *etherpad.Client {
+	if self.Etherpad == nil {
+		panic(etherpadFailed("etherpad is not configured"))
+	}
+	return self.Etherpad
 }
 
 func (self *App) HandleTxtEditorPostSave(w http.ResponseWriter, r *http.Request, txtName string, padName string) {
-	// get pad latest rev
-	epUrl := *self.EtherpadApiUrl
-	epUrl.Path = path.Join(epUrl.Path, "1.2.7", "getRevisionsCount")
-	queryValues := url.Values{}
-	queryValues.Set("apikey", self.EtherpadApiSecret)
-	queryValues.Set("padID", padName)
-	epUrl.RawQuery = queryValues.Encode()
-	resp, err := http.Get(epUrl.String())
-	checkHTTP(err)
-	defer resp.Body.Close()
-	glog.Infof("HandleTxtEditorPost(): getRevisionsCount resp: %q", resp)
-	decoder := json.NewDecoder(resp.Body)
-	epResp := epResponse{}
-	err = decoder.Decode(&epResp)
-	checkHTTP(err)
-	glog.Infof("HandleTxtEditorPost(): getRevisionsCount epResp: %q", epResp)
-	// XXX: check resp....
-	// {"code":0,"message":"ok","data":null}
-	// {"code":1,"message":"padID does already exist","data":null}
-
-	// get pad latest rev
-	epUrl = *self.EtherpadApiUrl
-	epUrl.Path = path.Join(epUrl.Path, "1.2.7", "getRevisionsCount")
-	queryValues = url.Values{}
-	queryValues.Set("apikey", self.EtherpadApiSecret)
-	queryValues.Set("padID", padName)
-	epUrl.RawQuery = queryValues.Encode()
-	resp, err = http.Get(epUrl.String())
-	checkHTTP(err)
-	defer resp.Body.Close()
-	glog.Infof("HandleTxtEditorPost(): getRevisionsCount resp: %q", resp)
-	decoder = json.NewDecoder(resp.Body)
-	epResp = epResponse{}
-	err = decoder.Decode(&epResp)
-	checkHTTP(err)
-	glog.Infof("HandleTxtEditorPost(): getRevisionsCount epResp: %q", epResp)
-	if epResp.Code != 0 {
-		panic("HandleTxtEditorPost(): epResp code != 0")
-	}
-	if epResp.Data == nil {
-		panic("HandleTxtEditorPost(): no data")
-	}
-	revsIface := epResp.Data["revisions"]
-	if revsIface == nil {
-		panic("HandleTxtEditorPost(): no revisions field value")
-	}
-	revsFloat, ok := revsIface.(float64)
-	if !ok {
-		panic("HandleTxtEditorPost(): revisions field not a number")
-	}
-	rev := fmt.Sprintf("%d", int(revsFloat))
-
-	// given rev, get pad text
-
-	epUrl = *self.EtherpadApiUrl
-	epUrl.Path = path.Join(epUrl.Path, "1.2.7", "getText")
-	queryValues = url.Values{}
-	queryValues.Set("apikey", self.EtherpadApiSecret)
-	queryValues.Set("padID", padName)
-	queryValues.Set("rev", rev)
-	epUrl.RawQuery = queryValues.Encode()
-	resp, err = http.Get(epUrl.String())
-	checkHTTP(err)
-	defer resp.Body.Close()
-	glog.Infof("HandleTxtEditorPost(): getText resp: %q", resp)
-	decoder = json.NewDecoder(resp.Body)
-	epResp = epResponse{}
-	err = decoder.Decode(&epResp)
-	checkHTTP(err)
-	glog.Infof("HandleTxtEditorPost(): getText epResp: %t", epResp)
-	glog.Infof("HandleTxtEditorPost(): getText epResp: %q", epResp)
-	if epResp.Code != 0 {
-		panic("HandleTxtEditorPost(): epResp code != 0")
-	}
-	if epResp.Data == nil {
-		panic("HandleTxtEditorPost(): no data")
-	}
-	textIface := epResp.Data["text"]
-	if textIface == nil {
-		panic("HandleTxtEditorPost(): no text field value")
-	}
-	text, ok := textIface.(string)
-	if !ok {
-		panic("HandleTxtEditorPost(): text field not a string")
+	ep := self.etherpad()
+
+	// pin the revision, so the text saved is the one the log names
+	rev, err := ep.GetRevisionsCount(r.Context(), padName)
+	checkEtherpad(err)
+	padText, err := ep.GetText(r.Context(), padName, rev)
+	checkEtherpad(err)
+	glog.Infof("HandleTxtEditorPost(): got %d bytes of rev %d of pad %s", len(padText), rev, padName)
+
+	unlock := self.lockSave(txtName)
+	defer unlock()
+	before := self.contentOf(txtName)
+	if !checkVersion(r, versionOf(before)) {
+		self.renderTxtConflict(w, r, txtName, padText, "", before)
+		return
 	}
 
+	text := chart.AddAuthor(padText, self.Author(r))
+
 	txtFile, err := self.TxtEditFile(txtName)
 	checkHTTP(err)
-	defer txtFile.Close()
+	defer txtFile.Abort()
 
 	reader := bytes.NewBufferString(text)
 
 	written, err := io.Copy(txtFile, reader)
 	checkHTTP(err)
+	err = txtFile.Close()
+	checkHTTP(err)
 
 	glog.Infof("HandleTxtEditorPost(): wrote %d bytes of txt body", written)
-	w.WriteHeader(http.StatusNoContent)
+	self.record(r, txtName, audit.SAVE, before, []byte(text))
+	unlock()
+
+	// crediting the author changes the chart; have the pad follow
+	if text != padText {
+		err = self.ReloadPad(r.Context(), txtName, padName)
+		checkEtherpad(err)
+	} else {
+		self.trackPad(txtName, padName, rev)
+	}
+
+	// reopen the editor, so its next save names this version
+	w.Header().Set("ETag", etagOf(versionOf([]byte(text))))
+	http.Redirect(w, r, "", http.StatusSeeOther)
 }
 
 func (self *App) HandleTxtEditorPostReload(w http.ResponseWriter, r *http.Request, txtName string, padName string) {
-	self.ReloadPad(txtName, padName)
+	err := self.ReloadPad(r.Context(), txtName, padName)
+	checkEtherpad(err)
+	content := self.contentOf(txtName)
+	self.record(r, txtName, audit.RELOAD, content, content)
 	http.Redirect(w, r, "", http.StatusSeeOther)
 }
 
 // BUG(mistone): XSS Safety for TXT editor?
 func (self *App) HandleTxtEditorPost(w http.ResponseWriter, r *http.Request) {
-	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.ChartsRoot)
-	checkHTTP(err)
-
-	txtName := path.Clean(path.Dir(fp))
+	txtName := ChartName(r)
 	glog.Infof("HandleTxtEditorPost(): got txt: %s", txtName)
 
-	// get pad id
-	hash := sha1.New()
-	hash.Write([]byte(txtName))
-	padName := hex.EncodeToString(hash.Sum(nil))
+	padName := padFor(txtName)
 	glog.Infof("HandleTxtEditorPost(): calculated pad name: %s", padName)
 
+	parseForm(r)
 	action := r.FormValue("action")
 	glog.Infof("HandleTxtEditorPost(): processing action: %s", action)
 
-	switch action {
-	default:
-		panic(fmt.Sprintf("HandleTxtEditorPost(): unknown action: %s", action))
-	case "save":
+	switch {
+	case action == "preview":
+		self.HandleTxtEditorPostPreview(w, r)
+	case self.nativeTxtEditor() || r.PostForm["text"] != nil:
+		// etherpad editors post text only when resolving conflicts
+		self.HandleTxtNativeEditorPost(w, r, txtName, action)
+	case action == "save":
 		self.HandleTxtEditorPostSave(w, r, txtName, padName)
-	case "reload":
+	case action == "reload":
 		self.HandleTxtEditorPostReload(w, r, txtName, padName)
+	default:
+		panic(errBadRequest("Unknown editor action %q.", action))
 	}
-	return
 }
 
 type vTxtEditor struct {
 	*vRoot
 	TxtEditorUrl url.URL
 	ChartUrl     url.URL
+	Version      string
+	SyncUrl      url.URL
 }
 
-func (self *App) ReloadPad(txtName, padName string) error {
-	txtFile, err := self.TxtOpenFile(txtName)
+// ReloadPad resets the pad editing txtName to the chart's text.
+func (self *App) ReloadPad(ctx context.Context, txtName, padName string) error {
+	txtBody, err := store.ReadFile(self.Store, txtName)
 	checkHTTP(err)
-	defer txtFile.Close()
 
-	txtBodyRaw, err := ioutil.ReadAll(txtFile)
-	checkHTTP(err)
-	txtBody := string(txtBodyRaw)
-
-	epUrl := *self.EtherpadApiUrl
-	epUrl.Path = path.Join(epUrl.Path, "1.2.7", "setText")
-	queryValues := url.Values{}
-	queryValues.Set("apikey", self.EtherpadApiSecret)
-	queryValues.Set("padID", padName)
-	queryValues.Set("text", txtBody)
-	epUrl.RawQuery = queryValues.Encode()
-	resp, err := http.Get(epUrl.String())
-	checkHTTP(err)
-	defer resp.Body.Close()
-	glog.Infof("HandleTxtEditorGet(): setText resp: %q", resp)
-	// XXX: check resp....
+	ep := self.etherpad()
+	err = ep.SetText(ctx, padName, string(txtBody))
+	if err != nil {
+		return err
+	}
+	if self.PadSync != nil {
+		rev, err := ep.GetRevisionsCount(ctx, padName)
+		if err != nil {
+			return err
+		}
+		self.trackPad(txtName, padName, rev)
+	}
 	return nil
 }
 
 func (self *App) HandleTxtEditorGet(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("HandleTxtEditorGet(): starting")
 
-	fp, err := self.RemoveUrlPrefix(r.URL.Path, self.ChartsRoot)
-	checkHTTP(err)
-
-	txtName := path.Clean(path.Dir(fp))
+	txtName := ChartName(r)
 	glog.Infof("HandleTxtEditorGet(): handling txtName: %s", txtName)
 
-	realTxtName := path.Join(self.ChartsPath, txtName)
-	_, err = os.Stat(realTxtName)
-	if err != nil && os.IsNotExist(err) {
-		err = self.InitializeTxt(txtName)
+	chart := chart.NewChart(self.Store, txtName)
+	if !chart.IsChart() {
+		panic(errNotFound())
 	}
 
-	hash := sha1.New()
-	hash.Write([]byte(txtName))
-	padName := hex.EncodeToString(hash.Sum(nil))
-	glog.Infof("HandleTxtEditorGet(): calculated pad name: %s", padName)
-
-	// create the pad
-	epUrl := *self.EtherpadApiUrl
-	epUrl.Path = path.Join(epUrl.Path, "1.2.7", "createPad")
-	queryValues := url.Values{}
-	queryValues.Set("apikey", self.EtherpadApiSecret)
-	queryValues.Set("padID", padName)
-	epUrl.RawQuery = queryValues.Encode()
-	resp, err := http.Get(epUrl.String())
-	checkHTTP(err)
-	defer resp.Body.Close()
-	glog.Infof("HandleTxtEditorPost(): createPad resp: %q", resp)
-	decoder := json.NewDecoder(resp.Body)
-	epResp := epResponse{}
-	err = decoder.Decode(&epResp)
-	checkHTTP(err)
-	glog.Infof("HandleTxtEditorPost(): createPad epResp: %t", epResp)
-	if epResp.Code == 0 {
-		err := self.ReloadPad(txtName, padName)
-		checkHTTP(err)
-	}
-	// {"code":1,"message":"padID does already exist","data":null}
-	if epResp.Code == 1 && epResp.Message != "padID does already exist" {
-		panic("Unknown createPad response")
-	}
-	if epResp.Code != 0 && epResp.Code != 1 {
-		panic("Unknown createPad response")
-	}
+	self.createMissing(r, txtName, func() error {
+		return self.InitializeTxt(txtName, self.Author(r))
+	})
 
 	now := time.Now()
 	date := fmt.Sprintf("%s %0.2d, %d", now.Month().String(), now.Day(), now.Year())
 
-	editorUrl := *self.EtherpadApiUrl
-	editorUrl.Path = path.Join(path.Dir(editorUrl.Path), "p", padName)
-	editorValues := url.Values{}
-	editorValues.Set("showControls", "true")
-	editorValues.Set("showChat", "true")
-	editorValues.Set("showLineNumbers", "true")
-	editorValues.Set("useMonospaceFont", "true")
-	editorUrl.RawQuery = editorValues.Encode()
-
-	chart := chart.NewChart(path.Join(self.ChartsPath, txtName), self.ChartsPath)
-	if !chart.IsChart() {
-		panic("Not a chart!")
-	}
 	chartUrl, err := self.GetChartUrl(chart)
 	checkHTTP(err)
 	glog.Infof("HandleTxtEditorGet(): found chart url: %q", chartUrl)
@@ -332,12 +239,46 @@ func (self *App) HandleTxtEditorGet(w http.ResponseWriter, r *http.Request) {
 	} else {
 		title = title + slug[0:len(slug)-1]
 	}
+	root := newVRoot(self, "txt_editor", title, "(none)", date)
+
+	if self.nativeTxtEditor() {
+		self.HandleTxtNativeEditorGet(w, r, root, txtName, chartUrl)
+		return
+	}
+
+	padName := padFor(txtName)
+	glog.Infof("HandleTxtEditorGet(): calculated pad name: %s", padName)
+
+	// create the pad, holding the chart, unless someone is already editing
+	ep := self.etherpad()
+	txtBody, err := store.ReadFile(self.Store, txtName)
+	checkHTTP(err)
+	err = ep.CreatePad(r.Context(), padName, string(txtBody))
+	if errors.Is(err, etherpad.ErrPadExists) {
+		self.trackPad(txtName, padName, -1)
+	} else {
+		checkEtherpad(err)
+		self.trackPad(txtName, padName, 0)
+	}
+
+	// saves from the pad replace the chart as the pad last matched it
+	version := versionOf(txtBody)
+	if status, found := self.syncStatus(txtName); found {
+		version = versionOf(status.Base)
+	}
 
 	view := &vTxtEditor{
-		vRoot:        newVRoot(self, "txt_editor", title, "(none)", date),
-		TxtEditorUrl: editorUrl,
+		vRoot:        root,
+		TxtEditorUrl: ep.PadUrl(padName),
 		ChartUrl:     chartUrl,
+		Version:      version,
+	}
+	if self.PadSync != nil {
+		view.SyncUrl = url.URL{Path: "sync"}
 	}
+	view.PresenceUrl = "presence"
+	view.PresenceAction = presence.EDITING
+	view.CSRFToken = self.csrfToken(w, r)
 	glog.Infof("HandleTxtEditorGet(): view: %s", view)
 
 	self.renderTemplate(w, "txt_editor", view)
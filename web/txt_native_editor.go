@@ -0,0 +1,171 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/audit"
+	"akamai/atlas/chart"
+	"akamai/atlas/merge"
+	"akamai/atlas/presence"
+	"akamai/atlas/store"
+
+	"github.com/golang/glog"
+
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Chart editors, for App.TxtEditor.
+const (
+	TXT_EDITOR_ETHERPAD = "etherpad" // collaborative editing in etherpad pads
+	TXT_EDITOR_NATIVE   = "native"   // a textarea with a live preview
+)
+
+// nativeTxtEditor reports whether charts are edited with the native editor:
+// if chosen, or by default when there is no etherpad.
+func (self *App) nativeTxtEditor() bool {
+	if self.TxtEditor != "" {
+		return self.TxtEditor == TXT_EDITOR_NATIVE
+	}
+	return self.Etherpad == nil
+}
+
+type vTxtNativeEditor struct {
+	*vRoot
+	EditorUrl url.URL
+	ChartUrl  url.URL
+	Text      string
+	Base      string
+	Version   string
+	Preview   template.HTML
+
+	// Conflict says the posted save lost a race; Conflicts counts the
+	// places its merge with the winner needs resolving by hand.
+	Conflict  bool
+	Conflicts int
+}
+
+// renderPreview renders chart text as HandleChartGet would render it.
+func (self *App) renderPreview(text string) []byte {
+	_, body := chart.Parse(text)
+	return self.RenderChartHtml(body)
+}
+
+// formText returns the text posted in field, with the CRLFs browsers
+// submit textareas with turned back into newlines.
+func formText(r *http.Request, field string) string {
+	return strings.Replace(r.FormValue(field), "\r\n", "\n", -1)
+}
+
+// HandleTxtNativeEditorGet edits txtName in a textarea beside a preview.
+func (self *App) HandleTxtNativeEditorGet(w http.ResponseWriter, r *http.Request, root *vRoot, txtName string, chartUrl url.URL) {
+	content, err := store.ReadFile(self.Store, txtName)
+	checkHTTP(err)
+
+	self.renderNativeEditor(w, r, root, chartUrl, string(content), string(content), false, 0)
+}
+
+// renderNativeEditor shows text for editing as a change to base, the current
+// content.
+func (self *App) renderNativeEditor(w http.ResponseWriter, r *http.Request, root *vRoot, chartUrl url.URL, text string, base string, conflict bool, conflicts int) {
+	root.PageName = "txt_native_editor"
+	view := &vTxtNativeEditor{
+		vRoot:     root,
+		EditorUrl: url.URL{Path: path.Clean(r.URL.Path)},
+		ChartUrl:  chartUrl,
+		Text:      text,
+		Base:      base,
+		Version:   versionOf([]byte(base)),
+		Preview:   template.HTML(self.renderPreview(text)),
+		Conflict:  conflict,
+		Conflicts: conflicts,
+	}
+	view.CSRFToken = self.csrfToken(w, r)
+	view.PresenceUrl = path.Join(path.Dir(view.EditorUrl.Path), "presence")
+	view.PresenceAction = presence.EDITING
+
+	w.Header().Set("ETag", etagOf(view.Version))
+	if conflict {
+		w.WriteHeader(http.StatusConflict)
+	}
+	self.renderTemplate(w, "txt_native_editor", view)
+}
+
+// renderTxtConflict answers a save of yours, based on base, that lost a race
+// with a save of theirs, by showing the three-way merge of the two for
+// resolution. An unknown base is approximated by what the two share.
+func (self *App) renderTxtConflict(w http.ResponseWriter, r *http.Request, txtName string, yours string, base string, theirs []byte) {
+	c := chart.NewChart(self.Store, txtName)
+	chartUrl, err := self.GetChartUrl(c)
+	checkHTTP(err)
+
+	if base == "" {
+		base = merge.Common(yours, string(theirs))
+	}
+	merged, conflicts := merge.Merge(base, yours, string(theirs))
+	glog.Infof("renderTxtConflict(): conflicting save of %q by %q: %d conflicts", txtName, self.Author(r), conflicts)
+
+	root := newVRoot(self, "txt_editor", "Chart Editor: Conflict", "(none)", "")
+	self.renderNativeEditor(w, r, root, chartUrl, merged, string(theirs), true, conflicts)
+}
+
+// HandleTxtEditorPostPreview answers with the HTML of the posted chart text.
+func (self *App) HandleTxtEditorPostPreview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(self.renderPreview(formText(r, "text")))
+}
+
+// HandleTxtNativeEditorPost saves the posted text of txtName, unless someone
+// else saved it since the editor was opened, in which case the two saves are
+// merged for the poster to resolve.
+func (self *App) HandleTxtNativeEditorPost(w http.ResponseWriter, r *http.Request, txtName string, action string) {
+	if action != "save" {
+		panic(errBadRequest("Unknown editor action %q.", action))
+	}
+
+	text := formText(r, "text")
+	unlock := self.lockSave(txtName)
+	defer unlock()
+	before := self.contentOf(txtName)
+	if !checkVersion(r, versionOf(before)) {
+		// trust the posted base only if it is the version the save names
+		base := formText(r, "base")
+		if !checkVersion(r, versionOf([]byte(base))) {
+			base = ""
+		}
+		self.renderTxtConflict(w, r, txtName, text, base, before)
+		return
+	}
+
+	c := chart.NewChart(self.Store, txtName)
+	chartUrl, err := self.GetChartUrl(c)
+	checkHTTP(err)
+
+	text = chart.AddAuthor(text, self.Author(r))
+
+	txtFile, err := self.TxtEditFile(txtName)
+	checkHTTP(err)
+	defer txtFile.Abort()
+
+	_, err = io.WriteString(txtFile, text)
+	checkHTTP(err)
+	err = txtFile.Close()
+	checkHTTP(err)
+
+	glog.Infof("HandleTxtNativeEditorPost(): wrote %d bytes to %q", len(text), txtName)
+	self.record(r, txtName, audit.SAVE, before, []byte(text))
+	unlock()
+
+	// a conflict resolved for an etherpad editor leaves the pad behind
+	if !self.nativeTxtEditor() {
+		err = self.ReloadPad(r.Context(), txtName, padFor(txtName))
+		checkEtherpad(err)
+	}
+
+	w.Header().Set("ETag", etagOf(versionOf([]byte(text))))
+	http.Redirect(w, r, chartUrl.String(), http.StatusSeeOther)
+}
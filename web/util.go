@@ -6,24 +6,9 @@ import (
 	"github.com/golang/glog"
 
 	"net/http"
-	"runtime/debug"
 )
 
-func recoverHTTP(w http.ResponseWriter, r *http.Request) {
-	if rec := recover(); rec != nil {
-		switch err := rec.(type) {
-		case error:
-			glog.Infof("error: %v, req: %v", err, r)
-			debug.PrintStack()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		default:
-			glog.Infof("unknown error: %v, req: %v", err, r)
-			debug.PrintStack()
-			http.Error(w, "unknown error", http.StatusInternalServerError)
-		}
-	}
-}
-
+// checkHTTP raises err, to be answered by recoverHTTP.
 func checkHTTP(err error) {
 	if err != nil {
 		panic(err)
@@ -40,6 +25,8 @@ func (self *App) renderTemplate(w http.ResponseWriter, templateName string, view
 
 	err = tmpl.ExecuteTemplate(w, templateName, view)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// the page may be half-written, so just say so and log why
+		glog.Errorf("renderTemplate(): %q failed: %v", templateName, err)
+		http.Error(w, "unable to render page", http.StatusInternalServerError)
 	}
 }
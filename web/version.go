@@ -0,0 +1,171 @@
+// Copyright (c) 2013, 2014 Akamai Technologies, Inc.
+
+package web
+
+import (
+	"akamai/atlas/audit"
+	"akamai/atlas/chartfs"
+
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// versionOf returns the version of content that saves must name to replace
+// it, the hash the audit log records. Content that doesn't exist has version
+// "".
+func versionOf(content []byte) string {
+	return audit.Hash(content)
+}
+
+// etagOf returns the entity tag of version.
+func etagOf(version string) string {
+	if version == "" {
+		return ""
+	}
+	return `"` + version + `"`
+}
+
+// baseVersion returns the version r's save is based on and whether it named
+// one. Saves name it in an If-Match header or, from HTML forms, which can't
+// send headers, in a version field; If-None-Match: * names the version of
+// content that doesn't exist yet.
+func baseVersion(r *http.Request) (string, bool) {
+	if r.Header.Get("If-None-Match") == "*" {
+		return "", true
+	}
+	if im := r.Header.Get("If-Match"); im != "" {
+		return im, true
+	}
+	version, ok := r.Form["version"]
+	if !ok || len(version) == 0 {
+		return "", false
+	}
+	return etagOf(version[0]), true
+}
+
+// checkVersion reports whether r's save is based on current, the version of
+// what it would replace. It raises 428 for saves that don't say what they
+// are based on, leaving the caller to answer stale saves with 409.
+func checkVersion(r *http.Request, current string) bool {
+	base, ok := baseVersion(r)
+	if !ok {
+		panic(errPreconditionRequired())
+	}
+	if base == "" {
+		return current == ""
+	}
+	for _, tag := range strings.Split(base, ",") {
+		tag = strings.TrimSpace(tag)
+		if (tag == "*" && current != "") || (tag != "" && tag == etagOf(current)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameLocks serializes saves by chart name, so that a save's version check
+// and its write happen as one step, and keeps saves out of subtrees being
+// moved as a whole. The zero value is ready to use.
+type nameLocks struct {
+	mu    sync.Mutex
+	freed *sync.Cond
+	names map[string]bool // names locked
+	trees map[string]bool // subtrees locked
+}
+
+// beneath reports whether name is tree or lies beneath it.
+func beneath(name, tree string) bool {
+	return tree == "" || name == tree || strings.HasPrefix(name, tree+"/")
+}
+
+// busy reports whether name, or the subtree at name if tree, is locked in
+// part or whole. It is called with mu held.
+func (self *nameLocks) busy(name string, tree bool) bool {
+	for t := range self.trees {
+		if beneath(name, t) || (tree && beneath(t, name)) {
+			return true
+		}
+	}
+	if !tree {
+		return self.names[name]
+	}
+	for n := range self.names {
+		if beneath(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire waits until name, or the subtree at name if tree, is free, and
+// locks it, returning the function that unlocks it. The function may be
+// called more than once.
+func (self *nameLocks) acquire(name string, tree bool) func() {
+	self.mu.Lock()
+	if self.freed == nil {
+		self.freed = sync.NewCond(&self.mu)
+		self.names = map[string]bool{}
+		self.trees = map[string]bool{}
+	}
+	for self.busy(name, tree) {
+		self.freed.Wait()
+	}
+	held := self.names
+	if tree {
+		held = self.trees
+	}
+	held[name] = true
+	self.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			self.mu.Lock()
+			delete(held, name)
+			self.freed.Broadcast()
+			self.mu.Unlock()
+		})
+	}
+}
+
+// lock locks name, returning the function that unlocks it.
+func (self *nameLocks) lock(name string) func() {
+	return self.acquire(name, false)
+}
+
+// lockTree locks name and everything beneath it, returning the function
+// that unlocks them.
+func (self *nameLocks) lockTree(name string) func() {
+	return self.acquire(name, true)
+}
+
+// lockSave keeps anything else from writing name until the returned function
+// is called; saves hold it from checking their version until they've written.
+func (self *App) lockSave(name string) func() {
+	return self.saves.lock(chartfs.Clean(name))
+}
+
+// createMissing creates name with create unless it exists, recording the
+// creation for r. The check is made again under name's save lock, so that
+// concurrent requests create it once, and never over a save.
+func (self *App) createMissing(r *http.Request, name string, create func() error) {
+	if _, err := self.Store.Stat(name); !os.IsNotExist(err) {
+		return
+	}
+
+	defer self.lockSave(name)()
+	if _, err := self.Store.Stat(name); !os.IsNotExist(err) {
+		return
+	}
+	err := create()
+	checkHTTP(err)
+	self.record(r, name, audit.CREATE, nil, self.contentOf(name))
+}
+
+// lockTree keeps anything else from writing name or anything beneath it
+// until the returned function is called, as when moving the subtree.
+func (self *App) lockTree(name string) func() {
+	return self.saves.lockTree(chartfs.Clean(name))
+}
@@ -5,10 +5,24 @@
 package web
 
 import (
+	"akamai/atlas/acl"
+	"akamai/atlas/audit"
+	"akamai/atlas/auth"
+	"akamai/atlas/bundlecache"
 	"akamai/atlas/cfg"
+	"akamai/atlas/chartfs"
+	"akamai/atlas/etherpad"
+	"akamai/atlas/events"
+	"akamai/atlas/htmlsafe"
+	"akamai/atlas/padsync"
+	"akamai/atlas/presence"
+	"akamai/atlas/resumes"
 	"akamai/atlas/sitejsoncache"
 	"akamai/atlas/sitelistcache"
+	"akamai/atlas/staticcache"
+	"akamai/atlas/store"
 	"akamai/atlas/templatecache"
+	"akamai/atlas/trash"
 
 	"github.com/golang/glog"
 
@@ -18,6 +32,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 )
 
 const MAX_CHART_SIZE = 1000000
@@ -30,9 +45,33 @@ type App struct {
 	ChartsPath        string
 	EtherpadApiUrl    *url.URL
 	EtherpadApiSecret string
+	Etherpad          *etherpad.Client
+	TxtEditor         string
+	PadSync           *padsync.Syncer
+	PadSyncQuiet      time.Duration
+	Presence          *presence.Tracker
+	Events            *events.Broker
+	Trash             *trash.Trash
+	Resumes           *resumes.Registry
+	TrashRetention    time.Duration
+	SanitizeSvg       bool
+	HtmlPolicy        *htmlsafe.Policy
+	Store             store.Store
+	Auth              auth.Authenticator
+	OIDC              *auth.OIDC
+	Sessions          *auth.Sessions
+	CSRF              *auth.CSRF
+	ACL               *acl.Db
+	Audit             *audit.Log
+	Router            *Router
+	StaticFS          *chartfs.FS
+	saves             nameLocks
+	aclGen            int64 // the ACL generation site.json versions follow; guarded by SiteJsonCache
 	*templatecache.TemplateCache
 	*sitelistcache.SiteListCache
 	*sitejsoncache.SiteJsonCache
+	*staticcache.StaticCache
+	*bundlecache.BundleCache
 }
 
 var errTooShort = errors.New("URL path too short.")
@@ -64,23 +103,89 @@ func (self *App) RemoveUrlPrefix(urlPath string, prefix string) (string, error)
 }
 
 func (self *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer recoverHTTP(w, r)
+	defer self.recoverHTTP(w, r)
+
+	if !isSafeMethod(r.Method) {
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)
+	}
 
 	glog.Infof("HandleRootApp: path: %v", r.URL.Path)
 
-	isStatic := strings.HasPrefix(r.URL.Path, path.Clean("/"+self.StaticRoot))
-	if isStatic {
-		self.HandleStatic(w, r)
+	if self.checkCSRF(w, r) {
 		return
 	}
 
-	isChart := strings.HasPrefix(r.URL.Path, path.Clean("/"+self.ChartsRoot))
-	if isChart {
-		self.HandleChart(w, r)
-		return
+	if self.authEnabled() {
+		r = self.authenticate(r)
+	}
+
+	self.route(w, r)
+}
+
+// Init cleans up self's paths and creates its caches. Charts are kept in
+// ChartsPath unless a Store is supplied.
+func (self *App) Init() error {
+	self.StaticRoot = path.Clean("/" + self.StaticRoot)
+
+	if self.Sessions == nil {
+		self.Sessions = auth.NewSessions()
+	}
+
+	if self.CSRF == nil {
+		csrf, err := auth.NewCSRF()
+		if err != nil {
+			return err
+		}
+		self.CSRF = csrf
+	}
+
+	if self.Etherpad == nil && self.EtherpadApiUrl != nil {
+		self.Etherpad = etherpad.New(self.EtherpadApiUrl, self.EtherpadApiSecret)
+	}
+
+	if self.Events == nil {
+		self.Events = events.New()
+	}
+
+	if self.Presence == nil {
+		self.Presence = presence.New()
+	}
+
+	if self.HtmlPolicy == nil {
+		self.HtmlPolicy = htmlsafe.Default
 	}
 
-	glog.Infof("warning: can't route path: %v", r.URL.Path)
+	if self.Store == nil {
+		self.Store = store.NewLocal(self.ChartsPath)
+	}
+	self.StaticFS = chartfs.New(self.StaticPath)
+
+	if self.Resumes == nil {
+		self.Resumes = resumes.New()
+	}
+	self.Resumes.Probe()
+
+	if self.Trash == nil {
+		self.Trash = trash.New(self.Store)
+		if self.TrashRetention > 0 {
+			self.Trash.Retention = self.TrashRetention
+		}
+	}
+
+	if self.PadSync == nil && self.Etherpad != nil && !self.nativeTxtEditor() && self.PadSyncQuiet > 0 {
+		self.PadSync = self.newPadSync(self.PadSyncQuiet)
+	}
+
+	self.SiteListCache = sitelistcache.New(self.Store)
+	self.TemplateCache = templatecache.New(self.HtmlPath)
+	self.SiteJsonCache = sitejsoncache.New(self.SiteListCache)
+	self.StaticCache = staticcache.New(self.StaticFS)
+	self.BundleCache = bundlecache.New(self.StaticFS)
+
+	self.TemplateCache.Funcs = self.templateFuncs()
+	self.Router = self.routes()
+
+	return self.AddBundles()
 }
 
 // Serve initializes some variables on self and then delegates to net/http to
@@ -88,14 +193,19 @@ func (self *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (self *App) Serve() {
 	httpAddr := cfg.MustString("http.addr")
 
-	self.StaticRoot = path.Clean("/" + self.StaticRoot)
-
-	self.SiteListCache = sitelistcache.New(self.ChartsPath)
-	self.TemplateCache = templatecache.New(self.HtmlPath)
-	self.SiteJsonCache = sitejsoncache.New(self.SiteListCache)
+	err := self.Init()
+	if err != nil {
+		glog.Fatalf("Serve(): unable to initialize app: %v", err)
+	}
 
 	fmt.Printf("App: %v\n", self)
 
+	if self.PadSync != nil {
+		go self.PadSync.Run(nil)
+	}
+	go self.WatchCharts(nil)
+	go self.PurgeTrash(nil)
+
 	http.Handle("/", self)
 	glog.Fatal(http.ListenAndServe(httpAddr, nil))
 }
@@ -3,16 +3,42 @@
 package web
 
 import (
-	"akamai/atlas/sitejsoncache"
-	"akamai/atlas/sitelistcache"
-	"akamai/atlas/templatecache"
+	"akamai/atlas/acl"
+	"akamai/atlas/audit"
+	"akamai/atlas/auth"
+	"akamai/atlas/etherpad"
+	"akamai/atlas/fakeetherpad"
+	"akamai/atlas/fakeidp"
+	"akamai/atlas/merge"
+	"akamai/atlas/padsync"
+	"akamai/atlas/presence"
+	"akamai/atlas/resumes"
+	"akamai/atlas/store"
+	"akamai/atlas/trash"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"bufio"
 	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var normalApp *App
@@ -24,7 +50,6 @@ func init() {
 		testPath = "../"
 	}
 
-	httpAddr := "localhost:3001"
 	htmlPath := path.Join(testPath, "html/")
 	chartsPath := path.Join(testPath, "test/charts/")
 	staticPath := path.Join(testPath, "static/")
@@ -32,7 +57,6 @@ func init() {
 	staticRoot := "static/"
 
 	normalApp = &App{
-		HttpAddr:   httpAddr,
 		HtmlPath:   htmlPath,
 		StaticPath: staticPath,
 		StaticRoot: staticRoot,
@@ -40,9 +64,10 @@ func init() {
 		ChartsRoot: chartsRoot,
 	}
 
-	normalApp.SiteListCache = sitelistcache.New(chartsPath)
-	normalApp.TemplateCache = templatecache.New(htmlPath)
-	normalApp.SiteJsonCache = sitejsoncache.New(normalApp.SiteListCache)
+	err := normalApp.Init()
+	if err != nil {
+		panic(err)
+	}
 }
 
 func TestChartsGet(t *testing.T) {
@@ -79,7 +104,7 @@ func TestSiteJsonGet(t *testing.T) {
 	t.Parallel()
 	t.Log("TestSiteJsonGet(): starting.")
 	w := httptest.NewRecorder()
-	r, _ := http.NewRequest("GET", "http://localhost:3001/site.json", nil)
+	r, _ := http.NewRequest("GET", "http://localhost:3001/_/site.json", nil)
 	normalApp.ServeHTTP(w, r)
 	if w.Code != 200 {
 		t.Fatalf("TestSiteJsonGet() failed: response code %d != 200", w.Code)
@@ -93,11 +118,143 @@ func TestSiteJsonGet(t *testing.T) {
 	}
 }
 
+func TestSiteJsonGetDelta(t *testing.T) {
+	t.Parallel()
+	t.Log("TestSiteJsonGetDelta(): starting.")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost:3001/_/site.json?since=0", nil)
+	normalApp.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("TestSiteJsonGetDelta() failed: response code %d != 200", w.Code)
+	}
+	if w.Header().Get("X-Atlas-Version") == "" {
+		t.Fatalf("TestSiteJsonGetDelta() failed: missing X-Atlas-Version header")
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"full":true`) {
+		t.Fatalf("TestSiteJsonGetDelta() failed: since=0 did not produce a full delta:\n %s", w.Body)
+	}
+	if !strings.Contains(body, "Demo Atlas") {
+		t.Fatalf("TestSiteJsonGetDelta() failed: body does not mention 'Demo Atlas':\n %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:3001/_/site.json?since=yesterday", nil)
+	normalApp.ServeHTTP(w, r)
+	if w.Code != 400 {
+		t.Fatalf("TestSiteJsonGetDelta() failed: response code %d != 400", w.Code)
+	}
+}
+
+func TestSiteConcurrent(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nroot\n"))
+
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestSiteConcurrent() failed: Init: %v", err)
+	}
+
+	// pages refetching the site list and index while charts come and go
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				name := fmt.Sprintf("c%d/index.txt", j%4)
+				if i == 0 {
+					store.WriteFile(charts, name, []byte(fmt.Sprintf("%% C%d\n%% Test\n%% Today\n\n%d\n", j, j)))
+				} else if i == 1 {
+					charts.Remove(path.Dir(name))
+				}
+				for _, url := range []string{"/", "/_/site.json", "/_/site.json?since=0", "/_/site.json?since=1"} {
+					w := httptest.NewRecorder()
+					r, _ := http.NewRequest("GET", "http://localhost:3001"+url, nil)
+					app.ServeHTTP(w, r)
+					if w.Code != 200 {
+						t.Errorf("TestSiteConcurrent() failed: %s returned %d:\n %s", url, w.Code, w.Body)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStaticGetGzip(t *testing.T) {
+	t.Parallel()
+	t.Log("TestStaticGetGzip(): starting.")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost:3001/static/searchbox.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	normalApp.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("TestStaticGetGzip() failed: response code %d != 200", w.Code)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("TestStaticGetGzip() failed: Content-Encoding %q != gzip", w.Header().Get("Content-Encoding"))
+	}
+
+	u, err := normalApp.GetStaticUrl("searchbox.js")
+	if err != nil {
+		t.Fatalf("TestStaticGetGzip() failed: GetStaticUrl returned %q", err)
+	}
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:3001"+u.String(), nil)
+	r.Header.Set("If-None-Match", `W/"bogus", `+normalApp.StaticCache.Entries["/searchbox.js"].Blob.ETag(""))
+	normalApp.ServeHTTP(w, r)
+	if w.Code != 304 {
+		t.Fatalf("TestStaticGetGzip() failed: fingerprinted revalidation code %d != 304", w.Code)
+	}
+	if w.Header().Get("Cache-Control") != STATIC_MAX_AGE {
+		t.Fatalf("TestStaticGetGzip() failed: fingerprinted Cache-Control %q", w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestChartsGetBundles(t *testing.T) {
+	t.Parallel()
+	t.Log("TestChartsGetBundles(): starting.")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost:3001/", nil)
+	normalApp.ServeHTTP(w, r)
+	body := w.Body.String()
+
+	jsUrl, err := normalApp.GetAssetUrl("site.min.js")
+	if err != nil || jsUrl == "" {
+		t.Fatalf("TestChartsGetBundles() failed: GetAssetUrl returned (%q, %q)", jsUrl, err)
+	}
+	if !strings.Contains(body, jsUrl) {
+		t.Fatalf("TestChartsGetBundles() failed: body does not load %q:\n %s", jsUrl, w.Body)
+	}
+	if !strings.Contains(body, "/static/chart.min.css?v=") {
+		t.Fatalf("TestChartsGetBundles() failed: body does not load chart.min.css:\n %s", w.Body)
+	}
+	if strings.Contains(body, "chart.min.js") {
+		t.Fatalf("TestChartsGetBundles() failed: body loads nonexistent chart.min.js:\n %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:3001"+jsUrl, nil)
+	normalApp.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("TestChartsGetBundles() failed: bundle response code %d != 200", w.Code)
+	}
+	if w.Header().Get("Cache-Control") != STATIC_MAX_AGE {
+		t.Fatalf("TestChartsGetBundles() failed: bundle Cache-Control %q", w.Header().Get("Cache-Control"))
+	}
+	if !strings.Contains(w.Body.String(), "ticketUriPrefix") {
+		t.Fatalf("TestChartsGetBundles() failed: bundle lacks searchbox.js")
+	}
+}
+
 func TestChartSetGet(t *testing.T) {
 	t.Parallel()
 	t.Log("TestChartSetGet(): starting.")
 	w := httptest.NewRecorder()
-	r, _ := http.NewRequest("GET", "http://localhost:3001/pages/", nil)
+	r, _ := http.NewRequest("GET", "http://localhost:3001/_/pages", nil)
 	normalApp.ServeHTTP(w, r)
 	if w.Code != 200 {
 		t.Fatalf("TestChartSetGet() failed: response code %d != 200", w.Code)
@@ -117,6 +274,25 @@ func TestChartSetGet(t *testing.T) {
 	}
 }
 
+func TestRenderChartHtml(t *testing.T) {
+	t.Parallel()
+	t.Log("TestRenderChartHtml(): starting.")
+
+	body := "# Overview [ ](data:tkt,owner=me)\n\nE = mc<sup>2</sup> <img src=\"x.svg\" width=\"50\" onload=\"x()\">\n\n<script>alert(1)</script>\n\n[bad](javascript:alert(2))\n"
+	html := string(normalApp.RenderChartHtml(body))
+
+	for _, good := range []string{"<sup>2</sup>", `<img src="x.svg" width="50">`, `href="data:tkt,owner=me"`, "bad"} {
+		if !strings.Contains(html, good) {
+			t.Fatalf("TestRenderChartHtml() failed: html lacks %q:\n %s", good, html)
+		}
+	}
+	for _, bad := range []string{"<script", "onload", "javascript:"} {
+		if strings.Contains(html, bad) {
+			t.Fatalf("TestRenderChartHtml() failed: html contains %q:\n %s", bad, html)
+		}
+	}
+}
+
 func TestChartGet404(t *testing.T) {
 	t.Parallel()
 	t.Log("TestChartGet(): starting.")
@@ -128,6 +304,375 @@ func TestChartGet404(t *testing.T) {
 	}
 }
 
+// newMemoryApp returns an App like normalApp that keeps its charts in charts.
+func newMemoryApp(charts store.Store) (*App, error) {
+	app := &App{
+		HtmlPath:   normalApp.HtmlPath,
+		StaticPath: normalApp.StaticPath,
+		StaticRoot: normalApp.StaticRoot,
+		ChartsRoot: normalApp.ChartsRoot,
+		Store:      charts,
+	}
+	return app, app.Init()
+}
+
+func TestMemoryStoreGet(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Memory Root\n% Test\n% Today\n\nfrom memory\n"))
+	store.WriteFile(charts, "sub/index.txt", []byte("% Memory Sub\n% Test\n% Today\n\n![](pic.svg)\n"))
+	store.WriteFile(charts, "sub/pic.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><text>remembered</text></svg>`))
+
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestMemoryStoreGet() failed: Init: %v", err)
+	}
+
+	for url, want := range map[string]string{
+		"http://localhost:3001/":            "from memory",
+		"http://localhost:3001/sub/":        "Memory Sub",
+		"http://localhost:3001/_/site.json": "remembered",
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		app.ServeHTTP(w, r)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("TestMemoryStoreGet() failed: %s returned %d without %q:\n %s", url, w.Code, want, w.Body)
+		}
+	}
+}
+
+func TestChartsRoot(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nroot text\n"))
+	store.WriteFile(charts, "sub/index.txt", []byte("% Sub\n% Test\n% Today\n\nsub text\n"))
+	store.WriteFile(charts, "atlas/sub/index.txt", []byte("% Impostor\n% Test\n% Today\n\nimpostor text\n"))
+
+	app := &App{
+		HtmlPath:   normalApp.HtmlPath,
+		StaticPath: normalApp.StaticPath,
+		StaticRoot: normalApp.StaticRoot,
+		ChartsRoot: "atlas",
+		Store:      charts,
+	}
+	if err := app.Init(); err != nil {
+		t.Fatalf("TestChartsRoot() failed: Init: %v", err)
+	}
+
+	// handlers read what the route table matched, beneath ChartsRoot
+	for url, want := range map[string]string{
+		"http://localhost:3001/atlas/":                  "root text",
+		"http://localhost:3001/atlas/sub/":              "sub text",
+		"http://localhost:3001/atlas/sub/index.txt":     "sub text",
+		"http://localhost:3001/atlas/sub/index.txt/raw": "sub text",
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		app.ServeHTTP(w, r)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("TestChartsRoot() failed: %s returned %d without %q:\n %s", url, w.Code, want, w.Body)
+		}
+	}
+}
+
+// addCSRF makes r carry a form token and an Origin, as if sent from one of
+// app's pages. Add r's session cookie first.
+func addCSRF(app *App, r *http.Request) {
+	w := httptest.NewRecorder()
+	token, _ := app.CSRF.Token(w, r)
+	r.Header.Set(auth.CSRF_HEADER, token)
+	r.Header.Set("Origin", "http://"+r.Host)
+}
+
+type testAuth map[string]string
+
+func (self testAuth) Authenticate(name, password string) (*auth.User, error) {
+	if pw, ok := self[name]; ok && pw == password {
+		return &auth.User{Name: name, FullName: "Test " + name}, nil
+	}
+	return nil, auth.ErrBadCredentials
+}
+
+func TestLogin(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nbody\n"))
+
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestLogin() failed: Init: %v", err)
+	}
+	app.Auth = testAuth{"ada": "engine"}
+
+	serve := func(method, url string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		var r *http.Request
+		if form != nil {
+			r, _ = http.NewRequest(method, url, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r, _ = http.NewRequest(method, url, nil)
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		if method == "POST" {
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("GET", "http://localhost:3001/", nil); w.Code != 200 {
+		t.Fatalf("TestLogin() failed: anonymous read returned %d", w.Code)
+	}
+	w := serve("GET", "http://localhost:3001/new/index.txt/editor", nil)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), LOGIN_PATH+"?next=") {
+		t.Fatalf("TestLogin() failed: anonymous editor returned %d, %q", w.Code, w.Header().Get("Location"))
+	}
+	if _, err := charts.Stat("new/index.txt"); err == nil {
+		t.Fatalf("TestLogin() failed: anonymous editor visit created a chart")
+	}
+	if w := serve("POST", "http://localhost:3001/x.svg/editor", url.Values{}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("TestLogin() failed: anonymous post returned %d", w.Code)
+	}
+
+	if w := serve("GET", "http://localhost:3001/login?next=/sub/", nil); w.Code != 200 || !strings.Contains(w.Body.String(), `value="/sub/"`) {
+		t.Fatalf("TestLogin() failed: login page returned %d:\n %s", w.Code, w.Body)
+	}
+	if w := serve("POST", "http://localhost:3001/login", url.Values{"name": {"ada"}, "password": {"wrong"}}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("TestLogin() failed: bad password returned %d", w.Code)
+	}
+
+	w = serve("POST", "http://localhost:3001/login", url.Values{"name": {"ada"}, "password": {"engine"}, "next": {"//evil.example/"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("TestLogin() failed: login returned %d, %q", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+
+	svg := base64.StdEncoding.EncodeToString([]byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`))
+	if w := serve("POST", "http://localhost:3001/x.svg/editor", url.Values{"filepath": {svg}, "version": {""}}, cookies...); w.Code != http.StatusNoContent {
+		t.Fatalf("TestLogin() failed: logged-in post returned %d:\n %s", w.Code, w.Body)
+	}
+
+	app.InitializeTxt("new/index.txt", "Test ada")
+	body, _ := store.ReadFile(charts, "new/index.txt")
+	if !strings.HasPrefix(string(body), "% Title\n% Test ada\n") {
+		t.Fatalf("TestLogin() failed: new chart does not credit its author:\n %s", body)
+	}
+
+	// logging out takes a POST, with a token
+	if w := serve("GET", "http://localhost:3001/logout", nil, cookies...); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("TestLogin() failed: GET logout returned %d", w.Code)
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:3001/logout", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("TestLogin() failed: tokenless logout returned %d", w.Code)
+	}
+	if w := serve("POST", "http://localhost:3001/x.svg/editor", url.Values{"filepath": {svg}, "version": {"W/\"x\""}}, cookies...); w.Code == http.StatusUnauthorized {
+		t.Fatalf("TestLogin() failed: tokenless logout ended the session")
+	}
+	if w := serve("POST", "http://localhost:3001/logout", nil, cookies...); w.Code != http.StatusSeeOther {
+		t.Fatalf("TestLogin() failed: logout returned %d", w.Code)
+	}
+	if w := serve("POST", "http://localhost:3001/x.svg/editor", url.Values{"filepath": {svg}}, cookies...); w.Code != http.StatusUnauthorized {
+		t.Fatalf("TestLogin() failed: post after logout returned %d", w.Code)
+	}
+}
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\npublic ![](secret/plan.svg)\n"))
+	store.WriteFile(charts, "secret/index.txt", []byte("% Secret Plans\n% Test\n% Today\n\nclassified\n"))
+	store.WriteFile(charts, "secret/plan.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><text>blueprint</text></svg>`))
+
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestACL() failed: Init: %v", err)
+	}
+	app.Auth = testAuth{"ada": "engine", "bob": "builder"}
+
+	sqlDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestACL() failed: open: %v", err)
+	}
+	defer sqlDb.Close()
+	sqlDb.SetMaxOpenConns(1)
+
+	app.ACL, err = acl.NewDb(sqlDb)
+	if err != nil {
+		t.Fatalf("TestACL() failed: NewDb: %v", err)
+	}
+	app.ACL.Set("secret", "@staff", acl.READ|acl.EDIT)
+	app.ACL.AddMember("staff", "ada")
+
+	serve := func(method, url string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		var r *http.Request
+		if form != nil {
+			r, _ = http.NewRequest(method, url, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r, _ = http.NewRequest(method, url, nil)
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		if method == "POST" {
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+	login := func(name, password string) []*http.Cookie {
+		w := serve("POST", "http://localhost:3001/login", url.Values{"name": {name}, "password": {password}}, nil)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("TestACL() failed: login as %s returned %d", name, w.Code)
+		}
+		return w.Result().Cookies()
+	}
+
+	if w := serve("GET", "http://localhost:3001/secret/", nil, nil); w.Code != http.StatusSeeOther {
+		t.Fatalf("TestACL() failed: anonymous read of secret returned %d", w.Code)
+	}
+	for _, u := range []string{"/_/site.json", "/_/site.json?since=0", "/_/pages"} {
+		w := serve("GET", "http://localhost:3001"+u, nil, nil)
+		if w.Code != 200 || strings.Contains(w.Body.String(), "classified") || strings.Contains(w.Body.String(), "Secret Plans") || strings.Contains(w.Body.String(), "blueprint") {
+			t.Fatalf("TestACL() failed: anonymous %s returned %d, or leaked secret:\n %s", u, w.Code, w.Body)
+		}
+	}
+
+	bob := login("bob", "builder")
+	if w := serve("GET", "http://localhost:3001/secret/", nil, bob); w.Code != http.StatusForbidden {
+		t.Fatalf("TestACL() failed: bob's read of secret returned %d", w.Code)
+	}
+	if w := serve("GET", "http://localhost:3001/secret/index.txt/editor", nil, bob); w.Code != http.StatusForbidden {
+		t.Fatalf("TestACL() failed: bob's edit of secret returned %d", w.Code)
+	}
+
+	ada := login("ada", "engine")
+	if w := serve("GET", "http://localhost:3001/secret/", nil, ada); w.Code != 200 || !strings.Contains(w.Body.String(), "classified") {
+		t.Fatalf("TestACL() failed: ada's read of secret returned %d", w.Code)
+	}
+	w := serve("GET", "http://localhost:3001/_/site.json", nil, ada)
+	if !strings.Contains(w.Body.String(), "classified") || !strings.Contains(w.Body.String(), "blueprint") {
+		t.Fatalf("TestACL() failed: ada's site.json lacks secret:\n %s", w.Body)
+	}
+
+	// losing access replaces what ada's index holds
+	version := w.Header().Get("X-Atlas-Version")
+	app.ACL.RemoveMember("staff", "ada")
+	w = serve("GET", "http://localhost:3001/_/site.json?since="+version, nil, ada)
+	if !strings.Contains(w.Body.String(), `"full":true`) || strings.Contains(w.Body.String(), "classified") {
+		t.Fatalf("TestACL() failed: ada's site.json since %s after losing access is not a full copy without secret:\n %s", version, w.Body)
+	}
+	app.ACL.AddMember("staff", "ada")
+
+	// deleting a chart takes administering everything beneath it
+	store.WriteFile(charts, "projects/index.txt", []byte("% Projects\n% Test\n% Today\n"))
+	store.WriteFile(charts, "projects/bob/index.txt", []byte("% Bob's\n% Test\n% Today\n"))
+	app.ACL.Set("projects", "ada", acl.ADMIN)
+	app.ACL.Set("projects/bob", "bob", acl.ADMIN)
+	if w := serve("POST", "http://localhost:3001/projects/index.txt/delete", nil, ada); w.Code != http.StatusForbidden {
+		t.Fatalf("TestACL() failed: ada's delete over bob's chart returned %d", w.Code)
+	}
+	if _, err := charts.Stat("projects/bob/index.txt"); err != nil {
+		t.Fatalf("TestACL() failed: bob's chart deleted: %v", err)
+	}
+	app.ACL.Set("projects/bob", "ada", acl.ADMIN)
+	if w := serve("POST", "http://localhost:3001/projects/index.txt/delete", nil, ada); w.Code != http.StatusSeeOther {
+		t.Fatalf("TestACL() failed: ada's delete returned %d", w.Code)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Parallel()
+
+	idp := fakeidp.New("atlas", "s3cret")
+	defer idp.Close()
+	idp.SetClaims(map[string]interface{}{"sub": "42", "preferred_username": "grace", "groups": []string{"staff"}})
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "secret/index.txt", []byte("% Secret Plans\n% Test\n% Today\n\nclassified\n"))
+
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestOIDCLogin() failed: Init: %v", err)
+	}
+	app.OIDC, err = auth.NewOIDC(auth.OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "atlas",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://localhost:3001" + OIDC_CALLBACK_PATH,
+	})
+	if err != nil {
+		t.Fatalf("TestOIDCLogin() failed: NewOIDC: %v", err)
+	}
+
+	sqlDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestOIDCLogin() failed: open: %v", err)
+	}
+	defer sqlDb.Close()
+	sqlDb.SetMaxOpenConns(1)
+	app.ACL, _ = acl.NewDb(sqlDb)
+	app.ACL.Set("secret", "@staff", acl.READ)
+
+	serve := func(url string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("http://localhost:3001/secret/", nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("TestOIDCLogin() failed: anonymous read returned %d", w.Code)
+	}
+	w = serve("http://localhost:3001"+w.Header().Get("Location"), nil)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), idp.URL) {
+		t.Fatalf("TestOIDCLogin() failed: login returned %d, %q", w.Code, w.Header().Get("Location"))
+	}
+	stateCookies := w.Result().Cookies()
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noFollow.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("TestOIDCLogin() failed: authorize: %v", err)
+	}
+	resp.Body.Close()
+
+	w = serve(resp.Header.Get("Location"), stateCookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/secret/" {
+		t.Fatalf("TestOIDCLogin() failed: callback returned %d, %q:\n %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+
+	w = serve("http://localhost:3001/secret/", w.Result().Cookies())
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "classified") {
+		t.Fatalf("TestOIDCLogin() failed: staff read returned %d", w.Code)
+	}
+
+	if w := serve("http://localhost:3001"+OIDC_CALLBACK_PATH+"?state=x&code=y", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("TestOIDCLogin() failed: forged callback returned %d", w.Code)
+	}
+}
+
 func TestSvgEditorGet(t *testing.T) {
 	t.Parallel()
 	t.Log("TestSvgEditorGet(): starting.")
@@ -167,6 +712,8 @@ func TestSvgEditorPost(t *testing.T) {
 	svgBodyReader := bytes.NewBufferString(svgBody)
 	r1, _ := http.NewRequest("POST", svgEditorUrl, svgBodyReader)
 	r1.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r1.Header.Set("If-None-Match", "*")
+	addCSRF(normalApp, r1)
 	normalApp.ServeHTTP(w1, r1)
 	if w1.Code != 204 {
 		t.Fatalf("TestSvgEditorPost() failed: response code %d != 204", w1.Code)
@@ -176,73 +723,1271 @@ func TestSvgEditorPost(t *testing.T) {
 	w2 := httptest.NewRecorder()
 	r2, _ := http.NewRequest("GET", svgUrl, nil)
 	normalApp.ServeHTTP(w2, r2)
-	if w2.Code != 200 {
-		t.Fatalf("TestSvgEditorPost() failed: response code %d != 200", w2.Code)
+	if w2.Code != 200 || w2.Header().Get("ETag") != w1.Header().Get("ETag") {
+		t.Fatalf("TestSvgEditorPost() failed: response code %d != 200, ETag %q", w2.Code, w2.Header().Get("ETag"))
+	}
+
+	// creating it again is a conflict
+	w3 := httptest.NewRecorder()
+	r3, _ := http.NewRequest("POST", svgEditorUrl, bytes.NewBufferString(svgBody))
+	r3.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r3.Header.Set("If-None-Match", "*")
+	addCSRF(normalApp, r3)
+	normalApp.ServeHTTP(w3, r3)
+	if w3.Code != http.StatusConflict || w3.Header().Get("ETag") != w1.Header().Get("ETag") {
+		t.Fatalf("TestSvgEditorPost() failed: stale save returned %d, ETag %q", w3.Code, w3.Header().Get("ETag"))
 	}
 }
 
-func TestResumePost(t *testing.T) {
+func TestSvgEditorPostUnsafe(t *testing.T) {
 	t.Parallel()
-	t.Log("TestResumePost(): starting.")
+	t.Log("TestSvgEditorPostUnsafe(): starting.")
 
 	// try to delete whatever we create
-	defer os.RemoveAll(path.Join(normalApp.ChartsPath, "resumes/hello.pdf"))
+	defer os.RemoveAll(path.Join(normalApp.ChartsPath, "unsafechart"))
 
-	resumeUrl := "/resumes/hello.pdf/"
+	svgUrl := "/unsafechart/evil.svg"
+	svgEditorUrl := path.Join(svgUrl, "editor")
 
-	// check that resumes/hello/ doesn't exist yet...
-	w0 := httptest.NewRecorder()
-	r0, _ := http.NewRequest("GET", resumeUrl, nil)
-	normalApp.ServeHTTP(w0, r0)
-	if w0.Code != 404 {
-		t.Fatalf("TestResumePost() failed: response code %d != 404", w0.Code)
-	}
+	svg := `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`
+	form := url.Values{"filepath": {base64.StdEncoding.EncodeToString([]byte(svg))}}
 
-	// create resumes/hello/hello.pdf
 	w1 := httptest.NewRecorder()
-	resumeBodyReader, err := os.Open(path.Join(normalApp.ChartsPath, "hello.pdf"))
-	if err != nil {
-		t.Fatalf("TestResumePost() failed: unable to open hello.pdf: %q", err)
-	}
-	defer resumeBodyReader.Close()
-
-	r1, _ := http.NewRequest("POST", resumeUrl, resumeBodyReader)
-	r1.Header.Add("Content-Type", "application/pdf")
+	r1, _ := http.NewRequest("POST", svgEditorUrl, bytes.NewBufferString(form.Encode()))
+	r1.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	addCSRF(normalApp, r1)
 	normalApp.ServeHTTP(w1, r1)
-	if w1.Code != 303 {
-		t.Fatalf("TestResumePost() failed: response code %d != 303", w1.Code)
+	if w1.Code != 422 {
+		t.Fatalf("TestSvgEditorPostUnsafe() failed: response code %d != 422", w1.Code)
+	}
+	if !strings.Contains(w1.Body.String(), "onload") {
+		t.Fatalf("TestSvgEditorPostUnsafe() failed: report does not mention 'onload':\n %s", w1.Body)
 	}
 
-	// check that resumes/hello/ now exists
 	w2 := httptest.NewRecorder()
-	r2, _ := http.NewRequest("GET", resumeUrl, nil)
+	r2, _ := http.NewRequest("GET", svgUrl, nil)
 	normalApp.ServeHTTP(w2, r2)
-	if w2.Code != 200 {
-		t.Fatalf("TestResumePost() failed: response code %d != 200", w2.Code)
+	if w2.Code != 404 {
+		t.Fatalf("TestSvgEditorPostUnsafe() failed: unsafe svg was saved; response code %d != 404", w2.Code)
 	}
 }
 
-func TestRemoveUrlPrefix(t *testing.T) {
+func TestCSRF(t *testing.T) {
 	t.Parallel()
-	t.Log("TestRemoveUrlPrefix(): starting.")
 
-	fp, err := normalApp.RemoveUrlPrefix("/", "/")
-	if fp != "" || err != nil {
-		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	charts := store.NewMemory()
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestCSRF() failed: Init: %v", err)
 	}
 
-	fp, err = normalApp.RemoveUrlPrefix("/", "/abc")
-	if fp != "" || err == nil {
-		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"/>`
+	form := url.Values{"filepath": {base64.StdEncoding.EncodeToString([]byte(svg))}}
+	post := func(prepare func(r *http.Request)) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost:3001/x.svg/editor", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		prepare(r)
+		app.ServeHTTP(w, r)
+		return w.Code
 	}
 
-	fp, err = normalApp.RemoveUrlPrefix("/abc", "")
-	if fp != "abc" || err != nil {
-		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	if code := post(func(r *http.Request) {}); code != http.StatusForbidden {
+		t.Fatalf("TestCSRF() failed: tokenless post returned %d", code)
+	}
+	if code := post(func(r *http.Request) {
+		addCSRF(app, r)
+		r.Header.Set(auth.CSRF_HEADER, "forged")
+	}); code != http.StatusForbidden {
+		t.Fatalf("TestCSRF() failed: forged token returned %d", code)
+	}
+	if code := post(func(r *http.Request) {
+		addCSRF(app, r)
+		r.Header.Set("Origin", "http://evil.example")
+	}); code != http.StatusForbidden {
+		t.Fatalf("TestCSRF() failed: cross-origin save returned %d", code)
+	}
+	if _, err := charts.Stat("x.svg"); err == nil {
+		t.Fatalf("TestCSRF() failed: refused post saved anyway")
+	}
+	if code := post(func(r *http.Request) {
+		addCSRF(app, r)
+		r.Header.Set("If-None-Match", "*")
+	}); code != http.StatusNoContent {
+		t.Fatalf("TestCSRF() failed: good post returned %d", code)
 	}
 
-	fp, err = normalApp.RemoveUrlPrefix("/abc", "/abc/")
-	if fp != "" || err != nil {
-		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	// the editor page carries a token bound to the cookie it sets
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost:3001/x.svg/editor", nil)
+	app.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `name="csrf-token" content="`) || len(w.Result().Cookies()) == 0 {
+		t.Fatalf("TestCSRF() failed: editor page lacks a token:\n %s", w.Body)
+	}
+
+	// and so do chart pages, whose tokens multipart forms may carry
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nbody\n"))
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:3001/", nil)
+	app.ServeHTTP(w, r)
+	m := regexp.MustCompile(`name="csrf-token" content="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("TestCSRF() failed: chart page lacks a token:\n %s", w.Body)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("csrf_token", m[1])
+	mw.WriteField("filepath", base64.StdEncoding.EncodeToString([]byte(svg)))
+	mw.Close()
+	r, _ = http.NewRequest("POST", "http://localhost:3001/y.svg/editor", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Origin", "http://localhost:3001")
+	r.Header.Set("If-None-Match", "*")
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("TestCSRF() failed: multipart post returned %d:\n %s", w.Code, w.Body)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-web-audit")
+	if err != nil {
+		t.Fatalf("TestAudit() failed: tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "x.svg", []byte("<svg/>"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestAudit() failed: Init: %v", err)
+	}
+	app.Audit, err = audit.Open(path.Join(tmp, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("TestAudit() failed: Open: %v", err)
+	}
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"/>`
+	form := url.Values{"filepath": {base64.StdEncoding.EncodeToString([]byte(svg))}}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://localhost:3001/x.svg/editor", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("If-Match", etagOf(versionOf([]byte("<svg/>"))))
+	addCSRF(app, r)
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("TestAudit() failed: save returned %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:3001/admin/audit?action=save&path=x", nil)
+	app.ServeHTTP(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), audit.Hash([]byte("<svg/>"))) || !strings.Contains(w.Body.String(), audit.Hash([]byte(svg))) {
+		t.Fatalf("TestAudit() failed: audit page returned %d:\n %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:3001/admin/audit.jsonl?user=nobody", nil)
+	app.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Fatalf("TestAudit() failed: filtered export returned %d:\n %s", w.Code, w.Body)
+	}
+
+	app.Auth = testAuth{"ada": "engine"}
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("TestAudit() failed: anonymous export returned %d", w.Code)
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	t.Parallel()
+
+	epServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer epServer.Close()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nbody\n"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestHTTPErrors() failed: Init: %v", err)
+	}
+	apiUrl, _ := url.Parse(epServer.URL + "/api")
+	app.Etherpad = etherpad.New(apiUrl, "")
+
+	serve := func(method, url string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, body)
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		if !isSafeMethod(method) {
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("DELETE", "http://localhost:3001/", nil, "")
+	if w.Code != http.StatusMethodNotAllowed || !strings.Contains(w.Header().Get("Allow"), "GET") {
+		t.Fatalf("TestHTTPErrors() failed: DELETE returned %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	if w := serve("HEAD", "http://localhost:3001/", nil, ""); w.Code != 200 {
+		t.Fatalf("TestHTTPErrors() failed: HEAD returned %d", w.Code)
+	}
+	if w := serve("POST", "http://localhost:3001/index.txt", nil, ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("TestHTTPErrors() failed: POST to a chart returned %d", w.Code)
+	}
+
+	w = serve("GET", "http://localhost:3001/missing/", nil, "")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "404 Not Found") {
+		t.Fatalf("TestHTTPErrors() failed: missing chart returned %d:\n %s", w.Code, w.Body)
+	}
+
+	// a bad upload used to stop the server
+	if w := serve("POST", "http://localhost:3001/resumes/evil.exe/", strings.NewReader("MZ"), "application/octet-stream"); w.Code != http.StatusBadRequest {
+		t.Fatalf("TestHTTPErrors() failed: bad resume returned %d", w.Code)
+	}
+
+	big := url.Values{"filepath": {strings.Repeat("A", MAX_BODY_SIZE)}}
+	if w := serve("POST", "http://localhost:3001/x.svg/editor", strings.NewReader(big.Encode()), "application/x-www-form-urlencoded"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("TestHTTPErrors() failed: huge post returned %d", w.Code)
+	}
+
+	w = serve("GET", "http://localhost:3001/index.txt/editor", nil, "")
+	if w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), epServer.URL) {
+		t.Fatalf("TestHTTPErrors() failed: etherpad outage returned %d:\n %s", w.Code, w.Body)
+	}
+
+	// every refusal comes on an error page
+	bad := url.Values{"filepath": {"not base64!"}}
+	for _, c := range []struct {
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{"GET", "http://localhost:3001/_/site.json?since=yesterday", "", http.StatusBadRequest},
+		{"GET", "http://localhost:3001/static/nothing.js", "", http.StatusNotFound},
+		{"POST", "http://localhost:3001/x.svg/editor", bad.Encode(), http.StatusBadRequest},
+		{"POST", "http://localhost:3001/x.svg/editor", "filepath=" + url.QueryEscape(base64.StdEncoding.EncodeToString([]byte("<svg"))), http.StatusBadRequest},
+	} {
+		w := serve(c.method, c.url, strings.NewReader(c.body), "application/x-www-form-urlencoded")
+		if w.Code != c.code || !strings.Contains(w.Body.String(), `class="error"`) {
+			t.Fatalf("TestHTTPErrors() failed: %s %s returned %d, not %d on an error page:\n %s", c.method, c.url, w.Code, c.code, w.Body)
+		}
+	}
+}
+
+func TestResumePost(t *testing.T) {
+	t.Parallel()
+	t.Log("TestResumePost(): starting.")
+
+	// try to delete whatever we create
+	defer os.RemoveAll(path.Join(normalApp.ChartsPath, "resumes/hello.pdf"))
+
+	resumeUrl := "/resumes/hello.pdf/"
+
+	// check that resumes/hello/ doesn't exist yet...
+	w0 := httptest.NewRecorder()
+	r0, _ := http.NewRequest("GET", resumeUrl, nil)
+	normalApp.ServeHTTP(w0, r0)
+	if w0.Code != 404 {
+		t.Fatalf("TestResumePost() failed: response code %d != 404", w0.Code)
+	}
+
+	// create resumes/hello/hello.pdf
+	w1 := httptest.NewRecorder()
+	resumeBodyReader, err := os.Open(path.Join(normalApp.ChartsPath, "hello.pdf"))
+	if err != nil {
+		t.Fatalf("TestResumePost() failed: unable to open hello.pdf: %q", err)
+	}
+	defer resumeBodyReader.Close()
+
+	r1, _ := http.NewRequest("POST", resumeUrl, resumeBodyReader)
+	r1.Header.Add("Content-Type", "application/pdf")
+	addCSRF(normalApp, r1)
+	normalApp.ServeHTTP(w1, r1)
+	if w1.Code != 303 {
+		t.Fatalf("TestResumePost() failed: response code %d != 303", w1.Code)
+	}
+
+	// check that resumes/hello/ now exists
+	w2 := httptest.NewRecorder()
+	r2, _ := http.NewRequest("GET", resumeUrl, nil)
+	normalApp.ServeHTTP(w2, r2)
+	if w2.Code != 200 {
+		t.Fatalf("TestResumePost() failed: response code %d != 200", w2.Code)
+	}
+
+	// browsers upload multipart forms, with the token as a field
+	defer os.RemoveAll(path.Join(normalApp.ChartsPath, "resumes/form.pdf"))
+	pdf, err := ioutil.ReadFile(path.Join(normalApp.ChartsPath, "hello.pdf"))
+	if err != nil {
+		t.Fatalf("TestResumePost() failed: unable to read hello.pdf: %q", err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile(RESUME_FIELD, "form.pdf")
+	part.Write(pdf)
+	w3 := httptest.NewRecorder()
+	r3, _ := http.NewRequest("POST", "/resumes/form.pdf/", &body)
+	token, _ := normalApp.CSRF.Token(w3, r3)
+	mw.WriteField("csrf_token", token)
+	mw.Close()
+	r3.Header.Set("Content-Type", mw.FormDataContentType())
+	normalApp.ServeHTTP(w3, r3)
+	if w3.Code != 303 {
+		t.Fatalf("TestResumePost() failed: multipart upload returned %d:\n %s", w3.Code, w3.Body)
+	}
+	upload, _ := ioutil.ReadFile(path.Join(normalApp.ChartsPath, "resumes/form.pdf/upload.pdf"))
+	if !bytes.Equal(upload, pdf) {
+		t.Fatalf("TestResumePost() failed: multipart upload kept %d bytes, not the %d uploaded", len(upload), len(pdf))
+	}
+}
+
+func TestResumePostUnsafe(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestResumePostUnsafe() failed: Init: %v", err)
+	}
+	app.Resumes = resumes.NewRegistry(&resumes.Converter{
+		Name:   "markdown",
+		Inputs: []string{".md"},
+		Output: ".pdf",
+		Convert: func(job *resumes.Job, src, dst string) error {
+			svg := `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><text>page</text></svg>`
+			err := ioutil.WriteFile(path.Join(path.Dir(dst), "page.svg"), []byte(svg), 0644)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(dst, []byte("%PDF-1.4 pretend\n"), 0644)
+		},
+	})
+
+	// drawings made by converting resumes are stored without scripts
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/resumes/cv.md/", strings.NewReader("# CV\n"))
+	r.Header.Set("Content-Type", "text/markdown")
+	addCSRF(app, r)
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("TestResumePostUnsafe() failed: upload returned %d:\n %s", w.Code, w.Body)
+	}
+	page, err := store.ReadFile(charts, "resumes/cv.md/page.svg")
+	if err != nil || strings.Contains(string(page), "script") || !strings.Contains(string(page), "page") {
+		t.Fatalf("TestResumePostUnsafe() failed: stored page %q, %v", page, err)
+	}
+	report, _ := store.ReadFile(charts, "resumes/cv.md/"+resumes.REPORT_NAME)
+	if !strings.Contains(string(report), "sanitize page.svg") {
+		t.Fatalf("TestResumePostUnsafe() failed: report lacks the sanitizing:\n %s", report)
+	}
+}
+
+func TestResumePostFailed(t *testing.T) {
+	t.Parallel()
+
+	app, err := newMemoryApp(store.NewMemory())
+	if err != nil {
+		t.Fatalf("TestResumePostFailed() failed: Init: %v", err)
+	}
+	app.Resumes = resumes.NewRegistry(&resumes.Converter{
+		Name:   "markdown",
+		Inputs: []string{".md"},
+		Output: ".pdf",
+		Tools:  []string{"sh"},
+		Convert: func(job *resumes.Job, src, dst string) error {
+			return job.Run("markdown", "sh", "-c", "echo unable to read /srv/private; exit 1")
+		},
+	})
+
+	// say which steps failed, leaving how to the log
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/resumes/cv.md/", strings.NewReader("# CV\n"))
+	r.Header.Set("Content-Type", "text/markdown")
+	addCSRF(app, r)
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "markdown") {
+		t.Fatalf("TestResumePostFailed() failed: upload returned %d:\n %s", w.Code, w.Body)
+	}
+	for _, secret := range []string{"/srv/private", "sh -c", "upload.md", "exit status"} {
+		if strings.Contains(w.Body.String(), secret) {
+			t.Fatalf("TestResumePostFailed() failed: upload revealed %q:\n %s", secret, w.Body)
+		}
+	}
+}
+
+func TestRemoveUrlPrefix(t *testing.T) {
+	t.Parallel()
+	t.Log("TestRemoveUrlPrefix(): starting.")
+
+	fp, err := normalApp.RemoveUrlPrefix("/", "/")
+	if fp != "" || err != nil {
+		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	}
+
+	fp, err = normalApp.RemoveUrlPrefix("/", "/abc")
+	if fp != "" || err == nil {
+		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	}
+
+	fp, err = normalApp.RemoveUrlPrefix("/abc", "")
+	if fp != "abc" || err != nil {
+		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	}
+
+	fp, err = normalApp.RemoveUrlPrefix("/abc", "/abc/")
+	if fp != "" || err != nil {
+		t.Fatalf("TestRemoveUrlPrefix() failed: (/ /) -> (%q %q)", fp, err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-web-routes")
+	if err != nil {
+		t.Fatalf("TestRoutes() failed: tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nbody\n"))
+	store.WriteFile(charts, "pages/index.txt", []byte("% Pages\n% Test\n% Today\n\na chart named pages\n"))
+	store.WriteFile(charts, "x.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><text>drawn</text></svg>`))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestRoutes() failed: Init: %v", err)
+	}
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, nil)
+		if !isSafeMethod(method) {
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	// charts are no longer shadowed by site views of the same name
+	if w := serve("GET", "http://localhost:3001/pages"); w.Code != 200 || !strings.Contains(w.Body.String(), "a chart named pages") {
+		t.Fatalf("TestRoutes() failed: chart named pages returned %d:\n %s", w.Code, w.Body)
+	}
+	if w := serve("GET", "http://localhost:3001/_/pages"); w.Code != 200 || !strings.Contains(w.Body.String(), "Pages") {
+		t.Fatalf("TestRoutes() failed: pages returned %d", w.Code)
+	}
+	if w := serve("GET", "http://localhost:3001/site.json"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/_/site.json" {
+		t.Fatalf("TestRoutes() failed: legacy site.json returned %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	for _, u := range []string{"/_/nothing", "/admin", "/admin/nothing", "/login", "/static/nothing.js"} {
+		if w := serve("GET", "http://localhost:3001"+u); w.Code != http.StatusNotFound {
+			t.Fatalf("TestRoutes() failed: reserved %s returned %d", u, w.Code)
+		}
+	}
+	if w := serve("DELETE", "http://localhost:3001/_/pages"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Fatalf("TestRoutes() failed: DELETE of pages returned %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w := serve("GET", "http://localhost:3001/x.svg/raw")
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || !strings.Contains(w.Body.String(), "<text>drawn</text>") {
+		t.Fatalf("TestRoutes() failed: raw returned %d, %q:\n %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	if w := serve("GET", "http://localhost:3001/pages/raw"); w.Code != http.StatusNotFound {
+		t.Fatalf("TestRoutes() failed: raw of a directory returned %d", w.Code)
+	}
+
+	if w := serve("GET", "http://localhost:3001/x.svg/history"); w.Code != http.StatusNotFound {
+		t.Fatalf("TestRoutes() failed: history without an audit log returned %d", w.Code)
+	}
+	app.Audit, err = audit.Open(path.Join(tmp, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("TestRoutes() failed: Open: %v", err)
+	}
+	app.Audit.Append(&audit.Record{User: "ada", Addr: "10.0.0.1:1", Path: "x.svg", Action: audit.SAVE})
+	app.Audit.Append(&audit.Record{User: "bob", Addr: "10.0.0.2:1", Path: "x.svg.bak", Action: audit.SAVE})
+	w = serve("GET", "http://localhost:3001/x.svg/history")
+	if body := w.Body.String(); w.Code != 200 || !strings.Contains(body, "ada") || strings.Contains(body, "bob") || strings.Contains(body, "10.0.0.1") {
+		t.Fatalf("TestRoutes() failed: history returned %d:\n %s", w.Code, body)
+	}
+
+	if w := serve("GET", "http://localhost:3001/admin/routes"); w.Code != 200 || !strings.Contains(w.Body.String(), "txt editor") {
+		t.Fatalf("TestRoutes() failed: routes returned %d:\n %s", w.Code, w.Body)
+	}
+}
+
+func TestTxtEditor(t *testing.T) {
+	t.Parallel()
+
+	fake := fakeetherpad.New("key")
+	defer fake.Close()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nbody\n"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestTxtEditor() failed: Init: %v", err)
+	}
+	apiUrl, _ := url.Parse(fake.URL + "/api")
+	app.Etherpad = etherpad.New(apiUrl, "key")
+
+	serve := func(method, url string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	// opening the editor creates the chart and a pad holding it
+	w := serve("GET", "http://localhost:3001/new/index.txt/editor", nil)
+	pad := padFor("new/index.txt")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), fake.URL+"/p/"+pad) {
+		t.Fatalf("TestTxtEditor() failed: GET returned %d:\n %s", w.Code, w.Body)
+	}
+	created, err := store.ReadFile(charts, "new/index.txt")
+	if err != nil {
+		t.Fatalf("TestTxtEditor() failed: chart not created: %v", err)
+	}
+	if text, _ := fake.Text(pad); text != string(created) {
+		t.Fatalf("TestTxtEditor() failed: pad holds %q, not the chart", text)
+	}
+
+	// reopening it leaves edits in progress alone
+	fake.Edit(pad, "% New\n% Test\n% Today\n\nedited\n", "a.1")
+	serve("GET", "http://localhost:3001/new/index.txt/editor", nil)
+	if text, _ := fake.Text(pad); !strings.Contains(text, "edited") {
+		t.Fatalf("TestTxtEditor() failed: reopening reset the pad to %q", text)
+	}
+
+	if w := serve("POST", "http://localhost:3001/new/index.txt/editor", url.Values{"action": {"save"}}); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("TestTxtEditor() failed: unversioned save returned %d", w.Code)
+	}
+	w = serve("POST", "http://localhost:3001/new/index.txt/editor", url.Values{"action": {"save"}, "version": {versionOf(created)}})
+	saved, _ := store.ReadFile(charts, "new/index.txt")
+	if w.Code != http.StatusSeeOther || w.Header().Get("ETag") != etagOf(versionOf(saved)) {
+		t.Fatalf("TestTxtEditor() failed: save returned %d:\n %s", w.Code, w.Body)
+	}
+	if !strings.Contains(string(saved), "edited") {
+		t.Fatalf("TestTxtEditor() failed: saved %q", saved)
+	}
+
+	// a save from an editor opened before the last one is merged, not written
+	fake.Edit(pad, "% New\n% Test\n% Today\n\nedited\nagain\n", "a.1")
+	w = serve("POST", "http://localhost:3001/new/index.txt/editor", url.Values{"action": {"save"}, "version": {versionOf(created)}})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "again") {
+		t.Fatalf("TestTxtEditor() failed: stale save returned %d:\n %s", w.Code, w.Body)
+	}
+	if now, _ := store.ReadFile(charts, "new/index.txt"); string(now) != string(saved) {
+		t.Fatalf("TestTxtEditor() failed: stale save wrote %q", now)
+	}
+
+	store.WriteFile(charts, "new/index.txt", []byte("% New\n% Test\n% Today\n\nfrom disk\n"))
+	if w := serve("POST", "http://localhost:3001/new/index.txt/editor", url.Values{"action": {"reload"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("TestTxtEditor() failed: reload returned %d:\n %s", w.Code, w.Body)
+	}
+	if text, _ := fake.Text(pad); !strings.Contains(text, "from disk") {
+		t.Fatalf("TestTxtEditor() failed: reload left %q", text)
+	}
+
+	// saves fail cleanly while etherpad is down
+	fake.Close()
+	if w := serve("POST", "http://localhost:3001/new/index.txt/editor", url.Values{"action": {"save"}, "version": {"*"}}); w.Code != http.StatusBadGateway {
+		t.Fatalf("TestTxtEditor() failed: save with etherpad down returned %d", w.Code)
+	}
+
+	app.TxtEditor = TXT_EDITOR_ETHERPAD
+	app.Etherpad = nil
+	if w := serve("GET", "http://localhost:3001/index.txt/editor", nil); w.Code != http.StatusBadGateway {
+		t.Fatalf("TestTxtEditor() failed: GET without etherpad returned %d", w.Code)
+	}
+}
+
+func TestPadSync(t *testing.T) {
+	t.Parallel()
+
+	fake := fakeetherpad.New("key")
+	defer fake.Close()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nbody\n"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestPadSync() failed: Init: %v", err)
+	}
+	apiUrl, _ := url.Parse(fake.URL + "/api")
+	app.Etherpad = etherpad.New(apiUrl, "key")
+	app.PadSync = app.newPadSync(0)
+
+	serve := func(method, url string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+	status := func() vPadSync {
+		var view vPadSync
+		w := serve("GET", "http://localhost:3001/index.txt/sync", nil)
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &view) != nil {
+			t.Fatalf("TestPadSync() failed: status returned %d:\n %s", w.Code, w.Body)
+		}
+		return view
+	}
+
+	// asking about a pad doesn't track it
+	if w := serve("GET", "http://localhost:3001/index.txt/sync", nil); w.Code != http.StatusNotFound || len(app.PadSync.Names()) != 0 {
+		t.Fatalf("TestPadSync() failed: untracked status returned %d", w.Code)
+	}
+
+	w := serve("GET", "http://localhost:3001/index.txt/editor", nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `data-sync-url="sync"`) {
+		t.Fatalf("TestPadSync() failed: editor returned %d:\n %s", w.Code, w.Body)
+	}
+	chart, _ := store.ReadFile(charts, "index.txt")
+	if view := status(); view.State != padsync.SYNCED || view.Version != versionOf(chart) {
+		t.Fatalf("TestPadSync() failed: fresh pad: %+v", view)
+	}
+
+	// edits are saved without anyone clicking save
+	pad := padFor("index.txt")
+	fake.Edit(pad, "% Root\n% Test\n% Today\n\nsynced\n", "a.1")
+	app.PadSync.Sync(context.Background())
+	chart, _ = store.ReadFile(charts, "index.txt")
+	if view := status(); view.State != padsync.SYNCED || view.Rev != 1 || view.Version != versionOf(chart) || !strings.Contains(string(chart), "synced") {
+		t.Fatalf("TestPadSync() failed: edited pad: %+v, chart %q", view, chart)
+	}
+
+	// but not over changes made elsewhere, which saving by hand merges
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n\nfrom disk\n"))
+	fake.Edit(pad, "% Root\n% Test\n% Today\n\nsynced\nagain\n", "a.1")
+	app.PadSync.Sync(context.Background())
+	if view := status(); view.State != padsync.CONFLICT || view.Version != versionOf(chart) {
+		t.Fatalf("TestPadSync() failed: conflicting pad: %+v", view)
+	}
+	w = serve("GET", "http://localhost:3001/index.txt/editor", nil)
+	if !strings.Contains(w.Body.String(), versionOf(chart)) {
+		t.Fatalf("TestPadSync() failed: editor names the wrong version:\n %s", w.Body)
+	}
+	w = serve("POST", "http://localhost:3001/index.txt/editor", url.Values{"action": {"save"}, "version": {versionOf(chart)}})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "from disk") {
+		t.Fatalf("TestPadSync() failed: save returned %d:\n %s", w.Code, w.Body)
+	}
+
+	if w := serve("POST", "http://localhost:3001/index.txt/editor", url.Values{"action": {"reload"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("TestPadSync() failed: reload returned %d", w.Code)
+	}
+	if view := status(); view.State != padsync.SYNCED {
+		t.Fatalf("TestPadSync() failed: reloaded pad: %+v", view)
+	}
+
+	// a pad left over from before a restart isn't saved over the chart
+	app.PadSync = app.newPadSync(0)
+	fake.Edit(pad, "% Root\n% Test\n% Today\n\nleft over\n", "a.1")
+	if w := serve("GET", "http://localhost:3001/index.txt/editor", nil); w.Code != 200 {
+		t.Fatalf("TestPadSync() failed: reopened editor returned %d", w.Code)
+	}
+	app.PadSync.Sync(context.Background())
+	if view := status(); view.State != padsync.CONFLICT {
+		t.Fatalf("TestPadSync() failed: left over pad: %+v", view)
+	}
+	if chart, _ := store.ReadFile(charts, "index.txt"); !strings.Contains(string(chart), "from disk") {
+		t.Fatalf("TestPadSync() failed: left over pad saved %q", chart)
+	}
+
+	app.TxtEditor = TXT_EDITOR_NATIVE
+	if w := serve("GET", "http://localhost:3001/index.txt/sync", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("TestPadSync() failed: native status returned %d", w.Code)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	t.Parallel()
+
+	fake := fakeetherpad.New("key")
+	defer fake.Close()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "sub/index.txt", []byte("% Sub\n% Authors\n% Today\n\n# Overview\n"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestPresence() failed: Init: %v", err)
+	}
+
+	serve := func(method, url string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+	visitors := func(w *httptest.ResponseRecorder) []presence.Visitor {
+		var view vPresence
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &view) != nil {
+			t.Fatalf("TestPresence() failed: presence returned %d:\n %s", w.Code, w.Body)
+		}
+		return view.Visitors
+	}
+
+	w := serve("GET", "http://localhost:3001/sub/", nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `data-presence-url="/sub/index.txt/presence" data-action="viewing"`) {
+		t.Fatalf("TestPresence() failed: chart returned %d:\n %s", w.Code, w.Body)
+	}
+	w = serve("GET", "http://localhost:3001/sub/index.txt/editor", nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `data-presence-url="/sub/index.txt/presence" data-action="editing"`) {
+		t.Fatalf("TestPresence() failed: editor returned %d:\n %s", w.Code, w.Body)
+	}
+
+	if vs := visitors(serve("POST", "http://localhost:3001/sub/index.txt/presence", url.Values{"action": {"viewing"}, "tab": {"t1"}})); len(vs) != 0 {
+		t.Fatalf("TestPresence() failed: alone, but saw %+v", vs)
+	}
+	if vs := visitors(serve("POST", "http://localhost:3001/sub/index.txt/presence", url.Values{"action": {"editing"}, "tab": {"t2"}})); len(vs) != 1 || vs[0].Action != presence.VIEWING {
+		t.Fatalf("TestPresence() failed: editor saw %+v", vs)
+	}
+	if vs := visitors(serve("GET", "http://localhost:3001/sub/index.txt/presence", nil)); len(vs) != 2 || vs[0].Action != presence.EDITING {
+		t.Fatalf("TestPresence() failed: listed %+v", vs)
+	}
+
+	if w := serve("POST", "http://localhost:3001/sub/index.txt/presence", url.Values{"action": {"leave"}, "tab": {"t2"}}); w.Code != http.StatusNoContent {
+		t.Fatalf("TestPresence() failed: leave returned %d", w.Code)
+	}
+	if w := serve("POST", "http://localhost:3001/sub/index.txt/presence", url.Values{"action": {"viewing"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("TestPresence() failed: tabless heartbeat returned %d", w.Code)
+	}
+
+	// people in the pad are editing, even without an atlas page open
+	apiUrl, _ := url.Parse(fake.URL + "/api")
+	app.Etherpad = etherpad.New(apiUrl, "key")
+	fake.Edit(padFor("sub/index.txt"), "% Sub\n% Authors\n% Today\n\n# Overview\n", "a.1")
+	fake.Connect(padFor("sub/index.txt"), "a.1", "Eve")
+	if vs := visitors(serve("GET", "http://localhost:3001/sub/index.txt/presence", nil)); len(vs) != 2 || vs[0].Name != "Eve" || vs[0].Action != presence.EDITING {
+		t.Fatalf("TestPresence() failed: with pad users, listed %+v", vs)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "sub/index.txt", []byte("% Sub\n% Authors\n% Today\n\n# Overview\n"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestEvents() failed: Init: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go app.WatchCharts(stop)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost:3001/sub/", nil)
+	app.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `<meta name="atlas-events" content="/_/events?chart=sub%2F"/>`) {
+		t.Fatalf("TestEvents() failed: chart page doesn't follow its events:\n %s", w.Body)
+	}
+
+	server := httptest.NewServer(app)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/_/events?chart=sub/")
+	if err != nil || resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("TestEvents() failed: GET: %v, %v", resp, err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	next := func() string {
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				t.Fatalf("TestEvents() failed: reading stream: %v", err)
+			}
+			if strings.HasPrefix(line, "event: ") {
+				data, _ := lines.ReadString('\n')
+				return strings.TrimPrefix(line, "event: ") + data
+			}
+		}
+	}
+
+	// other charts' changes are left out, but change the site
+	store.WriteFile(charts, "other/index.txt", []byte("% Other\n% Authors\n% Today\n"))
+	store.WriteFile(charts, "sub/diagram.svg", []byte("<svg/>"))
+	if ev := next(); ev != "chart\ndata: {\"chart\":\"sub/\",\"name\":\"sub/diagram.svg\"}\n" {
+		t.Fatalf("TestEvents() failed: got %q", ev)
+	}
+	if ev := next(); ev != "site\ndata: {}\n" {
+		t.Fatalf("TestEvents() failed: got %q", ev)
+	}
+}
+
+func TestTxtNativeEditor(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "sub/index.txt", []byte("% Sub\n% Authors\n% Today\n\n# Overview\n"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestTxtNativeEditor() failed: Init: %v", err)
+	}
+
+	serve := func(method, url string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	// without etherpad, charts are edited natively
+	w := serve("GET", "http://localhost:3001/sub/index.txt/editor", nil)
+	if body := w.Body.String(); w.Code != 200 || !strings.Contains(body, "<textarea") || !strings.Contains(body, "Overview</h1>") {
+		t.Fatalf("TestTxtNativeEditor() failed: GET returned %d:\n %s", w.Code, body)
+	}
+	version := versionOf([]byte("% Sub\n% Authors\n% Today\n\n# Overview\n"))
+	if !strings.Contains(w.Body.String(), version) {
+		t.Fatalf("TestTxtNativeEditor() failed: editor lacks version %s", version)
+	}
+
+	w = serve("POST", "http://localhost:3001/sub/index.txt/editor", url.Values{"action": {"preview"}, "text": {"% T\n% A\n% D\n\n*new* <script>alert(1)</script>"}})
+	if body := w.Body.String(); w.Code != 200 || !strings.Contains(body, "<em>new</em>") || strings.Contains(body, "<script>") || strings.Contains(body, "% T") {
+		t.Fatalf("TestTxtNativeEditor() failed: preview returned %d:\n %s", w.Code, body)
+	}
+
+	text := "% Sub\n% Authors\n% Today\n\n# Saved\n"
+	w = serve("POST", "http://localhost:3001/sub/index.txt/editor", url.Values{"action": {"save"}, "text": {text}, "version": {version}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/sub/" {
+		t.Fatalf("TestTxtNativeEditor() failed: save returned %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	if saved, _ := store.ReadFile(charts, "sub/index.txt"); string(saved) != text {
+		t.Fatalf("TestTxtNativeEditor() failed: saved %q", saved)
+	}
+
+	// a save based on the old version conflicts, and keeps the posted text
+	w = serve("POST", "http://localhost:3001/sub/index.txt/editor", url.Values{"action": {"save"}, "text": {"# Lost?"}, "version": {version}})
+	if body := w.Body.String(); w.Code != http.StatusConflict || !strings.Contains(body, "# Lost?") || !strings.Contains(body, versionOf([]byte(text))) {
+		t.Fatalf("TestTxtNativeEditor() failed: stale save returned %d:\n %s", w.Code, body)
+	}
+	if saved, _ := store.ReadFile(charts, "sub/index.txt"); string(saved) != text {
+		t.Fatalf("TestTxtNativeEditor() failed: stale save wrote %q", saved)
+	}
+
+	// given its base, a stale save is merged with the one it lost to
+	base := "% Sub\n% Authors\n% Today\n\n# Overview\n"
+	w = serve("POST", "http://localhost:3001/sub/index.txt/editor", url.Values{"action": {"save"}, "text": {strings.Replace(base, "% Sub", "% Sub Chart", 1)}, "base": {base}, "version": {version}})
+	if body := w.Body.String(); w.Code != http.StatusConflict || !strings.Contains(body, "% Sub Chart\n% Authors\n% Today\n\n# Saved\n") || strings.Contains(body, html.EscapeString(merge.MARK_YOURS)) {
+		t.Fatalf("TestTxtNativeEditor() failed: mergeable save returned %d:\n %s", w.Code, body)
+	}
+	w = serve("POST", "http://localhost:3001/sub/index.txt/editor", url.Values{"action": {"save"}, "text": {base + "# Mine\n"}, "base": {base}, "version": {version}})
+	if body := w.Body.String(); w.Code != http.StatusConflict || !strings.Contains(body, html.EscapeString(merge.MARK_YOURS)) {
+		t.Fatalf("TestTxtNativeEditor() failed: conflicting save returned %d:\n %s", w.Code, body)
+	}
+
+	if w := serve("POST", "http://localhost:3001/sub/index.txt/editor", url.Values{"action": {"save"}, "text": {text}}); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("TestTxtNativeEditor() failed: unversioned save returned %d", w.Code)
+	}
+
+	// saves that aren't text leave the chart as it was
+	w = serve("POST", "http://localhost:3001/sub/index.txt/editor", url.Values{"action": {"save"}, "text": {"% Sub\n\xff\xfe"}, "version": {versionOf([]byte(text))}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("TestTxtNativeEditor() failed: binary save returned %d", w.Code)
+	}
+	if saved, _ := store.ReadFile(charts, "sub/index.txt"); string(saved) != text {
+		t.Fatalf("TestTxtNativeEditor() failed: binary save wrote %q", saved)
+	}
+}
+
+func TestSvgEditFile(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "sub/diagram.svg", []byte("<svg/>"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestSvgEditFile() failed: Init: %v", err)
+	}
+
+	for _, body := range []string{"", "<svg>", "<svg></g>", "not xml"} {
+		svgFile, err := app.SvgEditFile("sub/diagram.svg")
+		if err != nil {
+			t.Fatalf("TestSvgEditFile() failed: SvgEditFile: %v", err)
+		}
+		io.WriteString(svgFile, body)
+		if err := svgFile.Close(); err == nil {
+			t.Fatalf("TestSvgEditFile() failed: saved %q", body)
+		}
+		if saved, _ := store.ReadFile(charts, "sub/diagram.svg"); string(saved) != "<svg/>" {
+			t.Fatalf("TestSvgEditFile() failed: saving %q left %q", body, saved)
+		}
+	}
+
+	// aborted writes are dropped, even if they would have been fine
+	svgFile, _ := app.SvgEditFile("sub/diagram.svg")
+	io.WriteString(svgFile, "<svg><g/></svg>")
+	svgFile.Abort()
+	svgFile.Close()
+	if saved, _ := store.ReadFile(charts, "sub/diagram.svg"); string(saved) != "<svg/>" {
+		t.Fatalf("TestSvgEditFile() failed: aborted write left %q", saved)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-web-trash")
+	if err != nil {
+		t.Fatalf("TestTrash() failed: tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Authors\n% Today\n"))
+	store.WriteFile(charts, "sub/index.txt", []byte("% Sub\n% Authors\n% Today\n"))
+	store.WriteFile(charts, "sub/deep/index.txt", []byte("% Deep\n% Authors\n% Today\n"))
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestTrash() failed: Init: %v", err)
+	}
+	app.Audit, err = audit.Open(path.Join(tmp, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("TestTrash() failed: Open: %v", err)
+	}
+
+	serve := func(method, url string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(app, r)
+		}
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("GET", "http://localhost:3001/sub/", nil); !strings.Contains(w.Body.String(), `href="/sub/index.txt/delete"`) {
+		t.Fatalf("TestTrash() failed: chart page lacks a delete link:\n %s", w.Body)
+	}
+	if w := serve("GET", "http://localhost:3001/", nil); strings.Contains(w.Body.String(), "/delete") {
+		t.Fatalf("TestTrash() failed: root chart offers to be deleted")
+	}
+	if w := serve("POST", "http://localhost:3001/index.txt/delete", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("TestTrash() failed: deleting the root returned %d", w.Code)
+	}
+	if w := serve("GET", "http://localhost:3001/sub/index.txt/delete", nil); w.Code != 200 || !strings.Contains(w.Body.String(), `method="post"`) {
+		t.Fatalf("TestTrash() failed: GET delete returned %d:\n %s", w.Code, w.Body)
+	}
+
+	w := serve("POST", "http://localhost:3001/sub/index.txt/delete", nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("TestTrash() failed: delete returned %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	if _, err := charts.Stat("sub/deep/index.txt"); !os.IsNotExist(err) {
+		t.Fatalf("TestTrash() failed: deleted chart still there: %v", err)
+	}
+
+	// the trash is neither listed nor served
+	app.SiteListCache.Lock()
+	app.SiteListCache.Make()
+	for name := range app.SiteListCache.Entries {
+		if trash.Contains(name) {
+			t.Fatalf("TestTrash() failed: site list has %q", name)
+		}
+	}
+	app.SiteListCache.Unlock()
+	items, _ := app.Trash.List()
+	if len(items) != 1 {
+		t.Fatalf("TestTrash() failed: trash holds %+v", items)
+	}
+	if w := serve("GET", "http://localhost:3001/.trash/"+items[0].ID+"/index.txt", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("TestTrash() failed: trashed chart served with %d", w.Code)
+	}
+
+	if w := serve("GET", "http://localhost:3001/admin/trash", nil); w.Code != 200 || !strings.Contains(w.Body.String(), `value="`+items[0].ID+`"`) {
+		t.Fatalf("TestTrash() failed: trash page returned %d:\n %s", w.Code, w.Body)
+	}
+
+	// restores don't overwrite what has taken a chart's place
+	store.WriteFile(charts, "sub/index.txt", []byte("% New Sub\n"))
+	w = serve("POST", "http://localhost:3001/admin/trash", url.Values{"id": {items[0].ID}, "name": {"sub"}})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "already") {
+		t.Fatalf("TestTrash() failed: conflicting restore returned %d:\n %s", w.Code, w.Body)
+	}
+	w = serve("POST", "http://localhost:3001/admin/trash", url.Values{"id": {items[0].ID}, "name": {"old/sub"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/old/sub/" {
+		t.Fatalf("TestTrash() failed: restore returned %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	if text, _ := store.ReadFile(charts, "old/sub/deep/index.txt"); string(text) != "% Deep\n% Authors\n% Today\n" {
+		t.Fatalf("TestTrash() failed: restored %q", text)
+	}
+
+	// expired charts are purged
+	serve("POST", "http://localhost:3001/old/sub/index.txt/delete", nil)
+	app.Trash.Retention = 0
+	stop := make(chan struct{})
+	close(stop)
+	app.PurgeTrash(stop)
+	if items, _ := app.Trash.List(); len(items) != 0 {
+		t.Fatalf("TestTrash() failed: purge left %+v", items)
+	}
+
+	recs, _ := app.Audit.Query(&audit.Filter{}, 0)
+	var actions []string
+	for _, rec := range recs {
+		actions = append(actions, rec.Action+" "+rec.Path)
+	}
+	if strings.Join(actions, ", ") != "purge old/sub, delete old/sub, restore old/sub, delete sub" {
+		t.Fatalf("TestTrash() failed: audited %q", actions)
+	}
+}
+
+// slowStore is a store whose writers are slow to commit, widening any window
+// between reading a file and replacing it.
+type slowStore struct {
+	store.Store
+}
+
+type slowWriter struct {
+	store.Writer
+}
+
+func (self slowStore) Create(name string) (store.Writer, error) {
+	w, err := self.Store.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowWriter{w}, nil
+}
+
+func (self slowWriter) Close() error {
+	time.Sleep(10 * time.Millisecond)
+	return self.Writer.Close()
+}
+
+func TestSaveConcurrent(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "x.svg", []byte("<svg/>"))
+	app, err := newMemoryApp(slowStore{charts})
+	if err != nil {
+		t.Fatalf("TestSaveConcurrent() failed: Init: %v", err)
+	}
+
+	save := func(i int, base string) int {
+		svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" id="s%d"/>`, i)
+		form := url.Values{"filepath": {base64.StdEncoding.EncodeToString([]byte(svg))}}
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost:3001/x.svg/editor", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("If-Match", etagOf(versionOf([]byte(base))))
+		addCSRF(app, r)
+		app.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// build the error page's templates before racing to render them
+	if code := save(-1, "<svg id=\"stale\"/>"); code != http.StatusConflict {
+		t.Fatalf("TestSaveConcurrent() failed: stale save returned %d", code)
+	}
+
+	const SAVES = 8
+	codes := make(chan int, SAVES)
+	var wg sync.WaitGroup
+	for i := 0; i < SAVES; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- save(i, "<svg/>")
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	saved := 0
+	for code := range codes {
+		switch code {
+		case http.StatusNoContent:
+			saved++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("TestSaveConcurrent() failed: save returned %d", code)
+		}
+	}
+	if saved != 1 {
+		t.Fatalf("TestSaveConcurrent() failed: %d saves of the same version succeeded, want 1", saved)
+	}
+}
+
+func TestDeleteConcurrent(t *testing.T) {
+	t.Parallel()
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Authors\n% Today\n"))
+	store.WriteFile(charts, "sub/index.txt", []byte("% Sub\n% Authors\n% Today\n"))
+	store.WriteFile(charts, "sub/deep/x.svg", []byte("<svg/>"))
+	app, err := newMemoryApp(slowStore{charts})
+	if err != nil {
+		t.Fatalf("TestDeleteConcurrent() failed: Init: %v", err)
+	}
+
+	serve := func(method, url string, body string, header string, value string) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		addCSRF(app, r)
+		app.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// build the error page's templates before racing to render them
+	if code := serve("POST", "http://localhost:3001/sub/deep/x.svg/editor", "", "If-Match", `"stale"`); code != http.StatusBadRequest && code != http.StatusConflict {
+		t.Fatalf("TestDeleteConcurrent() failed: stale save returned %d", code)
+	}
+
+	// a save beneath a chart being deleted doesn't land after it's gone
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"/>`
+	form := url.Values{"filepath": {base64.StdEncoding.EncodeToString([]byte(svg))}}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var deleted int
+	go func() {
+		defer wg.Done()
+		deleted = serve("POST", "http://localhost:3001/sub/index.txt/delete", "", "", "")
+	}()
+	time.Sleep(2 * time.Millisecond)
+	saved := serve("POST", "http://localhost:3001/sub/deep/x.svg/editor", form.Encode(), "If-Match", etagOf(versionOf([]byte("<svg/>"))))
+	wg.Wait()
+
+	if deleted != http.StatusSeeOther || (saved != http.StatusNoContent && saved != http.StatusConflict) {
+		t.Fatalf("TestDeleteConcurrent() failed: delete returned %d, save %d", deleted, saved)
+	}
+	if _, err := charts.Stat("sub/deep/x.svg"); !os.IsNotExist(err) {
+		t.Fatalf("TestDeleteConcurrent() failed: save outlived the delete: %v", err)
+	}
+}
+
+func TestCreateConcurrent(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-web-create")
+	if err != nil {
+		t.Fatalf("TestCreateConcurrent() failed: tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	charts := store.NewMemory()
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Authors\n% Today\n"))
+	store.WriteFile(charts, "old.svg", []byte("<svg/>"))
+	app, err := newMemoryApp(slowStore{charts})
+	if err != nil {
+		t.Fatalf("TestCreateConcurrent() failed: Init: %v", err)
+	}
+	app.TxtEditor = TXT_EDITOR_NATIVE
+	app.Audit, err = audit.Open(path.Join(tmp, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("TestCreateConcurrent() failed: Open: %v", err)
+	}
+
+	// build the editors' templates before racing to render them
+	for _, u := range []string{"/index.txt/editor", "/old.svg/editor"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:3001"+u, nil)
+		app.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("TestCreateConcurrent() failed: %s returned %d", u, w.Code)
+		}
+	}
+
+	// opening the editors of a new chart at once creates it once
+	const OPENS = 4
+	var wg sync.WaitGroup
+	for i := 0; i < OPENS; i++ {
+		for _, u := range []string{"/new/index.txt/editor", "/new/plan.svg/editor"} {
+			wg.Add(1)
+			go func(u string) {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("GET", "http://localhost:3001"+u, nil)
+				app.ServeHTTP(w, r)
+				if w.Code != 200 {
+					t.Errorf("TestCreateConcurrent() failed: %s returned %d", u, w.Code)
+				}
+			}(u)
+		}
+	}
+	wg.Wait()
+
+	recs, err := app.Audit.Query(&audit.Filter{Action: audit.CREATE}, 0)
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("TestCreateConcurrent() failed: %d creations recorded, not 2: %v", len(recs), err)
+	}
+}
+
+func TestACLSymlink(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "atlas-web-symlink")
+	if err != nil {
+		t.Fatalf("TestACLSymlink() failed: tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	charts := store.NewLocal(tmp)
+	store.WriteFile(charts, "index.txt", []byte("% Root\n% Test\n% Today\n"))
+	store.WriteFile(charts, "public/index.txt", []byte("% Public\n% Test\n% Today\n"))
+	store.WriteFile(charts, "resumes/cv/index.txt", []byte("% Resume\n% Test\n% Today\n\nconfidential\n"))
+	if err := os.Symlink("../resumes/cv", path.Join(tmp, "public/cv")); err != nil {
+		t.Fatalf("TestACLSymlink() failed: symlink: %v", err)
+	}
+
+	app, err := newMemoryApp(charts)
+	if err != nil {
+		t.Fatalf("TestACLSymlink() failed: Init: %v", err)
+	}
+	sqlDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestACLSymlink() failed: open: %v", err)
+	}
+	defer sqlDb.Close()
+	sqlDb.SetMaxOpenConns(1)
+	app.ACL, err = acl.NewDb(sqlDb)
+	if err != nil {
+		t.Fatalf("TestACLSymlink() failed: NewDb: %v", err)
+	}
+	app.ACL.Set("resumes", "@hr", acl.READ)
+
+	// links are held to the rules of where they lead
+	for _, u := range []string{"/public/cv/", "/public/cv/index.txt/raw", "/_/site.json", "/_/pages"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:3001"+u, nil)
+		app.ServeHTTP(w, r)
+		if strings.Contains(w.Body.String(), "confidential") || strings.Contains(w.Body.String(), "% Resume") {
+			t.Fatalf("TestACLSymlink() failed: anonymous %s returned %d, leaking the resume:\n %s", u, w.Code, w.Body)
+		}
 	}
 }